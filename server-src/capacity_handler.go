@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// unreservedService is a service whose tasks reserve no CPU or no memory, so
+// the scheduler places them without accounting for what they use.
+type unreservedService struct {
+	ServiceID     string `json:"serviceId"`
+	ServiceName   string `json:"serviceName"`
+	Stack         string `json:"stack,omitempty"`
+	Tasks         int    `json:"tasks"` // Tasks holding resources
+	MissingCPU    bool   `json:"missingCpu"`
+	MissingMemory bool   `json:"missingMemory"`
+	HasLimits     bool   `json:"hasLimits"`
+}
+
+// replicaFitNode is how many more replicas of a service a node can take.
+type replicaFitNode struct {
+	NodeID    string `json:"nodeId"`
+	Hostname  string `json:"hostname"`
+	Eligible  bool   `json:"eligible"`
+	Reason    string `json:"reason,omitempty"` // Why the node is not eligible or takes no replica
+	Replicas  int    `json:"replicas"`
+	Unbounded bool   `json:"unbounded,omitempty"` // Nothing reserved and no max replicas per node
+}
+
+// replicaFit answers whether the requested replicas of a service fit on the
+// nodes its placement allows, with their current reservations.
+type replicaFit struct {
+	ServiceID             string           `json:"serviceId"`
+	ServiceName           string           `json:"serviceName"`
+	Requested             int              `json:"requested"`
+	CPUsPerReplica        float64          `json:"cpusPerReplica"`
+	MemoryBytesPerReplica int64            `json:"memoryBytesPerReplica"`
+	MaxReplicasPerNode    uint64           `json:"maxReplicasPerNode,omitempty"`
+	Constraints           []string         `json:"constraints,omitempty"`
+	Fits                  bool             `json:"fits"`
+	MaxReplicas           int              `json:"maxReplicas"` // More replicas the cluster can take
+	Unbounded             bool             `json:"unbounded,omitempty"`
+	Nodes                 []replicaFitNode `json:"nodes"`
+}
+
+// capacityResponse represents the response structure for the capacity
+// planning endpoint
+type capacityResponse struct {
+	Available                   bool                `json:"available"`
+	Cluster                     *clusterCapacity    `json:"cluster,omitempty"`
+	ServicesWithoutReservations []unreservedService `json:"servicesWithoutReservations"`
+	Fit                         *replicaFit         `json:"fit,omitempty"`
+	Error                       *string             `json:"error,omitempty"`
+	Message                     *string             `json:"message,omitempty"`
+}
+
+// capacityRequest is a parsed capacity planning request.
+type capacityRequest struct {
+	service  string // Service ID or name to fit replicas of, empty for none
+	replicas int
+}
+
+// parseCapacityRequest reads the `service` and `replicas` query parameters.
+func parseCapacityRequest(r *http.Request) (capacityRequest, error) {
+	query := r.URL.Query()
+	request := capacityRequest{service: query.Get("service"), replicas: 1}
+	if replicas := query.Get("replicas"); replicas != "" {
+		if request.service == "" {
+			return request, fmt.Errorf("replicas requires a service")
+		}
+		parsed, err := strconv.Atoi(replicas)
+		if err != nil || parsed <= 0 {
+			return request, fmt.Errorf("invalid replicas %q: expected a positive number", replicas)
+		}
+		request.replicas = parsed
+	}
+	return request, nil
+}
+
+// servicesWithoutReservations lists the services reserving no CPU or no
+// memory, by name.
+func servicesWithoutReservations(services []swarm.Service, tasks []swarm.Task) []unreservedService {
+	holding := make(map[string]int)
+	for _, task := range tasks {
+		if taskHoldsResources(task) {
+			holding[task.ServiceID]++
+		}
+	}
+	unreserved := []unreservedService{}
+	for _, service := range services {
+		resources := service.Spec.TaskTemplate.Resources
+		var reservations swarm.Resources
+		if resources != nil && resources.Reservations != nil {
+			reservations = *resources.Reservations
+		}
+		if reservations.NanoCPUs > 0 && reservations.MemoryBytes > 0 {
+			continue
+		}
+		unreserved = append(unreserved, unreservedService{
+			ServiceID:     service.ID,
+			ServiceName:   service.Spec.Name,
+			Stack:         service.Spec.Labels[stackNamespaceLabel],
+			Tasks:         holding[service.ID],
+			MissingCPU:    reservations.NanoCPUs <= 0,
+			MissingMemory: reservations.MemoryBytes <= 0,
+			HasLimits:     resources != nil && resources.Limits != nil && (resources.Limits.NanoCPUs > 0 || resources.Limits.MemoryBytes > 0),
+		})
+	}
+	sort.Slice(unreserved, func(i, j int) bool { return unreserved[i].ServiceName < unreserved[j].ServiceName })
+	return unreserved
+}
+
+// placementConstraint is a parsed `key==value` or `key!=value` service
+// placement constraint.
+type placementConstraint struct {
+	key   string
+	equal bool
+	value string
+}
+
+// parsePlacementConstraint parses a constraint the way swarm does.
+func parsePlacementConstraint(constraint string) (placementConstraint, error) {
+	for _, operator := range []string{"==", "!="} {
+		key, value, found := strings.Cut(constraint, operator)
+		if !found {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" || value == "" {
+			break
+		}
+		return placementConstraint{key: key, equal: operator == "==", value: value}, nil
+	}
+	return placementConstraint{}, fmt.Errorf("invalid constraint %q", constraint)
+}
+
+// String formats the constraint back to key==value or key!=value.
+func (c placementConstraint) String() string {
+	if c.equal {
+		return c.key + "==" + c.value
+	}
+	return c.key + "!=" + c.value
+}
+
+// matches reports whether a node satisfies the constraint. As in swarm,
+// values compare case-insensitively and a missing label only satisfies `!=`.
+func (c placementConstraint) matches(node swarm.Node) (bool, error) {
+	var actual string
+	var found bool
+	key := strings.ToLower(c.key)
+	switch {
+	case key == "node.id":
+		actual, found = node.ID, true
+	case key == "node.hostname":
+		actual, found = node.Description.Hostname, true
+	case key == "node.role":
+		actual, found = string(node.Spec.Role), true
+	case key == "node.platform.os":
+		actual, found = node.Description.Platform.OS, true
+	case key == "node.platform.arch":
+		actual, found = node.Description.Platform.Architecture, true
+	case strings.HasPrefix(key, "node.labels."):
+		actual, found = node.Spec.Labels[c.key[len("node.labels."):]]
+	case strings.HasPrefix(key, "engine.labels."):
+		actual, found = node.Description.Engine.Labels[c.key[len("engine.labels."):]]
+	default:
+		return false, fmt.Errorf("unsupported constraint key %q", c.key)
+	}
+	if !found {
+		return !c.equal, nil
+	}
+	return strings.EqualFold(actual, c.value) == c.equal, nil
+}
+
+// normalizedArchitecture maps the architecture names of the engine and of
+// the images to one name.
+func normalizedArchitecture(architecture string) string {
+	switch strings.ToLower(architecture) {
+	case "x86_64", "x86-64", "amd64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	}
+	return strings.ToLower(architecture)
+}
+
+// platformMatches reports whether a node runs one of the platforms of the
+// service, any node when the service lists none.
+func platformMatches(node swarm.Node, platforms []swarm.Platform) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	for _, platform := range platforms {
+		if platform.OS != "" && !strings.EqualFold(platform.OS, node.Description.Platform.OS) {
+			continue
+		}
+		if platform.Architecture != "" && normalizedArchitecture(platform.Architecture) != normalizedArchitecture(node.Description.Platform.Architecture) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// nodeIneligibility is why the scheduler would not place a task of the
+// service on the node, empty if it would.
+func nodeIneligibility(node swarm.Node, placement *swarm.Placement, constraints []placementConstraint) string {
+	if node.Status.State != swarm.NodeStateReady {
+		return "node is " + string(node.Status.State)
+	}
+	if node.Spec.Availability != swarm.NodeAvailabilityActive {
+		return "node availability is " + string(node.Spec.Availability)
+	}
+	for _, constraint := range constraints {
+		matches, err := constraint.matches(node)
+		if err != nil {
+			return err.Error()
+		}
+		if !matches {
+			return "constraint " + constraint.String() + " not satisfied"
+		}
+	}
+	if placement != nil && !platformMatches(node, placement.Platforms) {
+		return "platform " + node.Description.Platform.OS + "/" + node.Description.Platform.Architecture + " not supported"
+	}
+	return ""
+}
+
+// fitReplicas computes how many more replicas of the service every node can
+// take, given its reservations, placement and the tasks holding resources.
+func fitReplicas(service swarm.Service, replicas int, nodes []swarm.Node, tasks []swarm.Task) *replicaFit {
+	var reservations swarm.Resources
+	if resources := service.Spec.TaskTemplate.Resources; resources != nil && resources.Reservations != nil {
+		reservations = *resources.Reservations
+	}
+	placement := service.Spec.TaskTemplate.Placement
+	fit := &replicaFit{
+		ServiceID:             service.ID,
+		ServiceName:           service.Spec.Name,
+		Requested:             replicas,
+		CPUsPerReplica:        float64(reservations.NanoCPUs) / 1e9,
+		MemoryBytesPerReplica: reservations.MemoryBytes,
+		Nodes:                 make([]replicaFitNode, 0, len(nodes)),
+	}
+
+	var constraints []placementConstraint
+	var constraintErr error
+	if placement != nil {
+		fit.MaxReplicasPerNode = placement.MaxReplicas
+		fit.Constraints = placement.Constraints
+		for _, constraint := range placement.Constraints {
+			parsed, err := parsePlacementConstraint(constraint)
+			if err != nil {
+				constraintErr = err
+				break
+			}
+			constraints = append(constraints, parsed)
+		}
+	}
+
+	cluster := aggregateClusterCapacity(nodes, tasks)
+	capacities := make(map[string]nodeCapacity, len(cluster.Nodes))
+	for _, capacity := range cluster.Nodes {
+		capacities[capacity.NodeID] = capacity
+	}
+	serviceTasks := make(map[string]int)
+	for _, task := range tasks {
+		if task.ServiceID == service.ID && taskHoldsResources(task) {
+			serviceTasks[task.NodeID]++
+		}
+	}
+
+	for _, node := range nodes {
+		entry := replicaFitNode{NodeID: node.ID, Hostname: node.Description.Hostname}
+		if constraintErr != nil {
+			entry.Reason = constraintErr.Error()
+		} else {
+			entry.Reason = nodeIneligibility(node, placement, constraints)
+		}
+		if entry.Reason != "" {
+			fit.Nodes = append(fit.Nodes, entry)
+			continue
+		}
+		entry.Eligible = true
+
+		capacity := capacities[node.ID]
+		limit, limited := 0, false
+		if reservations.NanoCPUs > 0 {
+			headroom := node.Description.Resources.NanoCPUs - int64(math.Round(capacity.ReservedCPUs*1e9))
+			limit, limited = int(max(headroom, 0)/reservations.NanoCPUs), true
+		}
+		if reservations.MemoryBytes > 0 {
+			byMemory := int(max(capacity.HeadroomMemoryBytes, 0) / reservations.MemoryBytes)
+			if !limited || byMemory < limit {
+				limit = byMemory
+			}
+			limited = true
+		}
+		if placement != nil && placement.MaxReplicas > 0 {
+			byMax := max(int(placement.MaxReplicas)-serviceTasks[node.ID], 0)
+			if !limited || byMax < limit {
+				limit = byMax
+			}
+			limited = true
+		}
+		if !limited {
+			entry.Unbounded = true
+			fit.Unbounded = true
+		} else {
+			entry.Replicas = limit
+			fit.MaxReplicas += limit
+			if limit == 0 {
+				entry.Reason = "no capacity left"
+			}
+		}
+		fit.Nodes = append(fit.Nodes, entry)
+	}
+	sort.Slice(fit.Nodes, func(i, j int) bool { return fit.Nodes[i].Hostname < fit.Nodes[j].Hostname })
+	fit.Fits = fit.Unbounded || fit.MaxReplicas >= replicas
+	return fit
+}
+
+// capacityHandler reports the capacity of every node and of the cluster
+// against the reservations and limits of their tasks, the services reserving
+// nothing, and whether more replicas of a service fit.
+func capacityHandler(w http.ResponseWriter, r *http.Request) {
+	request, err := parseCapacityRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := capacityResponse{ServicesWithoutReservations: []unreservedService{}}
+	writeResponse := func() {
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("capacityHandler: encoding response failed: %v", err)
+		}
+	}
+
+	cli, err := getCli()
+	if err != nil {
+		errMsg := "Error getting Docker client: " + err.Error()
+		response.Error = &errMsg
+		writeResponse()
+		return
+	}
+	nodes, err := cli.NodeList(context.Background(), swarm.NodeListOptions{})
+	if err != nil {
+		errMsg := "Error listing nodes: " + err.Error()
+		response.Error = &errMsg
+		writeResponse()
+		return
+	}
+	services, err := cli.ServiceList(context.Background(), swarm.ServiceListOptions{})
+	if err != nil {
+		errMsg := "Error fetching services: " + err.Error()
+		response.Error = &errMsg
+		writeResponse()
+		return
+	}
+	tasks, err := runningTasks(cli, "")
+	if err != nil {
+		errMsg := "Error fetching tasks: " + err.Error()
+		response.Error = &errMsg
+		writeResponse()
+		return
+	}
+
+	response.Available = true
+	response.Cluster = aggregateClusterCapacity(nodes, tasks)
+	response.ServicesWithoutReservations = servicesWithoutReservations(services, tasks)
+	if request.service != "" {
+		var service *swarm.Service
+		for i := range services {
+			if services[i].ID == request.service || services[i].Spec.Name == request.service {
+				service = &services[i]
+				break
+			}
+		}
+		if service == nil {
+			errMsg := "Service not found"
+			response.Error = &errMsg
+			writeResponse()
+			return
+		}
+		response.Fit = fitReplicas(*service, request.replicas, nodes, tasks)
+	}
+	writeResponse()
+}
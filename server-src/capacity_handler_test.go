@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// capacityService builds a service reserving nanoCPUs and memory per replica.
+func capacityService(id, name string, nanoCPUs, memory int64, placement *swarm.Placement) swarm.Service {
+	service := swarm.Service{ID: id, Spec: swarm.ServiceSpec{
+		Annotations:  swarm.Annotations{Name: name, Labels: map[string]string{stackNamespaceLabel: "shop"}},
+		TaskTemplate: swarm.TaskSpec{Placement: placement},
+	}}
+	if nanoCPUs > 0 || memory > 0 {
+		service.Spec.TaskTemplate.Resources = &swarm.ResourceRequirements{Reservations: &swarm.Resources{NanoCPUs: nanoCPUs, MemoryBytes: memory}}
+	}
+	return service
+}
+
+// TestParsePlacementConstraint verifies the parsing and the matching of the
+// supported constraints.
+func TestParsePlacementConstraint(t *testing.T) {
+	node := swarm.Node{
+		ID:   "n1",
+		Spec: swarm.NodeSpec{Role: swarm.NodeRoleWorker, Annotations: swarm.Annotations{Labels: map[string]string{"zone": "eu-1"}}},
+		Description: swarm.NodeDescription{
+			Hostname: "alpha",
+			Platform: swarm.Platform{OS: "linux", Architecture: "x86_64"},
+			Engine:   swarm.EngineDescription{Labels: map[string]string{"storage": "ssd"}},
+		},
+	}
+	for constraint, want := range map[string]bool{
+		"node.role == worker":        true,
+		"node.role==Manager":         false,
+		"node.hostname!=alpha":       false,
+		"node.id==n1":                true,
+		"node.platform.os==linux":    true,
+		"node.labels.zone==EU-1":     true,
+		"node.labels.gpu==true":      false,
+		"node.labels.gpu!=true":      true,
+		"engine.labels.storage==ssd": true,
+	} {
+		parsed, err := parsePlacementConstraint(constraint)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", constraint, err)
+		}
+		if matches, err := parsed.matches(node); err != nil || matches != want {
+			t.Errorf("%s: expected %v, got %v/%v", constraint, want, matches, err)
+		}
+	}
+	for _, constraint := range []string{"node.role", "==worker", "node.role=="} {
+		if _, err := parsePlacementConstraint(constraint); err == nil {
+			t.Errorf("%s: expected an error", constraint)
+		}
+	}
+	parsed, _ := parsePlacementConstraint("node.color==blue")
+	if _, err := parsed.matches(node); err == nil {
+		t.Error("expected an unsupported key to be reported")
+	}
+}
+
+// TestFitReplicas verifies the replicas every node can take with its
+// headroom, placement and max replicas per node.
+func TestFitReplicas(t *testing.T) {
+	nodes := append([]swarm.Node{}, capacityNodes...)
+	nodes[1].Spec.Availability = swarm.NodeAvailabilityActive
+	nodes[1].Status.State = swarm.NodeStateReady
+	nodes = append(nodes, swarm.Node{ID: "n3", Spec: swarm.NodeSpec{Availability: swarm.NodeAvailabilityDrain},
+		Status: swarm.NodeStatus{State: swarm.NodeStateReady}, Description: swarm.NodeDescription{Hostname: "gamma"}})
+
+	// alpha has 2.5 CPUs and 5000 bytes left, beta 1 CPU and 1500 bytes.
+	fit := fitReplicas(capacityService("s1", "shop_web", 5e8, 1000, nil), 6, nodes, capacityTasks)
+	if fit.MaxReplicas != 6 || !fit.Fits || fit.Unbounded {
+		t.Fatalf("unexpected fit %+v", fit)
+	}
+	if fit.Nodes[0].Replicas != 5 || fit.Nodes[1].Replicas != 1 || fit.Nodes[2].Eligible || fit.Nodes[2].Reason != "node availability is drain" {
+		t.Errorf("unexpected nodes %+v", fit.Nodes)
+	}
+	if fit := fitReplicas(capacityService("s1", "shop_web", 5e8, 1000, nil), 7, nodes, capacityTasks); fit.Fits {
+		t.Errorf("expected 7 replicas not to fit, got %+v", fit)
+	}
+
+	// t1 and t2 already hold two of the three replicas allowed on alpha.
+	tasks := append([]swarm.Task{}, capacityTasks...)
+	tasks[0].ServiceID, tasks[1].ServiceID = "s2", "s2"
+	placed := fitReplicas(capacityService("s2", "shop_db", 0, 0, &swarm.Placement{
+		Constraints: []string{"node.role==manager"},
+		MaxReplicas: 3,
+	}), 2, nodes, tasks)
+	if placed.MaxReplicas != 1 || placed.Fits || placed.Nodes[0].Replicas != 1 || placed.Nodes[1].Eligible {
+		t.Fatalf("unexpected placed fit %+v", placed)
+	}
+
+	unbounded := fitReplicas(capacityService("s3", "shop_cache", 0, 0, &swarm.Placement{
+		Platforms: []swarm.Platform{{OS: "linux", Architecture: "amd64"}},
+	}), 100, nodes, capacityTasks)
+	if !unbounded.Fits || !unbounded.Unbounded || !unbounded.Nodes[0].Unbounded || unbounded.Nodes[1].Eligible {
+		t.Errorf("unexpected unbounded fit %+v", unbounded)
+	}
+}
+
+// TestCapacityHandler verifies the capacity report, the services without
+// reservations and the fit of a service named in the query.
+func TestCapacityHandler(t *testing.T) {
+	for _, query := range []string{"replicas=2", "service=shop_web&replicas=0", "service=shop_web&replicas=x"} {
+		rr := httptest.NewRecorder()
+		capacityHandler(rr, httptest.NewRequest("GET", "/ui/capacity?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rr.Code)
+		}
+	}
+
+	tasks := append([]swarm.Task{}, capacityTasks...)
+	tasks[4].ServiceID = "s2"
+	tasks[4].Spec.Resources = &swarm.ResourceRequirements{Limits: &swarm.Limit{NanoCPUs: 2e9, MemoryBytes: 4000}}
+	worker := capacityService("s2", "shop_worker", 0, 0, nil)
+	worker.Spec.TaskTemplate.Resources = tasks[4].Spec.Resources
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": capacityNodes,
+		"/v1.35/services": []swarm.Service{
+			capacityService("s1", "shop_web", 5e8, 1000, nil),
+			worker,
+			capacityService("s3", "shop_db", 1e9, 0, nil),
+		},
+		"/v1.35/tasks": tasks,
+	})
+
+	rr := httptest.NewRecorder()
+	capacityHandler(rr, httptest.NewRequest("GET", "/ui/capacity?service=shop_web&replicas=3", nil))
+	var response capacityResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || response.Cluster == nil || response.Cluster.HeadroomCPUs != 3.5 || response.Cluster.HeadroomMemoryBytes != 6500 ||
+		response.Cluster.LimitCPUs != 2 || response.Cluster.LimitMemoryBytes != 4000 {
+		t.Fatalf("unexpected capacity %s", rr.Body.String())
+	}
+	unreserved := response.ServicesWithoutReservations
+	if len(unreserved) != 2 || unreserved[0].ServiceName != "shop_db" || unreserved[0].MissingCPU || !unreserved[0].MissingMemory ||
+		unreserved[1].ServiceName != "shop_worker" || unreserved[1].Tasks != 1 || !unreserved[1].HasLimits {
+		t.Errorf("unexpected services without reservations %+v", unreserved)
+	}
+	// beta is neither ready nor active in the fixture.
+	if response.Fit == nil || response.Fit.ServiceID != "s1" || !response.Fit.Fits || response.Fit.MaxReplicas != 5 {
+		t.Errorf("unexpected fit %+v", response.Fit)
+	}
+
+	rr = httptest.NewRecorder()
+	capacityHandler(rr, httptest.NewRequest("GET", "/ui/capacity?service=ghost", nil))
+	response = capacityResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || response.Error == nil || *response.Error != "Service not found" {
+		t.Errorf("expected an unknown service to be reported, got %s", rr.Body.String())
+	}
+}
@@ -5,15 +5,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -49,6 +52,17 @@ const logChannelSize = 64
 // for some non-follow requests, so waiting for EOF alone would block.
 const tailCollectIdle = 100 * time.Millisecond
 
+// collectIdle is how long a one-shot request waits for another line. Grouped
+// lines only leave groupLogLines once its flush delay passed, so the wait
+// must outlast it or the last event would be lost while Docker keeps the
+// response open.
+func collectIdle(opts logsOptions) time.Duration {
+	if opts.group {
+		return groupFlushDelay(opts.groupWindow) + tailCollectIdle
+	}
+	return tailCollectIdle
+}
+
 // defaultTail is used when the client requests an unparsable number of lines.
 const defaultTail = 20
 
@@ -120,14 +134,26 @@ func processPayload(conn *websocket.Conn, payload []byte) error {
 
 // logsOptions holds the parameters of a logs websocket request.
 type logsOptions struct {
-	serviceID  string
+	serviceID string
+	// taskID, when set, reads the logs of that single task instead of the
+	// whole service.
+	taskID     string
 	tail       string
 	since      string
+	until      string
 	follow     bool
 	timestamps bool
 	stdout     bool
 	stderr     bool
 	details    bool
+	// cursor wraps every line into a logMessage carrying its cursor.
+	cursor bool
+	// resumeFrom is the cursor of the last line a reconnecting client got.
+	resumeFrom string
+	// group merges multi-line events into one message; lines arriving within
+	// groupWindow of each other are merged too.
+	group       bool
+	groupWindow time.Duration
 }
 
 // dayDurationPattern matches a relative duration expressed in days, e.g. "2d".
@@ -138,7 +164,7 @@ var dayDurationPattern = regexp.MustCompile(`^(\d+)d$`)
 // which supports "s", "m" and "h" but *not* days: a request for "2d" would
 // fail outright and the client would receive no logs at all. Days are
 // therefore expanded into hours. Absolute timestamps are passed through
-// untouched.
+// untouched. `until` is resolved by the same code and normalized with it.
 func normalizeSince(since string) string {
 	if match := dayDurationPattern.FindStringSubmatch(strings.TrimSpace(since)); match != nil {
 		if days, err := strconv.Atoi(match[1]); err == nil {
@@ -151,7 +177,12 @@ func normalizeSince(since string) string {
 // parseLogsOptions extracts the log parameters from the request. Absent or
 // unparsable parameters fall back to defaults rather than failing the request.
 func parseLogsOptions(r *http.Request) logsOptions {
-	query := r.URL.Query()
+	return logsOptionsFromQuery(mux.Vars(r)["id"], r.URL.Query())
+}
+
+// logsOptionsFromQuery builds the log options of a service from query
+// parameters, the way parseLogsOptions documents it.
+func logsOptionsFromQuery(serviceID string, query url.Values) logsOptions {
 	boolParam := func(key string) bool {
 		value, _ := strconv.ParseBool(query.Get(key))
 		return value
@@ -160,16 +191,76 @@ func parseLogsOptions(r *http.Request) logsOptions {
 	if tail == "" {
 		tail = "all"
 	}
-	return logsOptions{
-		serviceID:  mux.Vars(r)["id"],
+	opts := logsOptions{
+		serviceID:  serviceID,
 		tail:       tail,
 		since:      normalizeSince(query.Get("since")),
+		until:      normalizeSince(query.Get("until")),
 		follow:     boolParam("follow"),
 		timestamps: boolParam("timestamps"),
 		stdout:     boolParam("stdout"),
 		stderr:     boolParam("stderr"),
 		details:    boolParam("details"),
+		cursor:     boolParam("cursor"),
+		resumeFrom: query.Get("resumeFrom"),
+		group:      boolParam("group"),
+	}
+	if window, err := time.ParseDuration(query.Get("groupWindow")); err == nil && window > 0 {
+		opts.groupWindow = window
+	}
+	// A grouped event holds several lines, which only a logMessage can carry
+	// as one websocket message.
+	if opts.group {
+		opts.cursor = true
+	}
+	if cursor, err := parseLogCursor(opts.resumeFrom); err == nil {
+		opts = resumeLogsOptions(opts, cursor)
+	}
+	// No new line can fall into a window that already ended, so following
+	// it is a one-shot request that would otherwise never end.
+	if now := time.Now(); opts.follow {
+		if until, hasUntil := resolveLogTime(opts.until, now); hasUntil && !until.After(now) {
+			opts.follow = false
+		}
+	}
+	return opts
+}
+
+// errUntilBeforeSince reports a logs window that ends before it starts.
+var errUntilBeforeSince = errors.New("until must not be before since")
+
+// resolveLogTime turns a normalized `since` or `until` value into an absolute
+// time, the way the Docker daemon would: relative durations count back from
+// now, RFC 3339 and Unix timestamps are taken as they are. It reports false
+// for an empty or unrecognized value, which is left for Docker to judge.
+func resolveLogTime(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, true
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole := int64(seconds)
+		return time.Unix(whole, int64((seconds-float64(whole))*1e9)), true
 	}
+	return time.Time{}, false
+}
+
+// validateLogsWindow rejects a window whose `until` lies before its `since`.
+// Docker would accept such a request and answer with no logs at all, which the
+// client could not tell apart from a quiet service.
+func validateLogsWindow(opts logsOptions, now time.Time) error {
+	since, hasSince := resolveLogTime(opts.since, now)
+	until, hasUntil := resolveLogTime(opts.until, now)
+	if hasSince && hasUntil && until.Before(since) {
+		return errUntilBeforeSince
+	}
+	return nil
 }
 
 // tailCount returns the number of lines a one-shot request asked for.
@@ -180,23 +271,15 @@ func tailCount(tail string) int {
 	return defaultTail
 }
 
-// stripFramePrefix removes Docker's 8-byte multiplex header from a single log
-// line. It returns nil when the line carries no payload.
-func stripFramePrefix(line []byte) []byte {
-	if len(line) <= 8 {
-		return nil
-	}
-	return append([]byte(nil), line[8:]...)
-}
-
 // dockerServiceLogsHandler streams the logs of a Docker service over a
 // websocket.
 //
-// A single context governs the whole request: it is cancelled when the handler
-// returns or when the client disconnects, which closes the Docker log reader
-// and unblocks every goroutine started here. Log lines travel over one
-// channel, owned and closed by the reader, so no extra synchronisation is
-// needed between the reader and the writer.
+// A followed stream is shared through logStreams with every viewer asking for
+// the same lines; the handler only subscribes and pipes the lines it receives
+// to its client. A one-shot request reads its own stream: a single context
+// governs it and is cancelled when the handler returns or when the client
+// disconnects, which closes the Docker log reader and unblocks every goroutine
+// started here.
 func dockerServiceLogsHandler(w http.ResponseWriter, r *http.Request) {
 	opts := parseLogsOptions(r)
 
@@ -211,8 +294,16 @@ func dockerServiceLogsHandler(w http.ResponseWriter, r *http.Request) {
 	defer func() { _ = conn.Close() }()
 	defer log.Println("gone:", clientAddress)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if err := validateLogsWindow(opts, time.Now()); err != nil {
+		closeWithError(conn, "Invalid logs window: "+err.Error())
+		return
+	}
+	if opts.resumeFrom != "" {
+		if _, err := parseLogCursor(opts.resumeFrom); err != nil {
+			closeWithError(conn, "Invalid resumeFrom: "+err.Error())
+			return
+		}
+	}
 
 	cli, err := getCli()
 	if err != nil {
@@ -220,27 +311,44 @@ func dockerServiceLogsHandler(w http.ResponseWriter, r *http.Request) {
 		closeWithError(conn, "Docker client error")
 		return
 	}
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		return openServiceLogs(ctx, cli, opts)
+	}
 
-	logReader, err := cli.ServiceLogs(ctx, opts.serviceID, container.LogsOptions{
-		Tail:       opts.tail,
-		Since:      opts.since,
-		Follow:     opts.follow,
-		Timestamps: opts.timestamps,
-		ShowStdout: opts.stdout,
-		ShowStderr: opts.stderr,
-		Details:    opts.details,
-	})
-	if err != nil {
-		// Report the reason to the client: an unusable option (an invalid
-		// `since` for instance) would otherwise look like a service with no
-		// logs at all.
-		log.Printf("dockerServiceLogsHandler: ServiceLogs error: %v", err)
-		closeWithError(conn, "Docker logs error: "+err.Error())
+	if opts.follow {
+		subscriber := logStreams.subscribe(logStreamKey(cli.DaemonHost(), opts), opts, open,
+			func(reason string) {
+				if reason != "" {
+					closeWithError(conn, reason)
+				}
+			})
+		defer logStreams.unsubscribe(subscriber)
+		// The client is not expected to send anything; reading detects a
+		// disconnect, and leaving the stream closes the subscriber channel,
+		// which stops the streaming loop below.
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					logStreams.unsubscribe(subscriber)
+					return
+				}
+			}
+		}()
+		// The rate limit applies per connection, after the shared stream, so
+		// every viewer gets its own budget.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		streamLogs(conn, rateLimitedLogLines(ctx, subscriber.lines, opts))
 		return
 	}
-	if logReader == nil {
-		log.Printf("dockerServiceLogsHandler: no log stream for service %s", opts.serviceID)
-		closeWithError(conn, "Docker returned no log stream")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logReader, err := open(ctx)
+	if err != nil {
+		log.Printf("dockerServiceLogsHandler: ServiceLogs error: %v", err)
+		closeWithError(conn, logsErrorReason(err))
 		return
 	}
 	defer func() { _ = logReader.Close() }()
@@ -252,9 +360,8 @@ func dockerServiceLogsHandler(w http.ResponseWriter, r *http.Request) {
 		_ = logReader.Close()
 	}()
 
-	// The client is not expected to send anything; reading detects a
-	// disconnect. Closing the connection makes any pending write fail, which
-	// stops the streaming loop below.
+	// Reading detects a disconnect. Closing the connection makes any pending
+	// write fail, which stops the sending loop.
 	go func() {
 		defer cancel()
 		for {
@@ -265,11 +372,60 @@ func dockerServiceLogsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	if opts.follow {
-		streamLogs(ctx, conn, logReader)
-		return
+	sendLogTail(ctx, conn, logLines(ctx, logReader, opts), tailCount(opts.tail), collectIdle(opts))
+}
+
+// errNoLogStream reports a Docker answer that carried no log stream.
+var errNoLogStream = errors.New("no log stream")
+
+// openServiceLogs opens the Docker log stream of a service, or of one of its
+// tasks when the options name one, for the options of a request.
+func openServiceLogs(ctx context.Context, cli *client.Client, opts logsOptions) (io.ReadCloser, error) {
+	// The service logs API has no `until` parameter and the client drops
+	// Until from the query, so the window is enforced on our side from the
+	// line timestamps; they are requested whenever a bound applies, and
+	// whenever cursors are built from them. Docker would apply the tail
+	// before that filter, leaving only the matches among the last lines
+	// overall, so a window that already ended asks for every line and the
+	// tail is taken from the filtered lines by the one-shot reader.
+	now := time.Now()
+	until, hasUntil := resolveLogTime(opts.until, now)
+	tail := opts.tail
+	if hasUntil && !until.After(now) {
+		tail = "all"
 	}
-	sendLogTail(ctx, conn, logReader, tailCount(opts.tail))
+	serviceLogs := cli.ServiceLogs
+	id := opts.serviceID
+	if opts.taskID != "" {
+		serviceLogs, id = cli.TaskLogs, opts.taskID
+	}
+	logReader, err := serviceLogs(ctx, id, container.LogsOptions{
+		Tail:       tail,
+		Since:      opts.since,
+		Until:      opts.until,
+		Follow:     opts.follow,
+		Timestamps: opts.timestamps || hasUntil || opts.cursor,
+		ShowStdout: opts.stdout,
+		ShowStderr: opts.stderr,
+		Details:    opts.details,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if logReader == nil {
+		return nil, errNoLogStream
+	}
+	return logReader, nil
+}
+
+// logsErrorReason turns a failure to open a log stream into the reason sent
+// to the client. An unusable option (an invalid `since` for instance) would
+// otherwise look like a service with no logs at all.
+func logsErrorReason(err error) string {
+	if errors.Is(err, errNoLogStream) {
+		return "Docker returned no log stream"
+	}
+	return "Docker logs error: " + err.Error()
 }
 
 // closeWithError closes the websocket with an internal-error close frame
@@ -280,8 +436,10 @@ func closeWithError(conn *websocket.Conn, reason string) {
 	if len(reason) > 123 {
 		reason = strings.ToValidUTF8(reason[:123], "")
 	}
-	_ = conn.WriteMessage(websocket.CloseMessage,
-		websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason))
+	// WriteControl may run concurrently with the writer goroutine, which lets
+	// a shared log stream close a subscriber from its own goroutine.
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseInternalServerErr, reason), time.Now().Add(writeWait))
 }
 
 // readLogLines reads the Docker log stream line by line and forwards each line
@@ -309,28 +467,133 @@ func readLogLines(ctx context.Context, logReader io.Reader, lines chan<- []byte)
 	}
 }
 
-// streamLogs pipes the Docker log stream to the client until the stream ends
-// or the connection breaks. A full channel applies backpressure on the reader
-// instead of dropping the connection, and a client that stops consuming
-// altogether is dropped by the write deadline in writeLogPipeToClient.
-func streamLogs(ctx context.Context, conn *websocket.Conn, logReader io.Reader) {
+// logLines starts reading the Docker log stream and returns the channel its
+// lines arrive on. The lines pass through maskLogLines when log masking is
+// enabled, through filterLogsUntil when the request carries an `until` bound,
+// through groupLogLines when it groups multi-line events, and through
+// cursorLogLines when the client wants cursors; every stage owns and closes its
+// output, so the end of the stream propagates down to the consumer.
+func logLines(ctx context.Context, logReader io.Reader, opts logsOptions) <-chan []byte {
+	lines := make(chan []byte, logChannelSize)
+	go readLogLines(ctx, logReader, lines)
+
+	if logMasker := newLogMasker(); logMasker != nil {
+		masked := make(chan []byte, logChannelSize)
+		go maskLogLines(ctx, lines, masked, logMasker)
+		lines = masked
+	}
+	if until, hasUntil := resolveLogTime(opts.until, time.Now()); hasUntil {
+		filtered := make(chan []byte, logChannelSize)
+		go filterLogsUntil(ctx, lines, filtered, until, opts.timestamps || opts.cursor, opts.follow)
+		lines = filtered
+	}
+	if opts.group {
+		grouped := make(chan []byte, logChannelSize)
+		go groupLogLines(ctx, lines, grouped, logGroupPattern(), opts.groupWindow)
+		lines = grouped
+	}
+	if opts.cursor {
+		var resume *logCursor
+		if cursor, err := parseLogCursor(opts.resumeFrom); err == nil {
+			resume = &cursor
+		}
+		wrapped := make(chan []byte, logChannelSize)
+		go cursorLogLines(ctx, lines, wrapped, resume, opts.timestamps)
+		lines = wrapped
+	}
+	return lines
+}
+
+// filterLogsUntil forwards the lines logged at or before `until` and drops
+// the later ones. The lines must carry Docker's timestamp prefix; it is
+// removed again when the client did not ask for timestamps, so the bound does
+// not change what the client sees. Lines without a parsable timestamp are
+// forwarded, dropping them could hide output rather than bound it. A followed
+// stream ends with the first later line, or once `until` is reached.
+func filterLogsUntil(ctx context.Context, in <-chan []byte, out chan<- []byte, until time.Time, keepTimestamps, follow bool) {
+	defer close(out)
+	var reached <-chan time.Time
+	if follow {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		reached = timer.C
+	}
+	for {
+		var line []byte
+		select {
+		case received, ok := <-in:
+			if !ok {
+				return
+			}
+			line = received
+		case <-reached:
+			return
+		case <-ctx.Done():
+			return
+		}
+		header, payload := splitLogLine(line)
+		stamp, message, _ := bytes.Cut(payload, []byte{' '})
+		if logged, err := time.Parse(time.RFC3339Nano, string(stamp)); err == nil {
+			if logged.After(until) {
+				if follow {
+					return
+				}
+				continue
+			}
+			if !keepTimestamps {
+				line = joinLogLine(header, message, len(payload)-len(message))
+			}
+		}
+		select {
+		case out <- line:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// splitLogLine separates Docker's 8-byte multiplex header from the payload of
+// a single log line. A line too short to carry a header has no payload.
+func splitLogLine(line []byte) (header, payload []byte) {
+	if len(line) <= 8 {
+		return line, nil
+	}
+	return line[:8], line[8:]
+}
+
+// joinLogLine rebuilds a log line from its header and a payload that was
+// shortened by `removed` bytes. The frame size in the header shrinks by the
+// same amount, so the line is framed exactly as if Docker had sent it so.
+func joinLogLine(header, payload []byte, removed int) []byte {
+	line := make([]byte, 0, len(header)+len(payload))
+	line = append(line, header...)
+	if size := int(binary.BigEndian.Uint32(header[4:8])); size >= removed {
+		binary.BigEndian.PutUint32(line[4:8], uint32(size-removed))
+	}
+	return append(line, payload...)
+}
+
+// streamLogs pipes the log lines to the client until the stream ends or the
+// connection breaks. A full channel queues the lines in the broadcaster
+// instead of dropping the connection; a client that stops consuming
+// altogether is dropped by the write deadline in writeLogPipeToClient, or by
+// the broadcaster once its queue is full.
+func streamLogs(conn *websocket.Conn, lines <-chan []byte) {
 	conn.SetReadLimit(1024 * 1024)
 	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error {
 		return conn.SetReadDeadline(time.Now().Add(pongWait))
 	})
 
-	lines := make(chan []byte, logChannelSize)
-	go readLogLines(ctx, logReader, lines)
 	writeLogPipeToClient(conn, lines)
 }
 
 // sendLogTail answers a one-shot request: it collects the available log lines,
 // sends the last `tail` of them and closes the connection normally. Docker
-// keeps the response open for some non-follow requests, so collection ends on
-// an idle timeout rather than on EOF alone.
-func sendLogTail(ctx context.Context, conn *websocket.Conn, logReader io.Reader, tail int) {
-	lines := collectLogLines(ctx, logReader, tailCollectIdle)
+// keeps the response open for some non-follow requests, so collection ends
+// once no line arrived for `idle` rather than on EOF alone.
+func sendLogTail(ctx context.Context, conn *websocket.Conn, raw <-chan []byte, tail int, idle time.Duration) {
+	lines := collectLogLines(ctx, raw, idle)
 
 	start := 0
 	if len(lines) > tail {
@@ -348,11 +611,27 @@ func sendLogTail(ctx context.Context, conn *websocket.Conn, logReader io.Reader,
 
 // collectLogLines gathers log lines until the stream ends, the context is
 // cancelled or no new line arrived for `idle`.
-func collectLogLines(ctx context.Context, logReader io.Reader, idle time.Duration) [][]byte {
-	raw := make(chan []byte, logChannelSize)
-	go readLogLines(ctx, logReader, raw)
-
+func collectLogLines(ctx context.Context, raw <-chan []byte, idle time.Duration) [][]byte {
 	var lines [][]byte
+	forEachLogLine(ctx, raw, idle, func(payload []byte) bool {
+		lines = append(lines, payload)
+		return true
+	})
+	return lines
+}
+
+// forEachLogLine hands the payload of every non-empty log line to `visit`
+// until the stream ends, the context is cancelled, `visit` returns false or no
+// new line arrived for `idle`.
+func forEachLogLine(ctx context.Context, raw <-chan []byte, idle time.Duration, visit func(payload []byte) bool) {
+	forEachFramedLogLine(ctx, raw, idle, func(_, payload []byte) bool {
+		return visit(payload)
+	})
+}
+
+// forEachFramedLogLine is forEachLogLine, also handing over the multiplex
+// header of every line, which tells stdout from stderr.
+func forEachFramedLogLine(ctx context.Context, raw <-chan []byte, idle time.Duration, visit func(header, payload []byte) bool) {
 	// The timer only limits the gap *between* lines: it starts once the first
 	// line has arrived, so a slow first response does not truncate the output.
 	timer := time.NewTimer(idle)
@@ -365,10 +644,10 @@ func collectLogLines(ctx context.Context, logReader io.Reader, idle time.Duratio
 		select {
 		case line, ok := <-raw:
 			if !ok {
-				return lines
+				return
 			}
-			if payload := stripFramePrefix(line); len(payload) > 0 {
-				lines = append(lines, payload)
+			if header, payload := splitLogLine(line); len(payload) > 0 && !visit(header, payload) {
+				return
 			}
 			if !timer.Stop() {
 				select {
@@ -378,9 +657,9 @@ func collectLogLines(ctx context.Context, logReader io.Reader, idle time.Duratio
 			}
 			timer.Reset(idle)
 		case <-timer.C:
-			return lines
+			return
 		case <-ctx.Done():
-			return lines
+			return
 		}
 	}
 }
@@ -388,7 +667,7 @@ func collectLogLines(ctx context.Context, logReader io.Reader, idle time.Duratio
 // writeLogPipeToClient serializes writes to the websocket connection.
 // It sends regular ping messages to keep the connection alive and sets
 // write deadlines to avoid blocking forever on slow clients.
-func writeLogPipeToClient(websocketConn *websocket.Conn, channel chan []byte) {
+func writeLogPipeToClient(websocketConn *websocket.Conn, channel <-chan []byte) {
 	const writeWait = 10 * time.Second
 	// ticker interval chosen slightly less than the read deadline to
 	// ensure the peer's pong keeps the connection alive. Exported as a
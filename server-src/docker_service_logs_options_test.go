@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -134,3 +137,322 @@ func TestDockerServiceLogsHandler_SinceInDays(t *testing.T) {
 		t.Fatal("docker daemon was never called")
 	}
 }
+
+// TestParseLogsOptionsUntil verifies that `until` is read from the request and
+// that day units are expanded like they are for `since`.
+func TestParseLogsOptionsUntil(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/docker/logs/svc1?since=2d&until=1d", nil)
+	opts := parseLogsOptions(r)
+
+	if opts.since != "48h" || opts.until != "24h" {
+		t.Fatalf("expected since=48h and until=24h, got since=%q until=%q", opts.since, opts.until)
+	}
+}
+
+// TestResolveLogTime verifies the formats accepted for `since` and `until`.
+func TestResolveLogTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 14, 10, 0, 0, time.UTC)
+	cases := []struct {
+		in   string
+		want time.Time
+		ok   bool
+	}{
+		{"10m", now.Add(-10 * time.Minute), true},
+		{"2024-03-01T14:02:00Z", time.Date(2024, 3, 1, 14, 2, 0, 0, time.UTC), true},
+		{"1709301720", time.Unix(1709301720, 0), true},
+		{"1709301720.5", time.Unix(1709301720, 500000000), true},
+		{"", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, tc := range cases {
+		got, ok := resolveLogTime(tc.in, now)
+		if ok != tc.ok || !got.Equal(tc.want) {
+			t.Errorf("resolveLogTime(%q) = %v, %v; want %v, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// TestValidateLogsWindow verifies that only a window ending before it starts
+// is rejected.
+func TestValidateLogsWindow(t *testing.T) {
+	now := time.Date(2024, 3, 1, 14, 10, 0, 0, time.UTC)
+	cases := []struct {
+		since, until string
+		wantErr      bool
+	}{
+		{"2024-03-01T14:02:00Z", "2024-03-01T14:10:00Z", false},
+		{"2024-03-01T14:10:00Z", "2024-03-01T14:02:00Z", true},
+		{"1h", "10m", false},
+		{"10m", "1h", true},
+		{"", "1h", false},
+		{"1h", "", false},
+		{"1h", "not-a-time", false},
+	}
+	for _, tc := range cases {
+		err := validateLogsWindow(logsOptions{since: tc.since, until: tc.until}, now)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("validateLogsWindow(since=%q, until=%q) error = %v, wantErr %v", tc.since, tc.until, err, tc.wantErr)
+		}
+	}
+}
+
+// TestDockerServiceLogsHandler_UntilBeforeSince verifies that an inverted
+// window is reported to the client instead of reaching the Docker daemon.
+func TestDockerServiceLogsHandler_UntilBeforeSince(t *testing.T) {
+	called := make(chan struct{}, 1)
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc1")
+	q := u.Query()
+	q.Set("since", "2024-03-01T14:10:00Z")
+	q.Set("until", "2024-03-01T14:02:00Z")
+	q.Set("stdout", "true")
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseInternalServerErr {
+		t.Fatalf("expected an internal-error close frame, got %v", err)
+	}
+	if !strings.Contains(closeErr.Text, "until must not be before since") {
+		t.Fatalf("expected the close reason to explain the window, got %q", closeErr.Text)
+	}
+	select {
+	case <-called:
+		t.Fatal("docker daemon must not be called for an invalid window")
+	default:
+	}
+}
+
+// TestDockerServiceLogsHandler_UntilBoundsWindow verifies end-to-end that the
+// lines logged after `until` are dropped, and that the timestamps requested to
+// enforce the bound are removed again when the client did not ask for them.
+func TestDockerServiceLogsHandler_UntilBoundsWindow(t *testing.T) {
+	done := make(chan struct{})
+	timestampsCh := make(chan string, 1)
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			select {
+			case timestampsCh <- r.URL.Query().Get("timestamps"):
+			default:
+			}
+			_, _ = w.Write([]byte("12345678" + "2024-03-01T14:05:00.000000001Z inside\n"))
+			_, _ = w.Write([]byte("12345678" + "2024-03-01T14:11:00Z after\n"))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc1")
+	q := u.Query()
+	q.Set("tail", "20")
+	q.Set("since", "2024-03-01T14:02:00Z")
+	q.Set("until", "2024-03-01T14:10:00Z")
+	q.Set("stdout", "true")
+	q.Set("timestamps", "false")
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "inside" {
+		t.Fatalf("expected 'inside', got %q (%v)", string(msg), err)
+	}
+	var closeErr *websocket.CloseError
+	if _, msg, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure {
+		t.Fatalf("expected the window to end after one line, got %q (%v)", string(msg), err)
+	}
+
+	if timestamps := <-timestampsCh; timestamps != "1" {
+		t.Fatalf("expected timestamps to be requested from docker, got %q", timestamps)
+	}
+}
+
+// TestFilterLogsUntil verifies that a filtered line keeps a consistent frame
+// header and that lines without a timestamp are forwarded.
+func TestFilterLogsUntil(t *testing.T) {
+	frame := func(payload string) []byte {
+		header := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[4:], uint32(len(payload)+1))
+		return append(header, payload...)
+	}
+	in := make(chan []byte, 3)
+	in <- frame("2024-03-01T14:05:00Z kept")
+	in <- frame("2024-03-01T14:11:00Z dropped")
+	in <- frame("no timestamp")
+	close(in)
+
+	out := make(chan []byte, 3)
+	filterLogsUntil(context.Background(), in, out, time.Date(2024, 3, 1, 14, 10, 0, 0, time.UTC), false, false)
+
+	var got [][]byte
+	for line := range out {
+		got = append(got, line)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(got))
+	}
+	if string(got[0][8:]) != "kept" || binary.BigEndian.Uint32(got[0][4:8]) != uint32(len("kept")+1) {
+		t.Fatalf("unexpected first line %q", got[0])
+	}
+	if string(got[1][8:]) != "no timestamp" {
+		t.Fatalf("unexpected second line %q", got[1])
+	}
+}
+
+// TestDockerServiceLogsHandler_UntilAppliesTailAfterFilter verifies that a
+// window that already ended asks Docker for every line and takes the tail
+// from the lines within the window.
+func TestDockerServiceLogsHandler_UntilAppliesTailAfterFilter(t *testing.T) {
+	done := make(chan struct{})
+	tailCh := make(chan string, 1)
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			select {
+			case tailCh <- r.URL.Query().Get("tail"):
+			default:
+			}
+			for _, line := range []string{
+				"2024-03-01T14:05:00Z one",
+				"2024-03-01T14:06:00Z two",
+				"2024-03-01T14:11:00Z after",
+				"2024-03-01T14:12:00Z later",
+			} {
+				_, _ = w.Write([]byte("12345678" + line + "\n"))
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc1")
+	q := u.Query()
+	q.Set("tail", "1")
+	q.Set("since", "2024-03-01T14:02:00Z")
+	q.Set("until", "2024-03-01T14:10:00Z")
+	q.Set("stdout", "true")
+	// A followed window that already ended is answered once.
+	q.Set("follow", "true")
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "two" {
+		t.Fatalf("expected 'two', got %q (%v)", string(msg), err)
+	}
+	var closeErr *websocket.CloseError
+	if _, msg, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure {
+		t.Fatalf("expected the window to end after one line, got %q (%v)", string(msg), err)
+	}
+	if tail := <-tailCh; tail != "all" {
+		t.Fatalf("expected every line to be requested from docker, got tail=%q", tail)
+	}
+}
+
+// TestDockerServiceLogsHandler_FollowEndsAtUntil verifies that a followed
+// stream ends once `until` is reached, without a later line.
+func TestDockerServiceLogsHandler_FollowEndsAtUntil(t *testing.T) {
+	done := make(chan struct{})
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			_, _ = w.Write([]byte("12345678" + time.Now().UTC().Format(time.RFC3339Nano) + " now\n"))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc-until")
+	q := u.Query()
+	q.Set("until", time.Now().Add(300*time.Millisecond).UTC().Format(time.RFC3339Nano))
+	q.Set("stdout", "true")
+	q.Set("follow", "true")
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "now" {
+		t.Fatalf("expected 'now', got %q (%v)", string(msg), err)
+	}
+	var closeErr *websocket.CloseError
+	if _, msg, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure {
+		t.Fatalf("expected the stream to end at until, got %q (%v)", string(msg), err)
+	}
+}
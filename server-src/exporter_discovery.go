@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// The ways the exporter of every node is discovered.
+const (
+	exporterDiscoveryLabel  = "label"  // Tasks of the service carrying the discovery label
+	exporterDiscoveryStatic = "static" // DSD_*_TARGETS map of node hostnames or IDs to URLs
+	exporterDiscoveryDNS    = "dns"    // Addresses of tasks.<name>, matched to the nodes
+)
+
+// lookupHost resolves the DNS discovery names. For testing.
+var lookupHost = net.LookupHost
+
+// exporterDiscovery finds the exporter of every node, configured by the
+// environment variables with envPrefix, e.g. DSD_NODE_EXPORTER_DISCOVERY.
+type exporterDiscovery struct {
+	name          string // node-exporter or cadvisor
+	envPrefix     string
+	defaultPort   int
+	scrape        func(*swarm.Service) exporterScrapeConfig
+	discoveryMode string // Parsed once by loadExporterDiscoveryFromEnv
+	dnsPort       int
+}
+
+var (
+	nodeExporterDiscovery = exporterDiscovery{name: "node-exporter", envPrefix: nodeExporterEnvPrefix, defaultPort: 9100, scrape: nodeExporterScrapeConfig}
+	cadvisorDiscovery     = exporterDiscovery{name: "cadvisor", envPrefix: cadvisorEnvPrefix, defaultPort: 8080, scrape: cadvisorScrapeConfig}
+)
+
+// loadExporterDiscoveryFromEnv reads the discovery mode and DNS port of the
+// exporters, warning once about invalid values.
+func loadExporterDiscoveryFromEnv() {
+	for _, d := range []*exporterDiscovery{&nodeExporterDiscovery, &cadvisorDiscovery} {
+		d.discoveryMode = d.modeFromEnv()
+		d.dnsPort = d.portFromEnv()
+	}
+}
+
+// modeFromEnv is the configured discovery, `label` by default.
+func (d exporterDiscovery) modeFromEnv() string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(d.envPrefix + "DISCOVERY")))
+	switch value {
+	case "":
+		return exporterDiscoveryLabel
+	case exporterDiscoveryLabel, exporterDiscoveryStatic, exporterDiscoveryDNS:
+		return value
+	default:
+		log.Printf("WARNING: invalid %sDISCOVERY %q, using %q", d.envPrefix, value, exporterDiscoveryLabel)
+		return exporterDiscoveryLabel
+	}
+}
+
+// mode is the discovery read at startup.
+func (d exporterDiscovery) mode() string {
+	if d.discoveryMode == "" {
+		return exporterDiscoveryLabel
+	}
+	return d.discoveryMode
+}
+
+// standInService stands for the exporter when it is not discovered through a
+// swarm service. Its ID matches no task.
+func (d exporterDiscovery) standInService() *swarm.Service {
+	mode := d.mode()
+	return &swarm.Service{
+		ID: mode + ":" + d.name,
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: fmt.Sprintf("%s (%s discovery)", d.name, mode)},
+			Mode:        swarm.ServiceMode{Global: &swarm.GlobalService{}},
+		},
+	}
+}
+
+// dnsName is the service name whose tasks.<name> record lists the exporters.
+func (d exporterDiscovery) dnsName() string {
+	if value := strings.TrimSpace(os.Getenv(d.envPrefix + "DNS_NAME")); value != "" {
+		return value
+	}
+	return d.name
+}
+
+// port is the port of the exporters discovered through DNS, read at startup.
+func (d exporterDiscovery) port() int {
+	if d.dnsPort == 0 {
+		return d.defaultPort
+	}
+	return d.dnsPort
+}
+
+// portFromEnv is the configured DNS port, the default port of the exporter
+// when unset or invalid.
+func (d exporterDiscovery) portFromEnv() int {
+	value := strings.TrimSpace(os.Getenv(d.envPrefix + "PORT"))
+	if value == "" {
+		return d.defaultPort
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		log.Printf("WARNING: invalid %sPORT %q, using %d", d.envPrefix, value, d.defaultPort)
+		return d.defaultPort
+	}
+	return port
+}
+
+// targets maps the ID of every node with an exporter to its metrics URL, in
+// the static and DNS discovery modes.
+func (d exporterDiscovery) targets(cli *client.Client) (map[string]string, error) {
+	nodes, err := cli.NodeList(context.Background(), swarm.NodeListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	if d.mode() == exporterDiscoveryDNS {
+		return d.dnsTargets(cli, nodes)
+	}
+	return d.staticTargets(nodes), nil
+}
+
+// staticTargets reads the `hostname=URL` pairs of DSD_*_TARGETS, separated by
+// commas. A node may also be named by its ID.
+func (d exporterDiscovery) staticTargets(nodes []swarm.Node) map[string]string {
+	nodeIDs := make(map[string]string, 2*len(nodes))
+	for _, node := range nodes {
+		nodeIDs[node.ID] = node.ID
+		nodeIDs[node.Description.Hostname] = node.ID
+	}
+	targets := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv(d.envPrefix+"TARGETS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		node, url, ok := strings.Cut(entry, "=")
+		node, url = strings.TrimSpace(node), strings.TrimSpace(url)
+		if !ok || node == "" || url == "" {
+			log.Printf("WARNING: invalid %sTARGETS entry %q, expected hostname=URL", d.envPrefix, entry)
+			continue
+		}
+		nodeID, found := nodeIDs[node]
+		if !found {
+			log.Printf("WARNING: %sTARGETS names unknown node %q", d.envPrefix, node)
+			continue
+		}
+		targets[nodeID] = url
+	}
+	return targets
+}
+
+// dnsTargets resolves tasks.<name> and matches every address to the node of
+// the task of the <name> service attached with it or, for exporters outside
+// swarm, to the node with that address.
+func (d exporterDiscovery) dnsTargets(cli *client.Client, nodes []swarm.Node) (map[string]string, error) {
+	name := "tasks." + d.dnsName()
+	addresses, err := lookupHost(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+
+	nodesByAddress := make(map[string]string)
+	for _, node := range nodes {
+		if node.Status.Addr != "" {
+			nodesByAddress[node.Status.Addr] = node.ID
+		}
+	}
+	f := filters.NewArgs()
+	f.Add("service", d.dnsName())
+	f.Add("desired-state", string(swarm.TaskStateRunning))
+	tasks, err := cli.TaskList(context.Background(), swarm.TaskListOptions{Filters: f})
+	// An exporter outside swarm has no service of that name
+	if err != nil && !cerrdefs.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	for _, task := range tasks {
+		for _, attachment := range task.NetworksAttachments {
+			for _, address := range attachment.Addresses {
+				nodesByAddress[strings.SplitN(address, "/", 2)[0]] = task.NodeID
+			}
+		}
+	}
+
+	config := d.scrape(nil)
+	targets := make(map[string]string)
+	for _, address := range addresses {
+		nodeID, found := nodesByAddress[address]
+		if !found {
+			log.Printf("%s discovery: %s address %s matches no node", d.name, name, address)
+			continue
+		}
+		targets[nodeID] = config.url(address, d.port())
+	}
+	return targets, nil
+}
+
+// cachedTargets is targets, reused for the discovery TTL.
+func (d exporterDiscovery) cachedTargets(cli *client.Client) (map[string]string, error) {
+	return targetsCache.get(d.name+"|"+d.mode(), metricsDiscoveryTTL(), func() (map[string]string, error) {
+		return d.targets(cli)
+	})
+}
+
+// endpoint is the metrics URL of the exporter of a node in the static and
+// DNS discovery modes, scraped with the configuration of the environment.
+func (d exporterDiscovery) endpoint(cli *client.Client, nodeID string) (exporterEndpoint, error) {
+	targets, err := d.cachedTargets(cli)
+	if err != nil {
+		return exporterEndpoint{}, err
+	}
+	url, found := targets[nodeID]
+	if !found {
+		return exporterEndpoint{}, fmt.Errorf("no %s target for node %s with %s discovery", d.name, nodeID, d.mode())
+	}
+	return exporterEndpoint{url: url, config: d.scrape(nil)}, nil
+}
+
+// nodeIDs returns the nodes with an exporter: the nodes running a task of
+// the discovered service, or the nodes with a static or DNS target.
+func (d exporterDiscovery) nodeIDs(cli *client.Client, service *swarm.Service) ([]string, error) {
+	if d.mode() != exporterDiscoveryLabel {
+		targets, err := d.cachedTargets(cli)
+		if err != nil {
+			return nil, err
+		}
+		nodeIDs := make([]string, 0, len(targets))
+		for nodeID := range targets {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+		sort.Strings(nodeIDs)
+		return nodeIDs, nil
+	}
+
+	f := filters.NewArgs()
+	f.Add("service", service.ID)
+	f.Add("desired-state", string(swarm.TaskStateRunning))
+	tasks, err := cli.TaskList(context.Background(), swarm.TaskListOptions{Filters: f})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	nodeIDs := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateRunning {
+			nodeIDs = append(nodeIDs, task.NodeID)
+		}
+	}
+	return nodeIDs, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+var discoveryNodes = []swarm.Node{
+	{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}, Status: swarm.NodeStatus{Addr: "192.168.1.1"}},
+	{ID: "n2", Description: swarm.NodeDescription{Hostname: "beta"}, Status: swarm.NodeStatus{Addr: "192.168.1.2"}},
+}
+
+// setDiscoveryEnv sets an exporter discovery variable and reloads the
+// discovery, restoring it once the variable is restored.
+func setDiscoveryEnv(t *testing.T, key, value string) {
+	t.Helper()
+	// Registered first so it runs after t.Setenv restores the variable.
+	t.Cleanup(loadExporterDiscoveryFromEnv)
+	t.Setenv(key, value)
+	loadExporterDiscoveryFromEnv()
+}
+
+// TestExporterDiscovery_Static verifies that the static targets are matched
+// to the nodes by hostname or ID, skipping invalid and unknown entries.
+func TestExporterDiscovery_Static(t *testing.T) {
+	setDiscoveryEnv(t, "DSD_NODE_EXPORTER_DISCOVERY", "static")
+	t.Setenv("DSD_NODE_EXPORTER_TARGETS", "alpha=http://10.1.0.1:9100/metrics, n2 = https://beta.example:9100/metrics,bogus,ghost=http://10.1.0.9:9100/metrics")
+
+	targets := nodeExporterDiscovery.staticTargets(discoveryNodes)
+	want := map[string]string{"n1": "http://10.1.0.1:9100/metrics", "n2": "https://beta.example:9100/metrics"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Fatalf("expected %v, got %v", want, targets)
+	}
+	if service, _ := findNodeExporterService(nil); service == nil || service.ID != "static:node-exporter" {
+		t.Errorf("expected a stand-in service, got %+v", service)
+	}
+}
+
+// TestExporterDiscovery_DNS verifies that the addresses of tasks.<name> are
+// matched to the node of the task attached with them, or to the node with
+// that address.
+func TestExporterDiscovery_DNS(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	setDiscoveryEnv(t, "DSD_CADVISOR_DISCOVERY", "dns")
+	t.Setenv("DSD_CADVISOR_DNS_NAME", "monitoring_cadvisor")
+	setDiscoveryEnv(t, "DSD_CADVISOR_PORT", "9280")
+	original := lookupHost
+	defer func() { lookupHost = original }()
+	var resolved string
+	lookupHost = func(host string) ([]string, error) {
+		resolved = host
+		return []string{"10.0.0.5", "192.168.1.2", "10.9.9.9"}, nil
+	}
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": discoveryNodes,
+		"/v1.35/tasks": []swarm.Task{{ID: "t1", NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{"10.0.0.5/24"}}}}},
+	})
+	cli, _ := getCli()
+
+	targets, err := cadvisorDiscovery.targets(cli)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"n1": "http://10.0.0.5:9280/metrics", "n2": "http://192.168.1.2:9280/metrics"}
+	if resolved != "tasks.monitoring_cadvisor" || !reflect.DeepEqual(targets, want) {
+		t.Fatalf("expected %v from tasks.monitoring_cadvisor, got %v from %s", want, targets, resolved)
+	}
+
+	endpoint, err := getCAdvisorEndpoint(cli, cadvisorDiscovery.standInService(), "n2")
+	if err != nil || endpoint.url != "http://192.168.1.2:9280/metrics" {
+		t.Errorf("unexpected endpoint %s/%v", endpoint.url, err)
+	}
+	if endpoint.config != cadvisorScrapeConfig(nil) {
+		t.Errorf("expected the config of the environment, got %+v", endpoint.config)
+	}
+	if _, err := getCAdvisorEndpoint(cli, cadvisorDiscovery.standInService(), "n3"); err == nil {
+		t.Error("expected an error for a node without target")
+	}
+	nodeIDs, err := cadvisorDiscovery.nodeIDs(cli, nil)
+	if err != nil || !reflect.DeepEqual(nodeIDs, []string{"n1", "n2"}) {
+		t.Errorf("unexpected nodes %v/%v", nodeIDs, err)
+	}
+}
+
+// TestClusterMetricsHandler_StaticDiscovery verifies that the cluster metrics
+// are scraped from the static targets, without any exporter service.
+func TestClusterMetricsHandler_StaticDiscovery(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("node_memory_MemTotal_bytes 1000\nnode_memory_MemAvailable_bytes 250\n"))
+	}))
+	defer exporter.Close()
+	setDiscoveryEnv(t, "DSD_NODE_EXPORTER_DISCOVERY", "static")
+	t.Setenv("DSD_NODE_EXPORTER_TARGETS", "alpha="+exporter.URL+"/metrics")
+	stubDocker(t, map[string]interface{}{"/v1.35/nodes": discoveryNodes})
+
+	rr := httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics", nil))
+	var response clusterMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || response.NodeCount != 2 || response.TotalMemory != 1000 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	for _, node := range response.Nodes {
+		if node.NodeID == "n1" && (!node.Available || node.Endpoint != exporter.URL+"/metrics") {
+			t.Errorf("expected alpha scraped from its static target, got %+v", node)
+		}
+		if node.NodeID == "n2" && node.Available {
+			t.Errorf("expected beta without target to be unavailable, got %+v", node)
+		}
+	}
+}
+
+// TestExporterDiscovery_ModeReadAtStartup verifies that the mode and port are
+// parsed once, invalid values falling back to the defaults.
+func TestExporterDiscovery_ModeReadAtStartup(t *testing.T) {
+	setDiscoveryEnv(t, "DSD_NODE_EXPORTER_DISCOVERY", "consul")
+	setDiscoveryEnv(t, "DSD_NODE_EXPORTER_PORT", "99999")
+	if mode, port := nodeExporterDiscovery.mode(), nodeExporterDiscovery.port(); mode != exporterDiscoveryLabel || port != 9100 {
+		t.Fatalf("expected the defaults for invalid values, got %s/%d", mode, port)
+	}
+	t.Setenv("DSD_NODE_EXPORTER_DISCOVERY", "dns")
+	if mode := nodeExporterDiscovery.mode(); mode != exporterDiscoveryLabel {
+		t.Fatalf("expected the mode read at startup, got %s", mode)
+	}
+	if mode := (exporterDiscovery{}).mode(); mode != exporterDiscoveryLabel {
+		t.Fatalf("expected label discovery by default, got %s", mode)
+	}
+}
+
+// TestExporterDiscovery_DNSTasksOfService verifies that only the tasks of the
+// DNS name service are listed to match the addresses.
+func TestExporterDiscovery_DNSTasksOfService(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	setDiscoveryEnv(t, "DSD_CADVISOR_DISCOVERY", "dns")
+	setDiscoveryEnv(t, "DSD_CADVISOR_DNS_NAME", "monitoring_cadvisor")
+	original := lookupHost
+	defer func() { lookupHost = original }()
+	lookupHost = func(host string) ([]string, error) { return []string{"10.0.0.5"}, nil }
+
+	var serviceFilter []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.35/nodes":
+			_ = json.NewEncoder(w).Encode(discoveryNodes)
+		case "/v1.35/tasks":
+			f, err := filters.FromJSON(r.URL.Query().Get("filters"))
+			if err != nil {
+				t.Errorf("filters: %v", err)
+			}
+			serviceFilter = f.Get("service")
+			_ = json.NewEncoder(w).Encode([]swarm.Task{{ID: "t1", NodeID: "n2", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+				NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{"10.0.0.5/24"}}}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	SetCli(makeClientForServer(t, srv.URL))
+	defer ResetCli()
+	cli, _ := getCli()
+
+	targets, err := cadvisorDiscovery.targets(cli)
+	if err != nil || targets["n2"] != "http://10.0.0.5:8080/metrics" {
+		t.Fatalf("unexpected targets %v/%v", targets, err)
+	}
+	if !reflect.DeepEqual(serviceFilter, []string{"monitoring_cadvisor"}) {
+		t.Fatalf("expected the tasks of monitoring_cadvisor, got %v", serviceFilter)
+	}
+}
+
+// TestExporterDiscovery_DNSOutsideSwarm verifies that an exporter without a
+// swarm service of the DNS name is matched to the node with its address.
+func TestExporterDiscovery_DNSOutsideSwarm(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	setDiscoveryEnv(t, "DSD_NODE_EXPORTER_DISCOVERY", "dns")
+	setDiscoveryEnv(t, "DSD_NODE_EXPORTER_DNS_NAME", "external_exporter")
+	original := lookupHost
+	defer func() { lookupHost = original }()
+	lookupHost = func(host string) ([]string, error) { return []string{"192.168.1.1"}, nil }
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.35/nodes":
+			_ = json.NewEncoder(w).Encode(discoveryNodes)
+		case "/v1.35/tasks":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"service external_exporter not found"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	SetCli(makeClientForServer(t, srv.URL))
+	defer ResetCli()
+	cli, _ := getCli()
+
+	targets, err := nodeExporterDiscovery.targets(cli)
+	if err != nil || targets["n1"] != "http://192.168.1.1:9100/metrics" {
+		t.Fatalf("expected the exporter to be matched by node address, got %v/%v", targets, err)
+	}
+}
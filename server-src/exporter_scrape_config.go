@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// The prefixes of the environment variables configuring the scrapes of an
+// exporter, e.g. DSD_NODE_EXPORTER_SCHEME.
+const (
+	nodeExporterEnvPrefix = "DSD_NODE_EXPORTER_"
+	cadvisorEnvPrefix     = "DSD_CADVISOR_"
+)
+
+// scrapeSecretsDirEnv is the directory the file settings of the exporter
+// labels must point into. Anyone able to label a service could otherwise have
+// the dashboard send any of its files to an exporter.
+const (
+	scrapeSecretsDirEnv     = "DSD_SCRAPE_SECRETS_DIR"
+	defaultScrapeSecretsDir = "/run/secrets"
+)
+
+// The labels of an exporter service overriding its environment configuration.
+const (
+	scrapeSchemeLabel             = "dsd.scheme"
+	scrapeMetricsPathLabel        = "dsd.metrics-path"
+	scrapeCAFileLabel             = "dsd.ca-file"
+	scrapeCertFileLabel           = "dsd.cert-file"
+	scrapeKeyFileLabel            = "dsd.key-file"
+	scrapeServerNameLabel         = "dsd.tls-server-name"
+	scrapeInsecureSkipVerifyLabel = "dsd.insecure-skip-verify"
+	scrapeUsernameLabel           = "dsd.username"
+	scrapePasswordFileLabel       = "dsd.password-file"
+	scrapeBearerTokenFileLabel    = "dsd.bearer-token-file"
+)
+
+// exporterScrapeConfig is how an exporter is scraped. The zero value scrapes
+// /metrics over plain HTTP without credentials. Secrets are only read from
+// files, such as Docker secrets, and never from labels.
+type exporterScrapeConfig struct {
+	Scheme             string // http or https
+	MetricsPath        string
+	CAFile             string // CA bundle verifying the exporter certificate
+	CertFile           string // Client certificate
+	KeyFile            string
+	ServerName         string // Name expected in the exporter certificate, as tasks are reached by IP
+	InsecureSkipVerify bool
+	Username           string // Basic auth, with the password read from PasswordFile
+	PasswordFile       string
+	BearerTokenFile    string
+}
+
+// exporterScrapeConfigFor reads the scrape configuration of an exporter from
+// the environment variables with `envPrefix`, overridden by the labels of its
+// service when given.
+func exporterScrapeConfigFor(envPrefix string, service *swarm.Service) exporterScrapeConfig {
+	var labels map[string]string
+	if service != nil {
+		labels = service.Spec.Labels
+	}
+	setting := func(label, env string) string {
+		if value, ok := labels[label]; ok {
+			return strings.TrimSpace(value)
+		}
+		return strings.TrimSpace(os.Getenv(envPrefix + env))
+	}
+	// Files named by labels are only read from the secrets directory.
+	fileSetting := func(label, env string) string {
+		if value, ok := labels[label]; ok && !inScrapeSecretsDir(strings.TrimSpace(value)) {
+			log.Printf("WARNING: ignoring label %s=%q of service %s outside of %s", label, value, service.Spec.Name, scrapeSecretsDir())
+			return strings.TrimSpace(os.Getenv(envPrefix + env))
+		}
+		return setting(label, env)
+	}
+
+	config := exporterScrapeConfig{
+		Scheme:          strings.ToLower(setting(scrapeSchemeLabel, "SCHEME")),
+		MetricsPath:     setting(scrapeMetricsPathLabel, "METRICS_PATH"),
+		CAFile:          fileSetting(scrapeCAFileLabel, "CA_FILE"),
+		CertFile:        fileSetting(scrapeCertFileLabel, "CERT_FILE"),
+		KeyFile:         fileSetting(scrapeKeyFileLabel, "KEY_FILE"),
+		ServerName:      setting(scrapeServerNameLabel, "TLS_SERVER_NAME"),
+		Username:        setting(scrapeUsernameLabel, "USERNAME"),
+		PasswordFile:    fileSetting(scrapePasswordFileLabel, "PASSWORD_FILE"),
+		BearerTokenFile: fileSetting(scrapeBearerTokenFileLabel, "BEARER_TOKEN_FILE"),
+	}
+	if value := setting(scrapeInsecureSkipVerifyLabel, "INSECURE_SKIP_VERIFY"); value != "" {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("WARNING: invalid %sINSECURE_SKIP_VERIFY %q, verifying certificates", envPrefix, value)
+		}
+		config.InsecureSkipVerify = insecure
+	}
+	if config.Scheme != "" && config.Scheme != "http" && config.Scheme != "https" {
+		log.Printf("WARNING: invalid %sSCHEME %q, using http", envPrefix, config.Scheme)
+		config.Scheme = ""
+	}
+	return config
+}
+
+// scrapeSecretsDir is the directory the file labels may point into.
+func scrapeSecretsDir() string {
+	if dir := strings.TrimSpace(os.Getenv(scrapeSecretsDirEnv)); dir != "" {
+		return dir
+	}
+	return defaultScrapeSecretsDir
+}
+
+// inScrapeSecretsDir reports whether an absolute path lies below the secrets
+// directory once cleaned.
+func inScrapeSecretsDir(path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(scrapeSecretsDir()), filepath.Clean(path))
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// nodeExporterScrapeConfig is the scrape configuration of node-exporter.
+func nodeExporterScrapeConfig(service *swarm.Service) exporterScrapeConfig {
+	return exporterScrapeConfigFor(nodeExporterEnvPrefix, service)
+}
+
+// cadvisorScrapeConfig is the scrape configuration of cAdvisor.
+func cadvisorScrapeConfig(service *swarm.Service) exporterScrapeConfig {
+	return exporterScrapeConfigFor(cadvisorEnvPrefix, service)
+}
+
+// url is the metrics URL of the exporter listening on host:port.
+func (c exporterScrapeConfig) url(host string, port int) string {
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	path := c.MetricsPath
+	if path == "" {
+		path = "/metrics"
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)) + path
+}
+
+// usesTLSSettings reports whether the scrapes need their own TLS transport.
+func (c exporterScrapeConfig) usesTLSSettings() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.InsecureSkipVerify
+}
+
+// authorize adds the credentials of the exporter to a scrape. The files are
+// read on every scrape so rotated secrets are picked up.
+func (c exporterScrapeConfig) authorize(req *http.Request) error {
+	switch {
+	case c.BearerTokenFile != "":
+		token, err := os.ReadFile(c.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("reading bearer token file: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	case c.Username != "":
+		password := ""
+		if c.PasswordFile != "" {
+			content, err := os.ReadFile(c.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("reading password file: %w", err)
+			}
+			password = strings.TrimRight(string(content), "\r\n")
+		}
+		req.SetBasicAuth(c.Username, password)
+	}
+	return nil
+}
+
+// scrapeTLSKey identifies the TLS settings a transport is built for.
+type scrapeTLSKey struct {
+	caFile, certFile, keyFile, serverName string
+	insecureSkipVerify                    bool
+}
+
+// scrapeTransport is a transport and the modification times of the files it
+// was built from.
+type scrapeTransport struct {
+	transport *http.Transport
+	modTimes  [3]time.Time
+}
+
+var (
+	scrapeTransportsMu sync.Mutex
+	scrapeTransports   = make(map[scrapeTLSKey]scrapeTransport)
+)
+
+// fileModTime is the modification time of a file, zero when it has none.
+func fileModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// httpClient returns the client scraping the exporter. Plain configurations
+// share metricsHttpClient; TLS settings get a transport, rebuilt when the CA,
+// certificate or key files change so renewed certificates are picked up.
+func (c exporterScrapeConfig) httpClient() (*http.Client, error) {
+	if !c.usesTLSSettings() {
+		return metricsHttpClient, nil
+	}
+	key := scrapeTLSKey{c.CAFile, c.CertFile, c.KeyFile, c.ServerName, c.InsecureSkipVerify}
+	modTimes := [3]time.Time{fileModTime(c.CAFile), fileModTime(c.CertFile), fileModTime(c.KeyFile)}
+	scrapeTransportsMu.Lock()
+	defer scrapeTransportsMu.Unlock()
+	cached, ok := scrapeTransports[key]
+	if !ok || cached.modTimes != modTimes {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			cached.transport.CloseIdleConnections()
+		}
+		cached = scrapeTransport{transport: http.DefaultTransport.(*http.Transport).Clone(), modTimes: modTimes}
+		cached.transport.TLSClientConfig = tlsConfig
+		scrapeTransports[key] = cached
+	}
+	return &http.Client{Timeout: metricsHttpClient.Timeout, Transport: cached.transport}, nil
+}
+
+// tlsConfig builds the TLS client configuration from the CA bundle and the
+// client certificate.
+func (c exporterScrapeConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify, //nolint:gosec // Opted into by the operator
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// exporterEndpoint is the metrics URL of an exporter and the configuration it
+// is scraped with.
+type exporterEndpoint struct {
+	url    string
+	config exporterScrapeConfig
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// TestExporterScrapeConfigFor verifies that the labels of the exporter
+// service override the environment.
+func TestExporterScrapeConfigFor(t *testing.T) {
+	t.Setenv("DSD_NODE_EXPORTER_SCHEME", "HTTPS")
+	t.Setenv("DSD_NODE_EXPORTER_USERNAME", "prometheus")
+	t.Setenv("DSD_NODE_EXPORTER_INSECURE_SKIP_VERIFY", "true")
+
+	config := nodeExporterScrapeConfig(nil)
+	if config.Scheme != "https" || config.Username != "prometheus" || !config.InsecureSkipVerify {
+		t.Fatalf("unexpected environment config %+v", config)
+	}
+	if url := config.url("10.0.0.1", 9100); url != "https://10.0.0.1:9100/metrics" {
+		t.Errorf("unexpected URL %s", url)
+	}
+
+	service := &swarm.Service{Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{
+		scrapeSchemeLabel:             "http",
+		scrapeMetricsPathLabel:        "node/metrics",
+		scrapeInsecureSkipVerifyLabel: "false",
+	}}}}
+	config = nodeExporterScrapeConfig(service)
+	if config.Scheme != "http" || config.Username != "prometheus" || config.InsecureSkipVerify {
+		t.Fatalf("expected the labels to override the environment, got %+v", config)
+	}
+	if url := config.url("fe80::1", 9100); url != "http://[fe80::1]:9100/node/metrics" {
+		t.Errorf("unexpected URL %s", url)
+	}
+
+	t.Setenv("DSD_CADVISOR_SCHEME", "ftp")
+	if config := cadvisorScrapeConfig(nil); config.Scheme != "" {
+		t.Errorf("expected an invalid scheme to be ignored, got %q", config.Scheme)
+	}
+}
+
+// TestGetNodeExporterEndpoint_ScrapeConfig verifies that a resolved endpoint
+// is scraped with the configuration of its service.
+func TestGetNodeExporterEndpoint_ScrapeConfig(t *testing.T) {
+	service := &swarm.Service{Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "node-exporter", Labels: map[string]string{
+		scrapeSchemeLabel:          "https",
+		scrapeBearerTokenFileLabel: "/run/secrets/token",
+	}}}}
+	endpoint, err := getNodeExporterEndpoint(nil, service, "n1")
+	if err != nil || endpoint.url != "https://node-exporter:9100/metrics" {
+		t.Fatalf("unexpected endpoint %s/%v", endpoint.url, err)
+	}
+	if endpoint.config.BearerTokenFile != "/run/secrets/token" {
+		t.Errorf("expected the config of the service, got %+v", endpoint.config)
+	}
+}
+
+// TestFetchMetricFamilies_TLSAndAuth verifies the scrape of an exporter
+// behind TLS with basic auth or a bearer token.
+func TestFetchMetricFamilies_TLSAndAuth(t *testing.T) {
+	exporter := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if (!ok || user != "prometheus" || password != "s3cret") && r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("node_load1 1\n"))
+	}))
+	defer exporter.Close()
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+	caFile := write("ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: exporter.Certificate().Raw})))
+	passwordFile := write("password", "s3cret\n")
+	tokenFile := write("token", "t0ken\n")
+
+	if _, err := fetchMetricFamilies(exporter.URL, "node-exporter", exporterScrapeConfig{}); err == nil {
+		t.Error("expected the unknown certificate to be rejected")
+	}
+	if _, err := fetchMetricFamilies(exporter.URL, "node-exporter", exporterScrapeConfig{CAFile: caFile}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the scrape without credentials to be unauthorized, got %v", err)
+	}
+	for _, config := range []exporterScrapeConfig{
+		{CAFile: caFile, Username: "prometheus", PasswordFile: passwordFile},
+		{CAFile: caFile, BearerTokenFile: tokenFile},
+		{InsecureSkipVerify: true, BearerTokenFile: tokenFile},
+	} {
+		families, err := fetchMetricFamilies(exporter.URL, "node-exporter", config)
+		if err != nil || families["node_load1"] == nil {
+			t.Errorf("%+v: unexpected scrape %v/%v", config, families, err)
+		}
+	}
+	if _, err := fetchMetricFamilies(exporter.URL, "node-exporter", exporterScrapeConfig{BearerTokenFile: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected a missing token file to be reported")
+	}
+	if _, err := fetchMetricFamilies(exporter.URL, "node-exporter", exporterScrapeConfig{CAFile: passwordFile}); err == nil {
+		t.Error("expected a CA file without certificate to be reported")
+	}
+}
+
+// TestExporterScrapeConfigFor_SecretsDir verifies that the file labels must
+// point into the secrets directory, unlike the environment.
+func TestExporterScrapeConfigFor_SecretsDir(t *testing.T) {
+	t.Setenv("DSD_NODE_EXPORTER_CA_FILE", "/etc/ssl/exporter-ca.pem")
+	t.Setenv("DSD_NODE_EXPORTER_PASSWORD_FILE", "/etc/dsd/password")
+	service := &swarm.Service{Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "node-exporter", Labels: map[string]string{
+		scrapeCAFileLabel:          "/etc/shadow",
+		scrapePasswordFileLabel:    "/run/secrets/../../etc/passwd",
+		scrapeBearerTokenFileLabel: "/run/secrets/token",
+		scrapeCertFileLabel:        "run/secrets/cert.pem",
+		scrapeKeyFileLabel:         "/run/secrets",
+	}}}}
+	config := nodeExporterScrapeConfig(service)
+	if config.CAFile != "/etc/ssl/exporter-ca.pem" || config.PasswordFile != "/etc/dsd/password" || config.CertFile != "" || config.KeyFile != "" {
+		t.Fatalf("expected the labels outside of /run/secrets to be ignored, got %+v", config)
+	}
+	if config.BearerTokenFile != "/run/secrets/token" {
+		t.Fatalf("expected the token of /run/secrets, got %+v", config)
+	}
+
+	t.Setenv(scrapeSecretsDirEnv, "/etc/ssl/")
+	if config := nodeExporterScrapeConfig(service); config.CAFile != "/etc/ssl/exporter-ca.pem" || config.BearerTokenFile != "" {
+		t.Fatalf("expected the configured secrets directory, got %+v", config)
+	}
+	service.Spec.Labels[scrapeCAFileLabel] = "/etc/ssl/certs/ca.pem"
+	if config := nodeExporterScrapeConfig(service); config.CAFile != "/etc/ssl/certs/ca.pem" {
+		t.Fatalf("expected the label below the secrets directory, got %+v", config)
+	}
+}
+
+// TestExporterScrapeConfig_ReloadsTLSFiles verifies that a renewed CA file
+// rebuilds the transport.
+func TestExporterScrapeConfig_ReloadsTLSFiles(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("node_load1 1\n"))
+	})
+	// Every httptest TLS server shares one certificate, so each gets its own.
+	serve := func() *httptest.Server {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("key: %v", err)
+		}
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"example.com"},
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatalf("certificate: %v", err)
+		}
+		server := httptest.NewUnstartedServer(handler)
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+		server.StartTLS()
+		return server
+	}
+	first := serve()
+	defer first.Close()
+	second := serve()
+	defer second.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeCA := func(server *httptest.Server, modTime time.Time) {
+		if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := os.Chtimes(caFile, modTime, modTime); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	config := exporterScrapeConfig{CAFile: caFile, ServerName: "example.com"}
+
+	writeCA(first, time.Now().Add(-time.Hour))
+	if _, err := fetchMetricFamilies(first.URL, "node-exporter", config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := fetchMetricFamilies(second.URL, "node-exporter", config); err == nil {
+		t.Fatal("expected the certificate of the second server to be rejected")
+	}
+	writeCA(second, time.Now())
+	if _, err := fetchMetricFamilies(second.URL, "node-exporter", config); err != nil {
+		t.Fatalf("expected the renewed CA to be used, got %v", err)
+	}
+}
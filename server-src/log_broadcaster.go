@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logReplaySize bounds how many recent lines a shared log stream keeps for
+// viewers joining after it started.
+const logReplaySize = 1000
+
+// slowSubscriberReason is sent to a viewer dropped for falling behind.
+const slowSubscriberReason = "Client too slow to follow the logs"
+
+// subscriberQueueSize bounds how many lines may wait for a viewer of a
+// shared stream. It absorbs bursts such as a long tail; a viewer falling
+// further behind is dropped, so it never holds back the shared reader nor the
+// other viewers.
+const subscriberQueueSize = 10 * logReplaySize
+
+// logStreams shares the followed service logs between the viewers asking for
+// the same lines.
+var logStreams = newLogBroadcaster()
+
+// logOpener opens the Docker log stream a shared stream reads from.
+type logOpener func(ctx context.Context) (io.ReadCloser, error)
+
+// logBroadcaster keeps one Docker log stream per (daemon, service, options)
+// key and fans its lines out to every subscribed viewer. Without it, five
+// people following the same service would open five streams against the
+// manager.
+type logBroadcaster struct {
+	mu      sync.Mutex
+	streams map[string]*logStream
+}
+
+// logStream is a single upstream Docker log stream and its viewers. The ring
+// buffer holds the latest lines so a viewer joining late starts with the same
+// context the others have.
+type logStream struct {
+	key         string
+	opts        logsOptions
+	cancel      context.CancelFunc
+	subscribers map[*logSubscriber]struct{}
+	recent      *logRing
+}
+
+// logSubscriber is the view a single client has on a shared stream. The
+// shared reader queues the lines without waiting and the subscriber's own
+// goroutine delivers them on `lines`, which is closed when the subscription
+// ends; onClose runs first with the reason the stream ended for this viewer,
+// empty when it ended normally.
+type logSubscriber struct {
+	stream  *logStream
+	lines   chan []byte
+	onClose func(reason string)
+
+	mu     sync.Mutex
+	queue  [][]byte
+	ended  bool // No line is queued anymore
+	reason string
+	// wake tells the delivery goroutine that lines were queued or the
+	// subscription ended; done is closed when it is dropped, discarding the
+	// queued lines.
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newLogSubscriber(stream *logStream, replay [][]byte, onClose func(reason string)) *logSubscriber {
+	s := &logSubscriber{
+		stream:  stream,
+		lines:   make(chan []byte, logChannelSize),
+		onClose: onClose,
+		queue:   replay,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.deliver()
+	return s
+}
+
+// push queues a line for the viewer. It reports false when the queue is full.
+func (s *logSubscriber) push(line []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return true
+	}
+	if len(s.queue) >= subscriberQueueSize {
+		return false
+	}
+	s.queue = append(s.queue, line)
+	s.signal()
+	return true
+}
+
+// finish ends the subscription once the queued lines are delivered.
+func (s *logSubscriber) finish(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.ended = true
+		s.reason = reason
+	}
+	s.signal()
+}
+
+// close ends the subscription at once, discarding the queued lines.
+func (s *logSubscriber) close(reason string) {
+	s.finish(reason)
+	s.once.Do(func() { close(s.done) })
+}
+
+// signal wakes the delivery goroutine up. The caller holds mu.
+func (s *logSubscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the queued lines to the viewer, waiting for it as long as it
+// takes, until the subscription ends.
+func (s *logSubscriber) deliver() {
+	defer func() {
+		s.mu.Lock()
+		reason := s.reason
+		s.mu.Unlock()
+		if s.onClose != nil {
+			s.onClose(reason)
+		}
+		close(s.lines)
+	}()
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			ended := s.ended
+			s.mu.Unlock()
+			if ended {
+				return
+			}
+			select {
+			case <-s.wake:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		line := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.lines <- line:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func newLogBroadcaster() *logBroadcaster {
+	return &logBroadcaster{streams: make(map[string]*logStream)}
+}
+
+// logStreamKey identifies the viewers that can share a Docker log stream: the
+// same daemon, the same service and the same options.
+func logStreamKey(daemonHost string, opts logsOptions) string {
+	return strings.Join([]string{
+		daemonHost,
+		opts.serviceID,
+		opts.taskID,
+		opts.tail,
+		opts.since,
+		opts.until,
+		strconv.FormatBool(opts.timestamps),
+		strconv.FormatBool(opts.stdout),
+		strconv.FormatBool(opts.stderr),
+		strconv.FormatBool(opts.details),
+		strconv.FormatBool(opts.cursor),
+		opts.resumeFrom,
+		strconv.FormatBool(opts.group),
+		opts.groupWindow.String(),
+	}, "\x00")
+}
+
+// subscribe attaches a viewer to the stream of `key`, opening the Docker
+// stream with `open` when it is the first one. A late viewer first receives
+// the buffered lines, bounded by the tail of the request.
+func (b *logBroadcaster) subscribe(key string, opts logsOptions, open logOpener, onClose func(reason string)) *logSubscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stream, found := b.streams[key]
+	if !found {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = &logStream{
+			key:         key,
+			opts:        opts,
+			cancel:      cancel,
+			subscribers: make(map[*logSubscriber]struct{}),
+			recent:      newLogRing(logReplaySize),
+		}
+		b.streams[key] = stream
+		go b.run(ctx, stream, open)
+	}
+
+	subscriber := newLogSubscriber(stream, stream.recent.last(replayCount(opts.tail)), onClose)
+	stream.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+// unsubscribe detaches a viewer. The Docker stream is closed once the last
+// viewer has left. Unsubscribing twice is harmless.
+func (b *logBroadcaster) unsubscribe(subscriber *logSubscriber) {
+	b.mu.Lock()
+	stream := subscriber.stream
+	if _, subscribed := stream.subscribers[subscriber]; subscribed {
+		delete(stream.subscribers, subscriber)
+		if len(stream.subscribers) == 0 && b.streams[stream.key] == stream {
+			delete(b.streams, stream.key)
+			stream.cancel()
+		}
+	}
+	b.mu.Unlock()
+	subscriber.close("")
+}
+
+// run reads the Docker stream and fans its lines out until the stream ends or
+// the last viewer left. Every viewer has its own queue, so a slow one never
+// holds the reader back; a viewer whose queue is full is dropped on its own
+// and the others keep receiving.
+func (b *logBroadcaster) run(ctx context.Context, stream *logStream, open logOpener) {
+	defer stream.cancel()
+
+	logReader, err := open(ctx)
+	if err != nil {
+		log.Printf("logBroadcaster: opening logs of service %s failed: %v", stream.opts.serviceID, err)
+		b.end(stream, logsErrorReason(err))
+		return
+	}
+	defer func() { _ = logReader.Close() }()
+	// Closing the reader is the only way to unblock a pending read.
+	go func() {
+		<-ctx.Done()
+		_ = logReader.Close()
+	}()
+
+	for line := range logLines(ctx, logReader, stream.opts) {
+		b.mu.Lock()
+		stream.recent.push(line)
+		for subscriber := range stream.subscribers {
+			if !subscriber.push(line) {
+				delete(stream.subscribers, subscriber)
+				subscriber.close(slowSubscriberReason)
+			}
+		}
+		if len(stream.subscribers) == 0 && b.streams[stream.key] == stream {
+			delete(b.streams, stream.key)
+			stream.cancel()
+		}
+		b.mu.Unlock()
+	}
+	b.end(stream, "")
+}
+
+// end removes a finished stream and ends the subscriptions still attached to
+// it with `reason`, once they delivered their queued lines.
+func (b *logBroadcaster) end(stream *logStream, reason string) {
+	b.mu.Lock()
+	if b.streams[stream.key] == stream {
+		delete(b.streams, stream.key)
+	}
+	subscribers := stream.subscribers
+	stream.subscribers = make(map[*logSubscriber]struct{})
+	b.mu.Unlock()
+
+	for subscriber := range subscribers {
+		subscriber.finish(reason)
+	}
+}
+
+// replayCount returns how many buffered lines a late viewer receives: the
+// tail it asked for, or the whole buffer when it asked for all lines.
+func replayCount(tail string) int {
+	if n, err := strconv.Atoi(tail); err == nil && n >= 0 {
+		return n
+	}
+	return logReplaySize
+}
+
+// logRing is a fixed-size ring buffer of log lines.
+type logRing struct {
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([][]byte, size)}
+}
+
+// push stores a line, overwriting the oldest one once the ring is full.
+func (r *logRing) push(line []byte) {
+	if len(r.lines) == 0 {
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns up to n of the latest lines, oldest first.
+func (r *logRing) last(n int) [][]byte {
+	count := r.next
+	if r.full {
+		count = len(r.lines)
+	}
+	if n < count {
+		count = n
+	}
+	result := make([][]byte, 0, count)
+	for i := count; i > 0; i-- {
+		result = append(result, r.lines[(r.next-i+len(r.lines))%len(r.lines)])
+	}
+	return result
+}
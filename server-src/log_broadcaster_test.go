@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// pipeOpener returns a logOpener serving the read end of a pipe, and the
+// channel the opening context is published on.
+func pipeOpener(reader io.ReadCloser) (logOpener, chan context.Context) {
+	opened := make(chan context.Context, 1)
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		opened <- ctx
+		return reader, nil
+	}, opened
+}
+
+// receiveLine reads one line from a subscriber or fails after a second.
+func receiveLine(t *testing.T, subscriber *logSubscriber) string {
+	t.Helper()
+	select {
+	case line, ok := <-subscriber.lines:
+		if !ok {
+			t.Fatal("subscription closed unexpectedly")
+		}
+		return string(line)
+	case <-time.After(time.Second):
+		t.Fatal("no line received")
+	}
+	return ""
+}
+
+// TestLogRing verifies that the ring keeps the latest lines in order.
+func TestLogRing(t *testing.T) {
+	ring := newLogRing(3)
+	if got := ring.last(10); len(got) != 0 {
+		t.Fatalf("expected an empty ring, got %q", got)
+	}
+	for _, line := range []string{"a", "b", "c", "d"} {
+		ring.push([]byte(line))
+	}
+	got := ring.last(10)
+	if len(got) != 3 || string(got[0]) != "b" || string(got[2]) != "d" {
+		t.Fatalf("expected [b c d], got %q", got)
+	}
+	if got := ring.last(1); len(got) != 1 || string(got[0]) != "d" {
+		t.Fatalf("expected [d], got %q", got)
+	}
+}
+
+// TestLogBroadcaster_SharesStreamAndReplays verifies that viewers of the same
+// key share one upstream and that a late viewer starts with the recent lines.
+func TestLogBroadcaster_SharesStreamAndReplays(t *testing.T) {
+	b := newLogBroadcaster()
+	reader, writer := io.Pipe()
+	open, opened := pipeOpener(reader)
+	opts := logsOptions{serviceID: "svc1", tail: "2"}
+
+	first := b.subscribe("key", opts, open, nil)
+	_, _ = writer.Write([]byte("one\ntwo\nthree\n"))
+	for _, want := range []string{"one", "two", "three"} {
+		if got := receiveLine(t, first); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	second := b.subscribe("key", opts, func(context.Context) (io.ReadCloser, error) {
+		t.Error("a second upstream must not be opened")
+		return nil, io.EOF
+	}, nil)
+	for _, want := range []string{"two", "three"} {
+		if got := receiveLine(t, second); got != want {
+			t.Fatalf("expected replayed %q, got %q", want, got)
+		}
+	}
+
+	_, _ = writer.Write([]byte("four\n"))
+	if receiveLine(t, first) != "four" || receiveLine(t, second) != "four" {
+		t.Fatal("expected both viewers to receive the new line")
+	}
+
+	ctx := <-opened
+	b.unsubscribe(first)
+	if ctx.Err() != nil {
+		t.Fatal("the upstream must stay open while a viewer is left")
+	}
+	b.unsubscribe(second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the upstream must be closed once the last viewer left")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.streams) != 0 {
+		t.Fatalf("expected no stream left, got %d", len(b.streams))
+	}
+}
+
+// TestLogBroadcaster_DropsSlowSubscriber verifies that a viewer that stops
+// consuming is dropped on its own once its queue is full, while the others
+// keep receiving without waiting for it.
+func TestLogBroadcaster_DropsSlowSubscriber(t *testing.T) {
+	b := newLogBroadcaster()
+	reader, writer := io.Pipe()
+	defer func() { _ = writer.Close() }()
+	open, _ := pipeOpener(reader)
+	opts := logsOptions{serviceID: "svc1", tail: "0"}
+
+	reasons := make(chan string, 1)
+	slow := b.subscribe("key", opts, open, func(reason string) { reasons <- reason })
+	fast := b.subscribe("key", opts, open, nil)
+	defer b.unsubscribe(fast)
+
+	// The fast viewer consumes every chunk before the next one is written,
+	// the slow one never reads.
+	chunk := strings.Repeat("line\n", logChannelSize)
+	for i := 0; i < subscriberQueueSize/logChannelSize+3; i++ {
+		_, _ = writer.Write([]byte(chunk))
+		for j := 0; j < logChannelSize; j++ {
+			receiveLine(t, fast)
+		}
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != slowSubscriberReason {
+			t.Fatalf("expected the slow reason, got %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the slow viewer was not dropped")
+	}
+	b.unsubscribe(slow)
+}
+
+// TestLogBroadcaster_BurstWithoutDrop verifies that a burst larger than the
+// subscriber channel is queued instead of dropping a viewer that keeps
+// reading.
+func TestLogBroadcaster_BurstWithoutDrop(t *testing.T) {
+	b := newLogBroadcaster()
+	reader, writer := io.Pipe()
+	defer func() { _ = writer.Close() }()
+	open, _ := pipeOpener(reader)
+	reasons := make(chan string, 1)
+	subscriber := b.subscribe("key", logsOptions{serviceID: "svc1", tail: "0"}, open, func(reason string) { reasons <- reason })
+	defer b.unsubscribe(subscriber)
+
+	const burst = logChannelSize * 10
+	go func() { _, _ = writer.Write([]byte(strings.Repeat("line\n", burst))) }()
+	// Let the burst fill every buffer before reading.
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < burst; i++ {
+		receiveLine(t, subscriber)
+	}
+	select {
+	case reason := <-reasons:
+		t.Fatalf("the viewer was dropped: %q", reason)
+	default:
+	}
+}
+
+// TestLogBroadcaster_EndDeliversQueuedLines verifies that the lines queued
+// for a viewer when the upstream ends are delivered before its channel closes.
+func TestLogBroadcaster_EndDeliversQueuedLines(t *testing.T) {
+	b := newLogBroadcaster()
+	reader, writer := io.Pipe()
+	open, _ := pipeOpener(reader)
+	reasons := make(chan string, 1)
+	subscriber := b.subscribe("key", logsOptions{serviceID: "svc1", tail: "0"}, open, func(reason string) { reasons <- reason })
+
+	const count = logChannelSize * 3
+	_, _ = writer.Write([]byte(strings.Repeat("line\n", count)))
+	_ = writer.Close()
+	received := 0
+	for range subscriber.lines {
+		received++
+	}
+	if received != count {
+		t.Fatalf("expected %d lines, got %d", count, received)
+	}
+	if reason := <-reasons; reason != "" {
+		t.Fatalf("expected a normal end, got %q", reason)
+	}
+}
+
+// TestDockerServiceLogsHandler_FollowDeliversBurst verifies end-to-end that a
+// viewer following a service gets every line of a burst far larger than the
+// subscriber buffer.
+func TestDockerServiceLogsHandler_FollowDeliversBurst(t *testing.T) {
+	const count = 5000
+	done := make(chan struct{})
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			_, _ = w.Write([]byte(strings.Repeat("12345678line\n", count)))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc-burst")
+	q := u.Query()
+	q.Set("tail", "all")
+	q.Set("stdout", "true")
+	q.Set("follow", "true")
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; i < count; i++ {
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "line" {
+			t.Fatalf("line %d: expected 'line', got %q (%v)", i, string(msg), err)
+		}
+	}
+}
+
+// TestLogBroadcaster_ReportsOpenError verifies that a failure to open the
+// upstream reaches every viewer.
+func TestLogBroadcaster_ReportsOpenError(t *testing.T) {
+	b := newLogBroadcaster()
+	reasons := make(chan string, 1)
+	subscriber := b.subscribe("key", logsOptions{serviceID: "svc1"}, func(context.Context) (io.ReadCloser, error) {
+		return nil, errNoLogStream
+	}, func(reason string) { reasons <- reason })
+
+	select {
+	case reason := <-reasons:
+		if reason != "Docker returned no log stream" {
+			t.Fatalf("unexpected reason %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the viewer was not told about the failure")
+	}
+	if _, ok := <-subscriber.lines; ok {
+		t.Fatal("expected the subscription to be closed")
+	}
+}
+
+// TestDockerServiceLogsHandler_FollowSharesUpstream verifies end-to-end that
+// two clients following the same service share one Docker log stream.
+func TestDockerServiceLogsHandler_FollowSharesUpstream(t *testing.T) {
+	done := make(chan struct{})
+	var requests int32
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			atomic.AddInt32(&requests, 1)
+			_, _ = w.Write([]byte("12345678shared\n"))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc1")
+	q := u.Query()
+	q.Set("tail", "10")
+	q.Set("stdout", "true")
+	q.Set("follow", "true")
+	u.RawQuery = q.Encode()
+
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "shared" {
+			t.Fatalf("viewer %d: expected 'shared', got %q (%v)", i, string(msg), err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected one docker log stream, got %d", n)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logCursor identifies a streamed log line: its Docker timestamp and its
+// position among the lines sharing that timestamp. A client reconnecting with
+// `resumeFrom=<cursor>` continues right after the line it names.
+type logCursor struct {
+	timestamp time.Time
+	seq       int
+}
+
+// errInvalidCursor reports a `resumeFrom` value that is not a cursor.
+var errInvalidCursor = errors.New("expected <unix-nanoseconds>-<sequence>")
+
+// String encodes the cursor as "<unix-nanoseconds>-<sequence>", a form that
+// needs no escaping in a query string.
+func (c logCursor) String() string {
+	return strconv.FormatInt(c.timestamp.UnixNano(), 10) + "-" + strconv.Itoa(c.seq)
+}
+
+// parseLogCursor decodes a cursor produced by logCursor.String.
+func parseLogCursor(value string) (logCursor, error) {
+	nanos, seq, found := strings.Cut(value, "-")
+	if !found {
+		return logCursor{}, errInvalidCursor
+	}
+	unixNanos, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return logCursor{}, errInvalidCursor
+	}
+	position, err := strconv.Atoi(seq)
+	if err != nil || position < 0 {
+		return logCursor{}, errInvalidCursor
+	}
+	return logCursor{timestamp: time.Unix(0, unixNanos).UTC(), seq: position}, nil
+}
+
+// after reports whether the line at (timestamp, seq) comes after the cursor.
+func (c logCursor) after(timestamp time.Time, seq int) bool {
+	if !timestamp.Equal(c.timestamp) {
+		return timestamp.After(c.timestamp)
+	}
+	return seq > c.seq
+}
+
+// logMessage is the websocket message of a log line sent with its cursor.
+type logMessage struct {
+	Cursor string `json:"cursor,omitempty"`
+	Line   string `json:"line"`
+}
+
+// cursorLogLines wraps every line into a logMessage carrying its cursor. The
+// lines must carry Docker's timestamp prefix; it is removed from the message
+// again when the client did not ask for timestamps. With a `resume` cursor,
+// the lines up to and including the one it names are skipped: the stream was
+// opened at the cursor's timestamp, so the overlap is exactly the lines
+// already delivered before the reconnect.
+//
+// A payload grouped by groupLogLines holds several lines; each of them is
+// numbered, and the message carries the cursor of its last one, so resuming
+// after the message skips all of them.
+//
+// The sequence restarts with every new timestamp. Docker timestamps have
+// nanosecond precision, so it is almost always zero and only tells apart the
+// lines of a burst logged at the very same instant.
+func cursorLogLines(ctx context.Context, in <-chan []byte, out chan<- []byte, resume *logCursor, keepTimestamps bool) {
+	defer close(out)
+	var previous time.Time
+	seq := 0
+	for line := range in {
+		header, payload := splitLogLine(line)
+		var last *logCursor
+		texts := make([][]byte, 0, 1)
+		for _, part := range bytes.Split(payload, []byte{'\n'}) {
+			stamp, text, _ := bytes.Cut(part, []byte{' '})
+			logged, err := time.Parse(time.RFC3339Nano, string(stamp))
+			if err != nil {
+				texts = append(texts, part)
+				continue
+			}
+			if logged.Equal(previous) {
+				seq++
+			} else {
+				previous, seq = logged, 0
+			}
+			last = &logCursor{timestamp: logged, seq: seq}
+			if keepTimestamps {
+				texts = append(texts, part)
+			} else {
+				texts = append(texts, text)
+			}
+		}
+		message := logMessage{Line: string(bytes.Join(texts, []byte{'\n'}))}
+		if last != nil {
+			if resume != nil {
+				if !resume.after(last.timestamp, last.seq) {
+					continue
+				}
+				resume = nil
+			}
+			message.Cursor = last.String()
+		}
+		encoded, err := json.Marshal(message)
+		if err != nil {
+			continue
+		}
+		select {
+		case out <- frameLogMessage(header, encoded):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// frameLogMessage prefixes an encoded message with a multiplex header sized
+// to it, keeping the stream type of the line it was built from.
+func frameLogMessage(header, message []byte) []byte {
+	framed := make([]byte, 8, 8+len(message))
+	if len(header) > 0 && header[0] <= 2 {
+		framed[0] = header[0]
+	} else {
+		framed[0] = 1
+	}
+	binary.BigEndian.PutUint32(framed[4:8], uint32(len(message)))
+	return append(framed, message...)
+}
+
+// resumeLogsOptions rewrites the options of a request resuming from `cursor`:
+// the stream restarts at the cursor's timestamp and carries every line from
+// there, the overlap being skipped by cursorLogLines.
+func resumeLogsOptions(opts logsOptions, cursor logCursor) logsOptions {
+	opts.since = cursor.timestamp.Format(time.RFC3339Nano)
+	opts.tail = "all"
+	opts.cursor = true
+	return opts
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// TestLogCursorRoundTrip verifies that a cursor survives its encoding.
+func TestLogCursorRoundTrip(t *testing.T) {
+	cursor := logCursor{timestamp: time.Date(2024, 3, 1, 14, 5, 0, 123456789, time.UTC), seq: 2}
+	parsed, err := parseLogCursor(cursor.String())
+	if err != nil {
+		t.Fatalf("parseLogCursor: %v", err)
+	}
+	if !parsed.timestamp.Equal(cursor.timestamp) || parsed.seq != cursor.seq {
+		t.Fatalf("expected %v, got %v", cursor, parsed)
+	}
+	for _, invalid := range []string{"", "123", "abc-1", "123-x", "123--1"} {
+		if _, err := parseLogCursor(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+// TestCursorLogLines verifies the sequence numbering within a timestamp and
+// that resuming skips exactly the lines up to the cursor.
+func TestCursorLogLines(t *testing.T) {
+	run := func(resume *logCursor, keepTimestamps bool) []logMessage {
+		in := make(chan []byte, 4)
+		in <- []byte("12345678" + "2024-03-01T14:05:00Z first")
+		in <- []byte("12345678" + "2024-03-01T14:05:00Z second")
+		in <- []byte("12345678" + "2024-03-01T14:05:01Z third")
+		in <- []byte("12345678" + "no timestamp")
+		close(in)
+		out := make(chan []byte, 4)
+		cursorLogLines(context.Background(), in, out, resume, keepTimestamps)
+
+		var messages []logMessage
+		for framed := range out {
+			var message logMessage
+			if err := json.Unmarshal(framed[8:], &message); err != nil {
+				t.Fatalf("invalid message %q: %v", framed, err)
+			}
+			messages = append(messages, message)
+		}
+		return messages
+	}
+
+	messages := run(nil, false)
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %+v", messages)
+	}
+	second := logCursor{timestamp: time.Date(2024, 3, 1, 14, 5, 0, 0, time.UTC), seq: 1}
+	if messages[0].Line != "first" || messages[1].Cursor != second.String() {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+	if messages[3].Cursor != "" || messages[3].Line != "no timestamp" {
+		t.Fatalf("expected a line without timestamp to carry no cursor, got %+v", messages[3])
+	}
+
+	resume, _ := parseLogCursor(messages[0].Cursor)
+	resumed := run(&resume, true)
+	if len(resumed) != 3 || resumed[0].Line != "2024-03-01T14:05:00Z second" {
+		t.Fatalf("expected to resume after the first line, got %+v", resumed)
+	}
+}
+
+// TestDockerServiceLogsHandler_ResumeFrom verifies end-to-end that a resumed
+// follow restarts Docker at the cursor's timestamp and skips the overlap.
+func TestDockerServiceLogsHandler_ResumeFrom(t *testing.T) {
+	done := make(chan struct{})
+	query := make(chan url.Values, 1)
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			select {
+			case query <- r.URL.Query():
+			default:
+			}
+			_, _ = w.Write([]byte("12345678" + "2024-03-01T14:05:00.000000001Z delivered\n"))
+			_, _ = w.Write([]byte("12345678" + "2024-03-01T14:05:00.000000001Z missed\n"))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	delivered := logCursor{timestamp: time.Date(2024, 3, 1, 14, 5, 0, 1, time.UTC)}
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc1")
+	q := u.Query()
+	q.Set("tail", "20")
+	q.Set("stdout", "true")
+	q.Set("follow", "true")
+	q.Set("resumeFrom", delivered.String())
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var message logMessage
+	if err := json.Unmarshal(msg, &message); err != nil {
+		t.Fatalf("expected a JSON message, got %q: %v", msg, err)
+	}
+	want := logCursor{timestamp: delivered.timestamp, seq: 1}.String()
+	if message.Line != "missed" || message.Cursor != want {
+		t.Fatalf("expected the line after the cursor, got %+v", message)
+	}
+
+	sent := <-query
+	if sent.Get("tail") != "all" || sent.Get("timestamps") != "1" || !strings.HasPrefix(sent.Get("since"), "1709301900.000000001") {
+		t.Fatalf("unexpected docker query %v", sent)
+	}
+}
+
+// TestDockerServiceLogsHandler_InvalidResumeFrom verifies that a malformed
+// cursor is reported instead of silently restarting the stream.
+func TestDockerServiceLogsHandler_InvalidResumeFrom(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/docker/logs/svc1?follow=true&resumeFrom=bogus", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != websocket.CloseInternalServerErr || !strings.Contains(closeErr.Text, "resumeFrom") {
+		t.Fatalf("expected an invalid-cursor close frame, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+const logGroupPatternEnv = "DSD_LOGS_GROUP_PATTERN"
+
+// defaultLogGroupPattern matches the lines continuing a multi-line event:
+// indented lines, Java frames and causes ("at …", "Caused by: …", "... 12
+// more") and Python tracebacks.
+const defaultLogGroupPattern = `^(\s|at |Caused by:|Traceback|\.\.\. \d+ more)`
+
+// logGroupFlushDelay is how long a grouped event waits for a continuation
+// line before it is sent. A stack trace arrives in one burst, so the delay only
+// needs to bridge the gaps within that burst.
+const logGroupFlushDelay = 200 * time.Millisecond
+
+// logGroupMaxLines bounds the lines merged into a single event, so a service
+// printing nothing but indented lines still reaches the client.
+const logGroupMaxLines = 1000
+
+// groupFlushDelay is how long groupLogLines waits for a continuation line:
+// logGroupFlushDelay, or the grouping window when it is longer.
+func groupFlushDelay(window time.Duration) time.Duration {
+	if window > logGroupFlushDelay {
+		return window
+	}
+	return logGroupFlushDelay
+}
+
+// logGroupPattern returns the continuation pattern configured through
+// DSD_LOGS_GROUP_PATTERN. An unset or invalid pattern falls back to the
+// default rather than disabling grouping.
+func logGroupPattern() *regexp.Regexp {
+	value := os.Getenv(logGroupPatternEnv)
+	if value == "" {
+		return regexp.MustCompile(defaultLogGroupPattern)
+	}
+	pattern, err := regexp.Compile(value)
+	if err != nil {
+		log.Printf("WARNING: invalid %s %q, using the default: %v", logGroupPatternEnv, value, err)
+		return regexp.MustCompile(defaultLogGroupPattern)
+	}
+	return pattern
+}
+
+// logGroup is a multi-line event being assembled.
+type logGroup struct {
+	header  []byte
+	lines   [][]byte
+	arrival time.Time
+}
+
+// add appends a line to the event.
+func (g *logGroup) add(payload []byte, arrival time.Time) {
+	g.lines = append(g.lines, payload)
+	g.arrival = arrival
+}
+
+// accepts reports whether a line continues the event: it matches the
+// continuation pattern or, with a window set, arrived within it. Lines of
+// another stream — stderr after stdout — never join.
+func (g *logGroup) accepts(header []byte, text []byte, arrival time.Time, continuation *regexp.Regexp, window time.Duration) bool {
+	if len(g.lines) == 0 || len(g.lines) >= logGroupMaxLines {
+		return false
+	}
+	if len(header) > 0 && len(g.header) > 0 && header[0] != g.header[0] {
+		return false
+	}
+	return continuation.Match(text) || (window > 0 && arrival.Sub(g.arrival) <= window)
+}
+
+// frame joins the lines of the event into a single log line, its payload
+// holding one line per row.
+func (g *logGroup) frame() []byte {
+	return frameLogMessage(g.header, bytes.Join(g.lines, []byte{'\n'}))
+}
+
+// groupLogLines merges the lines of a multi-line event — a stack trace
+// typically — into one line before it is sent, so the client receives the
+// event as a single message. A line joins the pending event when its text,
+// Docker's timestamp excluded, matches `continuation`, or when it arrived
+// within `window` of the previous line. The pending event is sent as soon as a
+// line starts a new one, or once no line arrived for logGroupFlushDelay.
+//
+// The merged payload holds newlines, so the output must go through
+// cursorLogLines, which encodes it as one message.
+func groupLogLines(ctx context.Context, in <-chan []byte, out chan<- []byte, continuation *regexp.Regexp, window time.Duration) {
+	defer close(out)
+
+	flushDelay := groupFlushDelay(window)
+	timer := time.NewTimer(flushDelay)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	pending := &logGroup{}
+	flush := func() bool {
+		if len(pending.lines) == 0 {
+			return true
+		}
+		framed := pending.frame()
+		pending = &logGroup{}
+		select {
+		case out <- framed:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		select {
+		case line, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+			now := time.Now()
+			header, payload := splitLogLine(line)
+			text := payload
+			if stamp, rest, found := bytes.Cut(payload, []byte{' '}); found {
+				if _, err := time.Parse(time.RFC3339Nano, string(stamp)); err == nil {
+					text = rest
+				}
+			}
+			if !pending.accepts(header, text, now, continuation, window) {
+				if !flush() {
+					return
+				}
+				pending.header = header
+			}
+			pending.add(payload, now)
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(flushDelay)
+		case <-timer.C:
+			if !flush() {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
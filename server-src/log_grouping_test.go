@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// groupPayloads runs groupLogLines over the given payloads and returns the
+// payloads of the events it produced.
+func groupPayloads(t *testing.T, window time.Duration, payloads ...string) []string {
+	t.Helper()
+	in := make(chan []byte, len(payloads))
+	for _, payload := range payloads {
+		in <- frameLogMessage([]byte{1}, []byte(payload))
+	}
+	close(in)
+	out := make(chan []byte, len(payloads))
+	groupLogLines(context.Background(), in, out, logGroupPattern(), window)
+
+	var events []string
+	for line := range out {
+		events = append(events, string(line[8:]))
+	}
+	return events
+}
+
+// TestGroupLogLines_StackTraces verifies that Java and Python traces become
+// one event each, and that Docker timestamps do not hide the indentation.
+func TestGroupLogLines_StackTraces(t *testing.T) {
+	events := groupPayloads(t, 0,
+		"Exception in thread \"main\" java.lang.IllegalStateException: boom",
+		"\tat com.example.App.run(App.java:12)",
+		"Caused by: java.io.IOException: closed",
+		"\t... 3 more",
+		"2024-03-01T14:05:00Z request done",
+		"2024-03-01T14:05:01Z Traceback (most recent call last):",
+		"2024-03-01T14:05:01Z   File \"app.py\", line 3, in <module>",
+		"2024-03-01T14:05:01Z ValueError: bad",
+	)
+	want := []string{
+		"Exception in thread \"main\" java.lang.IllegalStateException: boom\n\tat com.example.App.run(App.java:12)\nCaused by: java.io.IOException: closed\n\t... 3 more",
+		"2024-03-01T14:05:00Z request done\n2024-03-01T14:05:01Z Traceback (most recent call last):\n2024-03-01T14:05:01Z   File \"app.py\", line 3, in <module>",
+		"2024-03-01T14:05:01Z ValueError: bad",
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %q", len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d: expected %q, got %q", i, want[i], events[i])
+		}
+	}
+}
+
+// TestGroupLogLines_Window verifies that a window merges lines arriving
+// together even when they do not look like continuations.
+func TestGroupLogLines_Window(t *testing.T) {
+	if events := groupPayloads(t, time.Minute, "one", "two"); len(events) != 1 || events[0] != "one\ntwo" {
+		t.Fatalf("expected one merged event, got %q", events)
+	}
+	if events := groupPayloads(t, 0, "one", "two"); len(events) != 2 {
+		t.Fatalf("expected two events without a window, got %q", events)
+	}
+}
+
+// TestGroupLogLines_FlushesWhenIdle verifies that a pending event is sent
+// without waiting for the next line.
+func TestGroupLogLines_FlushesWhenIdle(t *testing.T) {
+	in := make(chan []byte, 2)
+	out := make(chan []byte, 1)
+	defer close(in)
+	go groupLogLines(context.Background(), in, out, logGroupPattern(), 0)
+
+	in <- frameLogMessage([]byte{1}, []byte("error"))
+	in <- frameLogMessage([]byte{1}, []byte("  detail"))
+	select {
+	case line := <-out:
+		if string(line[8:]) != "error\n  detail" {
+			t.Fatalf("unexpected event %q", line[8:])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the pending event was not flushed")
+	}
+}
+
+// TestLogGroupPattern verifies the configuration of the continuation pattern.
+func TestLogGroupPattern(t *testing.T) {
+	t.Setenv(logGroupPatternEnv, `^\|`)
+	if pattern := logGroupPattern(); !pattern.MatchString("| continued") || pattern.MatchString("  indented") {
+		t.Fatalf("expected the configured pattern, got %s", pattern)
+	}
+	t.Setenv(logGroupPatternEnv, `(`)
+	if pattern := logGroupPattern(); pattern.String() != defaultLogGroupPattern {
+		t.Fatalf("expected an invalid pattern to fall back to the default, got %s", pattern)
+	}
+}
+
+// TestDockerServiceLogsHandler_GroupsStackTrace verifies end-to-end that a
+// stack trace reaches the client as a single message.
+func TestDockerServiceLogsHandler_GroupsStackTrace(t *testing.T) {
+	done := make(chan struct{})
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			for _, line := range []string{
+				"2024-03-01T14:05:00Z java.lang.NullPointerException",
+				"2024-03-01T14:05:00Z \tat com.example.App.main(App.java:5)",
+				"2024-03-01T14:05:01Z next",
+			} {
+				_, _ = w.Write([]byte("12345678" + line + "\n"))
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc1")
+	q := u.Query()
+	q.Set("stdout", "true")
+	q.Set("follow", "true")
+	q.Set("group", "true")
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var message logMessage
+		if err := json.Unmarshal(msg, &message); err != nil {
+			t.Fatalf("expected a JSON message, got %q: %v", msg, err)
+		}
+		got = append(got, message.Line)
+	}
+	if got[0] != "java.lang.NullPointerException\n\tat com.example.App.main(App.java:5)" || got[1] != "next" {
+		t.Fatalf("unexpected events %q", got)
+	}
+}
+
+// TestDockerServiceLogsHandler_OneShotGroupKeepsLastEvent verifies that a
+// one-shot grouped request still sends a trailing stack trace when Docker
+// keeps the response open.
+func TestDockerServiceLogsHandler_OneShotGroupKeepsLastEvent(t *testing.T) {
+	done := make(chan struct{})
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			for _, line := range []string{
+				"2024-03-01T14:05:00Z first",
+				"2024-03-01T14:05:01Z java.lang.IllegalStateException",
+				"2024-03-01T14:05:01Z \tat com.example.App.run(App.java:9)",
+			} {
+				_, _ = w.Write([]byte("12345678" + line + "\n"))
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc1")
+	q := u.Query()
+	q.Set("stdout", "true")
+	q.Set("tail", "10")
+	q.Set("group", "true")
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var got []string
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var message logMessage
+		if err := json.Unmarshal(msg, &message); err != nil {
+			t.Fatalf("expected a JSON message, got %q: %v", msg, err)
+		}
+		got = append(got, message.Line)
+	}
+	if len(got) != 2 || got[0] != "first" || got[1] != "java.lang.IllegalStateException\n\tat com.example.App.run(App.java:9)" {
+		t.Fatalf("unexpected events %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	maskLogsEnv         = "DSD_MASK_LOGS"
+	maskLogsPatternsEnv = "DSD_MASK_LOGS_PATTERNS"
+)
+
+// builtinLogSecretPatterns match the secrets application output carries in
+// shapes a command line does not: bearer tokens, "password: s3cr3t" and JSON
+// fields such as "apiKey":"…", and URL credentials within prose, where an
+// apostrophe can throw the command-line tokenizer off. The first group of each
+// pattern is the secret.
+var builtinLogSecretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bbearer\s+([^\s"',;]+)`),
+	regexp.MustCompile(`(?i)[\w.-]*(?:password|passwd|pwd|secret|token|api[_-]?key|private[_-]?key|credential)[\w.-]*"?\s*:\s*"?([^\s"',;}]+)`),
+	regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s:/@]+:([^\s@/]+)@`),
+}
+
+// isLogMaskingEnabled reports whether the secrets found in log lines must be
+// masked before the lines are sent. Masking rewrites application output and
+// cannot tell every secret from a harmless value, so it is off by default; set
+// DSD_MASK_LOGS to a true value to enable it.
+func isLogMaskingEnabled() bool {
+	enabled, err := strconv.ParseBool(os.Getenv(maskLogsEnv))
+	return err == nil && enabled
+}
+
+// logMaskPatterns returns the extra secret patterns configured through
+// DSD_MASK_LOGS_PATTERNS, separated by semicolons. An invalid pattern is
+// skipped with a warning rather than disabling the valid ones.
+func logMaskPatterns() []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, part := range strings.Split(os.Getenv(maskLogsPatternsEnv), ";") {
+		value := strings.TrimSpace(part)
+		if value == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			log.Printf("WARNING: ignoring invalid %s pattern %q: %v", maskLogsPatternsEnv, value, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// logMasker masks the secrets found in log lines.
+type logMasker struct {
+	patterns []*regexp.Regexp
+}
+
+// newLogMasker returns the masker configured through the environment, or nil
+// when log masking is disabled.
+func newLogMasker() *logMasker {
+	if !isLogMaskingEnabled() {
+		return nil
+	}
+	return &logMasker{patterns: append(append([]*regexp.Regexp(nil), builtinLogSecretPatterns...), logMaskPatterns()...)}
+}
+
+// mask masks the secrets of a single log line. The line is first read as a
+// command line, so the flag, header and URL rules of the spec masking apply,
+// then every secret pattern is applied: the groups a pattern captures are
+// masked, or its whole match when it captures none.
+func (m *logMasker) mask(line string) string {
+	masked := maskCommandLine(line, 0)
+	for _, pattern := range m.patterns {
+		masked = maskPatternMatches(pattern, masked)
+	}
+	return masked
+}
+
+// maskPatternMatches replaces the secrets matched by a pattern with a
+// fixed-length placeholder. A value that is already masked is left alone, so
+// overlapping rules do not stack placeholders.
+func maskPatternMatches(pattern *regexp.Regexp, line string) string {
+	matches := pattern.FindAllStringSubmatchIndex(line, -1)
+	if matches == nil {
+		return line
+	}
+	var masked strings.Builder
+	end := 0
+	for _, match := range matches {
+		bounds := match[2:]
+		if len(bounds) == 0 {
+			bounds = match[:2]
+		}
+		for i := 0; i+1 < len(bounds); i += 2 {
+			start, stop := bounds[i], bounds[i+1]
+			if start < end || start == stop {
+				continue
+			}
+			masked.WriteString(line[end:start])
+			if secret := line[start:stop]; secret == maskIfSet(secret) {
+				masked.WriteString(secret)
+			} else {
+				masked.WriteString(maskIfSet(secret))
+			}
+			end = stop
+		}
+	}
+	masked.WriteString(line[end:])
+	return masked.String()
+}
+
+// maskLogLines masks the secrets of every line before it travels further down
+// the pipeline, so neither the client nor a replay buffer ever holds them. The
+// frame size follows the payload, which the placeholders can grow or shrink.
+func maskLogLines(ctx context.Context, in <-chan []byte, out chan<- []byte, logMasker *logMasker) {
+	defer close(out)
+	for line := range in {
+		header, payload := splitLogLine(line)
+		if len(payload) > 0 {
+			masked := []byte(logMasker.mask(string(payload)))
+			line = joinLogLine(header, masked, len(payload)-len(masked))
+		}
+		select {
+		case out <- line:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
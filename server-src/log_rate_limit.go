@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logsRateLimitEnv     = "DSD_LOGS_RATE_LIMIT"
+	logsRateLimitModeEnv = "DSD_LOGS_RATE_LIMIT_MODE"
+)
+
+// The ways a rate-limited stream sheds the lines over its limit.
+const (
+	// logRateModeDrop forwards the first lines of every second and replaces
+	// the rest by a summary of how many were skipped.
+	logRateModeDrop = "drop"
+	// logRateModeSample forwards the first and the last lines of every second,
+	// the skipped lines in between being replaced by a summary.
+	logRateModeSample = "sample"
+)
+
+// logRateWindow is the period the line limit applies to.
+const logRateWindow = time.Second
+
+// logRateLimit is the per-connection limit of a followed log stream.
+type logRateLimit struct {
+	perSecond int
+	mode      string
+}
+
+// logRateLimitFromEnv returns the limit configured through DSD_LOGS_RATE_LIMIT
+// and DSD_LOGS_RATE_LIMIT_MODE. An unset, zero or invalid limit disables rate
+// limiting; an unknown mode falls back to dropping.
+func logRateLimitFromEnv() logRateLimit {
+	value := os.Getenv(logsRateLimitEnv)
+	if value == "" {
+		return logRateLimit{}
+	}
+	perSecond, err := strconv.Atoi(value)
+	if err != nil || perSecond < 0 {
+		log.Printf("WARNING: invalid %s %q, logs are not rate limited", logsRateLimitEnv, value)
+		return logRateLimit{}
+	}
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv(logsRateLimitModeEnv)))
+	switch mode {
+	case logRateModeDrop, logRateModeSample:
+	case "":
+		mode = logRateModeDrop
+	default:
+		log.Printf("WARNING: invalid %s %q, using %q", logsRateLimitModeEnv, mode, logRateModeDrop)
+		mode = logRateModeDrop
+	}
+	return logRateLimit{perSecond: perSecond, mode: mode}
+}
+
+// enabled reports whether the limit restricts anything.
+func (l logRateLimit) enabled() bool {
+	return l.perSecond > 0
+}
+
+// rateLimitedLogLines applies the configured rate limit to the lines of a
+// connection. Without a limit, the lines are returned as they are.
+func rateLimitedLogLines(ctx context.Context, lines <-chan []byte, opts logsOptions) <-chan []byte {
+	limit := logRateLimitFromEnv()
+	if !limit.enabled() {
+		return lines
+	}
+	limited := make(chan []byte, logChannelSize)
+	go limitLogLines(ctx, lines, limited, limit, opts.cursor)
+	return limited
+}
+
+// limitLogLines forwards at most `limit.perSecond` lines per second. The lines
+// over the limit are consumed at once, so a chatty service cannot flood the
+// browser nor fill the queue of its subscriber. The lines within the limit
+// wait for the client: one that reads slowly blocks this stage until the
+// broadcaster drops it for a full queue. What was skipped is reported by a
+// summary line, framed like the other lines and encoded as a logMessage when
+// `jsonMessages` is set.
+//
+// In sample mode, the second half of the budget holds the latest lines of the
+// second; they are sent after the summary when the second ends, so the client
+// sees how a burst started and how it ended.
+func limitLogLines(ctx context.Context, in <-chan []byte, out chan<- []byte, limit logRateLimit, jsonMessages bool) {
+	defer close(out)
+
+	head := limit.perSecond
+	var tail *logRing
+	if limit.mode == logRateModeSample {
+		head = limit.perSecond - limit.perSecond/2
+		tail = newLogRing(limit.perSecond / 2)
+	}
+	ticker := time.NewTicker(logRateWindow)
+	defer ticker.Stop()
+
+	send := func(line []byte) bool {
+		select {
+		case out <- line:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	count, tailed := 0, 0
+	// closeWindow sends the summary and the sampled tail of the second that
+	// ended, and starts the next one.
+	closeWindow := func() bool {
+		var latest [][]byte
+		if tail != nil {
+			latest = tail.last(tailed)
+			tail = newLogRing(limit.perSecond / 2)
+		}
+		skipped := count - head - len(latest)
+		count, tailed = 0, 0
+		if skipped > 0 && !send(logSkippedLine(skipped, jsonMessages)) {
+			return false
+		}
+		for _, line := range latest {
+			if !send(line) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		select {
+		case line, ok := <-in:
+			if !ok {
+				closeWindow()
+				return
+			}
+			count++
+			if count <= head {
+				if !send(line) {
+					return
+				}
+			} else if tail != nil {
+				tail.push(line)
+				tailed++
+			}
+		case <-ticker.C:
+			if !closeWindow() {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logSkippedText is the summary reporting skipped lines.
+func logSkippedText(skipped int) string {
+	return fmt.Sprintf("… %d lines skipped", skipped)
+}
+
+// logSkippedLine builds the summary line reporting skipped lines.
+func logSkippedLine(skipped int, jsonMessages bool) []byte {
+	text := []byte(logSkippedText(skipped))
+	if jsonMessages {
+		encoded, err := json.Marshal(logMessage{Line: string(text)})
+		if err == nil {
+			text = encoded
+		}
+	}
+	return frameLogMessage(nil, text)
+}
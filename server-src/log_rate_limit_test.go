@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// limitPayloads runs limitLogLines over a burst of numbered lines and returns
+// the payloads it forwarded.
+func limitPayloads(t *testing.T, limit logRateLimit, count int, jsonMessages bool) []string {
+	t.Helper()
+	in := make(chan []byte, count)
+	for i := 1; i <= count; i++ {
+		in <- frameLogMessage([]byte{1}, []byte("line "+strconv.Itoa(i)))
+	}
+	close(in)
+	out := make(chan []byte, count+1)
+	limitLogLines(context.Background(), in, out, limit, jsonMessages)
+
+	var payloads []string
+	for line := range out {
+		payloads = append(payloads, string(line[8:]))
+	}
+	return payloads
+}
+
+// TestLimitLogLines_Drop verifies that the lines over the limit are replaced
+// by a summary.
+func TestLimitLogLines_Drop(t *testing.T) {
+	got := limitPayloads(t, logRateLimit{perSecond: 3, mode: logRateModeDrop}, 10, false)
+	want := []string{"line 1", "line 2", "line 3", "… 7 lines skipped"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+// TestLimitLogLines_Sample verifies that head/tail sampling keeps the first
+// and the last lines of a burst.
+func TestLimitLogLines_Sample(t *testing.T) {
+	got := limitPayloads(t, logRateLimit{perSecond: 4, mode: logRateModeSample}, 10, false)
+	want := []string{"line 1", "line 2", "… 6 lines skipped", "line 9", "line 10"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+// TestLimitLogLines_UnderLimit verifies that a quiet stream is not altered.
+func TestLimitLogLines_UnderLimit(t *testing.T) {
+	if got := limitPayloads(t, logRateLimit{perSecond: 5, mode: logRateModeSample}, 3, false); len(got) != 3 || got[2] != "line 3" {
+		t.Fatalf("expected the lines untouched, got %q", got)
+	}
+}
+
+// TestLimitLogLines_JSONSummary verifies that the summary matches the message
+// format of a stream with cursors.
+func TestLimitLogLines_JSONSummary(t *testing.T) {
+	got := limitPayloads(t, logRateLimit{perSecond: 1, mode: logRateModeDrop}, 3, true)
+	var message logMessage
+	if len(got) != 2 || json.Unmarshal([]byte(got[1]), &message) != nil || message.Line != "… 2 lines skipped" || message.Cursor != "" {
+		t.Fatalf("expected a JSON summary without cursor, got %q", got)
+	}
+}
+
+// TestLogRateLimitFromEnv verifies the configuration of the limit.
+func TestLogRateLimitFromEnv(t *testing.T) {
+	cases := []struct {
+		limit, mode string
+		expected    logRateLimit
+	}{
+		{"", "sample", logRateLimit{}},
+		{"abc", "", logRateLimit{}},
+		{"-5", "", logRateLimit{}},
+		{"100", "", logRateLimit{perSecond: 100, mode: logRateModeDrop}},
+		{"100", "Sample", logRateLimit{perSecond: 100, mode: logRateModeSample}},
+		{"100", "bogus", logRateLimit{perSecond: 100, mode: logRateModeDrop}},
+	}
+	for _, tc := range cases {
+		t.Setenv(logsRateLimitEnv, tc.limit)
+		t.Setenv(logsRateLimitModeEnv, tc.mode)
+		if got := logRateLimitFromEnv(); got != tc.expected {
+			t.Errorf("%q/%q: expected %+v, got %+v", tc.limit, tc.mode, tc.expected, got)
+		}
+	}
+}
+
+// TestDockerServiceLogsHandler_RateLimitedFollowBackpressure verifies that a
+// limited follow stream longer than the subscriber buffer reaches the client
+// in full while it is within the limit, the limiter holding the shared reader
+// back instead of getting the viewer dropped.
+func TestDockerServiceLogsHandler_RateLimitedFollowBackpressure(t *testing.T) {
+	const count = logChannelSize * 10
+	t.Setenv(logsRateLimitEnv, strconv.Itoa(count*2))
+	done := make(chan struct{})
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/") && strings.Contains(r.URL.Path, "/logs") {
+			_, _ = w.Write([]byte(strings.Repeat("12345678line\n", count)))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			<-done
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/docker/logs/svc-limited")
+	q := u.Query()
+	q.Set("stdout", "true")
+	q.Set("follow", "true")
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// Reading late lets every buffer on the way fill up first.
+	time.Sleep(200 * time.Millisecond)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < count; i++ {
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "line" {
+			t.Fatalf("line %d: expected 'line', got %q (%v)", i, string(msg), err)
+		}
+	}
+}
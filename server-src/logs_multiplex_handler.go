@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// logsMuxMaxSubscriptions bounds the log sources a single connection follows.
+const logsMuxMaxSubscriptions = 32
+
+// The commands a client of the multiplexed logs websocket sends.
+const (
+	logsMuxSubscribe   = "subscribe"
+	logsMuxUnsubscribe = "unsubscribe"
+	logsMuxPause       = "pause"
+	logsMuxResume      = "resume"
+)
+
+// The messages the multiplexed logs websocket sends.
+const (
+	// logsMuxSubscribed acknowledges a subscription.
+	logsMuxSubscribed = "subscribed"
+	// logsMuxLine carries a log line.
+	logsMuxLine = "line"
+	// logsMuxEnd tells that a source sent all its lines.
+	logsMuxEnd = "end"
+	// logsMuxError reports a rejected command or a failed source.
+	logsMuxError = "error"
+)
+
+// logsControlMessage is a command of the multiplexed logs websocket. A
+// subscription names either a service or a task, and carries the options of
+// /docker/logs/{id} as its options; `id` is chosen by the client and tags the
+// messages of the subscription. Pausing or resuming without an id applies to
+// every subscription.
+type logsControlMessage struct {
+	Type    string                 `json:"type"`
+	ID      string                 `json:"id"`
+	Service string                 `json:"service,omitempty"`
+	Task    string                 `json:"task,omitempty"`
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+// logsMuxMessage is a message of the multiplexed logs websocket, tagged with
+// the subscription it belongs to.
+type logsMuxMessage struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Stream string `json:"stream,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+	Line   string `json:"line,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// logsMuxSession is a multiplexed logs connection and its subscriptions.
+type logsMuxSession struct {
+	ctx context.Context
+	// out is shared by every subscription. A full channel makes them wait in
+	// turn, as Go serves blocked senders in order, so a busy source slows the
+	// others down without starving them; each holds its shared stream back
+	// meanwhile rather than getting dropped from it.
+	out           chan []byte
+	wg            sync.WaitGroup
+	mu            sync.Mutex
+	subscriptions map[string]*logsMuxSubscription
+}
+
+// logsMuxSubscription is a log source followed by a session.
+type logsMuxSubscription struct {
+	id     string
+	opts   logsOptions
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// paused holds the lines of a one-shot source back; the lines of a
+	// followed one are skipped and counted, so the shared stream is not held
+	// back for as long as the subscription stays paused.
+	paused  bool
+	skipped int
+	// resumed is closed when a paused subscription resumes.
+	resumed chan struct{}
+	// reason is why the shared stream ended for the subscription, empty when
+	// it ended normally.
+	reason string
+}
+
+// logsMultiplexHandler serves a single websocket per browser tab carrying the
+// logs of several services or tasks. The client drives it with
+// logsControlMessage commands and receives logsMuxMessage messages tagged with
+// the id of their subscription. Followed sources share their Docker stream
+// through logStreams like /docker/logs/{id} does.
+func logsMultiplexHandler(w http.ResponseWriter, r *http.Request) {
+	clientAddress := r.RemoteAddr
+	log.Println("new multiplexed logs-websocket-connection:", clientAddress)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	defer log.Println("gone:", clientAddress)
+
+	conn.SetReadLimit(1024 * 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &logsMuxSession{
+		ctx:           ctx,
+		out:           make(chan []byte, logChannelSize),
+		subscriptions: make(map[string]*logsMuxSubscription),
+	}
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		writeLogPipeToClient(conn, session.out)
+	}()
+	// Once the client is gone, every subscription stops; the writer is only
+	// told to finish after the last of them, as they all send to it.
+	defer func() {
+		cancel()
+		session.wg.Wait()
+		close(session.out)
+		<-written
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var command logsControlMessage
+		if err := json.Unmarshal(data, &command); err != nil {
+			session.send(logsMuxMessage{Type: logsMuxError, Error: "Invalid command: " + err.Error()})
+			continue
+		}
+		session.handle(command)
+	}
+}
+
+// send queues a message for the client. It reports false once the session is
+// over.
+func (s *logsMuxSession) send(message logsMuxMessage) bool {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return true
+	}
+	select {
+	case s.out <- frameLogMessage(nil, encoded):
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// sendError reports a failure of the subscription `id` to the client.
+func (s *logsMuxSession) sendError(id, reason string) {
+	s.send(logsMuxMessage{ID: id, Type: logsMuxError, Error: reason})
+}
+
+// handle runs a command of the client.
+func (s *logsMuxSession) handle(command logsControlMessage) {
+	switch command.Type {
+	case logsMuxSubscribe:
+		s.subscribe(command)
+	case logsMuxUnsubscribe:
+		if subscription := s.remove(command.ID, nil); subscription != nil {
+			subscription.cancel()
+		} else {
+			s.sendError(command.ID, "Unknown subscription")
+		}
+	case logsMuxPause, logsMuxResume:
+		subscriptions := s.lookup(command.ID)
+		if len(subscriptions) == 0 && command.ID != "" {
+			s.sendError(command.ID, "Unknown subscription")
+		}
+		for _, subscription := range subscriptions {
+			if command.Type == logsMuxPause {
+				subscription.pause()
+			} else if skipped := subscription.resume(); skipped > 0 {
+				s.send(logsMuxMessage{ID: subscription.id, Type: logsMuxLine, Line: logSkippedText(skipped)})
+			}
+		}
+	default:
+		s.sendError(command.ID, fmt.Sprintf("Unknown command %q", command.Type))
+	}
+}
+
+// logsOptionsQuery turns the options of a subscription into the query
+// parameters of the logs endpoint. JSON numbers keep their integer form, so a
+// large tail or a Unix time is not written with an exponent.
+func logsOptionsQuery(options map[string]interface{}) url.Values {
+	query := url.Values{}
+	for key, value := range options {
+		switch v := value.(type) {
+		case float64:
+			query.Set(key, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			query.Set(key, fmt.Sprint(v))
+		}
+	}
+	return query
+}
+
+// subscribe validates a subscription and starts following its source.
+func (s *logsMuxSession) subscribe(command logsControlMessage) {
+	if command.ID == "" {
+		s.sendError("", "A subscription needs an id")
+		return
+	}
+	if (command.Service == "") == (command.Task == "") {
+		s.sendError(command.ID, "A subscription names either a service or a task")
+		return
+	}
+	opts := logsOptionsFromQuery(command.Service, logsOptionsQuery(command.Options))
+	opts.taskID = command.Task
+	if err := validateLogsWindow(opts, time.Now()); err != nil {
+		s.sendError(command.ID, "Invalid logs window: "+err.Error())
+		return
+	}
+	if opts.resumeFrom != "" {
+		if _, err := parseLogCursor(opts.resumeFrom); err != nil {
+			s.sendError(command.ID, "Invalid resumeFrom: "+err.Error())
+			return
+		}
+	}
+	cli, err := getCli()
+	if err != nil {
+		log.Printf("logsMultiplexHandler: getCli error: %v", err)
+		s.sendError(command.ID, "Docker client error")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	subscription := &logsMuxSubscription{id: command.ID, opts: opts, cancel: cancel}
+	s.mu.Lock()
+	_, exists := s.subscriptions[command.ID]
+	full := len(s.subscriptions) >= logsMuxMaxSubscriptions
+	if !exists && !full {
+		s.subscriptions[command.ID] = subscription
+	}
+	s.mu.Unlock()
+	switch {
+	case exists:
+		cancel()
+		s.sendError(command.ID, "Subscription id already in use")
+		return
+	case full:
+		cancel()
+		s.sendError(command.ID, fmt.Sprintf("At most %d subscriptions per connection", logsMuxMaxSubscriptions))
+		return
+	}
+
+	s.send(logsMuxMessage{ID: command.ID, Type: logsMuxSubscribed})
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		return openServiceLogs(ctx, cli, opts)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		defer s.remove(subscription.id, subscription)
+		if opts.follow {
+			s.follow(ctx, subscription, logStreamKey(cli.DaemonHost(), opts), open)
+		} else {
+			s.sendTail(ctx, subscription, open)
+		}
+	}()
+}
+
+// follow pipes the lines of a followed source to the client until the source
+// ends or the subscription is cancelled.
+func (s *logsMuxSession) follow(ctx context.Context, subscription *logsMuxSubscription, key string, open logOpener) {
+	subscriber := logStreams.subscribe(key, subscription.opts, open, subscription.end)
+	defer logStreams.unsubscribe(subscriber)
+
+	lines := rateLimitedLogLines(ctx, subscriber.lines, subscription.opts)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if ctx.Err() != nil {
+					return
+				}
+				if reason := subscription.endReason(); reason != "" {
+					s.sendError(subscription.id, reason)
+				} else {
+					s.send(logsMuxMessage{ID: subscription.id, Type: logsMuxEnd})
+				}
+				return
+			}
+			if subscription.skip() {
+				continue
+			}
+			header, payload := splitLogLine(line)
+			if !s.sendLine(subscription, header, payload) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendTail answers a one-shot source: it sends the last lines of its log, as
+// sendLogTail does for /docker/logs/{id}, and tells the client it is done.
+func (s *logsMuxSession) sendTail(ctx context.Context, subscription *logsMuxSubscription, open logOpener) {
+	logReader, err := open(ctx)
+	if err != nil {
+		log.Printf("logsMultiplexHandler: logs error: %v", err)
+		s.sendError(subscription.id, logsErrorReason(err))
+		return
+	}
+	defer func() { _ = logReader.Close() }()
+	go func() {
+		<-ctx.Done()
+		_ = logReader.Close()
+	}()
+
+	// The headers are kept so the lines carry their stream, as followed ones do.
+	var headers, payloads [][]byte
+	forEachFramedLogLine(ctx, logLines(ctx, logReader, subscription.opts), collectIdle(subscription.opts), func(header, payload []byte) bool {
+		headers, payloads = append(headers, header), append(payloads, payload)
+		return true
+	})
+	start := 0
+	if tail := tailCount(subscription.opts.tail); len(payloads) > tail {
+		start = len(payloads) - tail
+	}
+	for i := start; i < len(payloads); i++ {
+		if !subscription.waitResumed(ctx) || !s.sendLine(subscription, headers[i], payloads[i]) {
+			return
+		}
+	}
+	s.send(logsMuxMessage{ID: subscription.id, Type: logsMuxEnd})
+}
+
+// sendLine sends a log line tagged with its subscription. The payload is a
+// logMessage when the subscription asked for cursors, the bare line
+// otherwise.
+func (s *logsMuxSession) sendLine(subscription *logsMuxSubscription, header, payload []byte) bool {
+	message := logsMuxMessage{ID: subscription.id, Type: logsMuxLine, Line: string(payload)}
+	if len(header) > 0 {
+		switch header[0] {
+		case 1:
+			message.Stream = "stdout"
+		case 2:
+			message.Stream = "stderr"
+		}
+	}
+	if subscription.opts.cursor {
+		var wrapped logMessage
+		if err := json.Unmarshal(payload, &wrapped); err == nil {
+			message.Line, message.Cursor = wrapped.Line, wrapped.Cursor
+		}
+	}
+	return s.send(message)
+}
+
+// lookup returns the subscription `id`, or all of them when `id` is empty.
+func (s *logsMuxSession) lookup(id string) []*logsMuxSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id != "" {
+		if subscription, found := s.subscriptions[id]; found {
+			return []*logsMuxSubscription{subscription}
+		}
+		return nil
+	}
+	subscriptions := make([]*logsMuxSubscription, 0, len(s.subscriptions))
+	for _, subscription := range s.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+// remove forgets the subscription `id` and returns it. With `only` set, the
+// subscription is removed only if it still is that one, so a finished
+// subscription does not remove a newer one reusing its id.
+func (s *logsMuxSession) remove(id string, only *logsMuxSubscription) *logsMuxSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription, found := s.subscriptions[id]
+	if !found || (only != nil && subscription != only) {
+		return nil
+	}
+	delete(s.subscriptions, id)
+	return subscription
+}
+
+// pause holds the lines of the subscription back until it resumes.
+func (s *logsMuxSubscription) pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		s.paused = true
+		s.resumed = make(chan struct{})
+	}
+}
+
+// resume releases a paused subscription and returns how many lines were
+// skipped while it was paused.
+func (s *logsMuxSubscription) resume() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return 0
+	}
+	s.paused = false
+	close(s.resumed)
+	skipped := s.skipped
+	s.skipped = 0
+	return skipped
+}
+
+// skip reports whether a line of a followed source must be skipped because
+// the subscription is paused, and counts it.
+func (s *logsMuxSubscription) skip() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused {
+		s.skipped++
+	}
+	return s.paused
+}
+
+// waitResumed blocks while the subscription is paused. It reports false when
+// the subscription ended meanwhile.
+func (s *logsMuxSubscription) waitResumed(ctx context.Context) bool {
+	s.mu.Lock()
+	paused, resumed := s.paused, s.resumed
+	s.mu.Unlock()
+	if !paused {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// end records why the shared stream ended for the subscription. It runs on
+// the stream's goroutine, so it must not block on the client.
+func (s *logsMuxSubscription) end(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reason = reason
+}
+
+// endReason returns the reason recorded by end.
+func (s *logsMuxSubscription) endReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
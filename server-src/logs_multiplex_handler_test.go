@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// readMuxMessage reads the next message of the multiplexed logs websocket.
+func readMuxMessage(t *testing.T, conn *websocket.Conn) logsMuxMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var message logsMuxMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return message
+}
+
+// expectMuxMessage reads the next message and checks its id, type and line.
+func expectMuxMessage(t *testing.T, conn *websocket.Conn, id, kind, line string) logsMuxMessage {
+	t.Helper()
+	message := readMuxMessage(t, conn)
+	if message.ID != id || message.Type != kind || message.Line != line {
+		t.Fatalf("expected %s %s %q, got %+v", id, kind, line, message)
+	}
+	return message
+}
+
+// TestLogsMultiplexHandler verifies that one connection carries a one-shot
+// service source and a followed task source, and that a paused source
+// reports what it skipped once resumed.
+func TestLogsMultiplexHandler(t *testing.T) {
+	feed := make(chan string)
+	done := make(chan struct{})
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/services/svc1/logs"):
+			_, _ = w.Write([]byte("12345678" + "service line\n"))
+		case strings.Contains(r.URL.Path, "/tasks/task1/logs"):
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			for {
+				select {
+				case line := <-feed:
+					_, _ = w.Write([]byte("12345678" + line + "\n"))
+					if f, ok := w.(http.Flusher); ok {
+						f.Flush()
+					}
+				case <-done:
+					return
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs", logsMultiplexHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/docker/logs", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	send := func(command logsControlMessage) {
+		t.Helper()
+		if err := conn.WriteJSON(command); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	send(logsControlMessage{Type: logsMuxSubscribe, ID: "a", Service: "svc1", Options: map[string]interface{}{"stdout": true, "tail": 10}})
+	expectMuxMessage(t, conn, "a", logsMuxSubscribed, "")
+	expectMuxMessage(t, conn, "a", logsMuxLine, "service line")
+	expectMuxMessage(t, conn, "a", logsMuxEnd, "")
+
+	send(logsControlMessage{Type: logsMuxSubscribe, ID: "b", Task: "task1", Options: map[string]interface{}{"stdout": true, "follow": true}})
+	expectMuxMessage(t, conn, "b", logsMuxSubscribed, "")
+	feed <- "first"
+	expectMuxMessage(t, conn, "b", logsMuxLine, "first")
+
+	send(logsControlMessage{Type: logsMuxSubscribe, ID: "b", Service: "svc1"})
+	expectMuxMessage(t, conn, "b", logsMuxError, "")
+
+	send(logsControlMessage{Type: logsMuxPause, ID: "b"})
+	// The pause command and the lines travel separately; a command sent after
+	// it and answered proves it was handled.
+	send(logsControlMessage{Type: "bogus", ID: "sync"})
+	expectMuxMessage(t, conn, "sync", logsMuxError, "")
+	feed <- "skipped 1"
+	feed <- "skipped 2"
+	// Let the skipped lines cross the pipeline before resuming.
+	time.Sleep(200 * time.Millisecond)
+	send(logsControlMessage{Type: logsMuxResume})
+	expectMuxMessage(t, conn, "b", logsMuxLine, logSkippedText(2))
+	feed <- "after"
+	expectMuxMessage(t, conn, "b", logsMuxLine, "after")
+
+	send(logsControlMessage{Type: logsMuxUnsubscribe, ID: "b"})
+	send(logsControlMessage{Type: logsMuxUnsubscribe, ID: "b"})
+	expectMuxMessage(t, conn, "b", logsMuxError, "")
+}
+
+// TestLogsMultiplexHandler_InvalidSubscriptions verifies that unusable
+// subscriptions are rejected without closing the connection.
+func TestLogsMultiplexHandler_InvalidSubscriptions(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs", logsMultiplexHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/docker/logs", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	for _, command := range []logsControlMessage{
+		{Type: logsMuxSubscribe, Service: "svc1"},
+		{Type: logsMuxSubscribe, ID: "x"},
+		{Type: logsMuxSubscribe, ID: "x", Service: "svc1", Task: "task1"},
+		{Type: logsMuxSubscribe, ID: "x", Service: "svc1", Options: map[string]interface{}{"since": "1h", "until": "2h"}},
+		{Type: logsMuxSubscribe, ID: "x", Service: "svc1", Options: map[string]interface{}{"resumeFrom": "bogus"}},
+	} {
+		if err := conn.WriteJSON(command); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if message := readMuxMessage(t, conn); message.Type != logsMuxError || message.Error == "" {
+			t.Fatalf("%+v: expected an error, got %+v", command, message)
+		}
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if message := readMuxMessage(t, conn); message.Type != logsMuxError || !strings.Contains(message.Error, "Invalid command") {
+		t.Fatalf("expected an invalid-command error, got %+v", message)
+	}
+}
+
+// TestLogsMultiplexHandler_StreamTagAndEndReason verifies that one-shot lines
+// carry their stream like followed ones, and that a followed source whose
+// stream fails reports why.
+func TestLogsMultiplexHandler_StreamTagAndEndReason(t *testing.T) {
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/services/svc1/logs"):
+			_, _ = w.Write([]byte("\x01\x00\x00\x00\x00\x00\x00\x04out\n\x02\x00\x00\x00\x00\x00\x00\x04err\n"))
+		case strings.Contains(r.URL.Path, "/services/broken/logs"):
+			http.Error(w, `{"message":"no such service"}`, http.StatusNotFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer dockerSrv.Close()
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs", logsMultiplexHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/docker/logs", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := conn.WriteJSON(logsControlMessage{Type: logsMuxSubscribe, ID: "a", Service: "svc1", Options: map[string]interface{}{"stdout": true, "stderr": true}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	expectMuxMessage(t, conn, "a", logsMuxSubscribed, "")
+	if message := expectMuxMessage(t, conn, "a", logsMuxLine, "out"); message.Stream != "stdout" {
+		t.Errorf("expected stdout, got %+v", message)
+	}
+	if message := expectMuxMessage(t, conn, "a", logsMuxLine, "err"); message.Stream != "stderr" {
+		t.Errorf("expected stderr, got %+v", message)
+	}
+	expectMuxMessage(t, conn, "a", logsMuxEnd, "")
+
+	if err := conn.WriteJSON(logsControlMessage{Type: logsMuxSubscribe, ID: "b", Service: "broken", Options: map[string]interface{}{"stdout": true, "follow": true}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	expectMuxMessage(t, conn, "b", logsMuxSubscribed, "")
+	if message := expectMuxMessage(t, conn, "b", logsMuxError, ""); !strings.Contains(message.Error, "Docker logs error") {
+		t.Errorf("expected the failure of the stream, got %+v", message)
+	}
+}
+
+// TestLogsMultiplexHandler_BusySourceKeepsOthers verifies that a burst of one
+// followed source larger than the shared buffer does not get the other
+// subscriptions of the connection dropped.
+func TestLogsMultiplexHandler_BusySourceKeepsOthers(t *testing.T) {
+	const count = logChannelSize * 20
+	done := make(chan struct{})
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/services/busy/logs"):
+			_, _ = w.Write([]byte(strings.Repeat("12345678busy\n", count)))
+		case strings.Contains(r.URL.Path, "/services/quiet/logs"):
+			time.Sleep(50 * time.Millisecond)
+			_, _ = w.Write([]byte("12345678quiet\n"))
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		<-done
+	}))
+	defer dockerSrv.Close()
+	defer close(done)
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/docker/logs", logsMultiplexHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/docker/logs", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	for _, service := range []string{"quiet", "busy"} {
+		if err := conn.WriteJSON(logsControlMessage{Type: logsMuxSubscribe, ID: service, Service: service, Options: map[string]interface{}{"stdout": true, "follow": true}}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	lines := map[string]int{}
+	for lines["busy"] < count || lines["quiet"] < 1 {
+		message := readMuxMessage(t, conn)
+		switch message.Type {
+		case logsMuxError, logsMuxEnd:
+			t.Fatalf("unexpected %+v after %v", message, lines)
+		case logsMuxLine:
+			lines[message.ID]++
+		}
+	}
+}
+
+// TestLogsOptionsQuery verifies that large numeric options, decoded from JSON
+// as floats, reach the logs options unchanged.
+func TestLogsOptionsQuery(t *testing.T) {
+	var command logsControlMessage
+	if err := json.Unmarshal([]byte(`{"type":"subscribe","id":"a","service":"svc1","options":{"tail":1000000,"since":1700000000,"until":1700003600.5,"stdout":true}}`), &command); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	opts := logsOptionsFromQuery(command.Service, logsOptionsQuery(command.Options))
+	if opts.tail != "1000000" || opts.since != "1700000000" || opts.until != "1700003600.5" || !opts.stdout {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+}
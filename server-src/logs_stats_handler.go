@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// logStatsMaxBuckets bounds the histogram, so a tiny bucket over a long
+	// range cannot build an oversized response.
+	logStatsMaxBuckets = 1440
+	// logStatsMaxLines bounds the lines scanned per request; the response
+	// tells when the scan stopped early.
+	logStatsMaxLines = 500000
+	// logStatsMessageMaxLen bounds a normalized message.
+	logStatsMessageMaxLen = 200
+	// logStatsMaxMessages bounds the distinct messages counted per request;
+	// the lines of any further message are only counted as other messages.
+	logStatsMaxMessages = 10000
+	// logStatsDefaultTop is the number of recurring messages returned when the
+	// request does not ask for another.
+	logStatsDefaultTop = 10
+	// logStatsReadIdle is how long the scan waits for another line before it
+	// treats the stream as complete. Reading a long range can stall between
+	// chunks, so it is more patient than the one-shot websocket reader.
+	logStatsReadIdle = 2 * time.Second
+)
+
+// The levels a log line is classified into.
+const (
+	logLevelError   = "error"
+	logLevelWarn    = "warn"
+	logLevelInfo    = "info"
+	logLevelDebug   = "debug"
+	logLevelUnknown = "unknown"
+)
+
+// LogLevelCounts counts log lines per detected level.
+type LogLevelCounts struct {
+	Error   int `json:"error"`
+	Warn    int `json:"warn"`
+	Info    int `json:"info"`
+	Debug   int `json:"debug"`
+	Unknown int `json:"unknown"`
+	Total   int `json:"total"`
+}
+
+// add counts a line of the given level.
+func (c *LogLevelCounts) add(level string) {
+	switch level {
+	case logLevelError:
+		c.Error++
+	case logLevelWarn:
+		c.Warn++
+	case logLevelInfo:
+		c.Info++
+	case logLevelDebug:
+		c.Debug++
+	default:
+		c.Unknown++
+	}
+	c.Total++
+}
+
+// LogStatsBucket holds the counts of the lines logged within one bucket.
+type LogStatsBucket struct {
+	Start time.Time `json:"start"`
+	LogLevelCounts
+}
+
+// LogStatsMessage is a recurring message: its normalized text, how often it
+// occurred and the level it was logged at the last time.
+type LogStatsMessage struct {
+	Message string `json:"message"`
+	Level   string `json:"level"`
+	Count   int    `json:"count"`
+}
+
+// LogStatsHandlerResult is the response of the log statistics endpoint.
+type LogStatsHandlerResult struct {
+	ServiceID     string            `json:"serviceId"`
+	Since         time.Time         `json:"since"`
+	Until         time.Time         `json:"until"`
+	BucketSeconds float64           `json:"bucketSeconds"`
+	Totals        LogLevelCounts    `json:"totals"`
+	Buckets       []LogStatsBucket  `json:"buckets"`
+	TopMessages   []LogStatsMessage `json:"topMessages"`
+	OtherMessages int               `json:"otherMessages"` // Lines of messages beyond logStatsMaxMessages
+	LinesScanned  int               `json:"linesScanned"`
+	Truncated     bool              `json:"truncated"`
+}
+
+// logLevelWord matches the words naming a level, in the forms services
+// commonly print them.
+var logLevelWord = regexp.MustCompile(`(?i)^(fatal|panic|crit|critical|emerg|alert|err|error|warn|warning|notice|info|debug|trace)$`)
+
+// logfmtLevel matches a logfmt level field, as in `level=error`.
+var logfmtLevel = regexp.MustCompile(`(?i)\b(?:level|lvl|severity)=["']?([a-z]+)`)
+
+// logLevelPrefixWords is how many leading words may hold a plain level:
+// enough to skip a date, a time and a logger name.
+const logLevelPrefixWords = 4
+
+// classifyLogLevel detects the level of a log line from a JSON `level` field,
+// a logfmt level field or a level word among its first words.
+func classifyLogLevel(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "{") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(trimmed), &fields); err == nil {
+			for _, key := range []string{"level", "lvl", "severity", "log.level"} {
+				if value, ok := fields[key].(string); ok {
+					return normalizeLogLevel(value)
+				}
+			}
+			return logLevelUnknown
+		}
+	}
+	if match := logfmtLevel.FindStringSubmatch(trimmed); match != nil {
+		return normalizeLogLevel(match[1])
+	}
+	words := strings.Fields(trimmed)
+	if len(words) > logLevelPrefixWords {
+		words = words[:logLevelPrefixWords]
+	}
+	for _, word := range words {
+		word = strings.Trim(word, "[]():|<>-")
+		if logLevelWord.MatchString(word) {
+			return normalizeLogLevel(word)
+		}
+	}
+	return logLevelUnknown
+}
+
+// normalizeLogLevel maps a level name onto the levels counted.
+func normalizeLogLevel(level string) string {
+	switch strings.ToLower(level) {
+	case "fatal", "panic", "crit", "critical", "emerg", "alert", "err", "error":
+		return logLevelError
+	case "warn", "warning":
+		return logLevelWarn
+	case "notice", "info", "information":
+		return logLevelInfo
+	case "debug", "trace":
+		return logLevelDebug
+	}
+	return logLevelUnknown
+}
+
+// logMessageVariables matches the parts of a message that change between
+// occurrences of the same message: UUIDs, hex identifiers, IP addresses,
+// quoted strings and numbers.
+var logMessageVariables = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}(?::\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`\b(?:0x)?[0-9a-fA-F]*\d[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\b|\b(?:0x)?[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\d[0-9a-fA-F]*\b`), "<hex>"},
+	{regexp.MustCompile(`"[^"]*"|'[^']*'`), "<str>"},
+	{regexp.MustCompile(`\d+(?:\.\d+)?`), "<num>"},
+	{regexp.MustCompile(`\s+`), " "},
+}
+
+// normalizeLogMessage reduces a message to its recurring shape, so "timeout
+// after 31ms" and "timeout after 45ms" are counted together.
+func normalizeLogMessage(text string) string {
+	normalized := strings.TrimSpace(text)
+	for _, variable := range logMessageVariables {
+		normalized = variable.pattern.ReplaceAllString(normalized, variable.replacement)
+	}
+	if len(normalized) > logStatsMessageMaxLen {
+		normalized = strings.ToValidUTF8(normalized[:logStatsMessageMaxLen], "")
+	}
+	return normalized
+}
+
+// logStatsCollector accumulates the statistics of the lines it is given.
+type logStatsCollector struct {
+	start    time.Time
+	bucket   time.Duration
+	buckets  []LogStatsBucket
+	totals   LogLevelCounts
+	messages map[string]*LogStatsMessage
+	other    int
+	scanned  int
+}
+
+func newLogStatsCollector(start, end time.Time, bucket time.Duration) *logStatsCollector {
+	start = start.Truncate(bucket)
+	count := int(end.Sub(start)/bucket) + 1
+	buckets := make([]LogStatsBucket, count)
+	for i := range buckets {
+		buckets[i].Start = start.Add(time.Duration(i) * bucket)
+	}
+	return &logStatsCollector{
+		start:    start,
+		bucket:   bucket,
+		buckets:  buckets,
+		messages: make(map[string]*LogStatsMessage),
+	}
+}
+
+// add counts a log line payload. The payload must carry Docker's timestamp
+// prefix; a line without one cannot be placed in a bucket and is only counted
+// in the totals.
+func (c *logStatsCollector) add(payload []byte) {
+	c.scanned++
+	text := payload
+	var logged time.Time
+	if stamp, rest, found := bytes.Cut(payload, []byte{' '}); found {
+		if parsed, err := time.Parse(time.RFC3339Nano, string(stamp)); err == nil {
+			logged, text = parsed, rest
+		}
+	}
+	message := string(text)
+	level := classifyLogLevel(message)
+	c.totals.add(level)
+	if !logged.IsZero() && !logged.Before(c.start) {
+		if index := int(logged.Sub(c.start) / c.bucket); index < len(c.buckets) {
+			c.buckets[index].add(level)
+		}
+	}
+
+	normalized := normalizeLogMessage(message)
+	if normalized == "" {
+		return
+	}
+	entry, found := c.messages[normalized]
+	if !found {
+		if len(c.messages) >= logStatsMaxMessages {
+			c.other++
+			return
+		}
+		entry = &LogStatsMessage{Message: normalized}
+		c.messages[normalized] = entry
+	}
+	entry.Count++
+	entry.Level = level
+}
+
+// top returns the n messages that recurred most, the most frequent first.
+func (c *logStatsCollector) top(n int) []LogStatsMessage {
+	messages := make([]LogStatsMessage, 0, len(c.messages))
+	for _, message := range c.messages {
+		messages = append(messages, *message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Count != messages[j].Count {
+			return messages[i].Count > messages[j].Count
+		}
+		return messages[i].Message < messages[j].Message
+	})
+	if len(messages) > n {
+		messages = messages[:n]
+	}
+	return messages
+}
+
+// logsStatsHandler scans the logs of a service over a time range and returns
+// the number of lines per detected level, bucketed over time, together with
+// the messages that recurred most. That shows when a service started failing
+// without reading its raw logs.
+//
+// Query parameters: `since` (relative like "1h" or "2d", or absolute; default
+// 1h), `bucket` (a duration; default 1m) and `top` (default 10).
+func logsStatsHandler(w http.ResponseWriter, r *http.Request) {
+	serviceID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	now := time.Now()
+
+	since := normalizeSince(query.Get("since"))
+	if since == "" {
+		since = "1h"
+	}
+	start, ok := resolveLogTime(since, now)
+	if !ok || !start.Before(now) {
+		http.Error(w, "Invalid since: "+query.Get("since"), http.StatusBadRequest)
+		return
+	}
+	bucket := time.Minute
+	if value := query.Get("bucket"); value != "" {
+		parsed, err := time.ParseDuration(normalizeSince(value))
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid bucket: "+value, http.StatusBadRequest)
+			return
+		}
+		bucket = parsed
+	}
+	if now.Sub(start)/bucket >= logStatsMaxBuckets {
+		http.Error(w, "Too many buckets: use a larger bucket or a shorter range", http.StatusBadRequest)
+		return
+	}
+	top := logStatsDefaultTop
+	if value, err := strconv.Atoi(query.Get("top")); err == nil && value >= 0 {
+		top = value
+	}
+
+	cli, err := getCli()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	logReader, err := openServiceLogs(ctx, cli, logsOptions{
+		serviceID:  serviceID,
+		tail:       "all",
+		since:      start.Format(time.RFC3339Nano),
+		timestamps: true,
+		stdout:     true,
+		stderr:     true,
+	})
+	if err != nil {
+		http.Error(w, logsErrorReason(err), http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = logReader.Close() }()
+	go func() {
+		<-ctx.Done()
+		_ = logReader.Close()
+	}()
+
+	collector := newLogStatsCollector(start, now, bucket)
+	raw := make(chan []byte, logChannelSize)
+	go readLogLines(ctx, logReader, raw)
+	// The recurring messages quote the log lines, so they must not leak what
+	// the logs websocket would have masked.
+	if logMasker := newLogMasker(); logMasker != nil {
+		masked := make(chan []byte, logChannelSize)
+		go maskLogLines(ctx, raw, masked, logMasker)
+		raw = masked
+	}
+	truncated := false
+	forEachLogLine(ctx, raw, logStatsReadIdle, func(payload []byte) bool {
+		if collector.scanned >= logStatsMaxLines {
+			truncated = true
+			return false
+		}
+		collector.add(payload)
+		return true
+	})
+
+	result := LogStatsHandlerResult{
+		ServiceID:     serviceID,
+		Since:         collector.start,
+		Until:         now,
+		BucketSeconds: bucket.Seconds(),
+		Totals:        collector.totals,
+		Buckets:       collector.buckets,
+		TopMessages:   collector.top(top),
+		OtherMessages: collector.other,
+		LinesScanned:  collector.scanned,
+		Truncated:     truncated,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("logsStatsHandler: encoding response failed: %v", err)
+	}
+}
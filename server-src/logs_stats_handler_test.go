@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TestClassifyLogLevel verifies level detection for plain, logfmt and JSON
+// log lines.
+func TestClassifyLogLevel(t *testing.T) {
+	tests := map[string]string{
+		"ERROR something broke":                             logLevelError,
+		"2024/03/01 14:05:00 [WARN] disk almost full":       logLevelWarn,
+		"14:05:00.123 INFO  com.example.App - started":      logLevelInfo,
+		"debug: cache miss":                                 logLevelDebug,
+		`time=2024-03-01T14:05:00Z level=error msg="boom"`:  logLevelError,
+		`ts=1 lvl=warning msg=slow`:                         logLevelWarn,
+		`{"level":"info","msg":"ready"}`:                    logLevelInfo,
+		`{"severity":"CRITICAL","message":"down"}`:          logLevelError,
+		`{"msg":"no level"}`:                                logLevelUnknown,
+		"GET /health 200":                                   logLevelUnknown,
+		"a request took longer than expected, error budget": logLevelUnknown,
+	}
+	for line, want := range tests {
+		if got := classifyLogLevel(line); got != want {
+			t.Errorf("classifyLogLevel(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+// TestNormalizeLogMessage verifies that the variable parts of a message are
+// replaced, so its occurrences are counted together.
+func TestNormalizeLogMessage(t *testing.T) {
+	tests := map[string]string{
+		"timeout after 31ms":                               "timeout after <num>ms",
+		"connection from 10.0.0.12:5432 refused":           "connection from <ip> refused",
+		"task 3f2a9c1e-8b7d-4e6f-a1b2-c3d4e5f6a7b8 failed": "task <uuid> failed",
+		"container 4f9d1a2b3c failed":                      "container <hex> failed",
+		`user "alice"   not found`:                         "user <str> not found",
+	}
+	for message, want := range tests {
+		if got := normalizeLogMessage(message); got != want {
+			t.Errorf("normalizeLogMessage(%q) = %q, want %q", message, got, want)
+		}
+	}
+	if got := normalizeLogMessage(strings.Repeat("x", 500)); len(got) != logStatsMessageMaxLen {
+		t.Errorf("expected a long message to be truncated to %d bytes, got %d", logStatsMessageMaxLen, len(got))
+	}
+}
+
+// TestLogStatsCollector verifies the bucketing and the ranking of recurring
+// messages.
+func TestLogStatsCollector(t *testing.T) {
+	start := time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)
+	collector := newLogStatsCollector(start, start.Add(3*time.Minute), time.Minute)
+	if len(collector.buckets) != 4 {
+		t.Fatalf("expected 4 buckets, got %d", len(collector.buckets))
+	}
+	for _, line := range []string{
+		"2024-03-01T14:00:10Z ERROR timeout after 31ms",
+		"2024-03-01T14:00:50Z ERROR timeout after 45ms",
+		"2024-03-01T14:02:00Z INFO ready",
+		"no timestamp here",
+	} {
+		collector.add([]byte(line))
+	}
+
+	if collector.buckets[0].Error != 2 || collector.buckets[2].Info != 1 || collector.buckets[1].Total != 0 {
+		t.Fatalf("unexpected buckets %+v", collector.buckets)
+	}
+	if collector.totals.Total != 4 || collector.totals.Unknown != 1 {
+		t.Fatalf("unexpected totals %+v", collector.totals)
+	}
+	top := collector.top(1)
+	if len(top) != 1 || top[0].Message != "ERROR timeout after <num>ms" || top[0].Count != 2 || top[0].Level != logLevelError {
+		t.Fatalf("unexpected top messages %+v", top)
+	}
+}
+
+// TestLogStatsCollector_MaxMessages verifies that the distinct messages are
+// bounded, the lines of further messages being counted as other messages.
+func TestLogStatsCollector_MaxMessages(t *testing.T) {
+	start := time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)
+	collector := newLogStatsCollector(start, start.Add(time.Minute), time.Minute)
+	// Letters only, so normalizing keeps the messages distinct.
+	word := func(i int) string {
+		var letters []byte
+		for ; i > 0 || len(letters) == 0; i /= 20 {
+			letters = append(letters, byte('g'+i%20))
+		}
+		return string(letters)
+	}
+	for i := 0; i < logStatsMaxMessages+5; i++ {
+		collector.add([]byte("message " + word(i)))
+	}
+	collector.add([]byte("message " + word(0)))
+
+	if len(collector.messages) != logStatsMaxMessages || collector.other != 5 {
+		t.Fatalf("expected %d messages and 5 others, got %d and %d", logStatsMaxMessages, len(collector.messages), collector.other)
+	}
+	if top := collector.top(1); top[0].Message != "message g" || top[0].Count != 2 {
+		t.Fatalf("expected a known message to keep counting, got %+v", top)
+	}
+}
+
+// TestLogsStatsHandler verifies the endpoint against a fake Docker server.
+func TestLogsStatsHandler(t *testing.T) {
+	now := time.Now().UTC()
+	var query string
+	dockerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/services/svc1/logs") {
+			query = r.URL.RawQuery
+			for _, line := range []string{
+				now.Add(-2*time.Minute).Format(time.RFC3339Nano) + " level=error msg=\"db down\"",
+				now.Add(-2*time.Minute).Format(time.RFC3339Nano) + " level=error msg=\"db down\"",
+				now.Format(time.RFC3339Nano) + " level=info msg=ok",
+			} {
+				_, _ = w.Write([]byte("12345678" + line + "\n"))
+			}
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer dockerSrv.Close()
+
+	defer ResetCli()
+	SetCli(makeClientForServer(t, dockerSrv.URL))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/ui/logs/{id}/stats", logsStatsHandler)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/ui/logs/svc1/stats?since=10m&bucket=1m&top=5", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var result LogStatsHandlerResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if result.Totals.Error != 2 || result.Totals.Info != 1 || result.LinesScanned != 3 || result.Truncated {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if len(result.Buckets) != 11 {
+		t.Fatalf("expected 11 one-minute buckets, got %d", len(result.Buckets))
+	}
+	if len(result.TopMessages) == 0 || result.TopMessages[0].Count != 2 {
+		t.Fatalf("unexpected top messages %+v", result.TopMessages)
+	}
+	if !strings.Contains(query, "timestamps=1") || !strings.Contains(query, "since=") {
+		t.Fatalf("unexpected docker query %s", query)
+	}
+}
+
+// TestLogsStatsHandler_InvalidParameters verifies that unusable parameters
+// are rejected before Docker is asked for anything.
+func TestLogsStatsHandler_InvalidParameters(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/ui/logs/{id}/stats", logsStatsHandler)
+	for _, params := range []string{"since=bogus", "bucket=0s", "bucket=nope", "since=48h&bucket=1s"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/ui/logs/svc1/stats?"+params, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", params, rr.Code)
+		}
+	}
+}
@@ -24,16 +24,19 @@ var getCli = dockerclient.GetCli
 // SetCli injects a custom Docker client. Used by tests.
 func SetCli(c *client.Client) {
 	dockerclient.SetCli(c)
+	resetMetricsCaches()
 }
 
 // ResetCli clears the cached Docker client. Used by tests.
 func ResetCli() {
 	dockerclient.ResetCli()
+	resetMetricsCaches()
 }
 
 func main() {
 	log.Println("Starting Docker Swarm Dashboard...")
 	warnIfAllowedOriginsUnset()
+	startMetricsCollector()
 	log.Println("Starting server setup")
 	handler := buildHandler()
 	log.Println("Ready! Waiting for connections on port " + httpPort + "...")
@@ -63,22 +66,31 @@ func buildHandler() http.Handler {
 	apiRouter.HandleFunc("/docker/services/{id}/metrics", serviceMetricsHandler)
 	apiRouter.HandleFunc("/docker/nodes", dockerNodesHandler)
 	apiRouter.HandleFunc("/docker/nodes/metrics", clusterMetricsHandler)
+	apiRouter.HandleFunc("/docker/nodes/metrics/raw", clusterRawMetricsHandler)
 	apiRouter.HandleFunc("/docker/nodes/{id}/metrics", nodeMetricsHandler)
+	apiRouter.HandleFunc("/docker/nodes/{id}/metrics/raw", nodeRawMetricsHandler)
+	apiRouter.HandleFunc("/docker/nodes/{id}/containers/metrics", nodeContainersMetricsHandler)
 	apiRouter.HandleFunc("/docker/nodes/{id}", dockerNodesDetailsHandler)
 	apiRouter.HandleFunc("/docker/tasks", dockerTasksHandler)
 	apiRouter.HandleFunc("/docker/tasks/{id}", dockerTasksDetailsHandler)
 	apiRouter.HandleFunc("/docker/tasks/{id}/metrics", taskMetricsHandler)
 	if handlingLogs {
+		apiRouter.HandleFunc("/docker/logs", logsMultiplexHandler)
 		apiRouter.HandleFunc("/docker/logs/{id}", dockerServiceLogsHandler)
+		apiRouter.HandleFunc("/ui/logs/{id}/stats", logsStatsHandler)
 	}
 	apiRouter.HandleFunc("/ui/dashboard-settings", dashboardSettingsHandler)
 	apiRouter.HandleFunc("/ui/dashboardh", dashboardHHandler)
 	apiRouter.HandleFunc("/ui/dashboardv", dashboardVHandler)
 	apiRouter.HandleFunc("/ui/timeline", timelineHandler)
 	apiRouter.HandleFunc("/ui/stacks", stacksHandler)
+	apiRouter.HandleFunc("/ui/stacks/{name}/metrics", stackMetricsHandler)
 	apiRouter.HandleFunc("/ui/nodes", nodesHandler)
 	apiRouter.HandleFunc("/ui/tasks", tasksHandler)
 	apiRouter.HandleFunc("/ui/ports", portsHandler)
+	apiRouter.HandleFunc("/ui/metrics/diagnostics", metricsDiagnosticsHandler)
+	apiRouter.HandleFunc("/ui/top", topHandler)
+	apiRouter.HandleFunc("/ui/capacity", capacityHandler)
 	apiRouter.HandleFunc("/ui/logs/services", logsServicesHandler)
 	apiRouter.HandleFunc("/ui/version", versionHandler)
 
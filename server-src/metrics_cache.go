@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	metricsCacheTTLEnv      = "DSD_METRICS_CACHE_TTL"
+	metricsDiscoveryTTLEnv  = "DSD_METRICS_DISCOVERY_TTL"
+	metricsScrapeTimeoutEnv = "DSD_METRICS_SCRAPE_TIMEOUT"
+	metricsConcurrencyEnv   = "DSD_METRICS_CONCURRENCY"
+)
+
+const (
+	defaultMetricsCacheTTL      = 5 * time.Second
+	defaultMetricsDiscoveryTTL  = 30 * time.Second
+	defaultMetricsScrapeTimeout = 5 * time.Second
+	defaultMetricsConcurrency   = 8
+)
+
+// durationFromEnv reads a non-negative duration, falling back to `fallback`
+// when the variable is unset or invalid.
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		log.Printf("WARNING: invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// metricsSettings are the cache, discovery and concurrency settings of the
+// metrics, read once at startup by loadMetricsSettingsFromEnv.
+var metricsSettings = struct {
+	cacheTTL     time.Duration
+	discoveryTTL time.Duration
+	concurrency  int
+}{defaultMetricsCacheTTL, defaultMetricsDiscoveryTTL, defaultMetricsConcurrency}
+
+// metricsCacheTTL is how long a scraped exporter response is reused. Zero
+// disables the cache; concurrent scrapes of an endpoint are still shared.
+func metricsCacheTTL() time.Duration {
+	return metricsSettings.cacheTTL
+}
+
+// metricsDiscoveryTTL is how long the exporter services and the endpoints of
+// their tasks are reused.
+func metricsDiscoveryTTL() time.Duration {
+	return metricsSettings.discoveryTTL
+}
+
+// metricsConcurrency is the number of exporters scraped in parallel by a
+// request.
+func metricsConcurrency() int {
+	return metricsSettings.concurrency
+}
+
+// concurrencyFromEnv reads DSD_METRICS_CONCURRENCY, falling back to the
+// default when the variable is unset or invalid.
+func concurrencyFromEnv() int {
+	value := os.Getenv(metricsConcurrencyEnv)
+	if value == "" {
+		return defaultMetricsConcurrency
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("WARNING: invalid %s %q, using %d", metricsConcurrencyEnv, value, defaultMetricsConcurrency)
+		return defaultMetricsConcurrency
+	}
+	return parsed
+}
+
+// loadMetricsSettingsFromEnv reads the cache, discovery and concurrency
+// settings and applies DSD_METRICS_SCRAPE_TIMEOUT to the client scraping the
+// exporters, warning once about invalid values.
+func loadMetricsSettingsFromEnv() {
+	metricsSettings.cacheTTL = durationFromEnv(metricsCacheTTLEnv, defaultMetricsCacheTTL)
+	metricsSettings.discoveryTTL = durationFromEnv(metricsDiscoveryTTLEnv, defaultMetricsDiscoveryTTL)
+	metricsSettings.concurrency = concurrencyFromEnv()
+	timeout := durationFromEnv(metricsScrapeTimeoutEnv, defaultMetricsScrapeTimeout)
+	if timeout == 0 {
+		timeout = defaultMetricsScrapeTimeout
+	}
+	metricsHttpClient.Timeout = timeout
+}
+
+// ttlCacheEntry is a value loaded by a ttlCache.
+type ttlCacheEntry[V any] struct {
+	value  V
+	loaded time.Time
+}
+
+// ttlCacheCall is a load in progress, shared by the callers asking for the
+// same key meanwhile.
+type ttlCacheCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// errTTLCacheLoadPanicked is returned to the callers waiting for a load that
+// panicked.
+var errTTLCacheLoadPanicked = errors.New("loading the cached value panicked")
+
+// ttlCache reuses loaded values for a while and runs a single load per key at
+// a time. Failed loads are not cached.
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	entries map[string]ttlCacheEntry[V]
+	calls   map[string]*ttlCacheCall[V]
+}
+
+func newTTLCache[V any]() *ttlCache[V] {
+	return &ttlCache[V]{entries: make(map[string]ttlCacheEntry[V]), calls: make(map[string]*ttlCacheCall[V])}
+}
+
+// get returns the value of `key` loaded less than `ttl` ago, or loads it,
+// waiting for the load already running if there is one.
+func (c *ttlCache[V]) get(key string, ttl time.Duration, load func() (V, error)) (V, error) {
+	c.mu.Lock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.Sub(entry.loaded) >= ttl {
+			delete(c.entries, k)
+		}
+	}
+	if entry, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		return entry.value, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &ttlCacheCall[V]{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	// Release the waiting callers and the key even if load panics.
+	loaded := false
+	defer func() {
+		if !loaded {
+			call.err = errTTLCacheLoadPanicked
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		if call.err == nil && ttl > 0 {
+			c.entries[key] = ttlCacheEntry[V]{value: call.value, loaded: time.Now()}
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = load()
+	loaded = true
+	return call.value, call.err
+}
+
+// forget drops the cached values `match` selects, such as an endpoint that
+// stopped answering.
+func (c *ttlCache[V]) forget(match func(V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if match(entry.value) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// reset forgets the cached values.
+func (c *ttlCache[V]) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]ttlCacheEntry[V])
+}
+
+var (
+	scrapeCache   = newTTLCache[map[string]*dto.MetricFamily]()
+	serviceCache  = newTTLCache[*swarm.Service]()
+	endpointCache = newTTLCache[exporterEndpoint]()
+	targetsCache  = newTTLCache[map[string]string]()
+)
+
+// resetMetricsCaches forgets the cached discovery and scrapes, which belong
+// to the Docker client they were made with.
+func resetMetricsCaches() {
+	scrapeCache.reset()
+	serviceCache.reset()
+	endpointCache.reset()
+	targetsCache.reset()
+}
+
+// cachedNodeExporterService is findNodeExporterService, reused for the
+// discovery TTL.
+func cachedNodeExporterService(cli *client.Client) (*swarm.Service, error) {
+	return serviceCache.get("node-exporter|"+nodeExporterDiscovery.mode()+"|"+nodeExporterLabel, metricsDiscoveryTTL(), func() (*swarm.Service, error) {
+		return findNodeExporterService(cli)
+	})
+}
+
+// cachedCAdvisorService is findCAdvisorService, reused for the discovery TTL.
+func cachedCAdvisorService(cli *client.Client) (*swarm.Service, error) {
+	return serviceCache.get("cadvisor|"+cadvisorDiscovery.mode()+"|"+cadvisorLabel, metricsDiscoveryTTL(), func() (*swarm.Service, error) {
+		return findCAdvisorService(cli)
+	})
+}
+
+// cachedNodeExporterEndpoint is getNodeExporterEndpoint, reused for the
+// discovery TTL.
+func cachedNodeExporterEndpoint(cli *client.Client, service *swarm.Service, nodeID string) (exporterEndpoint, error) {
+	return endpointCache.get("node-exporter|"+service.ID+"|"+nodeID, metricsDiscoveryTTL(), func() (exporterEndpoint, error) {
+		return getNodeExporterEndpoint(cli, service, nodeID)
+	})
+}
+
+// cachedCAdvisorEndpoint is getCAdvisorEndpoint, reused for the discovery TTL.
+func cachedCAdvisorEndpoint(cli *client.Client, service *swarm.Service, nodeID string) (exporterEndpoint, error) {
+	return endpointCache.get("cadvisor|"+service.ID+"|"+nodeID, metricsDiscoveryTTL(), func() (exporterEndpoint, error) {
+		return getCAdvisorEndpoint(cli, service, nodeID)
+	})
+}
+
+// forgetEndpoint drops a failing exporter endpoint from the discovery caches,
+// so the next request resolves the node again instead of retrying the address
+// of a replaced task until the discovery TTL expires.
+func forgetEndpoint(url string) {
+	endpointCache.forget(func(cached exporterEndpoint) bool { return cached.url == url })
+	targetsCache.forget(func(targets map[string]string) bool {
+		for _, target := range targets {
+			if target == url {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// scrapeNodeExporter fetches the metrics of a node-exporter endpoint, sharing
+// the scrape with the concurrent requests and reusing it for the cache TTL.
+func scrapeNodeExporter(endpoint exporterEndpoint) (map[string]*dto.MetricFamily, error) {
+	families, err := scrapeCache.get(endpoint.url, metricsCacheTTL(), func() (map[string]*dto.MetricFamily, error) {
+		return fetchMetricsFromNodeExporter(endpoint)
+	})
+	if err != nil {
+		forgetEndpoint(endpoint.url)
+	}
+	return families, err
+}
+
+// scrapeCAdvisor fetches the metrics of a cAdvisor endpoint, sharing the
+// scrape with the concurrent requests and reusing it for the cache TTL.
+func scrapeCAdvisor(endpoint exporterEndpoint) (map[string]*dto.MetricFamily, error) {
+	families, err := scrapeCache.get(endpoint.url, metricsCacheTTL(), func() (map[string]*dto.MetricFamily, error) {
+		return fetchMetricsFromCAdvisor(endpoint)
+	})
+	if err != nil {
+		forgetEndpoint(endpoint.url)
+	}
+	return families, err
+}
+
+// metricsFanOut runs the scrapes of a request in parallel, at most
+// DSD_METRICS_CONCURRENCY at a time.
+type metricsFanOut struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newMetricsFanOut() *metricsFanOut {
+	return &metricsFanOut{slots: make(chan struct{}, metricsConcurrency())}
+}
+
+// Go runs fn on a goroutine once a slot is free.
+func (f *metricsFanOut) Go(fn func()) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.slots <- struct{}{}
+		defer func() { <-f.slots }()
+		fn()
+	}()
+}
+
+// Wait waits for every function started by Go.
+func (f *metricsFanOut) Wait() {
+	f.wg.Wait()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestTTLCache_SharesConcurrentLoads verifies that concurrent callers share
+// a single load.
+func TestTTLCache_SharesConcurrentLoads(t *testing.T) {
+	cache := newTTLCache[string]()
+	var loads int32
+	release := make(chan struct{})
+	load := func() (string, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return "body", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _ := cache.get("k", 0, load)
+			results <- value
+		}()
+	}
+	// Let the callers pile up on the running load.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if got := atomic.LoadInt32(&loads); got != 1 {
+		t.Fatalf("expected a single load, got %d", got)
+	}
+	for value := range results {
+		if value != "body" {
+			t.Fatalf("expected every caller to get the body, got %q", value)
+		}
+	}
+}
+
+// TestTTLCache_Expiry verifies reuse within the TTL, expiry, and that
+// failures are not cached.
+func TestTTLCache_Expiry(t *testing.T) {
+	cache := newTTLCache[int]()
+	calls := 0
+	load := func() (int, error) {
+		calls++
+		return calls, nil
+	}
+	if v, _ := cache.get("k", time.Hour, load); v != 1 {
+		t.Fatalf("expected the first load, got %d", v)
+	}
+	if v, _ := cache.get("k", time.Hour, load); v != 1 {
+		t.Fatalf("expected the cached value, got %d", v)
+	}
+	if v, _ := cache.get("k", 0, load); v != 2 {
+		t.Fatalf("expected a zero TTL to reload, got %d", v)
+	}
+
+	failing := func() (int, error) {
+		calls++
+		return 0, errors.New("boom")
+	}
+	if _, err := cache.get("f", time.Hour, failing); err == nil {
+		t.Fatal("expected the error")
+	}
+	if v, err := cache.get("f", time.Hour, load); err != nil || v != 4 {
+		t.Fatalf("expected the failure not to be cached, got %d/%v", v, err)
+	}
+
+	cache.reset()
+	if v, _ := cache.get("f", time.Hour, load); v != 5 {
+		t.Fatalf("expected a reload after reset, got %d", v)
+	}
+}
+
+// TestMetricsFanOut verifies that no more than the configured number of
+// functions run at once.
+func TestMetricsFanOut(t *testing.T) {
+	setMetricsEnv(t, metricsConcurrencyEnv, "2")
+	fanOut := newMetricsFanOut()
+	var running, peak int32
+	for i := 0; i < 8; i++ {
+		fanOut.Go(func() {
+			now := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	fanOut.Wait()
+	if peak != 2 {
+		t.Fatalf("expected at most 2 concurrent scrapes, got %d", peak)
+	}
+}
+
+// setMetricsEnv sets a metrics setting and reloads the settings, restoring
+// them once the variable is restored.
+func setMetricsEnv(t *testing.T, key, value string) {
+	t.Helper()
+	t.Cleanup(loadMetricsSettingsFromEnv)
+	t.Setenv(key, value)
+	loadMetricsSettingsFromEnv()
+}
+
+// TestMetricsCacheSettingsFromEnv verifies the settings and their fallbacks,
+// and that they are read once.
+func TestMetricsCacheSettingsFromEnv(t *testing.T) {
+	setMetricsEnv(t, metricsCacheTTLEnv, "0s")
+	setMetricsEnv(t, metricsDiscoveryTTLEnv, "bogus")
+	setMetricsEnv(t, metricsConcurrencyEnv, "-1")
+	setMetricsEnv(t, metricsScrapeTimeoutEnv, "12s")
+	if metricsCacheTTL() != 0 || metricsDiscoveryTTL() != defaultMetricsDiscoveryTTL || metricsConcurrency() != defaultMetricsConcurrency {
+		t.Fatalf("unexpected settings %v/%v/%d", metricsCacheTTL(), metricsDiscoveryTTL(), metricsConcurrency())
+	}
+	if metricsHttpClient.Timeout != 12*time.Second {
+		t.Fatalf("expected a 12s timeout, got %v", metricsHttpClient.Timeout)
+	}
+
+	t.Setenv(metricsConcurrencyEnv, "3")
+	if metricsConcurrency() != defaultMetricsConcurrency {
+		t.Fatalf("expected the concurrency read at startup, got %d", metricsConcurrency())
+	}
+}
+
+// TestScrapeNodeExporter_Cached verifies that an endpoint is scraped once
+// within the cache TTL.
+func TestScrapeNodeExporter_Cached(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	var hits int32
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = w.Write([]byte("node_load1 1\n"))
+	}))
+	defer exporter.Close()
+
+	for i := 0; i < 3; i++ {
+		if families, err := scrapeNodeExporter(exporterEndpoint{url: exporter.URL}); err != nil || families["node_load1"] == nil {
+			t.Fatalf("unexpected scrape %v/%v", families, err)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("expected a single scrape, got %d", hits)
+	}
+
+	setMetricsEnv(t, metricsCacheTTLEnv, "0")
+	resetMetricsCaches()
+	_, _ = scrapeNodeExporter(exporterEndpoint{url: exporter.URL})
+	_, _ = scrapeNodeExporter(exporterEndpoint{url: exporter.URL})
+	if atomic.LoadInt32(&hits) != 3 {
+		t.Fatalf("expected every scrape to reach the exporter without cache, got %d", hits)
+	}
+}
+
+// TestTTLCache_PanickingLoad verifies that a panicking load releases the
+// callers waiting for it and the key.
+func TestTTLCache_PanickingLoad(t *testing.T) {
+	cache := newTTLCache[int]()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		_, _ = cache.get("k", time.Hour, func() (int, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waiter := make(chan error)
+	go func() {
+		_, err := cache.get("k", time.Hour, func() (int, error) { return 1, nil })
+		waiter <- err
+	}()
+	// Let the waiter join the running load.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if recovered := <-panicked; recovered != "boom" {
+		t.Fatalf("expected the panic to reach the loading caller, got %v", recovered)
+	}
+	select {
+	case err := <-waiter:
+		if !errors.Is(err, errTTLCacheLoadPanicked) {
+			t.Fatalf("expected the waiter to get the panic error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the waiter was never released")
+	}
+	if v, err := cache.get("k", time.Hour, func() (int, error) { return 2, nil }); err != nil || v != 2 {
+		t.Fatalf("expected the key to load again, got %d/%v", v, err)
+	}
+}
+
+// TestScrapeNodeExporter_ForgetsFailingEndpoint verifies that a failed scrape
+// drops the cached endpoint and targets holding it.
+func TestScrapeNodeExporter_ForgetsFailingEndpoint(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead := exporter.URL + "/metrics"
+	exporter.Close()
+
+	resolutions := 0
+	resolve := func() (exporterEndpoint, error) {
+		resolutions++
+		return exporterEndpoint{url: dead}, nil
+	}
+	_, _ = endpointCache.get("node-exporter|s1|n1", time.Hour, resolve)
+	_, _ = endpointCache.get("node-exporter|s1|n2", time.Hour, func() (exporterEndpoint, error) {
+		return exporterEndpoint{url: "http://10.0.0.2:9100/metrics"}, nil
+	})
+	_, _ = targetsCache.get("node-exporter", time.Hour, func() (map[string]string, error) {
+		return map[string]string{"n1": dead}, nil
+	})
+
+	if _, err := scrapeNodeExporter(exporterEndpoint{url: dead}); err == nil {
+		t.Fatal("expected the scrape to fail")
+	}
+	_, _ = endpointCache.get("node-exporter|s1|n1", time.Hour, resolve)
+	if resolutions != 2 {
+		t.Errorf("expected the failing endpoint to be resolved again, got %d resolutions", resolutions)
+	}
+	if endpoint, _ := endpointCache.get("node-exporter|s1|n2", time.Hour, func() (exporterEndpoint, error) { return exporterEndpoint{}, errors.New("reloaded") }); endpoint.url != "http://10.0.0.2:9100/metrics" {
+		t.Errorf("expected the other endpoint to stay cached, got %q", endpoint.url)
+	}
+	targets, _ := targetsCache.get("node-exporter", time.Hour, func() (map[string]string, error) { return map[string]string{}, nil })
+	if len(targets) != 0 {
+		t.Errorf("expected the targets holding the endpoint to be forgotten, got %v", targets)
+	}
+}
+
+// TestScrapeCAdvisor_CachedSampleTime verifies that a cached scrape keeps the
+// time it was fetched at, so reading it later does not turn unchanged counters
+// into zero rates, and that the timestamps cAdvisor sets are kept.
+func TestScrapeCAdvisor_CachedSampleTime(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	setMetricsEnv(t, metricsCacheTTLEnv, "1h")
+	var hits int32
+	cadvisor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		_, _ = fmt.Fprintf(w, "container_cpu_usage_seconds_total{id=\"/docker/c1\",container_label_com_docker_swarm_task_id=\"t1\"} %d\n", 5*n)
+		_, _ = fmt.Fprintf(w, "container_cpu_usage_seconds_total{id=\"/docker/c2\",container_label_com_docker_swarm_task_id=\"t2\"} %d 1700000000500\n", 5*n)
+	}))
+	defer cadvisor.Close()
+
+	sampleTimes := func() map[string]float64 {
+		families, err := scrapeCAdvisor(exporterEndpoint{url: cadvisor.URL})
+		if err != nil {
+			t.Fatalf("scrape: %v", err)
+		}
+		parsed, _ := parseCAdvisorMetricFamilies(families, "", "")
+		times := make(map[string]float64)
+		for _, container := range parsed.ContainerMetrics {
+			times[container.TaskID] = container.ServerTime
+		}
+		return times
+	}
+	before := float64(time.Now().UnixMilli()) / 1000
+	first := sampleTimes()
+	after := float64(time.Now().UnixMilli()) / 1000
+	if first["t1"] < before || first["t1"] > after {
+		t.Fatalf("expected t1 to be sampled at the fetch time, between %v and %v, got %v", before, after, first["t1"])
+	}
+	if first["t2"] != 1700000000.5 {
+		t.Fatalf("expected the timestamp of cAdvisor to be kept, got %v", first["t2"])
+	}
+	if cached := sampleTimes(); cached["t1"] != first["t1"] || atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("expected the cached scrape to keep its sample time %v, got %v after %d scrapes", first["t1"], cached["t1"], hits)
+	}
+
+	families, err := decodeTextMetrics(strings.NewReader("node_load1 0.5 1700000000000\n"))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if node := parseNodeMetricFamilies(families); node.ServerTime != 1700000000 {
+		t.Fatalf("expected the node sample time without node_time_seconds, got %v", node.ServerTime)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	metricsCollectIntervalEnv = "DSD_METRICS_COLLECT_INTERVAL"
+	metricsRetentionEnv       = "DSD_METRICS_RETENTION"
+)
+
+// defaultMetricsRetention is how far back the history goes when
+// DSD_METRICS_RETENTION is not set.
+const defaultMetricsRetention = time.Hour
+
+// maxMetricsRounds bounds the rounds kept, whatever the interval and the
+// retention, so a tiny interval cannot exhaust the memory.
+const maxMetricsRounds = 10000
+
+// metricsHistory is the background collector, nil when history is disabled.
+var metricsHistory *metricsCollector
+
+// metricsRound is what one collection round gathered across the cluster.
+type metricsRound struct {
+	time time.Time
+	// nodes holds the node-exporter metrics by node ID.
+	nodes map[string]*ParsedMetrics
+	// containers holds the cAdvisor metrics of the swarm task containers.
+	containers []ContainerMemoryMetrics
+}
+
+// metricsCollector scrapes the exporters at a fixed interval and keeps the
+// rounds in a bounded ring buffer, oldest ones being overwritten first.
+type metricsCollector struct {
+	interval time.Duration
+
+	mu     sync.RWMutex
+	rounds []metricsRound
+	next   int
+	full   bool
+}
+
+// metricsCollectorConfigFromEnv reads DSD_METRICS_COLLECT_INTERVAL and
+// DSD_METRICS_RETENTION. A missing, zero or invalid interval disables the
+// collector; an invalid retention falls back to the default.
+func metricsCollectorConfigFromEnv() (interval, retention time.Duration) {
+	if value := os.Getenv(metricsCollectIntervalEnv); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			log.Printf("WARNING: invalid %s %q, metrics history is disabled", metricsCollectIntervalEnv, value)
+		} else {
+			interval = parsed
+		}
+	}
+	retention = defaultMetricsRetention
+	if value := os.Getenv(metricsRetentionEnv); value != "" {
+		parsed, err := time.ParseDuration(normalizeSince(value))
+		if err != nil || parsed <= 0 {
+			log.Printf("WARNING: invalid %s %q, keeping %s of metrics history", metricsRetentionEnv, value, defaultMetricsRetention)
+		} else {
+			retention = parsed
+		}
+	}
+	return interval, retention
+}
+
+func newMetricsCollector(interval, retention time.Duration) *metricsCollector {
+	size := int(retention / interval)
+	if size < 1 {
+		size = 1
+	}
+	if size > maxMetricsRounds {
+		size = maxMetricsRounds
+	}
+	return &metricsCollector{interval: interval, rounds: make([]metricsRound, size)}
+}
+
+// startMetricsCollector starts the background collector when an interval is
+// configured.
+func startMetricsCollector() {
+	interval, retention := metricsCollectorConfigFromEnv()
+	if interval <= 0 {
+		return
+	}
+	metricsHistory = newMetricsCollector(interval, retention)
+	log.Printf("Collecting metrics every %s, keeping %s of history", interval, retention)
+	go metricsHistory.run(context.Background())
+}
+
+// run collects a round right away and then at every interval until the
+// context is cancelled.
+func (c *metricsCollector) run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		if round, err := collectMetricsRound(); err != nil {
+			log.Printf("metricsCollector: %v", err)
+		} else {
+			c.add(round)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// add stores a round, overwriting the oldest one once the buffer is full.
+func (c *metricsCollector) add(round metricsRound) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rounds[c.next] = round
+	c.next = (c.next + 1) % len(c.rounds)
+	if c.next == 0 {
+		c.full = true
+	}
+}
+
+// history returns the rounds collected since `since`, oldest first, keeping at
+// most one round per `step`.
+func (c *metricsCollector) history(since time.Time, step time.Duration) []metricsRound {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	count, start := c.next, 0
+	if c.full {
+		count, start = len(c.rounds), c.next
+	}
+	var rounds []metricsRound
+	for i := 0; i < count; i++ {
+		round := c.rounds[(start+i)%len(c.rounds)]
+		if round.time.Before(since) {
+			continue
+		}
+		if len(rounds) > 0 && round.time.Sub(rounds[len(rounds)-1].time) < step {
+			continue
+		}
+		rounds = append(rounds, round)
+	}
+	return rounds
+}
+
+// collectMetricsRound scrapes every node-exporter and cAdvisor instance once.
+// An exporter that is not deployed leaves its part of the round empty.
+func collectMetricsRound() (metricsRound, error) {
+	round := metricsRound{time: time.Now(), nodes: make(map[string]*ParsedMetrics)}
+	cli, err := getCli()
+	if err != nil {
+		return round, fmt.Errorf("getting Docker client failed: %w", err)
+	}
+
+	if usingPrometheusBackend() {
+		return collectPrometheusMetricsRound(cli, round)
+	}
+
+	if service, err := cachedNodeExporterService(cli); err != nil {
+		log.Printf("metricsCollector: finding node-exporter service failed: %v", err)
+	} else if service != nil {
+		var mu sync.Mutex
+		scrapeRunningTasks(cli, nodeExporterDiscovery, service, func(nodeID string) {
+			endpoint, err := cachedNodeExporterEndpoint(cli, service, nodeID)
+			if err != nil {
+				return
+			}
+			metricFamilies, err := scrapeNodeExporter(endpoint)
+			if err != nil {
+				return
+			}
+			parsed := parseNodeMetricFamilies(metricFamilies)
+			applyNodeRates(nodeID, parsed)
+			mu.Lock()
+			round.nodes[nodeID] = parsed
+			mu.Unlock()
+		})
+	}
+
+	if service, err := cachedCAdvisorService(cli); err != nil {
+		log.Printf("metricsCollector: finding cAdvisor service failed: %v", err)
+	} else if service != nil {
+		var mu sync.Mutex
+		scrapeRunningTasks(cli, cadvisorDiscovery, service, func(nodeID string) {
+			endpoint, err := cachedCAdvisorEndpoint(cli, service, nodeID)
+			if err != nil {
+				return
+			}
+			metricFamilies, err := scrapeCAdvisor(endpoint)
+			if err != nil {
+				return
+			}
+			// Without a service to filter on, every container is parsed;
+			// only the swarm task containers are kept.
+			parsed, err := parseCAdvisorMetricFamilies(metricFamilies, "", "")
+			if err != nil {
+				return
+			}
+			applyContainerRates(parsed.ContainerMetrics)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, container := range parsed.ContainerMetrics {
+				if container.TaskID != "" {
+					round.containers = append(round.containers, container)
+				}
+			}
+		})
+	}
+	return round, nil
+}
+
+// collectPrometheusMetricsRound fills a round from Prometheus.
+func collectPrometheusMetricsRound(cli *client.Client, round metricsRound) (metricsRound, error) {
+	nodes, err := cli.NodeList(context.Background(), swarm.NodeListOptions{})
+	if err != nil {
+		return round, fmt.Errorf("listing nodes failed: %w", err)
+	}
+	if round.nodes, err = fetchAllNodeMetricsFromPrometheus(nodes); err != nil {
+		log.Printf("metricsCollector: %s", *prometheusErrorMessage(err))
+		round.nodes = make(map[string]*ParsedMetrics)
+	}
+	for nodeID, metrics := range round.nodes {
+		applyNodeRates(nodeID, metrics)
+	}
+	if containers, err := fetchContainerMetricsFromPrometheus(""); err != nil {
+		log.Printf("metricsCollector: %s", *prometheusErrorMessage(err))
+	} else {
+		applyContainerRates(containers.ContainerMetrics)
+		round.containers = containers.ContainerMetrics
+	}
+	return round, nil
+}
+
+// scrapeRunningTasks calls scrape in parallel, within the fan-out limit, for every node with an
+// exporter and waits for all of them.
+func scrapeRunningTasks(cli *client.Client, discovery exporterDiscovery, service *swarm.Service, scrape func(nodeID string)) {
+	nodeIDs, err := discovery.nodeIDs(cli, service)
+	if err != nil {
+		log.Printf("metricsCollector: finding the nodes of %s failed: %v", service.Spec.Name, err)
+		return
+	}
+	fanOut := newMetricsFanOut()
+	for _, nodeID := range nodeIDs {
+		fanOut.Go(func() { scrape(nodeID) })
+	}
+	fanOut.Wait()
+}
+
+// errMetricsRange reports unusable `range` or `step` parameters.
+var errMetricsRange = errors.New("range and step must be positive durations")
+
+// metricsRangeRequest holds the `range` and `step` of a history request.
+type metricsRangeRequest struct {
+	since time.Time
+	step  time.Duration
+}
+
+// parseMetricsRange reads the `range` and `step` query parameters. It reports
+// false when the request asks for no history. Without `step`, every collected
+// round of the range is returned.
+func parseMetricsRange(r *http.Request) (metricsRangeRequest, bool, error) {
+	query := r.URL.Query()
+	value := query.Get("range")
+	if value == "" {
+		return metricsRangeRequest{}, false, nil
+	}
+	window, err := time.ParseDuration(normalizeSince(value))
+	if err != nil || window <= 0 {
+		return metricsRangeRequest{}, true, errMetricsRange
+	}
+	request := metricsRangeRequest{since: time.Now().Add(-window)}
+	if value := query.Get("step"); value != "" {
+		step, err := time.ParseDuration(normalizeSince(value))
+		if err != nil || step <= 0 {
+			return metricsRangeRequest{}, true, errMetricsRange
+		}
+		request.step = step
+	}
+	return request, true, nil
+}
+
+// metricsHistoryRounds returns the rounds a history request asks for, or a
+// message telling why there is no history.
+func metricsHistoryRounds(request metricsRangeRequest) ([]metricsRound, *string) {
+	collector := metricsHistory
+	if collector == nil {
+		msg := fmt.Sprintf("Metrics history is disabled. Set %s to collect metrics in the background.", metricsCollectIntervalEnv)
+		return nil, &msg
+	}
+	return collector.history(request.since, request.step), nil
+}
+
+// metricsPointTime is the time of a history point, as a Unix timestamp like
+// the serverTime of live metrics.
+func metricsPointTime(round metricsRound) float64 {
+	return float64(round.time.UnixNano()) / float64(time.Second)
+}
+
+// summarizeServiceContainers aggregates the metrics of the containers of a
+// service the way serviceMetricsHandler does for live metrics.
+func summarizeServiceContainers(containers []ContainerMemoryMetrics) *ServiceMemoryMetrics {
+	summary := &ServiceMemoryMetrics{ContainerMetrics: containers}
+	for _, container := range containers {
+		summary.TotalUsage += container.Usage
+		summary.TotalLimit += container.Limit
+		if container.ServerTime > summary.ServerTime {
+			summary.ServerTime = container.ServerTime
+		}
+	}
+	if len(containers) > 0 {
+		summary.AverageUsage = summary.TotalUsage / float64(len(containers))
+		if summary.TotalLimit > 0 {
+			summary.AveragePercent = (summary.TotalUsage / summary.TotalLimit) * 100
+		}
+	}
+	sumExtendedContainerMetrics(summary)
+	return summary
+}
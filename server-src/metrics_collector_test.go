@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/gorilla/mux"
+)
+
+// seedMetricsHistory installs a collector holding the given rounds for the
+// duration of the test.
+func seedMetricsHistory(t *testing.T, rounds ...metricsRound) {
+	t.Helper()
+	collector := newMetricsCollector(time.Minute, time.Hour)
+	for _, round := range rounds {
+		collector.add(round)
+	}
+	previous := metricsHistory
+	metricsHistory = collector
+	t.Cleanup(func() { metricsHistory = previous })
+}
+
+// TestMetricsCollector_Ring verifies that the oldest rounds are overwritten
+// once the buffer is full and that the history is returned oldest first.
+func TestMetricsCollector_Ring(t *testing.T) {
+	collector := newMetricsCollector(time.Minute, 3*time.Minute)
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		collector.add(metricsRound{time: start.Add(time.Duration(i) * time.Minute)})
+	}
+	rounds := collector.history(time.Time{}, 0)
+	if len(rounds) != 3 {
+		t.Fatalf("expected 3 rounds, got %d", len(rounds))
+	}
+	for i, round := range rounds {
+		if want := start.Add(time.Duration(i+2) * time.Minute); !round.time.Equal(want) {
+			t.Fatalf("round %d: expected %v, got %v", i, want, round.time)
+		}
+	}
+
+	if rounds := collector.history(start.Add(3*time.Minute+time.Second), 0); len(rounds) != 1 {
+		t.Fatalf("expected the rounds since the given time only, got %d", len(rounds))
+	}
+	if rounds := collector.history(time.Time{}, 2*time.Minute); len(rounds) != 2 {
+		t.Fatalf("expected one round per step, got %d", len(rounds))
+	}
+}
+
+// TestNewMetricsCollector_Capacity verifies the bounds of the ring size.
+func TestNewMetricsCollector_Capacity(t *testing.T) {
+	if got := len(newMetricsCollector(time.Minute, time.Second).rounds); got != 1 {
+		t.Fatalf("expected at least one round, got %d", got)
+	}
+	if got := len(newMetricsCollector(time.Millisecond, 24*time.Hour).rounds); got != maxMetricsRounds {
+		t.Fatalf("expected %d rounds at most, got %d", maxMetricsRounds, got)
+	}
+}
+
+// TestMetricsCollectorConfigFromEnv verifies the interval and retention
+// settings and their fallbacks.
+func TestMetricsCollectorConfigFromEnv(t *testing.T) {
+	cases := []struct {
+		interval, retention string
+		wantInterval        time.Duration
+		wantRetention       time.Duration
+	}{
+		{"", "", 0, defaultMetricsRetention},
+		{"30s", "", 30 * time.Second, defaultMetricsRetention},
+		{"30s", "2d", 30 * time.Second, 48 * time.Hour},
+		{"bogus", "-1h", 0, defaultMetricsRetention},
+	}
+	for _, tc := range cases {
+		t.Setenv(metricsCollectIntervalEnv, tc.interval)
+		t.Setenv(metricsRetentionEnv, tc.retention)
+		interval, retention := metricsCollectorConfigFromEnv()
+		if interval != tc.wantInterval || retention != tc.wantRetention {
+			t.Errorf("%q/%q: expected %v/%v, got %v/%v", tc.interval, tc.retention, tc.wantInterval, tc.wantRetention, interval, retention)
+		}
+	}
+}
+
+// TestParseMetricsRange verifies the range and step query parameters.
+func TestParseMetricsRange(t *testing.T) {
+	r := httptest.NewRequest("GET", "/docker/nodes/n1/metrics", nil)
+	if _, ok, err := parseMetricsRange(r); ok || err != nil {
+		t.Fatalf("expected no history request, got %v/%v", ok, err)
+	}
+
+	r = httptest.NewRequest("GET", "/docker/nodes/n1/metrics?range=1h&step=30s", nil)
+	request, ok, err := parseMetricsRange(r)
+	if !ok || err != nil || request.step != 30*time.Second {
+		t.Fatalf("unexpected result %+v/%v/%v", request, ok, err)
+	}
+	if since := time.Since(request.since); since < time.Hour || since > time.Hour+time.Minute {
+		t.Fatalf("expected the range to start an hour ago, got %v", since)
+	}
+
+	for _, query := range []string{"range=bogus", "range=-1h", "range=1h&step=0s", "range=1h&step=x"} {
+		r = httptest.NewRequest("GET", "/docker/nodes/n1/metrics?"+query, nil)
+		if _, _, err := parseMetricsRange(r); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+// TestNodeMetricsHandler_History verifies that a node's history is served
+// from the collector.
+func TestNodeMetricsHandler_History(t *testing.T) {
+	now := time.Now()
+	seedMetricsHistory(t,
+		metricsRound{time: now.Add(-2 * time.Minute), nodes: map[string]*ParsedMetrics{"n1": {ServerTime: 1}}},
+		metricsRound{time: now.Add(-time.Minute), nodes: map[string]*ParsedMetrics{"n2": {ServerTime: 2}}},
+		metricsRound{time: now, nodes: map[string]*ParsedMetrics{"n1": {ServerTime: 3}}},
+	)
+
+	r := httptest.NewRequest("GET", "/docker/nodes/n1/metrics?range=1h", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "n1"})
+	rr := httptest.NewRecorder()
+	nodeMetricsHandler(rr, r)
+
+	var response nodeMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || len(response.History) != 2 || response.History[0].Metrics.ServerTime != 1 {
+		t.Fatalf("unexpected history %+v", response)
+	}
+	if response.Metrics == nil || response.Metrics.ServerTime != 3 {
+		t.Fatalf("expected the latest point as metrics, got %+v", response.Metrics)
+	}
+}
+
+// TestNodeMetricsHandler_HistoryErrors verifies a bad range and a disabled
+// collector.
+func TestNodeMetricsHandler_HistoryErrors(t *testing.T) {
+	r := httptest.NewRequest("GET", "/docker/nodes/n1/metrics?range=soon", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "n1"})
+	rr := httptest.NewRecorder()
+	nodeMetricsHandler(rr, r)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+
+	previous := metricsHistory
+	metricsHistory = nil
+	defer func() { metricsHistory = previous }()
+	r = httptest.NewRequest("GET", "/docker/nodes/n1/metrics?range=1h", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "n1"})
+	rr = httptest.NewRecorder()
+	nodeMetricsHandler(rr, r)
+	var response nodeMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if response.Available || response.Message == nil || !strings.Contains(*response.Message, metricsCollectIntervalEnv) {
+		t.Fatalf("expected a disabled message, got %+v", response)
+	}
+}
+
+// TestTaskMetricsHandler_History verifies that a task's history is served
+// from the collector.
+func TestTaskMetricsHandler_History(t *testing.T) {
+	now := time.Now()
+	seedMetricsHistory(t,
+		metricsRound{time: now.Add(-time.Minute), containers: []ContainerMemoryMetrics{{TaskID: "t1", Usage: 10}, {TaskID: "t2", Usage: 99}}},
+		metricsRound{time: now, containers: []ContainerMemoryMetrics{{TaskID: "t1", Usage: 20}}},
+	)
+
+	r := httptest.NewRequest("GET", "/docker/tasks/t1/metrics?range=10m", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "t1"})
+	rr := httptest.NewRecorder()
+	taskMetricsHandler(rr, r)
+
+	var response taskMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || len(response.History) != 2 || response.History[0].Metrics.Usage != 10 || response.Metrics.Usage != 20 {
+		t.Fatalf("unexpected history %+v", response)
+	}
+}
+
+// TestServiceMetricsHandler_History verifies that the containers of the
+// service's tasks are aggregated at every point.
+func TestServiceMetricsHandler_History(t *testing.T) {
+	now := time.Now()
+	seedMetricsHistory(t,
+		metricsRound{time: now.Add(-time.Minute), containers: []ContainerMemoryMetrics{
+			{TaskID: "t1", Usage: 100, Limit: 400},
+			{TaskID: "t2", Usage: 300, Limit: 400},
+			{TaskID: "other", Usage: 1000, Limit: 1000},
+		}},
+		metricsRound{time: now, containers: []ContainerMemoryMetrics{{TaskID: "other", Usage: 1000}}},
+	)
+
+	bServices, _ := json.Marshal([]swarm.Service{{ID: "s1", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "web"}}}})
+	bTasks, _ := json.Marshal([]swarm.Task{{ID: "t1", ServiceID: "s1"}, {ID: "t2", ServiceID: "s1"}})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.35/services":
+			_, _ = w.Write(bServices)
+		case "/v1.35/tasks":
+			_, _ = w.Write(bTasks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer ResetCli()
+	SetCli(makeClientForServer(t, server.URL))
+
+	r := httptest.NewRequest("GET", "/docker/services/s1/metrics?range=1h", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "s1"})
+	rr := httptest.NewRecorder()
+	serviceMetricsHandler(rr, r)
+
+	var response serviceMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || len(response.History) != 1 {
+		t.Fatalf("expected one point, got %+v", response)
+	}
+	metrics := response.History[0].Metrics
+	if metrics.TotalUsage != 400 || metrics.AverageUsage != 200 || metrics.AveragePercent != 50 || len(metrics.ContainerMetrics) != 2 {
+		t.Fatalf("unexpected aggregation %+v", metrics)
+	}
+}
+
+// TestClusterMetricsHandler_History verifies that the cluster totals are
+// aggregated at every point.
+func TestClusterMetricsHandler_History(t *testing.T) {
+	now := time.Now()
+	seedMetricsHistory(t,
+		metricsRound{time: now.Add(-time.Minute), nodes: map[string]*ParsedMetrics{
+			"n1": {System: SystemMetrics{NumCPUs: 2}, Memory: MemoryMetrics{Total: 100, Available: 50}},
+		}},
+		metricsRound{time: now, nodes: map[string]*ParsedMetrics{
+			"n1": {System: SystemMetrics{NumCPUs: 2}, Memory: MemoryMetrics{Total: 100, Available: 50}},
+			"n2": {System: SystemMetrics{NumCPUs: 4}, Memory: MemoryMetrics{Total: 100, Available: 0}},
+		}},
+	)
+
+	bNodes, _ := json.Marshal([]swarm.Node{{ID: "n1"}, {ID: "n2"}})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1.35/nodes" {
+			_, _ = w.Write(bNodes)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	defer ResetCli()
+	SetCli(makeClientForServer(t, server.URL))
+
+	rr := httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics?range=1h&step=1s", nil))
+
+	var response clusterMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || response.NodeCount != 2 || len(response.History) != 2 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if first := response.History[0]; first.TotalCPU != 2 || first.MemoryPercent != 50 {
+		t.Fatalf("unexpected first point %+v", first)
+	}
+	if response.TotalCPU != 6 || response.UsedMemory != 150 || response.NodesAvailable != 2 {
+		t.Fatalf("expected the latest totals, got %+v", response.clusterMetricsTotals)
+	}
+}
+
+// exporterPort returns the host and port an httptest server listens on.
+func exporterPort(t *testing.T, srv *httptest.Server) (string, uint32) {
+	t.Helper()
+	u, _ := url.Parse(srv.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+	return host, uint32(port)
+}
+
+// TestCollectMetricsRound verifies that a round scrapes the node-exporter and
+// the cAdvisor of every node running one, keeping the task containers.
+func TestCollectMetricsRound(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	nodeExporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("node_memory_MemTotal_bytes 1000\nnode_memory_MemAvailable_bytes 250\n"))
+	}))
+	defer nodeExporter.Close()
+	cadvisor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(stackCAdvisorMetrics + "container_memory_usage_bytes{id=\"/\"} 99999\n"))
+	}))
+	defer cadvisor.Close()
+	host, nodeExporterPort := exporterPort(t, nodeExporter)
+	_, cadvisorPort := exporterPort(t, cadvisor)
+
+	running := swarm.TaskStatus{State: swarm.TaskStateRunning}
+	attachments := []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/services": []swarm.Service{
+			{ID: "s-node-exporter", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{nodeExporterLabel: "true"}}},
+				Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: nodeExporterPort}}}},
+			{ID: "s-cadvisor", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{cadvisorLabel: "true"}}},
+				Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: cadvisorPort}}}},
+		},
+		"/v1.35/tasks": []swarm.Task{{ID: "tn", ServiceID: "s-node-exporter", NodeID: "n1", Status: running, NetworksAttachments: attachments}},
+	})
+
+	round, err := collectMetricsRound()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if round.nodes["n1"] == nil || round.nodes["n1"].Memory.Total != 1000 {
+		t.Fatalf("expected the node-exporter metrics of n1, got %+v", round.nodes)
+	}
+	// The container without task is not kept.
+	if len(round.containers) != 3 {
+		t.Fatalf("expected the 3 task containers, got %+v", round.containers)
+	}
+}
+
+// TestMetricsCollector_RunPrometheus verifies that the collector stores the
+// rounds it reads from Prometheus until it is stopped.
+func TestMetricsCollector_RunPrometheus(t *testing.T) {
+	stubPrometheus(t, map[string][]prometheusSeries{
+		"node_": prometheusNodeSeries[:4],
+		"container_": {series("100", "__name__", "container_memory_usage_bytes", "id", "/docker/c1",
+			"container_label_com_docker_swarm_task_id", "t1", "container_label_com_docker_swarm_service_name", "web")},
+	})
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": []swarm.Node{{ID: "n1", Description: swarm.NodeDescription{Hostname: "worker-1"}}},
+	})
+
+	collector := newMetricsCollector(time.Hour, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		collector.run(ctx)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(collector.history(time.Time{}, 0)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-stopped
+
+	rounds := collector.history(time.Time{}, 0)
+	if len(rounds) != 1 {
+		t.Fatalf("expected one round, got %d", len(rounds))
+	}
+	if rounds[0].nodes["n1"] == nil || rounds[0].nodes["n1"].Memory.Total != 1000 || len(rounds[0].containers) != 1 {
+		t.Fatalf("unexpected round %+v", rounds[0])
+	}
+}
+
+// TestCollectMetricsRound_Errors verifies that a round without exporters is
+// empty and that a failing node list fails a Prometheus round.
+func TestCollectMetricsRound_Errors(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	stubDocker(t, map[string]interface{}{"/v1.35/services": []swarm.Service{}})
+	round, err := collectMetricsRound()
+	if err != nil || len(round.nodes) != 0 || len(round.containers) != 0 {
+		t.Fatalf("expected an empty round, got %+v/%v", round, err)
+	}
+
+	stubPrometheus(t, nil)
+	if _, err := collectMetricsRound(); err == nil || !strings.Contains(err.Error(), "listing nodes failed") {
+		t.Fatalf("expected the node list to fail, got %v", err)
+	}
+}
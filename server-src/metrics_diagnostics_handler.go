@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricsDiagnosticsResponse explains how the dashboard reaches the metrics
+// exporters, node by node.
+type metricsDiagnosticsResponse struct {
+	Backend           string                `json:"backend"`
+	DashboardNetworks []string              `json:"dashboardNetworks"`
+	Prometheus        *metricsProbeResult   `json:"prometheus,omitempty"`
+	Exporters         []exporterDiagnostics `json:"exporters"`
+	Error             *string               `json:"error,omitempty"`
+}
+
+// exporterDiagnostics is the discovery of one exporter service.
+type exporterDiagnostics struct {
+	Name        string                    `json:"name"`
+	Discovery   string                    `json:"discovery"` // label, static or dns
+	Label       string                    `json:"label"`
+	ServiceID   string                    `json:"serviceId,omitempty"`
+	ServiceName string                    `json:"serviceName,omitempty"`
+	Global      bool                      `json:"global"`
+	Message     *string                   `json:"message,omitempty"`
+	Nodes       []exporterNodeDiagnostics `json:"nodes"`
+}
+
+// exporterNodeDiagnostics is how the exporter task of a node is reached.
+type exporterNodeDiagnostics struct {
+	NodeID    string                       `json:"nodeId"`
+	Hostname  string                       `json:"hostname"`
+	TaskID    string                       `json:"taskId,omitempty"`
+	TaskState string                       `json:"taskState,omitempty"`
+	Addresses []exporterAddressDiagnostics `json:"addresses"`
+	URL       string                       `json:"url,omitempty"`
+	Probe     *metricsProbeResult          `json:"probe,omitempty"`
+	Error     *string                      `json:"error,omitempty"`
+}
+
+// exporterAddressDiagnostics is a candidate address of an exporter task.
+type exporterAddressDiagnostics struct {
+	NetworkID   string `json:"networkId"`
+	NetworkName string `json:"networkName"`
+	Address     string `json:"address"`
+	Shared      bool   `json:"shared"` // The dashboard is attached to the network too
+}
+
+// metricsProbeResult is the outcome of fetching metrics once.
+type metricsProbeResult struct {
+	URL       string  `json:"url,omitempty"`
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latencyMs"`
+	Families  int     `json:"families,omitempty"` // Number of metric families decoded
+	Error     *string `json:"error,omitempty"`
+}
+
+// probeMetrics fetches metrics once, bypassing the scrape cache.
+func probeMetrics(endpoint exporterEndpoint, fetch func(exporterEndpoint) (map[string]*dto.MetricFamily, error)) *metricsProbeResult {
+	start := time.Now()
+	families, err := fetch(endpoint)
+	result := &metricsProbeResult{URL: endpoint.url, LatencyMs: float64(time.Since(start).Microseconds()) / 1000, Families: len(families)}
+	if err != nil {
+		errMsg := err.Error()
+		result.Error = &errMsg
+		return result
+	}
+	result.OK = true
+	return result
+}
+
+// probePrometheus runs the `up` query against the configured Prometheus.
+func probePrometheus() *metricsProbeResult {
+	start := time.Now()
+	_, err := queryPrometheus("up")
+	result := &metricsProbeResult{URL: prometheusURL(), LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		errMsg := err.Error()
+		result.Error = &errMsg
+		return result
+	}
+	result.OK = true
+	return result
+}
+
+// diagnoseExporter reports, for every node, the task of an exporter service,
+// its candidate addresses, the URL the dashboard resolves and the outcome of
+// a probe of that URL.
+func diagnoseExporter(cli *client.Client, name, label string, service *swarm.Service, nodes []swarm.Node, dashboardNets map[string]bool,
+	resolve func(*client.Client, *swarm.Service, string) (exporterEndpoint, error), fetch func(exporterEndpoint) (map[string]*dto.MetricFamily, error)) exporterDiagnostics {
+	diagnostics := exporterDiagnostics{Name: name, Discovery: exporterDiscoveryLabel, Label: label, Nodes: []exporterNodeDiagnostics{}}
+	if service == nil {
+		msg := fmt.Sprintf("No service with label '%s' found.", label)
+		diagnostics.Message = &msg
+		return diagnostics
+	}
+	diagnostics.ServiceID = service.ID
+	diagnostics.ServiceName = service.Spec.Name
+	diagnostics.Global = service.Spec.Mode.Global != nil
+	if !diagnostics.Global {
+		msg := "The service is not global, so some nodes may run no exporter task."
+		diagnostics.Message = &msg
+	}
+
+	f := filters.NewArgs()
+	f.Add("service", service.ID)
+	tasks, err := cli.TaskList(context.Background(), swarm.TaskListOptions{Filters: f})
+	if err != nil {
+		msg := "Error listing tasks: " + err.Error()
+		diagnostics.Message = &msg
+		return diagnostics
+	}
+	// Prefer the running task of every node, then its latest one.
+	tasksByNode := make(map[string]swarm.Task)
+	for _, task := range tasks {
+		current, seen := tasksByNode[task.NodeID]
+		switch {
+		case !seen:
+		case current.Status.State == swarm.TaskStateRunning:
+			continue
+		case task.Status.State != swarm.TaskStateRunning && !task.UpdatedAt.After(current.UpdatedAt):
+			continue
+		}
+		tasksByNode[task.NodeID] = task
+	}
+
+	diagnostics.Nodes = make([]exporterNodeDiagnostics, len(nodes))
+	var mu sync.Mutex
+	fanOut := newMetricsFanOut()
+	for i, node := range nodes {
+		entry := exporterNodeDiagnostics{NodeID: node.ID, Hostname: node.Description.Hostname, Addresses: []exporterAddressDiagnostics{}}
+		task, found := tasksByNode[node.ID]
+		if !found {
+			errMsg := fmt.Sprintf("No %s task on this node", name)
+			entry.Error = &errMsg
+			diagnostics.Nodes[i] = entry
+			continue
+		}
+		entry.TaskID = task.ID
+		entry.TaskState = string(task.Status.State)
+		for _, attachment := range task.NetworksAttachments {
+			for _, address := range attachment.Addresses {
+				entry.Addresses = append(entry.Addresses, exporterAddressDiagnostics{
+					NetworkID:   attachment.Network.ID,
+					NetworkName: attachment.Network.Spec.Name,
+					Address:     strings.SplitN(address, "/", 2)[0],
+					Shared:      dashboardNets[attachment.Network.ID],
+				})
+			}
+		}
+		if task.Status.State != swarm.TaskStateRunning {
+			errMsg := fmt.Sprintf("The %s task is %s", name, task.Status.State)
+			entry.Error = &errMsg
+			diagnostics.Nodes[i] = entry
+			continue
+		}
+
+		index := i
+		nodeID := node.ID
+		fanOut.Go(func() {
+			endpoint, err := resolve(cli, service, nodeID)
+			if err != nil {
+				errMsg := "Error resolving the endpoint: " + err.Error()
+				entry.Error = &errMsg
+			} else {
+				entry.URL = endpoint.url
+				entry.Probe = probeMetrics(endpoint, fetch)
+			}
+			mu.Lock()
+			diagnostics.Nodes[index] = entry
+			mu.Unlock()
+		})
+	}
+	fanOut.Wait()
+	return diagnostics
+}
+
+// diagnoseExporterTargets reports, for every node, the URL found by static or
+// DNS discovery and the outcome of a probe of that URL.
+func diagnoseExporterTargets(cli *client.Client, discovery exporterDiscovery, nodes []swarm.Node,
+	fetch func(exporterEndpoint) (map[string]*dto.MetricFamily, error)) exporterDiagnostics {
+	diagnostics := exporterDiagnostics{Name: discovery.name, Discovery: discovery.mode(), Nodes: []exporterNodeDiagnostics{}}
+	targets, err := discovery.targets(cli)
+	if err != nil {
+		msg := "Error discovering the targets: " + err.Error()
+		diagnostics.Message = &msg
+		return diagnostics
+	}
+
+	diagnostics.Nodes = make([]exporterNodeDiagnostics, len(nodes))
+	fanOut := newMetricsFanOut()
+	for i, node := range nodes {
+		entry := exporterNodeDiagnostics{NodeID: node.ID, Hostname: node.Description.Hostname, Addresses: []exporterAddressDiagnostics{}}
+		url, found := targets[node.ID]
+		if !found {
+			errMsg := fmt.Sprintf("No %s target for this node", discovery.name)
+			entry.Error = &errMsg
+			diagnostics.Nodes[i] = entry
+			continue
+		}
+		entry.URL = url
+		index := i
+		fanOut.Go(func() {
+			entry.Probe = probeMetrics(exporterEndpoint{url: url, config: discovery.scrape(nil)}, fetch)
+			diagnostics.Nodes[index] = entry
+		})
+	}
+	fanOut.Wait()
+	return diagnostics
+}
+
+// metricsDiagnosticsHandler reports how the node-exporter and cAdvisor
+// services are discovered and reached on every node. It bypasses the caches so
+// the report reflects the current state.
+func metricsDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response := metricsDiagnosticsResponse{Backend: metricsBackend(), DashboardNetworks: []string{}, Exporters: []exporterDiagnostics{}}
+	encode := func() {
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("metricsDiagnosticsHandler: encoding response failed: %v", err)
+		}
+	}
+
+	if response.Backend == metricsBackendPrometheus {
+		response.Prometheus = probePrometheus()
+	}
+
+	cli, err := getCli()
+	if err != nil {
+		errMsg := "Error getting Docker client: " + err.Error()
+		response.Error = &errMsg
+		encode()
+		return
+	}
+	nodes, err := cli.NodeList(context.Background(), swarm.NodeListOptions{})
+	if err != nil {
+		errMsg := "Error listing nodes: " + err.Error()
+		response.Error = &errMsg
+		encode()
+		return
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Description.Hostname < nodes[j].Description.Hostname })
+
+	dashboardNets := getDashboardNetworks(cli)
+	for network := range dashboardNets {
+		response.DashboardNetworks = append(response.DashboardNetworks, network)
+	}
+	sort.Strings(response.DashboardNetworks)
+
+	exporters := []struct {
+		name, label string
+		discovery   exporterDiscovery
+		find        func(*client.Client) (*swarm.Service, error)
+		resolve     func(*client.Client, *swarm.Service, string) (exporterEndpoint, error)
+		fetch       func(exporterEndpoint) (map[string]*dto.MetricFamily, error)
+	}{
+		{"node-exporter", nodeExporterLabel, nodeExporterDiscovery, findNodeExporterService, getNodeExporterEndpoint, fetchMetricsFromNodeExporter},
+		{"cadvisor", cadvisorLabel, cadvisorDiscovery, findCAdvisorService, getCAdvisorEndpoint, fetchMetricsFromCAdvisor},
+	}
+	for _, exporter := range exporters {
+		if exporter.discovery.mode() != exporterDiscoveryLabel {
+			response.Exporters = append(response.Exporters, diagnoseExporterTargets(cli, exporter.discovery, nodes, exporter.fetch))
+			continue
+		}
+		service, err := exporter.find(cli)
+		if err != nil {
+			msg := "Error finding the service: " + err.Error()
+			response.Exporters = append(response.Exporters, exporterDiagnostics{Name: exporter.name, Discovery: exporterDiscoveryLabel, Label: exporter.label, Message: &msg, Nodes: []exporterNodeDiagnostics{}})
+			continue
+		}
+		response.Exporters = append(response.Exporters, diagnoseExporter(cli, exporter.name, exporter.label, service, nodes, dashboardNets, exporter.resolve, exporter.fetch))
+	}
+	encode()
+}
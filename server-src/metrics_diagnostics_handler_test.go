@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// TestMetricsDiagnosticsHandler verifies the per-node report of a reachable
+// exporter, an unreachable one, a node without exporter and a missing
+// cAdvisor service.
+func TestMetricsDiagnosticsHandler(t *testing.T) {
+	mockExporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("node_load1 1\n"))
+	}))
+	defer mockExporter.Close()
+	u, _ := url.Parse(mockExporter.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	oldOsHostname := osHostname
+	osHostname = func() (string, error) { return "dashboard", nil }
+	defer func() { osHostname = oldOsHostname }()
+
+	overlay := swarm.Network{ID: "net-overlay", Spec: swarm.NetworkSpec{Annotations: swarm.Annotations{Name: "monitoring"}}}
+	ingress := swarm.Network{ID: "net-ingress", Spec: swarm.NetworkSpec{Annotations: swarm.Annotations{Name: "ingress"}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1.35/nodes":
+			_ = json.NewEncoder(w).Encode([]swarm.Node{
+				{ID: "n3", Description: swarm.NodeDescription{Hostname: "gamma"}},
+				{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}},
+				{ID: "n2", Description: swarm.NodeDescription{Hostname: "beta"}},
+			})
+		case r.URL.Path == "/v1.35/services":
+			_ = json.NewEncoder(w).Encode([]swarm.Service{{
+				ID: "s-exporter",
+				Spec: swarm.ServiceSpec{
+					Annotations: swarm.Annotations{Name: "node-exporter", Labels: map[string]string{nodeExporterLabel: "true"}},
+					Mode:        swarm.ServiceMode{Global: &swarm.GlobalService{}},
+				},
+				Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}},
+			}})
+		case r.URL.Path == "/v1.35/tasks":
+			tasks := []swarm.Task{
+				{ID: "t1", NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+					NetworksAttachments: []swarm.NetworkAttachment{
+						{Network: ingress, Addresses: []string{"10.0.0.5/24"}},
+						{Network: overlay, Addresses: []string{host + "/24"}},
+					}},
+				// Nothing listens on this address, so the probe fails.
+				{ID: "t2", NodeID: "n2", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+					NetworksAttachments: []swarm.NetworkAttachment{{Network: overlay, Addresses: []string{"127.0.0.2/24"}}}},
+			}
+			if f, err := filters.FromJSON(r.URL.Query().Get("filters")); err == nil && f.Contains("node") {
+				for _, task := range tasks {
+					if f.ExactMatch("node", task.NodeID) {
+						tasks = []swarm.Task{task}
+						break
+					}
+				}
+			}
+			_ = json.NewEncoder(w).Encode(tasks)
+		case strings.HasSuffix(r.URL.Path, "/containers/dashboard/json"):
+			_ = json.NewEncoder(w).Encode(container.InspectResponse{NetworkSettings: &container.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{"monitoring": {NetworkID: "net-overlay"}},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer ResetCli()
+	SetCli(makeClientForServer(t, server.URL))
+
+	rr := httptest.NewRecorder()
+	metricsDiagnosticsHandler(rr, httptest.NewRequest("GET", "/ui/metrics/diagnostics", nil))
+
+	var response metricsDiagnosticsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if response.Backend != metricsBackendExporters || response.Prometheus != nil || len(response.DashboardNetworks) != 1 || response.DashboardNetworks[0] != "net-overlay" {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if len(response.Exporters) != 2 {
+		t.Fatalf("expected both exporters, got %s", rr.Body.String())
+	}
+
+	exporter := response.Exporters[0]
+	if exporter.ServiceID != "s-exporter" || !exporter.Global || exporter.Message != nil || len(exporter.Nodes) != 3 {
+		t.Fatalf("unexpected node-exporter report %+v", exporter)
+	}
+	alpha, beta, gamma := exporter.Nodes[0], exporter.Nodes[1], exporter.Nodes[2]
+	if alpha.TaskID != "t1" || len(alpha.Addresses) != 2 || alpha.Addresses[0].Shared || !alpha.Addresses[1].Shared || alpha.Addresses[1].NetworkName != "monitoring" {
+		t.Errorf("unexpected addresses %+v", alpha)
+	}
+	if alpha.URL != "http://"+host+":"+portStr+"/metrics" || alpha.Probe == nil || !alpha.Probe.OK || alpha.Probe.Families == 0 || alpha.Error != nil {
+		t.Errorf("expected alpha to be reached on the shared network, got %+v", alpha)
+	}
+	if beta.Probe == nil || beta.Probe.OK || beta.Probe.Error == nil || !strings.Contains(beta.URL, "127.0.0.2") {
+		t.Errorf("expected the failed probe of beta, got %+v", beta)
+	}
+	if gamma.TaskID != "" || gamma.Error == nil || gamma.Probe != nil {
+		t.Errorf("expected gamma to report its missing task, got %+v", gamma)
+	}
+
+	if cadvisor := response.Exporters[1]; cadvisor.Name != "cadvisor" || cadvisor.Message == nil || len(cadvisor.Nodes) != 0 {
+		t.Errorf("expected the missing cAdvisor service to be reported, got %+v", cadvisor)
+	}
+}
+
+// TestMetricsDiagnosticsHandler_Prometheus verifies that the Prometheus
+// backend is probed.
+func TestMetricsDiagnosticsHandler_Prometheus(t *testing.T) {
+	srv, _ := stubPrometheus(t, map[string][]prometheusSeries{"up": {series("1", "__name__", "up")}})
+	stubDocker(t, map[string]interface{}{"/v1.35/nodes": []swarm.Node{}, "/v1.35/services": []swarm.Service{}})
+
+	rr := httptest.NewRecorder()
+	metricsDiagnosticsHandler(rr, httptest.NewRequest("GET", "/ui/metrics/diagnostics", nil))
+
+	var response metricsDiagnosticsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if response.Backend != metricsBackendPrometheus || response.Prometheus == nil || !response.Prometheus.OK || response.Prometheus.URL != srv.URL {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+}
+
+// TestMetricsDiagnosticsHandler_Targets verifies the report of static and DNS
+// discovery: a reachable target, a failing one, a node without target and a
+// DNS name that does not resolve.
+func TestMetricsDiagnosticsHandler_Targets(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("node_load1 1\nnode_load5 2\n"))
+	}))
+	defer reachable.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	setDiscoveryEnv(t, "DSD_NODE_EXPORTER_DISCOVERY", "static")
+	t.Setenv("DSD_NODE_EXPORTER_TARGETS", "alpha="+reachable.URL+"/metrics,beta="+failing.URL+"/metrics")
+	setDiscoveryEnv(t, "DSD_CADVISOR_DISCOVERY", "dns")
+	t.Setenv("DSD_CADVISOR_DNS_NAME", "monitoring_cadvisor")
+	original := lookupHost
+	defer func() { lookupHost = original }()
+	lookupHost = func(host string) ([]string, error) { return nil, &net.DNSError{Err: "no such host", Name: host} }
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": append([]swarm.Node{{ID: "n3", Description: swarm.NodeDescription{Hostname: "gamma"}}}, discoveryNodes...),
+		"/v1.35/tasks": []swarm.Task{},
+	})
+
+	rr := httptest.NewRecorder()
+	metricsDiagnosticsHandler(rr, httptest.NewRequest("GET", "/ui/metrics/diagnostics", nil))
+
+	var response metricsDiagnosticsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(response.Exporters) != 2 {
+		t.Fatalf("expected two exporters, got %s", rr.Body.String())
+	}
+	nodeExporter := response.Exporters[0]
+	if nodeExporter.Name != "node-exporter" || nodeExporter.Discovery != exporterDiscoveryStatic || len(nodeExporter.Nodes) != 3 {
+		t.Fatalf("unexpected node-exporter report %+v", nodeExporter)
+	}
+	alpha, beta, gamma := nodeExporter.Nodes[0], nodeExporter.Nodes[1], nodeExporter.Nodes[2]
+	if alpha.NodeID != "n1" || alpha.URL != reachable.URL+"/metrics" || alpha.Probe == nil || !alpha.Probe.OK || alpha.Probe.Families != 2 {
+		t.Errorf("expected alpha to be reachable, got %+v", alpha)
+	}
+	if beta.NodeID != "n2" || beta.Probe == nil || beta.Probe.OK || beta.Probe.Error == nil {
+		t.Errorf("expected the probe of beta to fail, got %+v", beta)
+	}
+	if gamma.NodeID != "n3" || gamma.URL != "" || gamma.Probe != nil || gamma.Error == nil || !strings.Contains(*gamma.Error, "No node-exporter target") {
+		t.Errorf("expected gamma to have no target, got %+v", gamma)
+	}
+
+	cadvisor := response.Exporters[1]
+	if cadvisor.Discovery != exporterDiscoveryDNS || cadvisor.Message == nil || !strings.Contains(*cadvisor.Message, "no such host") || len(cadvisor.Nodes) != 0 {
+		t.Errorf("expected the DNS discovery to fail, got %+v", cadvisor)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricsAcceptHeader asks the exporters, like a Prometheus scrape does, for
+// delimited protobuf first, then OpenMetrics, then the text format. UTF-8
+// metric and label names are accepted unescaped.
+const metricsAcceptHeader = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;escaping=allow-utf-8;q=0.5," +
+	"application/openmetrics-text;version=1.0.0;escaping=allow-utf-8;q=0.4," +
+	"text/plain;version=1.0.0;escaping=allow-utf-8;q=0.3," +
+	"text/plain;version=0.0.4;q=0.2," +
+	"*/*;q=0.1"
+
+// fetchMetricFamilies scrapes an exporter with its configuration and decodes
+// its response according to the format it answered with. `exporter` names it
+// in the errors.
+func fetchMetricFamilies(url, exporter string, config exporterScrapeConfig) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", metricsAcceptHeader)
+	if err := config.authorize(req); err != nil {
+		return nil, fmt.Errorf("%s credentials: %w", exporter, err)
+	}
+	client, err := config.httpClient()
+	if err != nil {
+		return nil, fmt.Errorf("%s TLS configuration: %w", exporter, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", exporter, resp.StatusCode)
+	}
+
+	fetched := time.Now()
+	families, err := decodeMetricFamilies(resp.Body, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s metrics: %w", exporter, err)
+	}
+	stampSampleTimes(families, fetched)
+	return families, nil
+}
+
+// stampSampleTimes gives the samples without a timestamp the time they were
+// fetched at, as Prometheus does when it scrapes them. A cached scrape thus
+// keeps the time its counters were sampled at.
+func stampSampleTimes(families map[string]*dto.MetricFamily, fetched time.Time) {
+	ms := fetched.UnixMilli()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.TimestampMs == nil {
+				metric.TimestampMs = proto.Int64(ms)
+			}
+		}
+	}
+}
+
+// sampleTime is the Unix time a sample was taken at, 0 when it has no
+// timestamp.
+func sampleTime(metric *dto.Metric) float64 {
+	if metric.TimestampMs == nil {
+		return 0
+	}
+	return float64(metric.GetTimestampMs()) / 1000
+}
+
+// latestSampleTime is the Unix time of the latest sample of the families, 0
+// when none has a timestamp.
+func latestSampleTime(families map[string]*dto.MetricFamily) float64 {
+	var latest float64
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if at := sampleTime(metric); at > latest {
+				latest = at
+			}
+		}
+	}
+	return latest
+}
+
+// decodeMetricFamilies decodes metrics in the exposition format described by
+// `contentType`. Unknown content types are read as the text format.
+func decodeMetricFamilies(r io.Reader, contentType string) (map[string]*dto.MetricFamily, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	switch {
+	case mediaType == expfmt.ProtoType && params["encoding"] == "delimited":
+		return decodeProtobufMetrics(r)
+	case mediaType == expfmt.OpenMetricsType:
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return decodeTextMetrics(bytes.NewReader(openMetricsToText(body)))
+	default:
+		return decodeTextMetrics(r)
+	}
+}
+
+// decodeProtobufMetrics decodes a stream of length-delimited MetricFamily
+// messages.
+func decodeProtobufMetrics(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim).WithEscapingScheme(model.NoEscaping)
+	decoder := expfmt.NewDecoder(r, format)
+	families := make(map[string]*dto.MetricFamily)
+	for {
+		family := &dto.MetricFamily{}
+		if err := decoder.Decode(family); err != nil {
+			if errors.Is(err, io.EOF) {
+				return families, nil
+			}
+			return nil, err
+		}
+		// Families are not repeated by well-behaved exporters; merge if they are.
+		if existing, ok := families[family.GetName()]; ok {
+			existing.Metric = append(existing.Metric, family.GetMetric()...)
+			continue
+		}
+		families[family.GetName()] = family
+	}
+}
+
+// decodeTextMetrics parses the text format, accepting quoted UTF-8 metric
+// and label names. A missing newline at the end of the input is tolerated.
+func decodeTextMetrics(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	return parser.TextToMetricFamilies(io.MultiReader(r, strings.NewReader("\n")))
+}
+
+// openMetricsToText rewrites OpenMetrics 1.0 into the text format: the EOF
+// and UNIT lines, the _created samples and the exemplars are dropped, the
+// counters are named after their _total samples, the types unknown to the
+// text format are mapped to the nearest one, and the timestamps are turned
+// from seconds into milliseconds.
+func openMetricsToText(body []byte) []byte {
+	// The type of every family, to name counters and drop _created samples.
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+		}
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(body))
+	scanner = bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			if rewritten, ok := openMetricsDescriptor(line, types); ok {
+				out.WriteString(rewritten)
+				out.WriteByte('\n')
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		name, rest := splitSampleName(line)
+		if family, ok := strings.CutSuffix(name, "_created"); ok {
+			switch types[family] {
+			case "counter", "histogram", "summary":
+				continue
+			}
+		}
+		out.WriteString(name)
+		out.WriteString(openMetricsSampleTail(rest))
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// openMetricsDescriptor rewrites a HELP or TYPE line, reporting false for
+// the lines the text format has no equivalent of.
+func openMetricsDescriptor(line string, types map[string]string) (string, bool) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+		// # EOF, # UNIT and comments
+		return "", false
+	}
+	name := fields[2]
+	switch types[name] {
+	case "counter":
+		name += "_total"
+	case "info":
+		name += "_info"
+	case "gaugehistogram":
+		// Its _bucket, _gcount and _gsum samples are kept untyped.
+		return "", false
+	}
+	if fields[1] == "HELP" {
+		help := ""
+		if len(fields) == 4 {
+			help = fields[3]
+		}
+		return "# HELP " + name + " " + help, true
+	}
+	metricType := types[fields[2]]
+	switch metricType {
+	case "counter", "gauge", "histogram", "summary":
+	case "info", "stateset":
+		metricType = "gauge"
+	default:
+		metricType = "untyped"
+	}
+	return "# TYPE " + name + " " + metricType, true
+}
+
+// splitSampleName splits a sample line after its metric name.
+func splitSampleName(line string) (name, rest string) {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return line, ""
+	}
+	return line[:end], line[end:]
+}
+
+// openMetricsSampleTail rewrites the labels, value and timestamp of a sample,
+// dropping its exemplar.
+func openMetricsSampleTail(rest string) string {
+	labels := ""
+	if strings.HasPrefix(rest, "{") {
+		end := labelSetEnd(rest)
+		labels, rest = rest[:end], rest[end:]
+	}
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 2 {
+		if seconds, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			fields[1] = strconv.FormatInt(int64(seconds*1000), 10)
+		}
+	}
+	return labels + " " + strings.Join(fields, " ")
+}
+
+// labelSetEnd returns the index after the closing brace of the label set at
+// the start of `s`, skipping the braces inside quoted values.
+func labelSetEnd(s string) int {
+	quoted, escaped := false, false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '}' && !quoted:
+			return i + 1
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestFetchMetricFamilies_Protobuf verifies that delimited protobuf is
+// requested and decoded, UTF-8 metric names included.
+func TestFetchMetricFamilies_Protobuf(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != metricsAcceptHeader {
+			t.Errorf("unexpected Accept header %q", r.Header.Get("Accept"))
+		}
+		format := expfmt.NewFormat(expfmt.TypeProtoDelim).WithEscapingScheme(model.NoEscaping)
+		w.Header().Set("Content-Type", string(format))
+		encoder := expfmt.NewEncoder(w, format)
+		for _, family := range []*dto.MetricFamily{
+			{Name: proto.String("node_load1"), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(0.5)}}}},
+			{Name: proto.String("node.boot.time"), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1700000000)}}}},
+		} {
+			if err := encoder.Encode(family); err != nil {
+				t.Errorf("encode: %v", err)
+			}
+		}
+	}))
+	defer exporter.Close()
+
+	families, err := fetchMetricFamilies(exporter.URL, "node-exporter", exporterScrapeConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(families) != 2 || getMetricValue(families["node_load1"].GetMetric()[0]) != 0.5 || families["node.boot.time"] == nil {
+		t.Fatalf("unexpected families %v", families)
+	}
+	if parsed := parseNodeMetricFamilies(families); parsed.System.Load1 != 0.5 {
+		t.Errorf("expected the decoded families to be parsed, got load %v", parsed.System.Load1)
+	}
+}
+
+// TestDecodeMetricFamilies_OpenMetrics verifies the rewriting of OpenMetrics
+// into the text format.
+func TestDecodeMetricFamilies_OpenMetrics(t *testing.T) {
+	body := `# HELP container_cpu_usage_seconds Cumulative cpu time consumed.
+# TYPE container_cpu_usage_seconds counter
+# UNIT container_cpu_usage_seconds seconds
+container_cpu_usage_seconds_total{id="/docker/a",name="x{y}"} 12.5 1700000000.123 # {trace_id="abc"} 1.0
+container_cpu_usage_seconds_created{id="/docker/a",name="x{y}"} 1600000000
+# TYPE build info
+build_info{version="1.0"} 1
+# TYPE container_last_seen unknown
+container_last_seen{id="/docker/a"} 1700000000
+# EOF
+`
+	families, err := decodeMetricFamilies(strings.NewReader(body), "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cpu, ok := families["container_cpu_usage_seconds_total"]
+	if !ok || cpu.GetType() != dto.MetricType_COUNTER || len(cpu.GetMetric()) != 1 {
+		t.Fatalf("expected the counter named after its samples, got %v", families)
+	}
+	if sample := cpu.GetMetric()[0]; getMetricValue(sample) != 12.5 || sample.GetTimestampMs() != 1700000000123 || metricLabel(sample, "name") != "x{y}" {
+		t.Errorf("unexpected counter sample %v", sample)
+	}
+	if _, ok := families["container_cpu_usage_seconds_created"]; ok {
+		t.Error("expected the _created samples to be dropped")
+	}
+	if info, ok := families["build_info"]; !ok || info.GetType() != dto.MetricType_GAUGE {
+		t.Errorf("expected the info family as a gauge, got %v", info)
+	}
+	if seen, ok := families["container_last_seen"]; !ok || seen.GetType() != dto.MetricType_UNTYPED {
+		t.Errorf("expected the unknown family untyped, got %v", seen)
+	}
+}
+
+// TestDecodeMetricFamilies_UTF8Text verifies that quoted UTF-8 names parse in
+// the text format, and that unknown content types are read as text.
+func TestDecodeMetricFamilies_UTF8Text(t *testing.T) {
+	body := "{\"node.load\",\"host.name\"=\"a\"} 1\nnode_load1 2"
+	families, err := decodeMetricFamilies(strings.NewReader(body), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	load, ok := families["node.load"]
+	if !ok || metricLabel(load.GetMetric()[0], "host.name") != "a" || families["node_load1"] == nil {
+		t.Fatalf("unexpected families %v", families)
+	}
+}
+
+// TestFetchMetricFamilies_InvalidBody verifies that an undecodable response
+// is reported.
+func TestFetchMetricFamilies_InvalidBody(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+		_, _ = w.Write([]byte{0x05, 0xff})
+	}))
+	defer exporter.Close()
+
+	if _, err := fetchMetricFamilies(exporter.URL, "cadvisor", exporterScrapeConfig{}); err == nil || !strings.Contains(err.Error(), "cadvisor") {
+		t.Fatalf("expected a decoding error naming the exporter, got %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// minRateInterval is the shortest interval rates are derived over. A sample
+// taken sooner after the previous one reuses the rates already computed, so
+// two clients polling together do not produce jittery rates.
+const minRateInterval = time.Second
+
+// rateSampleTTL is how long the previous sample of a node or container is kept
+// without being refreshed.
+const rateSampleTTL = 10 * time.Minute
+
+// NodeRates holds the rates derived from the counters of two node-exporter
+// samples.
+type NodeRates struct {
+	IntervalSeconds          float64       `json:"intervalSeconds"`
+	CPUBusyPercent           float64       `json:"cpuBusyPercent"`
+	CPUCores                 []CPUCoreRate `json:"cpuCores"`
+	Network                  []NetworkRate `json:"network"`
+	DiskIO                   []DiskIORate  `json:"diskIO"`
+	ContextSwitchesPerSecond float64       `json:"contextSwitchesPerSecond"`
+	InterruptsPerSecond      float64       `json:"interruptsPerSecond"`
+	Pressure                 *PressureRate `json:"pressure,omitempty"` // Set when the kernel exposes PSI
+}
+
+// PressureRate represents the share of time tasks stalled on a resource
+type PressureRate struct {
+	CPUWaitingPercent    float64 `json:"cpuWaitingPercent"`
+	MemoryWaitingPercent float64 `json:"memoryWaitingPercent"`
+	MemoryStalledPercent float64 `json:"memoryStalledPercent"`
+	IOWaitingPercent     float64 `json:"ioWaitingPercent"`
+	IOStalledPercent     float64 `json:"ioStalledPercent"`
+}
+
+// CPUCoreRate represents the utilization of a single core
+type CPUCoreRate struct {
+	CPU         string  `json:"cpu"`
+	BusyPercent float64 `json:"busyPercent"`
+}
+
+// NetworkRate represents the throughput of a network interface
+type NetworkRate struct {
+	Interface                string  `json:"interface"`
+	ReceiveBytesPerSecond    float64 `json:"receiveBytesPerSecond"`
+	TransmitBytesPerSecond   float64 `json:"transmitBytesPerSecond"`
+	ReceivePacketsPerSecond  float64 `json:"receivePacketsPerSecond"`
+	TransmitPacketsPerSecond float64 `json:"transmitPacketsPerSecond"`
+}
+
+// DiskIORate represents the throughput and IOPS of a disk
+type DiskIORate struct {
+	Device                string  `json:"device"`
+	ReadBytesPerSecond    float64 `json:"readBytesPerSecond"`
+	WrittenBytesPerSecond float64 `json:"writtenBytesPerSecond"`
+	ReadIOPS              float64 `json:"readIops"`
+	WriteIOPS             float64 `json:"writeIops"`
+	BusyPercent           float64 `json:"busyPercent"` // Share of time the disk was doing I/O
+}
+
+// cpuTimes sums CPU time counters, telling apart the time spent working.
+type cpuTimes struct {
+	busy  float64
+	total float64
+}
+
+// add accounts for the seconds spent in a node-exporter CPU mode. Idle and
+// I/O wait count as not busy.
+func (c cpuTimes) add(mode string, seconds float64) cpuTimes {
+	c.total += seconds
+	if mode != "idle" && mode != "iowait" {
+		c.busy += seconds
+	}
+	return c
+}
+
+// counterSample is the last sample of the counters of a node or container.
+type counterSample struct {
+	at       float64 // Unix timestamp of the counters
+	seen     time.Time
+	counters map[string]float64
+	rates    map[string]float64
+	interval float64
+}
+
+// counterSampler keeps the previous sample of every node or container to turn
+// counters into per-second rates.
+type counterSampler struct {
+	mu      sync.Mutex
+	samples map[string]*counterSample
+}
+
+func newCounterSampler() *counterSampler {
+	return &counterSampler{samples: make(map[string]*counterSample)}
+}
+
+var (
+	nodeRateSamples      = newCounterSampler()
+	containerRateSamples = newCounterSampler()
+)
+
+// rates records the counters of `key` sampled at the Unix time `at` and
+// returns their rates per second since the previous sample, with the interval
+// they cover. It returns nil on the first sample and for counters without a
+// sample time, whose rates stay pending. A counter that went backwards, as
+// after a restart, gets no rate.
+func (s *counterSampler) rates(key string, at float64, counters map[string]float64) (map[string]float64, float64) {
+	if at <= 0 {
+		return nil, 0
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, sample := range s.samples {
+		if now.Sub(sample.seen) > rateSampleTTL {
+			delete(s.samples, k)
+		}
+	}
+
+	previous := s.samples[key]
+	if previous != nil && at-previous.at < minRateInterval.Seconds() {
+		return previous.rates, previous.interval
+	}
+	current := &counterSample{at: at, seen: now, counters: counters}
+	s.samples[key] = current
+	if previous == nil {
+		return nil, 0
+	}
+
+	interval := at - previous.at
+	rates := make(map[string]float64, len(counters))
+	for name, value := range counters {
+		if before, ok := previous.counters[name]; ok && value >= before {
+			rates[name] = (value - before) / interval
+		}
+	}
+	current.rates, current.interval = rates, interval
+	return rates, interval
+}
+
+// busyPercent is the share of busy CPU time, from the rates of the busy and
+// the total counters named after `prefix`.
+func busyPercent(rates map[string]float64, prefix string) (float64, bool) {
+	busy, okBusy := rates[prefix+".busy"]
+	total, okTotal := rates[prefix+".total"]
+	if !okBusy || !okTotal || total <= 0 {
+		return 0, false
+	}
+	return busy / total * 100, true
+}
+
+// applyNodeRates derives the rates of a node from the previous sample of the
+// same node and stores them in `metrics`.
+func applyNodeRates(nodeID string, metrics *ParsedMetrics) {
+	if metrics == nil {
+		return
+	}
+	counters := map[string]float64{
+		"system.contextSwitches": metrics.System.ContextSwitches,
+		"system.interrupts":      metrics.System.Interrupts,
+	}
+	var all cpuTimes
+	for _, cpu := range metrics.CPU {
+		all = all.add(cpu.Mode, cpu.Value)
+	}
+	counters["cpu.busy"], counters["cpu.total"] = all.busy, all.total
+	for core, times := range metrics.cpuCores {
+		counters["core."+core+".busy"], counters["core."+core+".total"] = times.busy, times.total
+	}
+	for _, n := range metrics.Network {
+		prefix := "net." + n.Interface + "."
+		counters[prefix+"rx"] = n.ReceiveBytes
+		counters[prefix+"tx"] = n.TransmitBytes
+		counters[prefix+"rxPackets"] = n.ReceivePackets
+		counters[prefix+"txPackets"] = n.TransmitPackets
+	}
+	if metrics.Pressure.Available {
+		counters["pressure.cpuWaiting"] = metrics.Pressure.CPUWaitingSeconds
+		counters["pressure.memoryWaiting"] = metrics.Pressure.MemoryWaitingSeconds
+		counters["pressure.memoryStalled"] = metrics.Pressure.MemoryStalledSeconds
+		counters["pressure.ioWaiting"] = metrics.Pressure.IOWaitingSeconds
+		counters["pressure.ioStalled"] = metrics.Pressure.IOStalledSeconds
+	}
+	for _, d := range metrics.DiskIO {
+		prefix := "disk." + d.Device + "."
+		counters[prefix+"readBytes"] = d.ReadBytes
+		counters[prefix+"writtenBytes"] = d.WrittenBytes
+		counters[prefix+"reads"] = d.ReadsCompleted
+		counters[prefix+"writes"] = d.WritesCompleted
+		counters[prefix+"ioTime"] = d.IOTimeSeconds
+	}
+
+	rates, interval := nodeRateSamples.rates(nodeID, metrics.ServerTime, counters)
+	if rates == nil {
+		metrics.Rates = nil
+		return
+	}
+
+	result := &NodeRates{
+		IntervalSeconds:          interval,
+		CPUCores:                 make([]CPUCoreRate, 0, len(metrics.cpuCores)),
+		Network:                  make([]NetworkRate, 0, len(metrics.Network)),
+		DiskIO:                   make([]DiskIORate, 0, len(metrics.DiskIO)),
+		ContextSwitchesPerSecond: rates["system.contextSwitches"],
+		InterruptsPerSecond:      rates["system.interrupts"],
+	}
+	result.CPUBusyPercent, _ = busyPercent(rates, "cpu")
+	for core := range metrics.cpuCores {
+		if percent, ok := busyPercent(rates, "core."+core); ok {
+			result.CPUCores = append(result.CPUCores, CPUCoreRate{CPU: core, BusyPercent: percent})
+		}
+	}
+	sort.Slice(result.CPUCores, func(i, j int) bool {
+		a, errA := strconv.Atoi(result.CPUCores[i].CPU)
+		b, errB := strconv.Atoi(result.CPUCores[j].CPU)
+		if errA != nil || errB != nil {
+			return result.CPUCores[i].CPU < result.CPUCores[j].CPU
+		}
+		return a < b
+	})
+	for _, n := range metrics.Network {
+		prefix := "net." + n.Interface + "."
+		result.Network = append(result.Network, NetworkRate{
+			Interface:                n.Interface,
+			ReceiveBytesPerSecond:    rates[prefix+"rx"],
+			TransmitBytesPerSecond:   rates[prefix+"tx"],
+			ReceivePacketsPerSecond:  rates[prefix+"rxPackets"],
+			TransmitPacketsPerSecond: rates[prefix+"txPackets"],
+		})
+	}
+	for _, d := range metrics.DiskIO {
+		prefix := "disk." + d.Device + "."
+		result.DiskIO = append(result.DiskIO, DiskIORate{
+			Device:                d.Device,
+			ReadBytesPerSecond:    rates[prefix+"readBytes"],
+			WrittenBytesPerSecond: rates[prefix+"writtenBytes"],
+			ReadIOPS:              rates[prefix+"reads"],
+			WriteIOPS:             rates[prefix+"writes"],
+			BusyPercent:           rates[prefix+"ioTime"] * 100,
+		})
+	}
+	if metrics.Pressure.Available {
+		// Stalled seconds per second is the share of time spent stalled
+		result.Pressure = &PressureRate{
+			CPUWaitingPercent:    rates["pressure.cpuWaiting"] * 100,
+			MemoryWaitingPercent: rates["pressure.memoryWaiting"] * 100,
+			MemoryStalledPercent: rates["pressure.memoryStalled"] * 100,
+			IOWaitingPercent:     rates["pressure.ioWaiting"] * 100,
+			IOStalledPercent:     rates["pressure.ioStalled"] * 100,
+		}
+	}
+	metrics.Rates = result
+}
+
+// applyContainerRates derives the CPU and network rates of the containers
+// from their previous samples. It returns the number of containers without
+// rates yet: their first sample, or one without a sample time.
+func applyContainerRates(containers []ContainerMemoryMetrics) int {
+	pending := 0
+	for i := range containers {
+		container := &containers[i]
+		if container.ContainerID == "" {
+			continue
+		}
+		rates, _ := containerRateSamples.rates(container.ContainerID, container.ServerTime, map[string]float64{
+			"cpu": container.CPUUsage,
+			"rx":  container.NetworkRxBytes,
+			"tx":  container.NetworkTxBytes,
+		})
+		if rates == nil {
+			pending++
+			continue
+		}
+		// CPU seconds per second is the number of cores in use
+		container.CPUUsagePercent = rates["cpu"] * 100
+		if container.CPUPercent > 0 {
+			container.CPUQuotaUsagePercent = container.CPUUsagePercent / container.CPUPercent * 100
+		}
+		container.NetworkRxBytesPerSecond = rates["rx"]
+		container.NetworkTxBytesPerSecond = rates["tx"]
+	}
+	return pending
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// nodeSample builds node-exporter output at the given time with the given
+// per-core idle and user seconds and network and disk counters.
+func nodeSample(t *testing.T, at, idle0, user0, idle1, user1, rx, reads float64) *ParsedMetrics {
+	t.Helper()
+	text := fmt.Sprintf("node_time_seconds %v\n"+
+		"node_cpu_seconds_total{cpu=\"0\",mode=\"idle\"} %v\n"+
+		"node_cpu_seconds_total{cpu=\"0\",mode=\"user\"} %v\n"+
+		"node_cpu_seconds_total{cpu=\"1\",mode=\"idle\"} %v\n"+
+		"node_cpu_seconds_total{cpu=\"1\",mode=\"user\"} %v\n"+
+		"node_network_receive_bytes_total{device=\"eth0\"} %v\n"+
+		"node_disk_reads_completed_total{device=\"sda\"} %v\n",
+		at, idle0, user0, idle1, user1, rx, reads)
+	parsed, err := parsePrometheusMetrics(text)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return parsed
+}
+
+// approx reports whether two rates are equal up to rounding errors.
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+// TestCounterSampler verifies first samples, rates, counter resets, the
+// reuse of rates for samples taken too close together and samples without a
+// time.
+func TestCounterSampler(t *testing.T) {
+	s := newCounterSampler()
+	if rates, _ := s.rates("k", 100, map[string]float64{"a": 10, "b": 50}); rates != nil {
+		t.Fatalf("expected no rates on the first sample, got %v", rates)
+	}
+	rates, interval := s.rates("k", 110, map[string]float64{"a": 30, "b": 5})
+	if interval != 10 || !approx(rates["a"], 2) {
+		t.Fatalf("unexpected rates %v over %v", rates, interval)
+	}
+	if _, ok := rates["b"]; ok {
+		t.Fatalf("expected no rate for a counter that went backwards, got %v", rates)
+	}
+	if again, interval := s.rates("k", 110.5, map[string]float64{"a": 1000}); interval != 10 || !approx(again["a"], 2) {
+		t.Fatalf("expected the previous rates to be reused, got %v over %v", again, interval)
+	}
+	if rates, _ := s.rates("other", 110, map[string]float64{"a": 1}); rates != nil {
+		t.Fatalf("expected samples to be kept per key, got %v", rates)
+	}
+	// Without a sample time the rates stay pending rather than taking the
+	// time of the request.
+	for i := 0; i < 2; i++ {
+		if rates, interval := s.rates("untimed", 0, map[string]float64{"a": float64(i)}); rates != nil || interval != 0 {
+			t.Fatalf("expected no rates without a sample time, got %v over %v", rates, interval)
+		}
+	}
+}
+
+// TestApplyNodeRates verifies the CPU, per-core, network and disk rates of a
+// node.
+func TestApplyNodeRates(t *testing.T) {
+	nodeRateSamples = newCounterSampler()
+	defer func() { nodeRateSamples = newCounterSampler() }()
+
+	first := nodeSample(t, 1000, 100, 100, 100, 100, 1000, 10)
+	applyNodeRates("n1", first)
+	if first.Rates != nil {
+		t.Fatalf("expected no rates on the first sample, got %+v", first.Rates)
+	}
+
+	// Over 10s, core 0 is busy 5s out of 10 and core 1 is busy all along.
+	second := nodeSample(t, 1010, 105, 105, 100, 110, 6000, 60)
+	applyNodeRates("n1", second)
+	rates := second.Rates
+	if rates == nil || rates.IntervalSeconds != 10 {
+		t.Fatalf("expected rates over 10s, got %+v", rates)
+	}
+	if !approx(rates.CPUBusyPercent, 75) {
+		t.Fatalf("expected 75%% busy, got %v", rates.CPUBusyPercent)
+	}
+	if len(rates.CPUCores) != 2 || rates.CPUCores[0].CPU != "0" || !approx(rates.CPUCores[0].BusyPercent, 50) || !approx(rates.CPUCores[1].BusyPercent, 100) {
+		t.Fatalf("unexpected per-core rates %+v", rates.CPUCores)
+	}
+	if len(rates.Network) != 1 || !approx(rates.Network[0].ReceiveBytesPerSecond, 500) {
+		t.Fatalf("unexpected network rates %+v", rates.Network)
+	}
+	if len(rates.DiskIO) != 1 || !approx(rates.DiskIO[0].ReadIOPS, 5) {
+		t.Fatalf("unexpected disk rates %+v", rates.DiskIO)
+	}
+}
+
+// TestApplyNodeRates_Pressure verifies the share of time stalled on a
+// resource, and that it is left out without PSI.
+func TestApplyNodeRates_Pressure(t *testing.T) {
+	nodeRateSamples = newCounterSampler()
+	defer func() { nodeRateSamples = newCounterSampler() }()
+
+	sample := func(at, cpuWaiting, ioStalled float64) *ParsedMetrics {
+		parsed, err := parsePrometheusMetrics(fmt.Sprintf("node_time_seconds %v\n"+
+			"node_pressure_cpu_waiting_seconds_total %v\n"+
+			"node_pressure_io_stalled_seconds_total %v\n", at, cpuWaiting, ioStalled))
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		return parsed
+	}
+	applyNodeRates("n1", sample(1000, 10, 5))
+	second := sample(1010, 12, 5.5)
+	applyNodeRates("n1", second)
+	if second.Rates == nil || second.Rates.Pressure == nil {
+		t.Fatalf("expected pressure rates, got %+v", second.Rates)
+	}
+	if !approx(second.Rates.Pressure.CPUWaitingPercent, 20) || !approx(second.Rates.Pressure.IOStalledPercent, 5) {
+		t.Fatalf("unexpected pressure rates %+v", second.Rates.Pressure)
+	}
+
+	withoutPSI := nodeSample(t, 1000, 100, 100, 100, 100, 1000, 10)
+	applyNodeRates("n2", withoutPSI)
+	withoutPSI = nodeSample(t, 1010, 105, 105, 100, 110, 6000, 60)
+	applyNodeRates("n2", withoutPSI)
+	if withoutPSI.Rates == nil || withoutPSI.Rates.Pressure != nil {
+		t.Fatalf("expected no pressure rates without PSI, got %+v", withoutPSI.Rates)
+	}
+}
+
+// TestApplyContainerRates verifies the CPU and network rates of containers.
+func TestApplyContainerRates(t *testing.T) {
+	containerRateSamples = newCounterSampler()
+	defer func() { containerRateSamples = newCounterSampler() }()
+
+	applyContainerRates([]ContainerMemoryMetrics{{ContainerID: "c1", ServerTime: 100, CPUUsage: 10, NetworkRxBytes: 0}})
+	containers := []ContainerMemoryMetrics{{ContainerID: "c1", ServerTime: 104, CPUUsage: 12, NetworkRxBytes: 4000, CPUPercent: 200}}
+	applyContainerRates(containers)
+	c := containers[0]
+	if !approx(c.CPUUsagePercent, 50) || !approx(c.CPUQuotaUsagePercent, 25) || !approx(c.NetworkRxBytesPerSecond, 1000) {
+		t.Fatalf("unexpected container rates %+v", c)
+	}
+}
@@ -35,6 +35,8 @@ const (
 
 func init() {
 	loadMetricsLabelsFromEnv()
+	loadMetricsSettingsFromEnv()
+	loadExporterDiscoveryFromEnv()
 }
 
 func loadMetricsLabelsFromEnv() {
@@ -51,8 +53,12 @@ func loadMetricsLabelsFromEnv() {
 	}
 }
 
-// findNodeExporterService discovers the node-exporter service by label
+// findNodeExporterService discovers the node-exporter service by label, or
+// stands in for the exporters found by static or DNS discovery
 func findNodeExporterService(cli *client.Client) (*swarm.Service, error) {
+	if nodeExporterDiscovery.mode() != exporterDiscoveryLabel {
+		return nodeExporterDiscovery.standInService(), nil
+	}
 	services, err := cli.ServiceList(context.Background(), swarm.ServiceListOptions{})
 	if err != nil {
 		return nil, err
@@ -68,8 +74,12 @@ func findNodeExporterService(cli *client.Client) (*swarm.Service, error) {
 	return nil, nil
 }
 
-// findCAdvisorService discovers the cadvisor service by label
+// findCAdvisorService discovers the cadvisor service by label, or stands in
+// for the exporters found by static or DNS discovery
 func findCAdvisorService(cli *client.Client) (*swarm.Service, error) {
+	if cadvisorDiscovery.mode() != exporterDiscoveryLabel {
+		return cadvisorDiscovery.standInService(), nil
+	}
 	services, err := cli.ServiceList(context.Background(), swarm.ServiceListOptions{})
 	if err != nil {
 		return nil, err
@@ -108,7 +118,7 @@ func getDashboardNetworks(cli *client.Client) map[string]bool {
 
 // resolveServiceEndpoint finds the best IP/port for a service task on a specific node.
 // It prefers networks that the dashboard is also attached to.
-func resolveServiceEndpoint(cli *client.Client, service *swarm.Service, nodeID string, defaultPort int) (string, error) {
+func resolveServiceEndpoint(cli *client.Client, service *swarm.Service, nodeID string, defaultPort int, config exporterScrapeConfig) (string, error) {
 	if service == nil {
 		return "", fmt.Errorf("service is nil")
 	}
@@ -140,7 +150,7 @@ func resolveServiceEndpoint(cli *client.Client, service *swarm.Service, nodeID s
 
 	serviceID := service.ID
 	if serviceID == "" && service.Spec.Name != "" {
-		return fmt.Sprintf("http://%s:%d/metrics", service.Spec.Name, port), nil
+		return config.url(service.Spec.Name, port), nil
 	}
 
 	f := filters.NewArgs()
@@ -152,7 +162,7 @@ func resolveServiceEndpoint(cli *client.Client, service *swarm.Service, nodeID s
 	tasks, err := cli.TaskList(context.Background(), swarm.TaskListOptions{Filters: f})
 	if err != nil {
 		if service.Spec.Name != "" {
-			return fmt.Sprintf("http://%s:%d/metrics", service.Spec.Name, port), nil
+			return config.url(service.Spec.Name, port), nil
 		}
 		return "", fmt.Errorf("failed to list tasks: %w", err)
 	}
@@ -174,7 +184,7 @@ func resolveServiceEndpoint(cli *client.Client, service *swarm.Service, nodeID s
 
 				// If this network is shared with the dashboard, use it immediately
 				if dashboardNets[na.Network.ID] {
-					return fmt.Sprintf("http://%s:%d/metrics", addr, port), nil
+					return config.url(addr, port), nil
 				}
 
 				// Otherwise keep as fallback
@@ -186,11 +196,11 @@ func resolveServiceEndpoint(cli *client.Client, service *swarm.Service, nodeID s
 	}
 
 	if fallbackAddr != "" {
-		return fmt.Sprintf("http://%s:%d/metrics", fallbackAddr, port), nil
+		return config.url(fallbackAddr, port), nil
 	}
 
 	if service.Spec.Name != "" {
-		return fmt.Sprintf("http://%s:%d/metrics", service.Spec.Name, port), nil
+		return config.url(service.Spec.Name, port), nil
 	}
 
 	return "", fmt.Errorf("no task address found for service %s on node %s", serviceID, nodeID)
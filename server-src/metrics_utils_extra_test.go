@@ -144,7 +144,7 @@ func TestResolveServiceEndpoint_NoTasksFallback(t *testing.T) {
 		},
 	}
 
-	endpoint, err := resolveServiceEndpoint(cli, service, "node1", 8080)
+	endpoint, err := resolveServiceEndpoint(cli, service, "node1", 8080, exporterScrapeConfig{})
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -154,7 +154,7 @@ func TestResolveServiceEndpoint_NoTasksFallback(t *testing.T) {
 }
 
 func TestResolveServiceEndpoint_NilService(t *testing.T) {
-	_, err := resolveServiceEndpoint(nil, nil, "node1", 8080)
+	_, err := resolveServiceEndpoint(nil, nil, "node1", 8080, exporterScrapeConfig{})
 	if err == nil {
 		t.Error("expected error for nil service")
 	}
@@ -103,7 +103,7 @@ func TestResolveServiceEndpoint(t *testing.T) {
 		},
 	}
 
-	endpoint, err := resolveServiceEndpoint(cli, service, "node1", 9100)
+	endpoint, err := resolveServiceEndpoint(cli, service, "node1", 9100, exporterScrapeConfig{})
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// nodeGenericResource is a generic resource a node advertises, such as GPUs.
+type nodeGenericResource struct {
+	Kind  string   `json:"kind"`
+	Count int64    `json:"count"`           // Units of a discrete resource, or number of named resources
+	Names []string `json:"names,omitempty"` // Values of the named resources
+}
+
+// nodeCapacity is what swarm knows of a node without any exporter: its
+// description and the resources reserved by its tasks.
+type nodeCapacity struct {
+	NodeID                string                `json:"nodeId"`
+	Hostname              string                `json:"hostname"`
+	Role                  string                `json:"role"`
+	Availability          string                `json:"availability"`
+	State                 string                `json:"state"`
+	OS                    string                `json:"os"`
+	Architecture          string                `json:"architecture"`
+	EngineVersion         string                `json:"engineVersion"`
+	CPUs                  float64               `json:"cpus"`
+	MemoryBytes           int64                 `json:"memoryBytes"`
+	GenericResources      []nodeGenericResource `json:"genericResources"`
+	Tasks                 int                   `json:"tasks"` // Tasks holding resources on the node
+	ReservedCPUs          float64               `json:"reservedCpus"`
+	ReservedMemoryBytes   int64                 `json:"reservedMemoryBytes"`
+	ReservedCPUPercent    float64               `json:"reservedCpuPercent"`
+	ReservedMemoryPercent float64               `json:"reservedMemoryPercent"`
+	LimitCPUs             float64               `json:"limitCpus"` // Sum of the limits of the tasks that have one
+	LimitMemoryBytes      int64                 `json:"limitMemoryBytes"`
+	HeadroomCPUs          float64               `json:"headroomCpus"` // Capacity left to reserve
+	HeadroomMemoryBytes   int64                 `json:"headroomMemoryBytes"`
+}
+
+// clusterCapacity sums the capacity and reservations of the nodes.
+type clusterCapacity struct {
+	NodeCount             int                   `json:"nodeCount"`
+	CPUs                  float64               `json:"cpus"`
+	MemoryBytes           int64                 `json:"memoryBytes"`
+	GenericResources      []nodeGenericResource `json:"genericResources"`
+	Tasks                 int                   `json:"tasks"`
+	ReservedCPUs          float64               `json:"reservedCpus"`
+	ReservedMemoryBytes   int64                 `json:"reservedMemoryBytes"`
+	ReservedCPUPercent    float64               `json:"reservedCpuPercent"`
+	ReservedMemoryPercent float64               `json:"reservedMemoryPercent"`
+	LimitCPUs             float64               `json:"limitCpus"` // Sum of the limits of the tasks that have one
+	LimitMemoryBytes      int64                 `json:"limitMemoryBytes"`
+	HeadroomCPUs          float64               `json:"headroomCpus"` // Capacity left to reserve
+	HeadroomMemoryBytes   int64                 `json:"headroomMemoryBytes"`
+	Nodes                 []nodeCapacity        `json:"nodes"`
+}
+
+// taskHoldsResources reports whether the scheduler accounts the reservations
+// of a task to its node: the task is meant to run and has not ended.
+func taskHoldsResources(task swarm.Task) bool {
+	if task.DesiredState != swarm.TaskStateRunning {
+		return false
+	}
+	switch task.Status.State {
+	case swarm.TaskStateAssigned, swarm.TaskStateAccepted, swarm.TaskStatePreparing,
+		swarm.TaskStateReady, swarm.TaskStateStarting, swarm.TaskStateRunning:
+		return true
+	}
+	return false
+}
+
+// percentOf is part as a percentage of total, 0 without total.
+func percentOf(part, total float64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return part / total * 100
+}
+
+// addGenericResources merges generic resources into a map by kind.
+func addGenericResources(byKind map[string]*nodeGenericResource, resources []swarm.GenericResource) {
+	for _, resource := range resources {
+		switch {
+		case resource.DiscreteResourceSpec != nil:
+			kind := resource.DiscreteResourceSpec.Kind
+			if byKind[kind] == nil {
+				byKind[kind] = &nodeGenericResource{Kind: kind}
+			}
+			byKind[kind].Count += resource.DiscreteResourceSpec.Value
+		case resource.NamedResourceSpec != nil:
+			kind := resource.NamedResourceSpec.Kind
+			if byKind[kind] == nil {
+				byKind[kind] = &nodeGenericResource{Kind: kind}
+			}
+			byKind[kind].Count++
+			byKind[kind].Names = append(byKind[kind].Names, resource.NamedResourceSpec.Value)
+		}
+	}
+}
+
+// sortedGenericResources lists the merged generic resources by kind.
+func sortedGenericResources(byKind map[string]*nodeGenericResource) []nodeGenericResource {
+	resources := make([]nodeGenericResource, 0, len(byKind))
+	for _, resource := range byKind {
+		sort.Strings(resource.Names)
+		resources = append(resources, *resource)
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Kind < resources[j].Kind })
+	return resources
+}
+
+// nodeCapacityFromDescription builds the capacity of a node from its
+// description and the reservations of the given tasks placed on it.
+func nodeCapacityFromDescription(node swarm.Node, tasks []swarm.Task) nodeCapacity {
+	resources := node.Description.Resources
+	byKind := make(map[string]*nodeGenericResource)
+	addGenericResources(byKind, resources.GenericResources)
+	capacity := nodeCapacity{
+		NodeID:           node.ID,
+		Hostname:         node.Description.Hostname,
+		Role:             string(node.Spec.Role),
+		Availability:     string(node.Spec.Availability),
+		State:            string(node.Status.State),
+		OS:               node.Description.Platform.OS,
+		Architecture:     node.Description.Platform.Architecture,
+		EngineVersion:    node.Description.Engine.EngineVersion,
+		CPUs:             float64(resources.NanoCPUs) / 1e9,
+		MemoryBytes:      resources.MemoryBytes,
+		GenericResources: sortedGenericResources(byKind),
+	}
+	for _, task := range tasks {
+		if task.NodeID != node.ID || !taskHoldsResources(task) {
+			continue
+		}
+		capacity.Tasks++
+		if task.Spec.Resources != nil && task.Spec.Resources.Reservations != nil {
+			capacity.ReservedCPUs += float64(task.Spec.Resources.Reservations.NanoCPUs) / 1e9
+			capacity.ReservedMemoryBytes += task.Spec.Resources.Reservations.MemoryBytes
+		}
+		if task.Spec.Resources != nil && task.Spec.Resources.Limits != nil {
+			capacity.LimitCPUs += float64(task.Spec.Resources.Limits.NanoCPUs) / 1e9
+			capacity.LimitMemoryBytes += task.Spec.Resources.Limits.MemoryBytes
+		}
+	}
+	capacity.ReservedCPUPercent = percentOf(capacity.ReservedCPUs, capacity.CPUs)
+	capacity.ReservedMemoryPercent = percentOf(float64(capacity.ReservedMemoryBytes), float64(capacity.MemoryBytes))
+	capacity.HeadroomCPUs = capacity.CPUs - capacity.ReservedCPUs
+	capacity.HeadroomMemoryBytes = capacity.MemoryBytes - capacity.ReservedMemoryBytes
+	return capacity
+}
+
+// aggregateClusterCapacity sums the capacity of the nodes.
+func aggregateClusterCapacity(nodes []swarm.Node, tasks []swarm.Task) *clusterCapacity {
+	tasksByNode := make(map[string][]swarm.Task)
+	for _, task := range tasks {
+		tasksByNode[task.NodeID] = append(tasksByNode[task.NodeID], task)
+	}
+	byKind := make(map[string]*nodeGenericResource)
+	cluster := &clusterCapacity{NodeCount: len(nodes), Nodes: make([]nodeCapacity, 0, len(nodes))}
+	for _, node := range nodes {
+		capacity := nodeCapacityFromDescription(node, tasksByNode[node.ID])
+		addGenericResources(byKind, node.Description.Resources.GenericResources)
+		cluster.CPUs += capacity.CPUs
+		cluster.MemoryBytes += capacity.MemoryBytes
+		cluster.Tasks += capacity.Tasks
+		cluster.ReservedCPUs += capacity.ReservedCPUs
+		cluster.ReservedMemoryBytes += capacity.ReservedMemoryBytes
+		cluster.LimitCPUs += capacity.LimitCPUs
+		cluster.LimitMemoryBytes += capacity.LimitMemoryBytes
+		cluster.Nodes = append(cluster.Nodes, capacity)
+	}
+	sort.Slice(cluster.Nodes, func(i, j int) bool { return cluster.Nodes[i].Hostname < cluster.Nodes[j].Hostname })
+	cluster.GenericResources = sortedGenericResources(byKind)
+	cluster.ReservedCPUPercent = percentOf(cluster.ReservedCPUs, cluster.CPUs)
+	cluster.ReservedMemoryPercent = percentOf(float64(cluster.ReservedMemoryBytes), float64(cluster.MemoryBytes))
+	cluster.HeadroomCPUs = cluster.CPUs - cluster.ReservedCPUs
+	cluster.HeadroomMemoryBytes = cluster.MemoryBytes - cluster.ReservedMemoryBytes
+	return cluster
+}
+
+// runningTasks lists the tasks meant to run, on one node or, without
+// nodeID, on the whole cluster.
+func runningTasks(cli *client.Client, nodeID string) ([]swarm.Task, error) {
+	f := filters.NewArgs()
+	f.Add("desired-state", string(swarm.TaskStateRunning))
+	if nodeID != "" {
+		f.Add("node", nodeID)
+	}
+	return cli.TaskList(context.Background(), swarm.TaskListOptions{Filters: f})
+}
+
+// fetchNodeCapacity returns the capacity of a node from its description.
+func fetchNodeCapacity(cli *client.Client, nodeID string) (*nodeCapacity, error) {
+	node, _, err := cli.NodeInspectWithRaw(context.Background(), nodeID)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := runningTasks(cli, node.ID)
+	if err != nil {
+		return nil, err
+	}
+	capacity := nodeCapacityFromDescription(node, tasks)
+	return &capacity, nil
+}
+
+// fetchClusterCapacity returns the capacity of the given nodes.
+func fetchClusterCapacity(cli *client.Client, nodes []swarm.Node) (*clusterCapacity, error) {
+	tasks, err := runningTasks(cli, "")
+	if err != nil {
+		return nil, err
+	}
+	return aggregateClusterCapacity(nodes, tasks), nil
+}
+
+// fallbackNodeCapacity returns the capacity of a node whose exporter metrics
+// are missing, or nil when swarm cannot describe it either.
+func fallbackNodeCapacity(cli *client.Client, nodeID string) *nodeCapacity {
+	capacity, err := fetchNodeCapacity(cli, nodeID)
+	if err != nil {
+		log.Printf("nodeMetricsHandler: fetching the capacity of node %s failed: %v", nodeID, err)
+		return nil
+	}
+	return capacity
+}
+
+// fallbackClusterCapacity returns the capacity of the nodes without exporter
+// metrics, or nil when every node has some.
+func fallbackClusterCapacity(cli *client.Client, nodes []swarm.Node, withMetrics map[string]bool) *clusterCapacity {
+	var missing []swarm.Node
+	for _, node := range nodes {
+		if !withMetrics[node.ID] {
+			missing = append(missing, node)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	capacity, err := fetchClusterCapacity(cli, missing)
+	if err != nil {
+		log.Printf("clusterMetricsHandler: fetching the cluster capacity failed: %v", err)
+		return nil
+	}
+	return capacity
+}
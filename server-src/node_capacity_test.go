@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/gorilla/mux"
+)
+
+var capacityNodes = []swarm.Node{
+	{
+		ID:     "n1",
+		Spec:   swarm.NodeSpec{Role: swarm.NodeRoleManager, Availability: swarm.NodeAvailabilityActive},
+		Status: swarm.NodeStatus{State: swarm.NodeStateReady},
+		Description: swarm.NodeDescription{
+			Hostname: "alpha",
+			Platform: swarm.Platform{OS: "linux", Architecture: "x86_64"},
+			Engine:   swarm.EngineDescription{EngineVersion: "27.0.1"},
+			Resources: swarm.Resources{NanoCPUs: 4e9, MemoryBytes: 8000, GenericResources: []swarm.GenericResource{
+				{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "SSD", Value: 2}},
+				{NamedResourceSpec: &swarm.NamedGenericResource{Kind: "GPU", Value: "gpu-1"}},
+				{NamedResourceSpec: &swarm.NamedGenericResource{Kind: "GPU", Value: "gpu-0"}},
+			}},
+		},
+	},
+	{
+		ID:          "n2",
+		Description: swarm.NodeDescription{Hostname: "beta", Resources: swarm.Resources{NanoCPUs: 2e9, MemoryBytes: 2000}},
+	},
+}
+
+func reservingTask(id, nodeID string, state swarm.TaskState, nanoCPUs, memory int64) swarm.Task {
+	return swarm.Task{
+		ID: id, NodeID: nodeID, DesiredState: swarm.TaskStateRunning, Status: swarm.TaskStatus{State: state},
+		Spec: swarm.TaskSpec{Resources: &swarm.ResourceRequirements{Reservations: &swarm.Resources{NanoCPUs: nanoCPUs, MemoryBytes: memory}}},
+	}
+}
+
+var capacityTasks = []swarm.Task{
+	reservingTask("t1", "n1", swarm.TaskStateRunning, 1e9, 2000),
+	reservingTask("t2", "n1", swarm.TaskStatePreparing, 5e8, 1000),
+	reservingTask("t3", "n1", swarm.TaskStateFailed, 1e9, 1000),
+	reservingTask("t4", "n2", swarm.TaskStateRunning, 1e9, 500),
+	{ID: "t5", NodeID: "n2", DesiredState: swarm.TaskStateRunning, Status: swarm.TaskStatus{State: swarm.TaskStateRunning}},
+}
+
+// TestNodeCapacityFromDescription verifies the capacity, generic resources
+// and reservations of a node.
+func TestNodeCapacityFromDescription(t *testing.T) {
+	capacity := nodeCapacityFromDescription(capacityNodes[0], capacityTasks)
+	if capacity.CPUs != 4 || capacity.MemoryBytes != 8000 || capacity.Role != "manager" || capacity.EngineVersion != "27.0.1" || capacity.OS != "linux" {
+		t.Fatalf("unexpected description %+v", capacity)
+	}
+	// The failed task and the tasks of other nodes reserve nothing here.
+	if capacity.Tasks != 2 || capacity.ReservedCPUs != 1.5 || capacity.ReservedMemoryBytes != 3000 || capacity.ReservedCPUPercent != 37.5 || capacity.ReservedMemoryPercent != 37.5 {
+		t.Errorf("unexpected reservations %+v", capacity)
+	}
+	if len(capacity.GenericResources) != 2 || capacity.GenericResources[0].Kind != "GPU" || capacity.GenericResources[0].Count != 2 ||
+		capacity.GenericResources[0].Names[0] != "gpu-0" || capacity.GenericResources[1].Count != 2 {
+		t.Errorf("unexpected generic resources %+v", capacity.GenericResources)
+	}
+}
+
+// TestAggregateClusterCapacity verifies the sums over the nodes.
+func TestAggregateClusterCapacity(t *testing.T) {
+	cluster := aggregateClusterCapacity(capacityNodes, capacityTasks)
+	if cluster.NodeCount != 2 || cluster.CPUs != 6 || cluster.MemoryBytes != 10000 || cluster.Tasks != 4 ||
+		cluster.ReservedCPUs != 2.5 || cluster.ReservedMemoryBytes != 3500 || cluster.ReservedMemoryPercent != 35 {
+		t.Fatalf("unexpected cluster capacity %+v", cluster)
+	}
+	if len(cluster.Nodes) != 2 || cluster.Nodes[1].Hostname != "beta" || cluster.Nodes[1].ReservedCPUPercent != 50 {
+		t.Errorf("unexpected nodes %+v", cluster.Nodes)
+	}
+}
+
+// TestMetricsHandlers_CapacityOnly verifies that the node and cluster metrics
+// fall back to the capacity known to swarm without node-exporter.
+func TestMetricsHandlers_CapacityOnly(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/services": []swarm.Service{},
+		"/v1.35/nodes":    capacityNodes,
+		"/v1.35/nodes/n1": capacityNodes[0],
+		"/v1.35/tasks":    capacityTasks,
+	})
+
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n1/metrics", nil), map[string]string{"id": "n1"})
+	nodeMetricsHandler(rr, req)
+	var nodeResponse nodeMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &nodeResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if nodeResponse.Available || !nodeResponse.CapacityOnly || nodeResponse.Message == nil || nodeResponse.Capacity == nil || nodeResponse.Capacity.ReservedMemoryBytes != 3000 {
+		t.Fatalf("expected the capacity of the node, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics", nil))
+	var clusterResponse clusterMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &clusterResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if clusterResponse.Available || !clusterResponse.CapacityOnly || clusterResponse.Capacity == nil || clusterResponse.Capacity.CPUs != 6 {
+		t.Fatalf("expected the capacity of the cluster, got %s", rr.Body.String())
+	}
+}
+
+// TestMetricsHandlers_CapacityPerNode verifies that, with static discovery,
+// the nodes without target fall back to their capacity while the others keep
+// their node-exporter metrics.
+func TestMetricsHandlers_CapacityPerNode(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("node_memory_MemTotal_bytes 1000\nnode_memory_MemAvailable_bytes 250\n"))
+	}))
+	defer exporter.Close()
+	setDiscoveryEnv(t, "DSD_NODE_EXPORTER_DISCOVERY", "static")
+	t.Setenv("DSD_NODE_EXPORTER_TARGETS", "alpha="+exporter.URL+"/metrics")
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes":    capacityNodes,
+		"/v1.35/nodes/n2": capacityNodes[1],
+		"/v1.35/tasks":    capacityTasks,
+	})
+
+	rr := httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics", nil))
+	var clusterResponse clusterMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &clusterResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !clusterResponse.Available || clusterResponse.CapacityOnly || clusterResponse.NodesAvailable != 1 || clusterResponse.TotalMemory != 1000 {
+		t.Fatalf("expected the metrics of alpha, got %s", rr.Body.String())
+	}
+	if clusterResponse.Capacity == nil || clusterResponse.Capacity.NodeCount != 1 || clusterResponse.Capacity.Nodes[0].Hostname != "beta" || clusterResponse.Capacity.CPUs != 2 {
+		t.Fatalf("expected the capacity of beta, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	nodeMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n2/metrics", nil), map[string]string{"id": "n2"}))
+	var nodeResponse nodeMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &nodeResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if nodeResponse.Metrics != nil || !nodeResponse.CapacityOnly || nodeResponse.Capacity == nil || nodeResponse.Capacity.ReservedMemoryBytes != 500 {
+		t.Fatalf("expected the capacity of beta, got %s", rr.Body.String())
+	}
+}
+
+// TestMetricsHandlers_CapacityOnFailedScrape verifies that a node whose
+// node-exporter fails falls back to its capacity.
+func TestMetricsHandlers_CapacityOnFailedScrape(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer exporter.Close()
+	u, _ := url.Parse(exporter.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+	exporterTask := swarm.Task{ID: "tn", ServiceID: "s-exporter", NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+		NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}}
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/services": []swarm.Service{{ID: "s-exporter", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{nodeExporterLabel: "true"}}},
+			Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}}},
+		"/v1.35/nodes":    capacityNodes[:1],
+		"/v1.35/nodes/n1": capacityNodes[0],
+		"/v1.35/tasks":    append([]swarm.Task{exporterTask}, capacityTasks...),
+	})
+
+	rr := httptest.NewRecorder()
+	nodeMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n1/metrics", nil), map[string]string{"id": "n1"}))
+	var nodeResponse nodeMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &nodeResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if nodeResponse.Error == nil || !nodeResponse.CapacityOnly || nodeResponse.Capacity == nil || nodeResponse.Capacity.CPUs != 4 {
+		t.Fatalf("expected the error and the capacity of alpha, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics", nil))
+	var clusterResponse clusterMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &clusterResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if clusterResponse.Error == nil || !clusterResponse.CapacityOnly || clusterResponse.Capacity == nil || clusterResponse.Capacity.NodeCount != 1 {
+		t.Fatalf("expected the error and the capacity of the cluster, got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// dockerContainerCgroup matches the cgroup of a Docker container, such as
+// /docker/<id> or /system.slice/docker-<id>.scope, as opposed to the cgroups
+// aggregating several processes or containers.
+var dockerContainerCgroup = regexp.MustCompile(`docker[/-][0-9a-f]{64}(\.scope)?$`)
+
+// nodeContainersMetricsResponse represents the response structure for the
+// containers metrics endpoint of a node
+type nodeContainersMetricsResponse struct {
+	Available       bool                     `json:"available"`
+	Containers      []ContainerMemoryMetrics `json:"containers,omitempty"`      // Containers of swarm tasks
+	OtherContainers []ContainerMemoryMetrics `json:"otherContainers,omitempty"` // Containers started outside of swarm
+	ServerTime      float64                  `json:"serverTime,omitempty"`
+	Error           *string                  `json:"error,omitempty"`
+	Message         *string                  `json:"message,omitempty"`
+}
+
+// splitNodeContainers separates the containers of swarm tasks from the other
+// Docker containers, dropping the cgroups that are no container.
+func splitNodeContainers(containers []ContainerMemoryMetrics) (tasks, others []ContainerMemoryMetrics) {
+	tasks = []ContainerMemoryMetrics{}
+	others = []ContainerMemoryMetrics{}
+	for _, container := range containers {
+		switch {
+		case container.TaskID != "":
+			tasks = append(tasks, container)
+		case dockerContainerCgroup.MatchString(container.ContainerID):
+			others = append(others, container)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].TaskName < tasks[j].TaskName })
+	sort.Slice(others, func(i, j int) bool { return others[i].ContainerID < others[j].ContainerID })
+	return tasks, others
+}
+
+// nodeContainersMetricsHandler returns the metrics of every container of a
+// node from a single scrape of its cAdvisor.
+func nodeContainersMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	nodeID := mux.Vars(r)["id"]
+	if nodeID == "" {
+		http.Error(w, "Node ID is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse := func(response nodeContainersMetricsResponse) {
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("nodeContainersMetricsHandler: encoding response failed: %v", err)
+		}
+	}
+
+	cli, err := getCli()
+	if err != nil {
+		errMsg := "Error getting Docker client: " + err.Error()
+		writeResponse(nodeContainersMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+
+	if usingPrometheusBackend() {
+		// Prometheus keeps the containers of swarm tasks only.
+		metrics, err := fetchContainerMetricsFromPrometheus("container_label_com_docker_swarm_node_id=" + quotePromQL(nodeID))
+		if err != nil {
+			writeResponse(nodeContainersMetricsResponse{Available: true, Error: prometheusErrorMessage(err)})
+			return
+		}
+		applyContainerRates(metrics.ContainerMetrics)
+		tasks, _ := splitNodeContainers(metrics.ContainerMetrics)
+		writeResponse(nodeContainersMetricsResponse{Available: true, Containers: tasks, OtherContainers: []ContainerMemoryMetrics{}, ServerTime: metrics.ServerTime})
+		return
+	}
+
+	cadvisorService, err := cachedCAdvisorService(cli)
+	if err != nil {
+		errMsg := "Error finding cadvisor service: " + err.Error()
+		writeResponse(nodeContainersMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	if cadvisorService == nil {
+		msg := fmt.Sprintf("cAdvisor service not found. Deploy a global service with label '%s' to enable metrics.", cadvisorLabel)
+		writeResponse(nodeContainersMetricsResponse{Available: false, Message: &msg})
+		return
+	}
+
+	if _, _, err := cli.NodeInspectWithRaw(context.Background(), nodeID); err != nil {
+		errMsg := "Error inspecting node: " + err.Error()
+		writeResponse(nodeContainersMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+
+	endpoint, err := cachedCAdvisorEndpoint(cli, cadvisorService, nodeID)
+	if err != nil {
+		errMsg := "Error resolving cAdvisor endpoint: " + err.Error()
+		writeResponse(nodeContainersMetricsResponse{Available: true, Error: &errMsg})
+		return
+	}
+	metricFamilies, err := scrapeCAdvisor(endpoint)
+	if err != nil {
+		errMsg := "Error fetching metrics from cAdvisor: " + err.Error()
+		writeResponse(nodeContainersMetricsResponse{Available: true, Error: &errMsg})
+		return
+	}
+	metrics, err := parseCAdvisorMetricFamilies(metricFamilies, "", "")
+	if err != nil {
+		errMsg := "Error parsing cAdvisor metrics: " + err.Error()
+		writeResponse(nodeContainersMetricsResponse{Available: true, Error: &errMsg})
+		return
+	}
+
+	tasks, others := splitNodeContainers(metrics.ContainerMetrics)
+	applyContainerRates(tasks)
+	applyContainerRates(others)
+	writeResponse(nodeContainersMetricsResponse{Available: true, Containers: tasks, OtherContainers: others, ServerTime: metrics.ServerTime})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/gorilla/mux"
+)
+
+// TestSplitNodeContainers verifies that the containers of tasks and the other
+// Docker containers are told apart and the aggregate cgroups dropped.
+func TestSplitNodeContainers(t *testing.T) {
+	id := strings.Repeat("a", 64)
+	tasks, others := splitNodeContainers([]ContainerMemoryMetrics{
+		{ContainerID: "/docker/" + strings.Repeat("b", 64), TaskID: "t2", TaskName: "web.2"},
+		{ContainerID: "/"},
+		{ContainerID: "/docker"},
+		{ContainerID: "/system.slice/docker-" + id + ".scope"},
+		{ContainerID: "/docker/" + strings.Repeat("c", 64), TaskID: "t1", TaskName: "web.1"},
+		{ContainerID: "/system.slice/sshd.service"},
+	})
+	if len(tasks) != 2 || tasks[0].TaskID != "t1" || tasks[1].TaskID != "t2" {
+		t.Fatalf("unexpected task containers %+v", tasks)
+	}
+	if len(others) != 1 || !strings.Contains(others[0].ContainerID, id) {
+		t.Fatalf("unexpected other containers %+v", others)
+	}
+}
+
+// TestNodeContainersMetricsHandler verifies that the containers of a node come
+// from a single scrape of its cAdvisor.
+func TestNodeContainersMetricsHandler(t *testing.T) {
+	standalone := "/docker/" + strings.Repeat("d", 64)
+	var scrapes int32
+	cadvisor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+		_, _ = w.Write([]byte(stackCAdvisorMetrics + `container_memory_usage_bytes{id="` + standalone + `"} 42
+container_memory_usage_bytes{id="/"} 99999
+`))
+	}))
+	defer cadvisor.Close()
+	u, _ := url.Parse(cadvisor.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes/n1": swarm.Node{ID: "n1"},
+		"/v1.35/services": []swarm.Service{{ID: "s-cadvisor", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{cadvisorLabel: "true"}}},
+			Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}}},
+		"/v1.35/tasks": []swarm.Task{{ID: "tc", ServiceID: "s-cadvisor", NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}}},
+	})
+
+	rr := httptest.NewRecorder()
+	nodeContainersMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n1/containers/metrics", nil), map[string]string{"id": "n1"}))
+
+	var response nodeContainersMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || len(response.Containers) != 3 || len(response.OtherContainers) != 1 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if response.OtherContainers[0].ContainerID != standalone || response.OtherContainers[0].Usage != 42 {
+		t.Errorf("unexpected other container %+v", response.OtherContainers[0])
+	}
+	if got := atomic.LoadInt32(&scrapes); got != 1 {
+		t.Fatalf("expected a single scrape, got %d", got)
+	}
+}
+
+// TestNodeContainersMetricsHandler_Prometheus verifies that the containers are
+// selected by the node label of their task in Prometheus.
+func TestNodeContainersMetricsHandler_Prometheus(t *testing.T) {
+	_, queries := stubPrometheus(t, map[string][]prometheusSeries{"container_": {
+		series("100", "__name__", "container_memory_usage_bytes", "id", "/docker/c1", "container_label_com_docker_swarm_task_id", "t1"),
+	}})
+	stubDocker(t, map[string]interface{}{})
+
+	rr := httptest.NewRecorder()
+	nodeContainersMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n1/containers/metrics", nil), map[string]string{"id": "n1"}))
+
+	var response nodeContainersMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || len(response.Containers) != 1 || response.Containers[0].TaskID != "t1" {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if !strings.Contains((*queries)[0], `container_label_com_docker_swarm_node_id="n1"`) {
+		t.Fatalf("expected the query to select the node, got %q", (*queries)[0])
+	}
+}
+
+// TestNodeContainersMetricsHandler_Unavailable verifies that a missing
+// cAdvisor, an unknown node and failing scrapes are reported.
+func TestNodeContainersMetricsHandler_Unavailable(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	request := func(nodeID string) nodeContainersMetricsResponse {
+		rr := httptest.NewRecorder()
+		nodeContainersMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/"+nodeID+"/containers/metrics", nil), map[string]string{"id": nodeID}))
+		var response nodeContainersMetricsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode: %v (%s)", err, rr.Body.String())
+		}
+		return response
+	}
+
+	rr := httptest.NewRecorder()
+	nodeContainersMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes//containers/metrics", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without node ID, got %d", rr.Code)
+	}
+
+	stubDocker(t, map[string]interface{}{"/v1.35/services": []swarm.Service{}})
+	if response := request("n1"); response.Available || response.Message == nil || !strings.Contains(*response.Message, cadvisorLabel) {
+		t.Fatalf("expected the missing service to be reported, got %+v", response)
+	}
+
+	cadvisor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer cadvisor.Close()
+	u, _ := url.Parse(cadvisor.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+	service := swarm.Service{ID: "s-cadvisor", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{cadvisorLabel: "true"}}},
+		Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}}
+	resetMetricsCaches()
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes/n1": swarm.Node{ID: "n1"},
+		"/v1.35/services": []swarm.Service{service},
+		"/v1.35/tasks":    []swarm.Task{},
+	})
+	if response := request("unknown"); response.Available || response.Error == nil || !strings.Contains(*response.Error, "Error inspecting node") {
+		t.Fatalf("expected the unknown node to be reported, got %+v", response)
+	}
+	if response := request("n1"); !response.Available || response.Error == nil || !strings.Contains(*response.Error, "Error resolving cAdvisor endpoint") {
+		t.Fatalf("expected the node without cAdvisor to be reported, got %+v", response)
+	}
+
+	resetMetricsCaches()
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes/n1": swarm.Node{ID: "n1"},
+		"/v1.35/services": []swarm.Service{service},
+		"/v1.35/tasks": []swarm.Task{{ID: "tc", ServiceID: "s-cadvisor", NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}}},
+	})
+	if response := request("n1"); !response.Available || response.Error == nil || !strings.Contains(*response.Error, "Error fetching metrics from cAdvisor") {
+		t.Fatalf("expected the scrape error to be reported, got %+v", response)
+	}
+
+	srv, _ := stubPrometheus(t, map[string][]prometheusSeries{})
+	srv.Close()
+	if response := request("n1"); !response.Available || response.Error == nil || !strings.Contains(*response.Error, "Error querying Prometheus at "+srv.URL) {
+		t.Fatalf("expected the Prometheus error to be reported, got %+v", response)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricLabel returns the value of a label of a metric
+func metricLabel(metric *dto.Metric, name string) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+// parsePressureMetrics extracts the pressure stall information counters
+func parsePressureMetrics(metricFamilies map[string]*dto.MetricFamily) PressureMetrics {
+	var pressure PressureMetrics
+	families := []struct {
+		name  string
+		field *float64
+	}{
+		{"node_pressure_cpu_waiting_seconds_total", &pressure.CPUWaitingSeconds},
+		{"node_pressure_memory_waiting_seconds_total", &pressure.MemoryWaitingSeconds},
+		{"node_pressure_memory_stalled_seconds_total", &pressure.MemoryStalledSeconds},
+		{"node_pressure_io_waiting_seconds_total", &pressure.IOWaitingSeconds},
+		{"node_pressure_io_stalled_seconds_total", &pressure.IOStalledSeconds},
+	}
+	for _, family := range families {
+		if f, ok := metricFamilies[family.name]; ok && len(f.GetMetric()) > 0 {
+			*family.field = getMetricValue(f.GetMetric()[0])
+			pressure.Available = true
+		}
+	}
+	return pressure
+}
+
+// parseTemperatureMetrics extracts the hwmon and thermal zone temperatures
+func parseTemperatureMetrics(metricFamilies map[string]*dto.MetricFamily) []TemperatureMetric {
+	temperatures := make([]TemperatureMetric, 0)
+
+	// node_hwmon_sensor_label names the sensors of some chips, e.g. "Core 0"
+	sensorLabels := make(map[string]string)
+	if labels, ok := metricFamilies["node_hwmon_sensor_label"]; ok {
+		for _, metric := range labels.GetMetric() {
+			sensorLabels[metricLabel(metric, "chip")+"/"+metricLabel(metric, "sensor")] = metricLabel(metric, "label")
+		}
+	}
+	critical := make(map[string]float64)
+	if crit, ok := metricFamilies["node_hwmon_temp_crit_celsius"]; ok {
+		for _, metric := range crit.GetMetric() {
+			critical[metricLabel(metric, "chip")+"/"+metricLabel(metric, "sensor")] = getMetricValue(metric)
+		}
+	}
+	if hwmon, ok := metricFamilies["node_hwmon_temp_celsius"]; ok {
+		for _, metric := range hwmon.GetMetric() {
+			chip, sensor := metricLabel(metric, "chip"), metricLabel(metric, "sensor")
+			temperatures = append(temperatures, TemperatureMetric{
+				Source:          "hwmon",
+				Chip:            chip,
+				Sensor:          sensor,
+				Label:           sensorLabels[chip+"/"+sensor],
+				Celsius:         getMetricValue(metric),
+				CriticalCelsius: critical[chip+"/"+sensor],
+			})
+		}
+	}
+	if zones, ok := metricFamilies["node_thermal_zone_temp"]; ok {
+		for _, metric := range zones.GetMetric() {
+			temperatures = append(temperatures, TemperatureMetric{
+				Source:  "thermal_zone",
+				Chip:    metricLabel(metric, "type"),
+				Sensor:  metricLabel(metric, "zone"),
+				Celsius: getMetricValue(metric),
+			})
+		}
+	}
+
+	sort.Slice(temperatures, func(i, j int) bool {
+		a, b := temperatures[i], temperatures[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Chip != b.Chip {
+			return a.Chip < b.Chip
+		}
+		return a.Sensor < b.Sensor
+	})
+	return temperatures
+}
+
+// parseSystemdMetrics extracts the active and failed systemd units. Every
+// unit has one sample per state, the current one set to 1.
+func parseSystemdMetrics(metricFamilies map[string]*dto.MetricFamily) SystemdMetrics {
+	systemd := SystemdMetrics{FailedUnits: make([]string, 0)}
+	units, ok := metricFamilies["node_systemd_unit_state"]
+	if !ok {
+		return systemd
+	}
+	systemd.Available = true
+	for _, metric := range units.GetMetric() {
+		if getMetricValue(metric) != 1 {
+			continue
+		}
+		switch metricLabel(metric, "state") {
+		case "active":
+			systemd.ActiveUnits++
+		case "failed":
+			systemd.FailedUnits = append(systemd.FailedUnits, metricLabel(metric, "name"))
+		}
+	}
+	sort.Strings(systemd.FailedUnits)
+	return systemd
+}
+
+// parseRAIDMetrics extracts the state of the md arrays. An array is degraded
+// when it has failed disks or fewer active disks than it requires.
+func parseRAIDMetrics(metricFamilies map[string]*dto.MetricFamily) []RAIDArrayMetric {
+	arrays := make(map[string]*RAIDArrayMetric)
+	array := func(metric *dto.Metric) *RAIDArrayMetric {
+		device := metricLabel(metric, "device")
+		if arrays[device] == nil {
+			arrays[device] = &RAIDArrayMetric{Device: device}
+		}
+		return arrays[device]
+	}
+
+	if states, ok := metricFamilies["node_md_state"]; ok {
+		for _, metric := range states.GetMetric() {
+			a := array(metric)
+			if getMetricValue(metric) == 1 {
+				a.State = metricLabel(metric, "state")
+			}
+		}
+	}
+	if disks, ok := metricFamilies["node_md_disks"]; ok {
+		for _, metric := range disks.GetMetric() {
+			a := array(metric)
+			switch metricLabel(metric, "state") {
+			case "active":
+				a.ActiveDisks = getMetricValue(metric)
+			case "failed":
+				a.FailedDisks = getMetricValue(metric)
+			case "spare":
+				a.SpareDisks = getMetricValue(metric)
+			}
+		}
+	}
+	if required, ok := metricFamilies["node_md_disks_required"]; ok {
+		for _, metric := range required.GetMetric() {
+			array(metric).DisksRequired = getMetricValue(metric)
+		}
+	}
+	if blocks, ok := metricFamilies["node_md_blocks"]; ok {
+		for _, metric := range blocks.GetMetric() {
+			array(metric).Blocks = getMetricValue(metric)
+		}
+	}
+	if synced, ok := metricFamilies["node_md_blocks_synced"]; ok {
+		for _, metric := range synced.GetMetric() {
+			array(metric).BlocksSynced = getMetricValue(metric)
+		}
+	}
+
+	result := make([]RAIDArrayMetric, 0, len(arrays))
+	for _, a := range arrays {
+		a.Degraded = a.FailedDisks > 0 || (a.DisksRequired > 0 && a.ActiveDisks < a.DisksRequired)
+		result = append(result, *a)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Device < result[j].Device })
+	return result
+}
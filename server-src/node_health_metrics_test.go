@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+// TestParsePrometheusMetrics_NodeHealth verifies the pressure stall, temperature,
+// systemd and RAID sections.
+func TestParsePrometheusMetrics_NodeHealth(t *testing.T) {
+	text := `node_pressure_cpu_waiting_seconds_total 12
+node_pressure_memory_waiting_seconds_total 3
+node_pressure_memory_stalled_seconds_total 1
+node_pressure_io_waiting_seconds_total 40
+node_pressure_io_stalled_seconds_total 20
+node_hwmon_temp_celsius{chip="platform_coretemp_0",sensor="temp2"} 55
+node_hwmon_temp_celsius{chip="platform_coretemp_0",sensor="temp1"} 60
+node_hwmon_temp_crit_celsius{chip="platform_coretemp_0",sensor="temp1"} 100
+node_hwmon_sensor_label{chip="platform_coretemp_0",label="Package id 0",sensor="temp1"} 1
+node_thermal_zone_temp{type="x86_pkg_temp",zone="0"} 61
+node_systemd_unit_state{name="docker.service",state="active",type="notify"} 1
+node_systemd_unit_state{name="docker.service",state="failed",type="notify"} 0
+node_systemd_unit_state{name="ssh.service",state="active",type="notify"} 1
+node_systemd_unit_state{name="backup.service",state="failed",type="oneshot"} 1
+node_systemd_unit_state{name="backup.service",state="active",type="oneshot"} 0
+node_md_state{device="md0",state="active"} 1
+node_md_state{device="md0",state="recovering"} 0
+node_md_state{device="md1",state="recovering"} 1
+node_md_disks{device="md0",state="active"} 2
+node_md_disks{device="md0",state="failed"} 0
+node_md_disks{device="md1",state="active"} 1
+node_md_disks{device="md1",state="failed"} 1
+node_md_disks{device="md1",state="spare"} 1
+node_md_disks_required{device="md0"} 2
+node_md_disks_required{device="md1"} 2
+node_md_blocks{device="md1"} 1000
+node_md_blocks_synced{device="md1"} 400
+`
+	parsed, err := parsePrometheusMetrics(text)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	p := parsed.Pressure
+	if !p.Available || p.CPUWaitingSeconds != 12 || p.MemoryWaitingSeconds != 3 || p.MemoryStalledSeconds != 1 || p.IOWaitingSeconds != 40 || p.IOStalledSeconds != 20 {
+		t.Errorf("unexpected pressure %+v", p)
+	}
+
+	temps := parsed.Temperatures
+	if len(temps) != 3 {
+		t.Fatalf("expected 3 temperatures, got %+v", temps)
+	}
+	if temps[0].Sensor != "temp1" || temps[0].Label != "Package id 0" || temps[0].Celsius != 60 || temps[0].CriticalCelsius != 100 {
+		t.Errorf("unexpected hwmon sensor %+v", temps[0])
+	}
+	if temps[2].Source != "thermal_zone" || temps[2].Chip != "x86_pkg_temp" || temps[2].Celsius != 61 {
+		t.Errorf("unexpected thermal zone %+v", temps[2])
+	}
+
+	if !parsed.Systemd.Available || parsed.Systemd.ActiveUnits != 2 || len(parsed.Systemd.FailedUnits) != 1 || parsed.Systemd.FailedUnits[0] != "backup.service" {
+		t.Errorf("unexpected systemd %+v", parsed.Systemd)
+	}
+
+	if len(parsed.RAID) != 2 {
+		t.Fatalf("expected 2 arrays, got %+v", parsed.RAID)
+	}
+	md0, md1 := parsed.RAID[0], parsed.RAID[1]
+	if md0.State != "active" || md0.Degraded || md0.ActiveDisks != 2 {
+		t.Errorf("unexpected healthy array %+v", md0)
+	}
+	if md1.State != "recovering" || !md1.Degraded || md1.FailedDisks != 1 || md1.SpareDisks != 1 || md1.BlocksSynced != 400 {
+		t.Errorf("unexpected degraded array %+v", md1)
+	}
+}
+
+// TestParsePrometheusMetrics_NodeHealthMissing verifies the sections of a
+// node-exporter without these collectors.
+func TestParsePrometheusMetrics_NodeHealthMissing(t *testing.T) {
+	parsed, err := parsePrometheusMetrics("node_load1 1\n")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if parsed.Pressure.Available || parsed.Systemd.Available || parsed.Temperatures == nil || len(parsed.Temperatures) != 0 ||
+		parsed.Systemd.FailedUnits == nil || parsed.RAID == nil || len(parsed.RAID) != 0 {
+		t.Fatalf("unexpected sections %+v", parsed)
+	}
+}
@@ -4,18 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
 	"github.com/gorilla/mux"
 	dto "github.com/prometheus/client_model/go"
-	"github.com/prometheus/common/expfmt"
-	"github.com/prometheus/common/model"
 )
 
 // CPUMetric represents CPU time data for a specific mode
@@ -109,6 +107,47 @@ type FileDescriptorMetrics struct {
 	UsedPercent float64 `json:"usedPercent"`
 }
 
+// PressureMetrics represents the pressure stall information (PSI) counters,
+// the total time tasks waited for a resource
+type PressureMetrics struct {
+	Available            bool    `json:"available"` // The kernel exposes PSI
+	CPUWaitingSeconds    float64 `json:"cpuWaitingSeconds"`
+	MemoryWaitingSeconds float64 `json:"memoryWaitingSeconds"` // Some tasks waited for memory
+	MemoryStalledSeconds float64 `json:"memoryStalledSeconds"` // All non-idle tasks waited for memory
+	IOWaitingSeconds     float64 `json:"ioWaitingSeconds"`
+	IOStalledSeconds     float64 `json:"ioStalledSeconds"`
+}
+
+// TemperatureMetric represents a hardware temperature sensor
+type TemperatureMetric struct {
+	Source          string  `json:"source"` // hwmon or thermal_zone
+	Chip            string  `json:"chip"`   // hwmon chip or thermal zone type
+	Sensor          string  `json:"sensor"`
+	Label           string  `json:"label,omitempty"`
+	Celsius         float64 `json:"celsius"`
+	CriticalCelsius float64 `json:"criticalCelsius,omitempty"`
+}
+
+// SystemdMetrics represents the state of the systemd units
+type SystemdMetrics struct {
+	Available   bool     `json:"available"` // The systemd collector is enabled
+	ActiveUnits int      `json:"activeUnits"`
+	FailedUnits []string `json:"failedUnits"`
+}
+
+// RAIDArrayMetric represents a Linux software RAID (md) array
+type RAIDArrayMetric struct {
+	Device        string  `json:"device"`
+	State         string  `json:"state"` // active, inactive, recovering, resync or check
+	DisksRequired float64 `json:"disksRequired"`
+	ActiveDisks   float64 `json:"activeDisks"`
+	FailedDisks   float64 `json:"failedDisks"`
+	SpareDisks    float64 `json:"spareDisks"`
+	Blocks        float64 `json:"blocks"`
+	BlocksSynced  float64 `json:"blocksSynced"`
+	Degraded      bool    `json:"degraded"`
+}
+
 // ParsedMetrics represents the parsed and extracted metrics
 type ParsedMetrics struct {
 	CPU            []CPUMetric           `json:"cpu"`
@@ -120,52 +159,67 @@ type ParsedMetrics struct {
 	System         SystemMetrics         `json:"system"`
 	TCP            TCPMetrics            `json:"tcp"`
 	FileDescriptor FileDescriptorMetrics `json:"fileDescriptor"`
-	ServerTime     float64               `json:"serverTime"` // Unix timestamp
+	Pressure       PressureMetrics       `json:"pressure"`
+	Temperatures   []TemperatureMetric   `json:"temperatures"`
+	Systemd        SystemdMetrics        `json:"systemd"`
+	RAID           []RAIDArrayMetric     `json:"raid"`
+	Rates          *NodeRates            `json:"rates,omitempty"` // Derived from the previous sample of the node
+	ServerTime     float64               `json:"serverTime"`      // Unix timestamp
+
+	// cpuCores holds the CPU time counters of every core, needed to derive
+	// per-core utilization.
+	cpuCores map[string]cpuTimes
 }
 
 // nodeMetricsResponse represents the response structure for node metrics endpoint
 type nodeMetricsResponse struct {
-	Available bool           `json:"available"`
-	Metrics   *ParsedMetrics `json:"metrics,omitempty"`
-	Error     *string        `json:"error,omitempty"`
-	Message   *string        `json:"message,omitempty"`
+	Available    bool               `json:"available"`
+	Metrics      *ParsedMetrics     `json:"metrics,omitempty"`
+	History      []nodeMetricsPoint `json:"history,omitempty"`
+	CapacityOnly bool               `json:"capacityOnly,omitempty"` // No exporter metrics, only the capacity known to swarm
+	Capacity     *nodeCapacity      `json:"capacity,omitempty"`
+	Error        *string            `json:"error,omitempty"`
+	Message      *string            `json:"message,omitempty"`
+}
+
+// nodeMetricsPoint is a node's metrics at one point of the collected history
+type nodeMetricsPoint struct {
+	Time    float64        `json:"time"` // Unix timestamp
+	Metrics *ParsedMetrics `json:"metrics"`
 }
 
 // getNodeExporterEndpoint resolves the node-exporter endpoint for a specific node.
 // It prefers the task's overlay network address so the dashboard can query the exact
 // node instance instead of hitting the service VIP.
-func getNodeExporterEndpoint(cli *client.Client, service *swarm.Service, nodeID string) (string, error) {
-	return resolveServiceEndpoint(cli, service, nodeID, 9100)
-}
-
-// fetchMetricsFromNodeExporter fetches metrics from the node-exporter endpoint
-func fetchMetricsFromNodeExporter(url string) (string, error) {
-	resp, err := metricsHttpClient.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("node-exporter returned status %d", resp.StatusCode)
+func getNodeExporterEndpoint(cli *client.Client, service *swarm.Service, nodeID string) (exporterEndpoint, error) {
+	if nodeExporterDiscovery.mode() != exporterDiscoveryLabel {
+		return nodeExporterDiscovery.endpoint(cli, nodeID)
 	}
-
-	body, err := io.ReadAll(resp.Body)
+	config := nodeExporterScrapeConfig(service)
+	url, err := resolveServiceEndpoint(cli, service, nodeID, 9100, config)
 	if err != nil {
-		return "", err
+		return exporterEndpoint{}, err
 	}
+	return exporterEndpoint{url: url, config: config}, nil
+}
 
-	return string(body), nil
+// fetchMetricsFromNodeExporter fetches and decodes the metrics of the node-exporter endpoint
+func fetchMetricsFromNodeExporter(endpoint exporterEndpoint) (map[string]*dto.MetricFamily, error) {
+	return fetchMetricFamilies(endpoint.url, "node-exporter", endpoint.config)
 }
 
 // parsePrometheusMetrics parses Prometheus text format and extracts CPU and memory metrics
 func parsePrometheusMetrics(metricsText string) (*ParsedMetrics, error) {
-	parser := expfmt.NewTextParser(model.LegacyValidation)
-	metricFamilies, err := parser.TextToMetricFamilies(strings.NewReader(metricsText))
+	metricFamilies, err := decodeTextMetrics(strings.NewReader(metricsText))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse metrics: %w", err)
 	}
+	return parseNodeMetricFamilies(metricFamilies), nil
+}
 
+// parseNodeMetricFamilies extracts the CPU, memory, filesystem, network and
+// system metrics of node-exporter
+func parseNodeMetricFamilies(metricFamilies map[string]*dto.MetricFamily) *ParsedMetrics {
 	parsed := &ParsedMetrics{
 		CPU:            make([]CPUMetric, 0),
 		Memory:         MemoryMetrics{},
@@ -176,6 +230,9 @@ func parsePrometheusMetrics(metricsText string) (*ParsedMetrics, error) {
 		System:         SystemMetrics{},
 		TCP:            TCPMetrics{},
 		FileDescriptor: FileDescriptorMetrics{},
+		Temperatures:   make([]TemperatureMetric, 0),
+		Systemd:        SystemdMetrics{FailedUnits: make([]string, 0)},
+		RAID:           make([]RAIDArrayMetric, 0),
 	}
 
 	// Extract CPU metrics and count CPUs
@@ -183,6 +240,7 @@ func parsePrometheusMetrics(metricsText string) (*ParsedMetrics, error) {
 	if cpuFamily, ok := metricFamilies["node_cpu_seconds_total"]; ok {
 		cpuModes := make(map[string]float64)
 		cpuSet := make(map[string]bool)
+		parsed.cpuCores = make(map[string]cpuTimes)
 		for _, metric := range cpuFamily.GetMetric() {
 			var mode, cpu string
 			for _, label := range metric.GetLabel() {
@@ -195,6 +253,9 @@ func parsePrometheusMetrics(metricsText string) (*ParsedMetrics, error) {
 			if mode != "" {
 				value := getMetricValue(metric)
 				cpuModes[mode] += value
+				if cpu != "" {
+					parsed.cpuCores[cpu] = parsed.cpuCores[cpu].add(mode, value)
+				}
 			}
 			if cpu != "" {
 				cpuSet[cpu] = true
@@ -479,12 +540,15 @@ func parsePrometheusMetrics(metricsText string) (*ParsedMetrics, error) {
 		}
 	}
 
-	// Extract server time
+	// Extract server time, or the time of the samples without the time collector
 	if timeMetric, ok := metricFamilies["node_time_seconds"]; ok {
 		if len(timeMetric.GetMetric()) > 0 {
 			parsed.ServerTime = getMetricValue(timeMetric.GetMetric()[0])
 		}
 	}
+	if parsed.ServerTime == 0 {
+		parsed.ServerTime = latestSampleTime(metricFamilies)
+	}
 
 	// Extract load average
 	if load1, ok := metricFamilies["node_load1"]; ok {
@@ -595,7 +659,12 @@ func parsePrometheusMetrics(metricsText string) (*ParsedMetrics, error) {
 		parsed.FileDescriptor.UsedPercent = (parsed.FileDescriptor.Allocated / parsed.FileDescriptor.Maximum) * 100
 	}
 
-	return parsed, nil
+	parsed.Pressure = parsePressureMetrics(metricFamilies)
+	parsed.Temperatures = parseTemperatureMetrics(metricFamilies)
+	parsed.Systemd = parseSystemdMetrics(metricFamilies)
+	parsed.RAID = parseRAIDMetrics(metricFamilies)
+
+	return parsed
 }
 
 // getFilesystemLabels extracts device and mountpoint from filesystem metric labels
@@ -656,6 +725,16 @@ func nodeMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	historyRequest, wantsHistory, err := parseMetricsRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wantsHistory {
+		writeNodeMetricsHistory(w, nodeID, historyRequest)
+		return
+	}
+
 	cli, err := getCli()
 	if err != nil {
 		errMsg := "Error getting Docker client: " + err.Error()
@@ -668,8 +747,13 @@ func nodeMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if usingPrometheusBackend() {
+		writePrometheusNodeMetrics(w, cli, nodeID)
+		return
+	}
+
 	// Find the node-exporter service
-	service, err := findNodeExporterService(cli)
+	service, err := cachedNodeExporterService(cli)
 	if err != nil {
 		errMsg := "Error finding node-exporter service: " + err.Error()
 		response := nodeMetricsResponse{
@@ -688,49 +772,49 @@ func nodeMetricsHandler(w http.ResponseWriter, r *http.Request) {
 			Available: false,
 			Message:   &msg,
 		}
+		// Fall back to the capacity swarm knows of the node
+		response.Capacity = fallbackNodeCapacity(cli, nodeID)
+		response.CapacityOnly = response.Capacity != nil
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(response)
 		return
 	}
 
 	// Get the endpoint URL (resolve task IP for the requested node)
-	endpoint, err := getNodeExporterEndpoint(cli, service, nodeID)
+	endpoint, err := cachedNodeExporterEndpoint(cli, service, nodeID)
 	if err != nil {
 		errMsg := "Error constructing node-exporter endpoint: " + err.Error()
 		response := nodeMetricsResponse{
 			Available: false,
 			Error:     &errMsg,
 		}
+		// No exporter runs on, or is targeted at, the node
+		response.Capacity = fallbackNodeCapacity(cli, nodeID)
+		response.CapacityOnly = response.Capacity != nil
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(response)
 		return
 	}
 
 	// Fetch metrics from node-exporter
-	metricsText, err := fetchMetricsFromNodeExporter(endpoint)
+	metricFamilies, err := scrapeNodeExporter(endpoint)
 	if err != nil {
 		errMsg := "Error fetching metrics from node-exporter: " + err.Error()
 		response := nodeMetricsResponse{
 			Available: true, // Service is available but request failed
 			Error:     &errMsg,
 		}
+		response.Capacity = fallbackNodeCapacity(cli, nodeID)
+		response.CapacityOnly = response.Capacity != nil
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(response)
 		return
 	}
 
 	// Parse metrics
-	parsedMetrics, err := parsePrometheusMetrics(metricsText)
-	if err != nil {
-		errMsg := "Error parsing metrics: " + err.Error()
-		response := nodeMetricsResponse{
-			Available: true,
-			Error:     &errMsg,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(response)
-		return
-	}
+	parsedMetrics := parseNodeMetricFamilies(metricFamilies)
+
+	applyNodeRates(nodeID, parsedMetrics)
 
 	// Success
 	response := nodeMetricsResponse{
@@ -741,9 +825,30 @@ func nodeMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(response)
 }
 
-// clusterMetricsResponse represents the response structure for cluster metrics endpoint
-type clusterMetricsResponse struct {
-	Available      bool    `json:"available"`
+// writeNodeMetricsHistory answers a node metrics request for a time range
+// from the background collector.
+func writeNodeMetricsHistory(w http.ResponseWriter, nodeID string, request metricsRangeRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	rounds, msg := metricsHistoryRounds(request)
+	if msg != nil {
+		_ = json.NewEncoder(w).Encode(nodeMetricsResponse{Available: false, Message: msg})
+		return
+	}
+	response := nodeMetricsResponse{Available: true, History: []nodeMetricsPoint{}}
+	for _, round := range rounds {
+		if metrics, ok := round.nodes[nodeID]; ok {
+			response.History = append(response.History, nodeMetricsPoint{Time: metricsPointTime(round), Metrics: metrics})
+		}
+	}
+	if len(response.History) > 0 {
+		response.Metrics = response.History[len(response.History)-1].Metrics
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// clusterMetricsTotals holds the cluster-wide totals aggregated from the
+// node-exporter metrics of the nodes.
+type clusterMetricsTotals struct {
 	TotalCPU       int     `json:"totalCpu"`
 	TotalMemory    float64 `json:"totalMemory"`
 	UsedMemory     float64 `json:"usedMemory"`
@@ -751,14 +856,77 @@ type clusterMetricsResponse struct {
 	TotalDisk      float64 `json:"totalDisk"`
 	UsedDisk       float64 `json:"usedDisk"`
 	DiskPercent    float64 `json:"diskPercent"`
-	NodeCount      int     `json:"nodeCount"`
 	NodesAvailable int     `json:"nodesAvailable"`
-	Message        *string `json:"message,omitempty"`
-	Error          *string `json:"error,omitempty"`
+}
+
+// clusterMetricsResponse represents the response structure for cluster metrics endpoint
+type clusterMetricsResponse struct {
+	Available bool `json:"available"`
+	clusterMetricsTotals
+	NodeCount    int                   `json:"nodeCount"`
+	Nodes        []clusterNodeMetrics  `json:"nodes,omitempty"`
+	History      []clusterMetricsPoint `json:"history,omitempty"`
+	CapacityOnly bool                  `json:"capacityOnly,omitempty"` // No exporter metrics for any node, only the capacity known to swarm
+	Capacity     *clusterCapacity      `json:"capacity,omitempty"`     // Capacity of the nodes without exporter metrics
+	Message      *string               `json:"message,omitempty"`
+	Error        *string               `json:"error,omitempty"`
+}
+
+// clusterMetricsPoint is the cluster totals at one point of the collected history
+type clusterMetricsPoint struct {
+	Time float64 `json:"time"` // Unix timestamp
+	clusterMetricsTotals
+}
+
+// aggregateClusterMetrics sums the metrics of the nodes into cluster totals.
+// Disk totals count the root filesystem of every node, or its first
+// filesystem when "/" is not reported.
+func aggregateClusterMetrics(nodes []*ParsedMetrics) clusterMetricsTotals {
+	var totals clusterMetricsTotals
+	var availableMemory, availDisk float64
+	for _, metrics := range nodes {
+		if metrics == nil {
+			continue
+		}
+		totals.NodesAvailable++
+		totals.TotalCPU += metrics.System.NumCPUs
+		totals.TotalMemory += metrics.Memory.Total
+		availableMemory += metrics.Memory.Available
+
+		foundRoot := false
+		for _, fs := range metrics.Filesystem {
+			if fs.Mountpoint == "/" {
+				totals.TotalDisk += fs.Size
+				availDisk += fs.Available
+				foundRoot = true
+				break
+			}
+		}
+		if !foundRoot && len(metrics.Filesystem) > 0 {
+			totals.TotalDisk += metrics.Filesystem[0].Size
+			availDisk += metrics.Filesystem[0].Available
+		}
+	}
+
+	totals.UsedMemory = totals.TotalMemory - availableMemory
+	if totals.TotalMemory > 0 {
+		totals.MemoryPercent = (totals.UsedMemory / totals.TotalMemory) * 100
+	}
+	totals.UsedDisk = totals.TotalDisk - availDisk
+	if totals.TotalDisk > 0 {
+		totals.DiskPercent = (totals.UsedDisk / totals.TotalDisk) * 100
+	}
+	return totals
 }
 
 // clusterMetricsHandler handles requests for aggregated cluster metrics
 func clusterMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	historyRequest, wantsHistory, err := parseMetricsRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	cli, err := getCli()
 	if err != nil {
 		errMsg := "Error getting Docker client: " + err.Error()
@@ -780,8 +948,17 @@ func clusterMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if wantsHistory {
+		writeClusterMetricsHistory(w, len(nodes), historyRequest)
+		return
+	}
+	if usingPrometheusBackend() {
+		writePrometheusClusterMetrics(w, nodes)
+		return
+	}
+
 	// 2. Find node-exporter service
-	service, err := findNodeExporterService(cli)
+	service, err := cachedNodeExporterService(cli)
 	if err != nil {
 		errMsg := "Error finding node-exporter service: " + err.Error()
 		if encodeErr := json.NewEncoder(w).Encode(clusterMetricsResponse{Available: false, Error: &errMsg}); encodeErr != nil {
@@ -791,17 +968,18 @@ func clusterMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if service == nil {
 		msg := fmt.Sprintf("Node-exporter service not found. Deploy a global service with label '%s' to enable cluster metrics.", nodeExporterLabel)
-		if encodeErr := json.NewEncoder(w).Encode(clusterMetricsResponse{Available: false, Message: &msg}); encodeErr != nil {
+		response := clusterMetricsResponse{Available: false, NodeCount: len(nodes), Message: &msg}
+		// Fall back to the capacity swarm knows of the nodes
+		response.Capacity = fallbackClusterCapacity(cli, nodes, nil)
+		response.CapacityOnly = response.Capacity != nil
+		if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
 			log.Printf("Failed to encode message response: %v", encodeErr)
 		}
 		return
 	}
 
-	// 3. Get all running tasks for node-exporter
-	f := filters.NewArgs()
-	f.Add("service", service.ID)
-	f.Add("desired-state", string(swarm.TaskStateRunning))
-	tasks, err := cli.TaskList(context.Background(), swarm.TaskListOptions{Filters: f})
+	// 3. Get the nodes running a node-exporter
+	exporterNodeIDs, err := nodeExporterDiscovery.nodeIDs(cli, service)
 	if err != nil {
 		errMsg := "Error listing tasks: " + err.Error()
 		if encodeErr := json.NewEncoder(w).Encode(clusterMetricsResponse{Available: false, Error: &errMsg}); encodeErr != nil {
@@ -810,9 +988,15 @@ func clusterMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(tasks) == 0 {
+	if len(exporterNodeIDs) == 0 {
 		msg := "Node-exporter service found, but no running tasks were detected. Ensure it's deployed as a global service."
-		if encodeErr := json.NewEncoder(w).Encode(clusterMetricsResponse{Available: false, Message: &msg}); encodeErr != nil {
+		if nodeExporterDiscovery.mode() != exporterDiscoveryLabel {
+			msg = fmt.Sprintf("No node-exporter target was found with %s discovery.", nodeExporterDiscovery.mode())
+		}
+		response := clusterMetricsResponse{Available: false, NodeCount: len(nodes), Message: &msg}
+		response.Capacity = fallbackClusterCapacity(cli, nodes, nil)
+		response.CapacityOnly = response.Capacity != nil
+		if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
 			log.Printf("Failed to encode message response: %v", encodeErr)
 		}
 		return
@@ -820,102 +1004,185 @@ func clusterMetricsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// 4. Fetch metrics from all tasks in parallel
 	type nodeResult struct {
-		metrics *ParsedMetrics
-		err     error
+		nodeID   string
+		endpoint string
+		latency  time.Duration
+		metrics  *ParsedMetrics
+		err      error
 	}
-	resultsChan := make(chan nodeResult, len(tasks))
+	resultsChan := make(chan nodeResult, len(exporterNodeIDs))
 	startedGoroutines := 0
+	fanOut := newMetricsFanOut()
 
-	for _, task := range tasks {
-		if task.Status.State != swarm.TaskStateRunning {
-			continue
-		}
+	for _, nodeID := range exporterNodeIDs {
 		startedGoroutines++
-		go func(t swarm.Task) {
-			endpoint, err := getNodeExporterEndpoint(cli, service, t.NodeID)
+		fanOut.Go(func() {
+			endpoint, err := cachedNodeExporterEndpoint(cli, service, nodeID)
 			if err != nil {
-				resultsChan <- nodeResult{err: err}
+				resultsChan <- nodeResult{nodeID: nodeID, err: err}
 				return
 			}
-			metricsText, err := fetchMetricsFromNodeExporter(endpoint)
+			start := time.Now()
+			metricFamilies, err := scrapeNodeExporter(endpoint)
+			latency := time.Since(start)
 			if err != nil {
-				resultsChan <- nodeResult{err: err}
+				resultsChan <- nodeResult{nodeID: nodeID, endpoint: endpoint.url, latency: latency, err: err}
 				return
 			}
-			parsed, err := parsePrometheusMetrics(metricsText)
-			resultsChan <- nodeResult{metrics: parsed, err: err}
-		}(task)
+			parsed := parseNodeMetricFamilies(metricFamilies)
+			applyNodeRates(nodeID, parsed)
+			resultsChan <- nodeResult{nodeID: nodeID, endpoint: endpoint.url, latency: latency, metrics: parsed}
+		})
 	}
 
-	// 5. Aggregate results
-	var totalCPU int
-	var totalMemory, availableMemory float64
-	var totalDisk, availDisk float64
-	nodesWithMetrics := 0
-
+	// 5. Aggregate results, keeping a breakdown of every node
+	breakdown := newClusterNodeBreakdown(nodes, "No running node-exporter task on this node")
+	nodeMetrics := make([]*ParsedMetrics, 0, startedGoroutines)
+	withMetrics := make(map[string]bool, startedGoroutines)
 	for i := 0; i < startedGoroutines; i++ {
 		res := <-resultsChan
+		breakdown.set(res.nodeID, res.endpoint, res.latency, res.metrics, res.err)
 		if res.err == nil && res.metrics != nil {
-			nodesWithMetrics++
-			totalCPU += res.metrics.System.NumCPUs
-			totalMemory += res.metrics.Memory.Total
-			availableMemory += res.metrics.Memory.Available
-
-			// For disk, we sum up "/" if available, otherwise first filesystem
-			foundRoot := false
-			for _, fs := range res.metrics.Filesystem {
-				if fs.Mountpoint == "/" {
-					totalDisk += fs.Size
-					availDisk += fs.Available
-					foundRoot = true
-					break
-				}
-			}
-			if !foundRoot && len(res.metrics.Filesystem) > 0 {
-				totalDisk += res.metrics.Filesystem[0].Size
-				availDisk += res.metrics.Filesystem[0].Available
-			}
+			nodeMetrics = append(nodeMetrics, res.metrics)
+			withMetrics[res.nodeID] = true
 		}
 	}
 
-	if nodesWithMetrics == 0 && startedGoroutines > 0 {
+	if len(nodeMetrics) == 0 && startedGoroutines > 0 {
 		errMsg := "Failed to fetch metrics from node exporter instances. Check network connectivity."
-		if encodeErr := json.NewEncoder(w).Encode(clusterMetricsResponse{
+		response := clusterMetricsResponse{
 			Available: true,
 			Error:     &errMsg,
 			NodeCount: len(nodes),
-		}); encodeErr != nil {
+			Nodes:     breakdown.list(),
+		}
+		response.Capacity = fallbackClusterCapacity(cli, nodes, nil)
+		response.CapacityOnly = response.Capacity != nil
+		if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
 			log.Printf("Failed to encode error response: %v", encodeErr)
 		}
 		return
 	}
 
-	usedMemory := totalMemory - availableMemory
-	memPercent := 0.0
-	if totalMemory > 0 {
-		memPercent = (usedMemory / totalMemory) * 100
+	response := clusterMetricsResponse{
+		Available:            true,
+		clusterMetricsTotals: aggregateClusterMetrics(nodeMetrics),
+		NodeCount:            len(nodes),
+		Nodes:                breakdown.list(),
+		// The nodes without exporter, or whose scrape failed, keep their capacity
+		Capacity: fallbackClusterCapacity(cli, nodes, withMetrics),
 	}
 
-	usedDisk := totalDisk - availDisk
-	diskPercent := 0.0
-	if totalDisk > 0 {
-		diskPercent = (usedDisk / totalDisk) * 100
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode response: %v", err)
 	}
+}
 
-	response := clusterMetricsResponse{
-		Available:      true,
-		TotalCPU:       totalCPU,
-		TotalMemory:    totalMemory,
-		UsedMemory:     usedMemory,
-		MemoryPercent:  memPercent,
-		TotalDisk:      totalDisk,
-		UsedDisk:       usedDisk,
-		DiskPercent:    diskPercent,
-		NodeCount:      len(nodes),
-		NodesAvailable: nodesWithMetrics,
+// clusterNodeMetrics is the part of a node in the cluster metrics: where its
+// metrics were fetched from, how long it took, why it failed, and the values
+// it contributed to the totals.
+type clusterNodeMetrics struct {
+	NodeID         string   `json:"nodeId"`
+	Hostname       string   `json:"hostname"`
+	Endpoint       string   `json:"endpoint,omitempty"`
+	LatencyMs      float64  `json:"latencyMs"`
+	Available      bool     `json:"available"`
+	Error          *string  `json:"error,omitempty"`
+	CPUs           int      `json:"cpus"`
+	CPUBusyPercent *float64 `json:"cpuBusyPercent,omitempty"` // Only known from the second sample on
+	TotalMemory    float64  `json:"totalMemory"`
+	UsedMemory     float64  `json:"usedMemory"`
+	MemoryPercent  float64  `json:"memoryPercent"`
+	TotalDisk      float64  `json:"totalDisk"`
+	UsedDisk       float64  `json:"usedDisk"`
+	DiskPercent    float64  `json:"diskPercent"`
+}
+
+// clusterNodeBreakdown collects the per-node part of the cluster metrics.
+// Nodes no result was reported for keep the error telling why.
+type clusterNodeBreakdown struct {
+	nodes map[string]*clusterNodeMetrics
+}
+
+func newClusterNodeBreakdown(nodes []swarm.Node, missing string) *clusterNodeBreakdown {
+	b := &clusterNodeBreakdown{nodes: make(map[string]*clusterNodeMetrics, len(nodes))}
+	for _, node := range nodes {
+		errMsg := missing
+		b.nodes[node.ID] = &clusterNodeMetrics{NodeID: node.ID, Hostname: node.Description.Hostname, Error: &errMsg}
 	}
+	return b
+}
 
-	w.Header().Set("Content-Type", "application/json")
+// set records the outcome of fetching the metrics of a node.
+func (b *clusterNodeBreakdown) set(nodeID, endpoint string, latency time.Duration, metrics *ParsedMetrics, err error) {
+	entry := b.nodes[nodeID]
+	if entry == nil {
+		entry = &clusterNodeMetrics{NodeID: nodeID}
+		b.nodes[nodeID] = entry
+	}
+	entry.Endpoint = endpoint
+	entry.LatencyMs = float64(latency.Microseconds()) / 1000
+	entry.Error = nil
+	if err != nil {
+		errMsg := err.Error()
+		entry.Error = &errMsg
+		return
+	}
+	if metrics == nil {
+		return
+	}
+	totals := aggregateClusterMetrics([]*ParsedMetrics{metrics})
+	entry.Available = true
+	entry.CPUs = totals.TotalCPU
+	entry.TotalMemory, entry.UsedMemory, entry.MemoryPercent = totals.TotalMemory, totals.UsedMemory, totals.MemoryPercent
+	entry.TotalDisk, entry.UsedDisk, entry.DiskPercent = totals.TotalDisk, totals.UsedDisk, totals.DiskPercent
+	if metrics.Rates != nil {
+		busy := metrics.Rates.CPUBusyPercent
+		entry.CPUBusyPercent = &busy
+	}
+}
+
+// list returns the breakdown sorted by hostname.
+func (b *clusterNodeBreakdown) list() []clusterNodeMetrics {
+	list := make([]clusterNodeMetrics, 0, len(b.nodes))
+	for _, entry := range b.nodes {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hostname != list[j].Hostname {
+			return list[i].Hostname < list[j].Hostname
+		}
+		return list[i].NodeID < list[j].NodeID
+	})
+	return list
+}
+
+// writeClusterMetricsHistory answers a cluster metrics request for a time
+// range from the background collector. The totals of the response are those of
+// the latest point.
+func writeClusterMetricsHistory(w http.ResponseWriter, nodeCount int, request metricsRangeRequest) {
+	rounds, msg := metricsHistoryRounds(request)
+	if msg != nil {
+		if encodeErr := json.NewEncoder(w).Encode(clusterMetricsResponse{Available: false, Message: msg, NodeCount: nodeCount}); encodeErr != nil {
+			log.Printf("Failed to encode message response: %v", encodeErr)
+		}
+		return
+	}
+	response := clusterMetricsResponse{Available: true, NodeCount: nodeCount, History: []clusterMetricsPoint{}}
+	for _, round := range rounds {
+		nodeMetrics := make([]*ParsedMetrics, 0, len(round.nodes))
+		for _, metrics := range round.nodes {
+			nodeMetrics = append(nodeMetrics, metrics)
+		}
+		response.History = append(response.History, clusterMetricsPoint{
+			Time:                 metricsPointTime(round),
+			clusterMetricsTotals: aggregateClusterMetrics(nodeMetrics),
+		})
+	}
+	if len(response.History) > 0 {
+		response.clusterMetricsTotals = response.History[len(response.History)-1].clusterMetricsTotals
+	}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("Failed to encode response: %v", err)
 	}
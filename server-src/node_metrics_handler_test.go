@@ -13,6 +13,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	dockclient "github.com/docker/docker/client"
 	"github.com/gorilla/mux"
@@ -305,8 +306,8 @@ func TestGetNodeExporterEndpoint(t *testing.T) {
 	}
 
 	expected := "http://10.0.0.2:9100/metrics"
-	if endpoint != expected {
-		t.Errorf("Expected endpoint '%s', got '%s'", expected, endpoint)
+	if endpoint.url != expected {
+		t.Errorf("Expected endpoint '%s', got '%s'", expected, endpoint.url)
 	}
 }
 
@@ -363,8 +364,8 @@ func TestGetNodeExporterEndpoint_DefaultPort(t *testing.T) {
 	}
 
 	expected := "http://10.0.0.3:9100/metrics"
-	if endpoint != expected {
-		t.Errorf("Expected endpoint '%s', got '%s'", expected, endpoint)
+	if endpoint.url != expected {
+		t.Errorf("Expected endpoint '%s', got '%s'", expected, endpoint.url)
 	}
 }
 
@@ -469,18 +470,19 @@ func TestFetchMetricsFromNodeExporter(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	metrics, err := fetchMetricsFromNodeExporter(mockServer.URL + "/metrics")
+	metrics, err := fetchMetricsFromNodeExporter(exporterEndpoint{url: mockServer.URL + "/metrics"})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	if metrics != metricsData {
-		t.Errorf("Expected metrics '%s', got '%s'", metricsData, metrics)
+	cpu, ok := metrics["node_cpu_seconds_total"]
+	if !ok || len(cpu.GetMetric()) != 1 || getMetricValue(cpu.GetMetric()[0]) != 1000.5 {
+		t.Errorf("Expected the decoded CPU sample of '%s', got %v", metricsData, metrics)
 	}
 }
 
 func TestFetchMetricsFromNodeExporter_Error(t *testing.T) {
-	_, err := fetchMetricsFromNodeExporter("http://localhost:99999/metrics")
+	_, err := fetchMetricsFromNodeExporter(exporterEndpoint{url: "http://localhost:99999/metrics"})
 	if err == nil {
 		t.Error("Expected error when connecting to invalid endpoint")
 	}
@@ -1320,8 +1322,8 @@ func TestGetNodeExporterEndpoint_PublishedPortFallback(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if !strings.Contains(endpoint, "9200") {
-		t.Errorf("expected port 9200 in endpoint, got %s", endpoint)
+	if !strings.Contains(endpoint.url, "9200") {
+		t.Errorf("expected port 9200 in endpoint, got %s", endpoint.url)
 	}
 }
 
@@ -1344,8 +1346,8 @@ func TestGetNodeExporterEndpoint_EmptyIDWithName(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if !strings.Contains(endpoint, "node-exporter-dns") {
-		t.Errorf("expected service name in DNS fallback endpoint, got %s", endpoint)
+	if !strings.Contains(endpoint.url, "node-exporter-dns") {
+		t.Errorf("expected service name in DNS fallback endpoint, got %s", endpoint.url)
 	}
 }
 
@@ -1420,8 +1422,8 @@ func TestGetNodeExporterEndpoint_NonRunningTasksDNSFallback(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	// Should use DNS fallback (service name)
-	if !strings.Contains(endpoint, "node-exporter-dns2") {
-		t.Errorf("expected DNS fallback endpoint containing service name, got %s", endpoint)
+	if !strings.Contains(endpoint.url, "node-exporter-dns2") {
+		t.Errorf("expected DNS fallback endpoint containing service name, got %s", endpoint.url)
 	}
 }
 
@@ -1471,7 +1473,7 @@ func TestFetchMetricsFromNodeExporter_NonOKStatus(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	_, err := fetchMetricsFromNodeExporter(mockServer.URL + "/metrics")
+	_, err := fetchMetricsFromNodeExporter(exporterEndpoint{url: mockServer.URL + "/metrics"})
 	if err == nil {
 		t.Error("expected error for non-200 status from node-exporter")
 	}
@@ -1498,7 +1500,7 @@ func TestFetchMetricsFromNodeExporter_BodyReadError(t *testing.T) {
 		_ = conn.Close()
 	}()
 
-	_, err = fetchMetricsFromNodeExporter("http://" + addr + "/metrics")
+	_, err = fetchMetricsFromNodeExporter(exporterEndpoint{url: "http://" + addr + "/metrics"})
 	if err == nil {
 		t.Error("expected error when server closes connection before completing body")
 	}
@@ -1891,3 +1893,77 @@ func TestClusterMetricsHandler_GetCliError(t *testing.T) {
 		t.Errorf("expected mock error message, got %v", resp.Error)
 	}
 }
+
+// TestClusterMetricsHandler_PartialFailure verifies the per-node breakdown
+// when an exporter fails and a node runs no exporter.
+func TestClusterMetricsHandler_PartialFailure(t *testing.T) {
+	metricsData := "node_memory_MemTotal_bytes 1000\nnode_memory_MemAvailable_bytes 250\nnode_cpu_seconds_total{cpu=\"0\",mode=\"idle\"} 100\n"
+	mockExporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(metricsData))
+	}))
+	defer mockExporter.Close()
+
+	u, _ := url.Parse(mockExporter.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.35/nodes":
+			_ = json.NewEncoder(w).Encode([]swarm.Node{
+				{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}},
+				{ID: "n2", Description: swarm.NodeDescription{Hostname: "beta"}},
+				{ID: "n3", Description: swarm.NodeDescription{Hostname: "gamma"}},
+			})
+		case "/v1.35/services":
+			_ = json.NewEncoder(w).Encode([]swarm.Service{{
+				ID:       "s-exporter",
+				Spec:     swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{nodeExporterLabel: "true"}}},
+				Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}},
+			}})
+		case "/v1.35/tasks":
+			tasks := []swarm.Task{
+				{NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+					NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}},
+				// Nothing listens on this address, so the fetch fails.
+				{NodeID: "n2", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+					NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{"127.0.0.2/24"}}}},
+			}
+			if f, err := filters.FromJSON(r.URL.Query().Get("filters")); err == nil && f.Contains("node") {
+				for _, task := range tasks {
+					if f.ExactMatch("node", task.NodeID) {
+						tasks = []swarm.Task{task}
+						break
+					}
+				}
+			}
+			_ = json.NewEncoder(w).Encode(tasks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer ResetCli()
+	SetCli(makeClientForServer(t, server.URL))
+
+	w := httptest.NewRecorder()
+	clusterMetricsHandler(w, httptest.NewRequest("GET", "/docker/nodes/metrics", nil))
+
+	var resp clusterMetricsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.NodesAvailable != 1 || resp.TotalMemory != 1000 || len(resp.Nodes) != 3 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	alpha, beta, gamma := resp.Nodes[0], resp.Nodes[1], resp.Nodes[2]
+	if alpha.NodeID != "n1" || !alpha.Available || alpha.Error != nil || alpha.UsedMemory != 750 || alpha.MemoryPercent != 75 || alpha.CPUs != 1 || !strings.Contains(alpha.Endpoint, portStr) {
+		t.Errorf("unexpected healthy node %+v", alpha)
+	}
+	if beta.NodeID != "n2" || beta.Available || beta.Error == nil || !strings.Contains(beta.Endpoint, "127.0.0.2") {
+		t.Errorf("expected the failed fetch of beta to be reported, got %+v", beta)
+	}
+	if gamma.NodeID != "n3" || gamma.Available || gamma.Error == nil || !strings.Contains(*gamma.Error, "No running node-exporter") {
+		t.Errorf("expected gamma to report its missing exporter, got %+v", gamma)
+	}
+}
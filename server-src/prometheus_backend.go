@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	metricsBackendEnv          = "DSD_METRICS_BACKEND"
+	prometheusURLEnv           = "DSD_PROMETHEUS_URL"
+	prometheusNodeLabelEnv     = "DSD_PROMETHEUS_NODE_LABEL"
+	defaultPrometheusURL       = "http://prometheus:9090"
+	defaultPrometheusNodeLabel = "instance"
+)
+
+// The metrics backends a deployment can choose from.
+const (
+	// metricsBackendExporters scrapes the node-exporter and cAdvisor tasks.
+	metricsBackendExporters = "exporters"
+	// metricsBackendPrometheus queries a Prometheus server that already
+	// scrapes node-exporter and cAdvisor.
+	metricsBackendPrometheus = "prometheus"
+)
+
+// metricsBackend returns the backend configured through DSD_METRICS_BACKEND,
+// falling back to scraping the exporters.
+func metricsBackend() string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(metricsBackendEnv)))
+	switch value {
+	case metricsBackendPrometheus:
+		return metricsBackendPrometheus
+	case "", metricsBackendExporters:
+	default:
+		log.Printf("WARNING: invalid %s %q, using %q", metricsBackendEnv, value, metricsBackendExporters)
+	}
+	return metricsBackendExporters
+}
+
+// usingPrometheusBackend reports whether metrics come from Prometheus.
+func usingPrometheusBackend() bool {
+	return metricsBackend() == metricsBackendPrometheus
+}
+
+// prometheusURL is the base URL of the Prometheus HTTP API.
+func prometheusURL() string {
+	if value := strings.TrimSpace(os.Getenv(prometheusURLEnv)); value != "" {
+		return strings.TrimSuffix(value, "/")
+	}
+	return defaultPrometheusURL
+}
+
+// prometheusNodeLabel is the label telling apart the node-exporter series of
+// every node. Its value is matched against the node ID and the hostname.
+func prometheusNodeLabel() string {
+	if value := strings.TrimSpace(os.Getenv(prometheusNodeLabelEnv)); value != "" {
+		return value
+	}
+	return defaultPrometheusNodeLabel
+}
+
+// prometheusSeries is a sample of an instant vector returned by the
+// Prometheus query API.
+type prometheusSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+// prometheusQueryResponse is the envelope of the Prometheus query API.
+type prometheusQueryResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string             `json:"resultType"`
+		Result     []prometheusSeries `json:"result"`
+	} `json:"data"`
+}
+
+// queryPrometheus runs an instant PromQL query and returns the resulting
+// series.
+func queryPrometheus(query string) ([]prometheusSeries, error) {
+	endpoint := prometheusURL() + "/api/v1/query?" + url.Values{"query": {query}}.Encode()
+	resp, err := metricsHttpClient.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var result prometheusQueryResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("prometheus returned status %d", resp.StatusCode)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("prometheus query failed: %s: %s", result.ErrorType, result.Error)
+	}
+	if result.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("prometheus returned a %s instead of a vector", result.Data.ResultType)
+	}
+	return result.Data.Result, nil
+}
+
+// prometheusSeriesToText renders series in the Prometheus text exposition
+// format, so the exporter parsers can read what Prometheus returned. Series
+// without a metric name or with an unusable value are skipped.
+func prometheusSeriesToText(series []prometheusSeries) string {
+	lines := make([]string, 0, len(series))
+	for _, s := range series {
+		name := s.Metric["__name__"]
+		value, ok := s.Value[1].(string)
+		if name == "" || !ok {
+			continue
+		}
+		labelNames := make([]string, 0, len(s.Metric))
+		for label := range s.Metric {
+			if label != "__name__" {
+				labelNames = append(labelNames, label)
+			}
+		}
+		sort.Strings(labelNames)
+		labels := make([]string, 0, len(labelNames)+1)
+		for _, label := range labelNames {
+			quoted := label
+			if !model.LegacyValidation.IsValidLabelName(label) {
+				quoted = quotePrometheusLabel(label)
+			}
+			labels = append(labels, quoted+"="+quotePrometheusLabel(s.Metric[label]))
+		}
+		// UTF-8 metric names are quoted inside the braces.
+		if !model.LegacyValidation.IsValidMetricName(name) {
+			lines = append(lines, "{"+strings.Join(append([]string{quotePrometheusLabel(name)}, labels...), ",")+"} "+value)
+			continue
+		}
+		lines = append(lines, name+"{"+strings.Join(labels, ",")+"} "+value)
+	}
+	// The samples of a metric family must be contiguous.
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// quotePrometheusLabel quotes a label value as the text format expects.
+func quotePrometheusLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+// quotePromQL quotes a string for a PromQL label matcher.
+func quotePromQL(value string) string {
+	return quotePrometheusLabel(value)
+}
+
+// prometheusNodeMetricNames are the node-exporter metrics the node parsers
+// read. Prometheus is asked for these only, not for every node_ series.
+var prometheusNodeMetricNames = []string{
+	"node_boot_time_seconds",
+	"node_context_switches_total",
+	"node_cpu_seconds_total",
+	"node_disk_io_time_seconds_total",
+	"node_disk_io_time_weighted_seconds_total",
+	"node_disk_read_bytes_total",
+	"node_disk_reads_completed_total",
+	"node_disk_writes_completed_total",
+	"node_disk_written_bytes_total",
+	"node_entropy_available_bits",
+	"node_filefd_allocated",
+	"node_filefd_maximum",
+	"node_filesystem_avail_bytes",
+	"node_filesystem_size_bytes",
+	"node_hwmon_sensor_label",
+	"node_hwmon_temp_celsius",
+	"node_hwmon_temp_crit_celsius",
+	"node_intr_total",
+	"node_load1",
+	"node_load15",
+	"node_load5",
+	"node_md_blocks",
+	"node_md_blocks_synced",
+	"node_md_disks",
+	"node_md_disks_required",
+	"node_md_state",
+	"node_memory_Buffers_bytes",
+	"node_memory_Cached_bytes",
+	"node_memory_MemAvailable_bytes",
+	"node_memory_MemFree_bytes",
+	"node_memory_MemTotal_bytes",
+	"node_memory_SwapFree_bytes",
+	"node_memory_SwapTotal_bytes",
+	"node_netstat_Tcp_CurrEstab",
+	"node_network_receive_bytes_total",
+	"node_network_receive_drop_total",
+	"node_network_receive_errs_total",
+	"node_network_receive_packets_total",
+	"node_network_transmit_bytes_total",
+	"node_network_transmit_drop_total",
+	"node_network_transmit_errs_total",
+	"node_network_transmit_packets_total",
+	"node_pressure_cpu_waiting_seconds_total",
+	"node_pressure_io_stalled_seconds_total",
+	"node_pressure_io_waiting_seconds_total",
+	"node_pressure_memory_stalled_seconds_total",
+	"node_pressure_memory_waiting_seconds_total",
+	"node_procs_blocked",
+	"node_procs_running",
+	"node_sockstat_TCP_alloc",
+	"node_sockstat_TCP_inuse",
+	"node_sockstat_TCP_tw",
+	"node_systemd_unit_state",
+	"node_thermal_zone_temp",
+	"node_time_seconds",
+	"node_timex_offset_seconds",
+	"node_timex_sync_status",
+	"node_vmstat_pgfault",
+	"node_vmstat_pgmajfault",
+}
+
+// prometheusContainerMetricNames are the cAdvisor metrics the container parser
+// reads.
+var prometheusContainerMetricNames = []string{
+	"container_cpu_cfs_periods_total",
+	"container_cpu_cfs_throttled_periods_total",
+	"container_cpu_cfs_throttled_seconds_total",
+	"container_cpu_system_seconds_total",
+	"container_cpu_usage_seconds_total",
+	"container_cpu_user_seconds_total",
+	"container_fs_limit_bytes",
+	"container_fs_reads_bytes_total",
+	"container_fs_usage_bytes",
+	"container_fs_writes_bytes_total",
+	"container_memory_cache",
+	"container_memory_rss",
+	"container_memory_swap",
+	"container_memory_usage_bytes",
+	"container_memory_working_set_bytes",
+	"container_network_receive_bytes_total",
+	"container_network_receive_errors_total",
+	"container_network_receive_packets_dropped_total",
+	"container_network_receive_packets_total",
+	"container_network_transmit_bytes_total",
+	"container_network_transmit_errors_total",
+	"container_network_transmit_packets_dropped_total",
+	"container_network_transmit_packets_total",
+	"container_oom_events_total",
+	"container_spec_cpu_period",
+	"container_spec_cpu_quota",
+	"container_spec_memory_limit_bytes",
+}
+
+// prometheusNameMatcher selects the series of the given metric names.
+func prometheusNameMatcher(names []string) string {
+	return "__name__=~" + quotePromQL(strings.Join(names, "|"))
+}
+
+// prometheusNodeMatcher selects the node-exporter series of the nodes, whose
+// label holds their ID or hostname, with an optional port.
+func prometheusNodeMatcher(nodes ...swarm.Node) string {
+	candidates := make([]string, 0, 2*len(nodes))
+	for _, node := range nodes {
+		candidates = append(candidates, regexp.QuoteMeta(node.ID))
+		if node.Description.Hostname != "" {
+			candidates = append(candidates, regexp.QuoteMeta(node.Description.Hostname))
+		}
+	}
+	return prometheusNodeLabel() + "=~" + quotePromQL("("+strings.Join(candidates, "|")+")(:[0-9]+)?")
+}
+
+// fetchNodeMetricsFromPrometheus returns the node-exporter metrics of a node
+// as Prometheus last scraped them.
+func fetchNodeMetricsFromPrometheus(cli *client.Client, nodeID string) (*ParsedMetrics, error) {
+	node, _, err := cli.NodeInspectWithRaw(context.Background(), nodeID)
+	if err != nil {
+		return nil, err
+	}
+	series, err := queryPrometheus("{" + prometheusNameMatcher(prometheusNodeMetricNames) + "," + prometheusNodeMatcher(node) + "}")
+	if err != nil {
+		return nil, err
+	}
+	if len(series) == 0 {
+		return nil, fmt.Errorf("no node-exporter series with %s matching node %s", prometheusNodeLabel(), nodeID)
+	}
+	return parsePrometheusMetrics(prometheusSeriesToText(series))
+}
+
+// fetchAllNodeMetricsFromPrometheus returns the node-exporter metrics of the
+// swarm nodes known to Prometheus, by node ID. Only the series whose label
+// names one of the nodes are queried.
+func fetchAllNodeMetricsFromPrometheus(nodes []swarm.Node) (map[string]*ParsedMetrics, error) {
+	if len(nodes) == 0 {
+		return map[string]*ParsedMetrics{}, nil
+	}
+	series, err := queryPrometheus("{" + prometheusNameMatcher(prometheusNodeMetricNames) + "," + prometheusNodeMatcher(nodes...) + "}")
+	if err != nil {
+		return nil, err
+	}
+
+	byNode := groupPrometheusSeriesByNode(series, nodes)
+	result := make(map[string]*ParsedMetrics, len(byNode))
+	for nodeID, nodeSeries := range byNode {
+		parsed, err := parsePrometheusMetrics(prometheusSeriesToText(nodeSeries))
+		if err != nil {
+			continue
+		}
+		result[nodeID] = parsed
+	}
+	return result, nil
+}
+
+// groupPrometheusSeriesByNode groups node-exporter series by the ID of the
+// node their label names. Series matching none of the nodes are dropped.
+func groupPrometheusSeriesByNode(series []prometheusSeries, nodes []swarm.Node) map[string][]prometheusSeries {
+	label := prometheusNodeLabel()
+	byNode := make(map[string][]prometheusSeries)
+	for _, s := range series {
+		value := s.Metric[label]
+		if host, _, found := strings.Cut(value, ":"); found {
+			value = host
+		}
+		for _, node := range nodes {
+			if value != "" && (value == node.ID || value == node.Description.Hostname) {
+				byNode[node.ID] = append(byNode[node.ID], s)
+				break
+			}
+		}
+	}
+	return byNode
+}
+
+// fetchContainerMetricsFromPrometheus returns the cAdvisor metrics of the
+// swarm task containers, restricted by an optional PromQL label matcher.
+func fetchContainerMetricsFromPrometheus(matcher string) (*ServiceMemoryMetrics, error) {
+	selector := "{" + prometheusNameMatcher(prometheusContainerMetricNames) + `,container_label_com_docker_swarm_task_id!=""`
+	if matcher != "" {
+		selector += "," + matcher
+	}
+	selector += "}"
+	series, err := queryPrometheus(selector)
+	if err != nil {
+		return nil, err
+	}
+	// The values of an instant query hold no sample time: the counters only
+	// change when Prometheus scrapes cAdvisor, so the rates need that time.
+	times, err := queryPrometheus("max by (id) (timestamp(" + selector + "))")
+	if err != nil {
+		return nil, err
+	}
+	sampledAt := make(map[string]float64, len(times))
+	for _, s := range times {
+		if value, ok := s.Value[1].(string); ok {
+			if at, err := strconv.ParseFloat(value, 64); err == nil {
+				sampledAt[s.Metric["id"]] = at
+			}
+		}
+	}
+
+	// Prometheus already selected the containers; the parser keeps them all.
+	metrics, err := parseCAdvisorMetrics(prometheusSeriesToText(series), "", "")
+	if err != nil {
+		return nil, err
+	}
+	for i := range metrics.ContainerMetrics {
+		container := &metrics.ContainerMetrics[i]
+		container.ServerTime = sampledAt[container.ContainerID]
+		if container.ServerTime > metrics.ServerTime {
+			metrics.ServerTime = container.ServerTime
+		}
+	}
+	return metrics, nil
+}
+
+// prometheusErrorMessage describes a failed Prometheus query.
+func prometheusErrorMessage(err error) *string {
+	msg := fmt.Sprintf("Error querying Prometheus at %s: %v", prometheusURL(), err)
+	return &msg
+}
+
+// writePrometheusNodeMetrics answers a node metrics request from Prometheus.
+func writePrometheusNodeMetrics(w http.ResponseWriter, cli *client.Client, nodeID string) {
+	w.Header().Set("Content-Type", "application/json")
+	parsedMetrics, err := fetchNodeMetricsFromPrometheus(cli, nodeID)
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(nodeMetricsResponse{Available: true, Error: prometheusErrorMessage(err)})
+		return
+	}
+	applyNodeRates(nodeID, parsedMetrics)
+	_ = json.NewEncoder(w).Encode(nodeMetricsResponse{Available: true, Metrics: parsedMetrics})
+}
+
+// writePrometheusClusterMetrics answers a cluster metrics request from
+// Prometheus.
+func writePrometheusClusterMetrics(w http.ResponseWriter, swarmNodes []swarm.Node) {
+	start := time.Now()
+	nodes, err := fetchAllNodeMetricsFromPrometheus(swarmNodes)
+	latency := time.Since(start)
+	breakdown := newClusterNodeBreakdown(swarmNodes, "No node-exporter series in Prometheus for this node")
+	response := clusterMetricsResponse{Available: true, NodeCount: len(swarmNodes)}
+	if err != nil {
+		response.Error = prometheusErrorMessage(err)
+		for _, node := range swarmNodes {
+			breakdown.set(node.ID, prometheusURL(), latency, nil, err)
+		}
+	} else {
+		nodeMetrics := make([]*ParsedMetrics, 0, len(nodes))
+		for nodeID, metrics := range nodes {
+			applyNodeRates(nodeID, metrics)
+			breakdown.set(nodeID, prometheusURL(), latency, metrics, nil)
+			nodeMetrics = append(nodeMetrics, metrics)
+		}
+		response.clusterMetricsTotals = aggregateClusterMetrics(nodeMetrics)
+	}
+	response.Nodes = breakdown.list()
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// writePrometheusServiceMetrics answers a service metrics request from
+// Prometheus.
+func writePrometheusServiceMetrics(w http.ResponseWriter, serviceID string) {
+	w.Header().Set("Content-Type", "application/json")
+	metrics, err := fetchContainerMetricsFromPrometheus("container_label_com_docker_swarm_service_id=" + quotePromQL(serviceID))
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(serviceMetricsResponse{Available: true, Error: prometheusErrorMessage(err)})
+		return
+	}
+	applyContainerRates(metrics.ContainerMetrics)
+	_ = json.NewEncoder(w).Encode(serviceMetricsResponse{Available: true, Metrics: metrics})
+}
+
+// writePrometheusTaskMetrics answers a task metrics request from Prometheus.
+func writePrometheusTaskMetrics(w http.ResponseWriter, taskID string) {
+	metrics, err := fetchContainerMetricsFromPrometheus("container_label_com_docker_swarm_task_id=" + quotePromQL(taskID))
+	response := taskMetricsResponse{Available: true}
+	switch {
+	case err != nil:
+		response.Available = false
+		response.Error = prometheusErrorMessage(err)
+	case len(metrics.ContainerMetrics) == 0:
+		msg := "Metrics not available for this task"
+		response.Available = false
+		response.Message = &msg
+	default:
+		applyContainerRates(metrics.ContainerMetrics)
+		response.Metrics = &metrics.ContainerMetrics[0]
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("taskMetricsHandler: encoding response failed: %v", err)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/gorilla/mux"
+)
+
+// stubPrometheus serves canned series for the queries containing a key of
+// `results`, the longest matching key first, and records the queries it
+// received.
+func stubPrometheus(t *testing.T, results map[string][]prometheusSeries) (*httptest.Server, *[]string) {
+	t.Helper()
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+		var response prometheusQueryResponse
+		response.Status = "success"
+		response.Data.ResultType = "vector"
+		response.Data.Result = []prometheusSeries{}
+		matched := ""
+		for key, series := range results {
+			if strings.Contains(query, key) && len(key) > len(matched) {
+				response.Data.Result, matched = series, key
+			}
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	t.Setenv(metricsBackendEnv, metricsBackendPrometheus)
+	t.Setenv(prometheusURLEnv, srv.URL+"/")
+	t.Cleanup(srv.Close)
+	return srv, &queries
+}
+
+// series builds a Prometheus sample.
+func series(value string, labels ...string) prometheusSeries {
+	metric := make(map[string]string)
+	for i := 0; i+1 < len(labels); i += 2 {
+		metric[labels[i]] = labels[i+1]
+	}
+	return prometheusSeries{Metric: metric, Value: [2]interface{}{1700000000.0, value}}
+}
+
+// stubDocker serves the given JSON bodies by API path.
+func stubDocker(t *testing.T, bodies map[string]interface{}) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(ResetCli)
+	SetCli(makeClientForServer(t, srv.URL))
+}
+
+var prometheusNodeSeries = []prometheusSeries{
+	series("1700000000", "__name__", "node_time_seconds", "instance", "worker-1:9100"),
+	series("8", "__name__", "node_cpu_seconds_total", "instance", "worker-1:9100", "cpu", "0", "mode", "idle"),
+	series("1000", "__name__", "node_memory_MemTotal_bytes", "instance", "worker-1:9100"),
+	series("250", "__name__", "node_memory_MemAvailable_bytes", "instance", "worker-1:9100"),
+	series("500", "__name__", "node_memory_MemTotal_bytes", "instance", "unknown:9100"),
+}
+
+// TestPrometheusSeriesToText verifies that Prometheus series are rendered in
+// the text format, families kept together and label values escaped.
+func TestPrometheusSeriesToText(t *testing.T) {
+	text := prometheusSeriesToText([]prometheusSeries{
+		series("2", "__name__", "b_total", "x", "1"),
+		series("1", "__name__", "a", "path", `C:\dir "quoted"`),
+		series("3", "__name__", "b_total", "x", "2"),
+		series("4", "job", "nameless"),
+	})
+	want := "a{path=\"C:\\\\dir \\\"quoted\\\"\"} 1\nb_total{x=\"1\"} 2\nb_total{x=\"2\"} 3\n"
+	if text != want {
+		t.Fatalf("expected %q, got %q", want, text)
+	}
+}
+
+// TestPrometheusSeriesToText_UTF8 verifies that UTF-8 metric and label names
+// are quoted and parse back.
+func TestPrometheusSeriesToText_UTF8(t *testing.T) {
+	text := prometheusSeriesToText([]prometheusSeries{series("1", "__name__", "node.load", "host.name", "a")})
+	if want := "{\"node.load\",\"host.name\"=\"a\"} 1\n"; text != want {
+		t.Fatalf("expected %q, got %q", want, text)
+	}
+	families, err := decodeTextMetrics(strings.NewReader(text))
+	if err != nil || families["node.load"] == nil || metricLabel(families["node.load"].GetMetric()[0], "host.name") != "a" {
+		t.Fatalf("expected the quoted names to parse, got %v/%v", families, err)
+	}
+}
+
+// TestMetricsBackend verifies the backend selection.
+func TestMetricsBackend(t *testing.T) {
+	for value, want := range map[string]string{"": metricsBackendExporters, "Prometheus": metricsBackendPrometheus, "bogus": metricsBackendExporters} {
+		t.Setenv(metricsBackendEnv, value)
+		if got := metricsBackend(); got != want {
+			t.Errorf("%q: expected %q, got %q", value, want, got)
+		}
+	}
+}
+
+// TestNodeMetricsHandler_Prometheus verifies that node metrics are read from
+// Prometheus, selecting the node by hostname.
+func TestNodeMetricsHandler_Prometheus(t *testing.T) {
+	_, queries := stubPrometheus(t, map[string][]prometheusSeries{"node_": prometheusNodeSeries[:4]})
+	node := swarm.Node{ID: "n1", Description: swarm.NodeDescription{Hostname: "worker-1"}}
+	stubDocker(t, map[string]interface{}{"/v1.35/nodes/n1": node})
+
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n1/metrics", nil), map[string]string{"id": "n1"})
+	rr := httptest.NewRecorder()
+	nodeMetricsHandler(rr, r)
+
+	var response nodeMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || response.Metrics == nil || response.Metrics.Memory.Total != 1000 || response.Metrics.ServerTime != 1700000000 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if len(*queries) != 1 || !strings.Contains((*queries)[0], `instance=~"(n1|worker-1)(:[0-9]+)?"`) {
+		t.Fatalf("unexpected queries %q", *queries)
+	}
+	if strings.Contains((*queries)[0], ".+") || !strings.Contains((*queries)[0], "|node_memory_MemTotal_bytes|") {
+		t.Fatalf("expected the query to select the parsed metric names, got %q", (*queries)[0])
+	}
+}
+
+// TestClusterMetricsHandler_Prometheus verifies that only the series of the
+// swarm nodes are queried, grouped by node, and the ones of unknown nodes
+// ignored.
+func TestClusterMetricsHandler_Prometheus(t *testing.T) {
+	_, queries := stubPrometheus(t, map[string][]prometheusSeries{"node_": prometheusNodeSeries})
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": []swarm.Node{{ID: "n1", Description: swarm.NodeDescription{Hostname: "worker-1"}}, {ID: "n2"}},
+	})
+
+	rr := httptest.NewRecorder()
+	clusterMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics", nil))
+
+	var response clusterMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || response.NodeCount != 2 || response.NodesAvailable != 1 || response.TotalMemory != 1000 || response.UsedMemory != 750 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if len(response.Nodes) != 2 || !response.Nodes[1].Available || response.Nodes[0].NodeID != "n2" || response.Nodes[0].Error == nil {
+		t.Fatalf("expected n2 to be reported as missing from Prometheus, got %+v", response.Nodes)
+	}
+	if len(*queries) != 1 || !strings.Contains((*queries)[0], `instance=~"(n1|worker-1|n2)(:[0-9]+)?"`) {
+		t.Fatalf("expected the query to select the swarm nodes, got %q", *queries)
+	}
+}
+
+// TestServiceAndTaskMetricsHandlers_Prometheus verifies that container metrics
+// are read from Prometheus.
+func TestServiceAndTaskMetricsHandlers_Prometheus(t *testing.T) {
+	containerSeries := []prometheusSeries{
+		series("100", "__name__", "container_memory_usage_bytes", "id", "/docker/c1",
+			"container_label_com_docker_swarm_task_id", "t1", "container_label_com_docker_swarm_service_name", "web"),
+		series("400", "__name__", "container_spec_memory_limit_bytes", "id", "/docker/c1",
+			"container_label_com_docker_swarm_task_id", "t1", "container_label_com_docker_swarm_service_name", "web"),
+	}
+	_, queries := stubPrometheus(t, map[string][]prometheusSeries{"container_": containerSeries})
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/services": []swarm.Service{{ID: "s1", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "web"}}}},
+		"/v1.35/tasks/t1": swarm.Task{ID: "t1", ServiceID: "s1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning}},
+	})
+
+	rr := httptest.NewRecorder()
+	serviceMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/services/s1/metrics", nil), map[string]string{"id": "s1"}))
+	var serviceResponse serviceMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &serviceResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !serviceResponse.Available || serviceResponse.Metrics == nil || serviceResponse.Metrics.TotalUsage != 100 || serviceResponse.Metrics.AveragePercent != 25 {
+		t.Fatalf("unexpected service response %s", rr.Body.String())
+	}
+	if !strings.Contains((*queries)[0], `container_label_com_docker_swarm_service_id="s1"`) {
+		t.Fatalf("expected the query to select the service, got %q", (*queries)[0])
+	}
+	if strings.Contains((*queries)[0], ".+") || !strings.Contains((*queries)[0], "|container_memory_usage_bytes|") {
+		t.Fatalf("expected the query to select the parsed metric names, got %q", (*queries)[0])
+	}
+
+	rr = httptest.NewRecorder()
+	taskMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/tasks/t1/metrics", nil), map[string]string{"id": "t1"}))
+	var taskResponse taskMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &taskResponse); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !taskResponse.Available || taskResponse.Metrics == nil || taskResponse.Metrics.TaskID != "t1" || taskResponse.Metrics.Limit != 400 {
+		t.Fatalf("unexpected task response %s", rr.Body.String())
+	}
+}
+
+// TestFetchContainerMetricsFromPrometheus_Rates verifies that the container
+// rates are derived over the time Prometheus scraped the counters, so reading
+// them again before the next scrape leaves the rates pending instead of zero.
+func TestFetchContainerMetricsFromPrometheus_Rates(t *testing.T) {
+	containerRateSamples = newCounterSampler()
+	defer func() { containerRateSamples = newCounterSampler() }()
+	sample := func(cpu, at string) ContainerMemoryMetrics {
+		_, queries := stubPrometheus(t, map[string][]prometheusSeries{
+			"container_":              {series(cpu, "__name__", "container_cpu_usage_seconds_total", "id", "/docker/c1", "container_label_com_docker_swarm_task_id", "t1")},
+			"max by (id) (timestamp(": {series(at, "id", "/docker/c1")},
+		})
+		metrics, err := fetchContainerMetricsFromPrometheus("")
+		if err != nil || len(metrics.ContainerMetrics) != 1 {
+			t.Fatalf("unexpected metrics %+v/%v", metrics, err)
+		}
+		if len(*queries) != 2 || !strings.HasPrefix((*queries)[1], "max by (id) (timestamp({") {
+			t.Fatalf("expected the sample times to be queried, got %q", *queries)
+		}
+		applyContainerRates(metrics.ContainerMetrics)
+		return metrics.ContainerMetrics[0]
+	}
+
+	if first := sample("10", "1700000000"); first.ServerTime != 1700000000 || first.CPUUsagePercent != 0 {
+		t.Fatalf("unexpected first sample %+v", first)
+	}
+	if again := sample("10", "1700000000"); again.CPUUsagePercent != 0 || containerRateSamples.samples["/docker/c1"].rates != nil {
+		t.Fatalf("expected the rates to stay pending until Prometheus scrapes again, got %+v", again)
+	}
+	if next := sample("25", "1700000015"); next.CPUUsagePercent != 100 {
+		t.Fatalf("expected a full core over the scrape interval, got %+v", next)
+	}
+}
+
+// TestQueryPrometheus_Errors verifies that failed queries are reported.
+func TestQueryPrometheus_Errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+	}))
+	defer srv.Close()
+	t.Setenv(prometheusURLEnv, srv.URL)
+	if _, err := queryPrometheus("up"); err == nil || !strings.Contains(err.Error(), "parse error") {
+		t.Fatalf("expected the Prometheus error, got %v", err)
+	}
+
+	t.Setenv(prometheusURLEnv, "http://127.0.0.1:1")
+	if _, err := queryPrometheus("up"); err == nil {
+		t.Fatal("expected an error for an unreachable server")
+	}
+}
+
+// nodeExporterExposition is node-exporter output with families of every
+// section the node parsers read, and some they ignore.
+const nodeExporterExposition = `node_boot_time_seconds 1.6999e+09
+node_context_switches_total 5000
+node_cpu_seconds_total{cpu="0",mode="idle"} 900
+node_cpu_seconds_total{cpu="0",mode="user"} 100
+node_disk_io_time_seconds_total{device="sda"} 12
+node_disk_io_time_weighted_seconds_total{device="sda"} 20
+node_disk_read_bytes_total{device="sda"} 4096
+node_disk_reads_completed_total{device="sda"} 8
+node_disk_writes_completed_total{device="sda"} 4
+node_disk_written_bytes_total{device="sda"} 2048
+node_entropy_available_bits 256
+node_filefd_allocated 1000
+node_filefd_maximum 100000
+node_filesystem_avail_bytes{device="/dev/sda1",fstype="ext4",mountpoint="/"} 400
+node_filesystem_size_bytes{device="/dev/sda1",fstype="ext4",mountpoint="/"} 1000
+node_hwmon_sensor_label{chip="platform_coretemp_0",label="Core 0",sensor="temp2"} 1
+node_hwmon_temp_celsius{chip="platform_coretemp_0",sensor="temp2"} 45
+node_hwmon_temp_crit_celsius{chip="platform_coretemp_0",sensor="temp2"} 100
+node_intr_total 7000
+node_load1 0.5
+node_load5 0.4
+node_load15 0.3
+node_md_blocks{device="md0"} 1000
+node_md_blocks_synced{device="md0"} 500
+node_md_disks{device="md0",state="active"} 2
+node_md_disks{device="md0",state="failed"} 0
+node_md_disks_required{device="md0"} 2
+node_md_state{device="md0",state="resync"} 1
+node_memory_Buffers_bytes 10
+node_memory_Cached_bytes 20
+node_memory_MemAvailable_bytes 250
+node_memory_MemFree_bytes 100
+node_memory_MemTotal_bytes 1000
+node_memory_SwapFree_bytes 50
+node_memory_SwapTotal_bytes 100
+node_netstat_Tcp_CurrEstab 12
+node_network_receive_bytes_total{device="eth0"} 3000
+node_network_receive_drop_total{device="eth0"} 1
+node_network_receive_errs_total{device="eth0"} 2
+node_network_receive_packets_total{device="eth0"} 30
+node_network_transmit_bytes_total{device="eth0"} 4000
+node_network_transmit_drop_total{device="eth0"} 3
+node_network_transmit_errs_total{device="eth0"} 4
+node_network_transmit_packets_total{device="eth0"} 40
+node_network_up{device="eth0"} 1
+node_pressure_cpu_waiting_seconds_total 12
+node_pressure_io_stalled_seconds_total 20
+node_pressure_io_waiting_seconds_total 40
+node_pressure_memory_stalled_seconds_total 1
+node_pressure_memory_waiting_seconds_total 3
+node_procs_blocked 1
+node_procs_running 3
+node_scrape_collector_success{collector="cpu"} 1
+node_sockstat_TCP_alloc 9
+node_sockstat_TCP_inuse 7
+node_sockstat_TCP_tw 2
+node_systemd_unit_state{name="backup.service",state="failed",type="simple"} 1
+node_systemd_unit_state{name="docker.service",state="active",type="notify"} 1
+node_thermal_zone_temp{type="x86_pkg_temp",zone="0"} 50
+node_time_seconds 1.7e+09
+node_timex_offset_seconds 0.001
+node_timex_sync_status 1
+node_uname_info{machine="x86_64",nodename="worker-1",release="6.1.0",sysname="Linux"} 1
+node_vmstat_pgfault 100
+node_vmstat_pgmajfault 10
+`
+
+// cadvisorExposition is cAdvisor output for a swarm task container, with
+// families the container parser ignores.
+const cadvisorExposition = `container_cpu_cfs_periods_total{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 100
+container_cpu_cfs_throttled_periods_total{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 10
+container_cpu_cfs_throttled_seconds_total{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 2
+container_cpu_system_seconds_total{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 3
+container_cpu_usage_seconds_total{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 9
+container_cpu_user_seconds_total{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 6
+container_fs_limit_bytes{device="/dev/sda1",id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 1000
+container_fs_reads_bytes_total{device="/dev/sda1",id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 50
+container_fs_usage_bytes{device="/dev/sda1",id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 200
+container_fs_writes_bytes_total{device="/dev/sda1",id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 60
+container_last_seen{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 1.7e+09
+container_memory_cache{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 30
+container_memory_rss{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 70
+container_memory_swap{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 5
+container_memory_usage_bytes{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 100
+container_memory_working_set_bytes{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 90
+container_network_receive_bytes_total{id="/docker/c1",interface="eth0",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 300
+container_network_receive_errors_total{id="/docker/c1",interface="eth0",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 1
+container_network_receive_packets_dropped_total{id="/docker/c1",interface="eth0",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 2
+container_network_receive_packets_total{id="/docker/c1",interface="eth0",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 30
+container_network_transmit_bytes_total{id="/docker/c1",interface="eth0",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 400
+container_network_transmit_errors_total{id="/docker/c1",interface="eth0",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 3
+container_network_transmit_packets_dropped_total{id="/docker/c1",interface="eth0",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 4
+container_network_transmit_packets_total{id="/docker/c1",interface="eth0",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 40
+container_oom_events_total{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 1
+container_spec_cpu_period{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 100000
+container_spec_cpu_quota{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 50000
+container_spec_memory_limit_bytes{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 400
+container_start_time_seconds{id="/docker/c1",container_label_com_docker_swarm_service_name="web",container_label_com_docker_swarm_task_id="t1"} 1.6999e+09
+`
+
+// keepMetricNames keeps the samples of the given metric names, as the
+// Prometheus name matcher does.
+func keepMetricNames(t *testing.T, text string, names []string) string {
+	t.Helper()
+	matcher := regexp.MustCompile("^(" + strings.Join(names, "|") + ")$")
+	var kept []string
+	for _, line := range strings.Split(text, "\n") {
+		name, _, _ := strings.Cut(line, "{")
+		name, _, _ = strings.Cut(name, " ")
+		if matcher.MatchString(name) {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(strings.Split(strings.TrimSpace(text), "\n")) {
+		t.Fatalf("expected the fixture to hold metrics the parsers ignore")
+	}
+	return strings.Join(kept, "\n") + "\n"
+}
+
+// TestPrometheusMetricNames_CoverParsers verifies that the metric names asked
+// from Prometheus hold every metric the parsers read: parsing only them gives
+// the same result as parsing the whole exposition.
+func TestPrometheusMetricNames_CoverParsers(t *testing.T) {
+	all, err := parsePrometheusMetrics(nodeExporterExposition)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	selected, err := parsePrometheusMetrics(keepMetricNames(t, nodeExporterExposition, prometheusNodeMetricNames))
+	if err != nil {
+		t.Fatalf("parse selected: %v", err)
+	}
+	// The CPU modes are listed in no particular order.
+	for _, parsed := range []*ParsedMetrics{all, selected} {
+		sort.Slice(parsed.CPU, func(i, j int) bool { return parsed.CPU[i].Mode < parsed.CPU[j].Mode })
+	}
+	if !reflect.DeepEqual(all, selected) {
+		t.Errorf("node metrics differ when only the selected names are parsed:\nall      %+v\nselected %+v", all, selected)
+	}
+
+	allContainers, _ := parseCAdvisorMetrics(cadvisorExposition, "", "web")
+	selectedContainers, _ := parseCAdvisorMetrics(keepMetricNames(t, cadvisorExposition, prometheusContainerMetricNames), "", "web")
+	if len(allContainers.ContainerMetrics) != 1 {
+		t.Fatalf("expected the container of the fixture, got %+v", allContainers)
+	}
+	if !reflect.DeepEqual(allContainers, selectedContainers) {
+		t.Errorf("container metrics differ when only the selected names are parsed:\nall      %+v\nselected %+v", allContainers, selectedContainers)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/gorilla/mux"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// rawValue is a sample value. Values JSON cannot represent, NaN and the
+// infinities, are encoded as the strings Prometheus uses.
+type rawValue float64
+
+func (v rawValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return []byte(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+func (v *rawValue) UnmarshalJSON(data []byte) error {
+	var f float64
+	if err := json.Unmarshal(data, &f); err == nil {
+		*v = rawValue(f)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = rawValue(f)
+	return nil
+}
+
+// rawBucket is a cumulative histogram bucket
+type rawBucket struct {
+	UpperBound rawValue `json:"upperBound"`
+	Count      rawValue `json:"count"`
+}
+
+// rawQuantile is a summary quantile
+type rawQuantile struct {
+	Quantile rawValue `json:"quantile"`
+	Value    rawValue `json:"value"`
+}
+
+// rawMetricSample is a sample of a metric family. Counters, gauges and
+// untyped metrics have a value; summaries and histograms a count and a sum.
+type rawMetricSample struct {
+	Labels    map[string]string `json:"labels"`
+	Value     *rawValue         `json:"value,omitempty"`
+	Count     *rawValue         `json:"count,omitempty"`
+	Sum       *rawValue         `json:"sum,omitempty"`
+	Buckets   []rawBucket       `json:"buckets,omitempty"`
+	Quantiles []rawQuantile     `json:"quantiles,omitempty"`
+}
+
+// rawMetricFamily is a metric family as the exporter exposes it
+type rawMetricFamily struct {
+	Name    string            `json:"name"`
+	Help    string            `json:"help,omitempty"`
+	Type    string            `json:"type"`
+	Samples []rawMetricSample `json:"samples"`
+}
+
+// rawMetricsResponse represents the response structure for the raw metrics endpoint of a node
+type rawMetricsResponse struct {
+	Available bool              `json:"available"`
+	Families  []rawMetricFamily `json:"families,omitempty"`
+	Error     *string           `json:"error,omitempty"`
+	Message   *string           `json:"message,omitempty"`
+}
+
+// rawNodeMetrics holds the matching metric families of one node
+type rawNodeMetrics struct {
+	NodeID    string            `json:"nodeId"`
+	Hostname  string            `json:"hostname"`
+	Available bool              `json:"available"`
+	Families  []rawMetricFamily `json:"families"`
+	Error     *string           `json:"error,omitempty"`
+}
+
+// rawClusterMetricsResponse represents the response structure for the cluster-wide raw metrics endpoint
+type rawClusterMetricsResponse struct {
+	Available bool             `json:"available"`
+	Nodes     []rawNodeMetrics `json:"nodes,omitempty"`
+	Error     *string          `json:"error,omitempty"`
+	Message   *string          `json:"message,omitempty"`
+}
+
+// parseRawMatch compiles the `match` parameter, a regular expression the
+// whole metric family name must match, like a PromQL `__name__=~` matcher.
+func parseRawMatch(r *http.Request) (*regexp.Regexp, error) {
+	match := r.URL.Query().Get("match")
+	if match == "" {
+		return nil, fmt.Errorf("match is required, e.g. match=node_textfile_.+")
+	}
+	re, err := regexp.Compile("^(?:" + match + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid match %q: %v", match, err)
+	}
+	return re, nil
+}
+
+// parseRawMetricFamilies parses metrics in the text format and returns the
+// families whose name matches, sorted by name.
+func parseRawMetricFamilies(metricsText string, match *regexp.Regexp) ([]rawMetricFamily, error) {
+	metricFamilies, err := decodeTextMetrics(strings.NewReader(metricsText))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics: %w", err)
+	}
+	return selectRawMetricFamilies(metricFamilies, match), nil
+}
+
+// selectRawMetricFamilies returns the families whose name matches, sorted by
+// name.
+func selectRawMetricFamilies(metricFamilies map[string]*dto.MetricFamily, match *regexp.Regexp) []rawMetricFamily {
+	families := make([]rawMetricFamily, 0)
+	for name, family := range metricFamilies {
+		if !match.MatchString(name) {
+			continue
+		}
+		raw := rawMetricFamily{
+			Name:    name,
+			Help:    family.GetHelp(),
+			Type:    strings.ToLower(family.GetType().String()),
+			Samples: make([]rawMetricSample, 0, len(family.GetMetric())),
+		}
+		for _, metric := range family.GetMetric() {
+			raw.Samples = append(raw.Samples, rawSample(metric))
+		}
+		families = append(families, raw)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].Name < families[j].Name })
+	return families
+}
+
+// rawSample converts a parsed metric to a sample
+func rawSample(metric *dto.Metric) rawMetricSample {
+	sample := rawMetricSample{Labels: make(map[string]string, len(metric.GetLabel()))}
+	for _, label := range metric.GetLabel() {
+		sample.Labels[label.GetName()] = label.GetValue()
+	}
+	value := func(f float64) *rawValue {
+		v := rawValue(f)
+		return &v
+	}
+	switch {
+	case metric.GetSummary() != nil:
+		summary := metric.GetSummary()
+		sample.Count, sample.Sum = value(float64(summary.GetSampleCount())), value(summary.GetSampleSum())
+		for _, q := range summary.GetQuantile() {
+			sample.Quantiles = append(sample.Quantiles, rawQuantile{Quantile: rawValue(q.GetQuantile()), Value: rawValue(q.GetValue())})
+		}
+	case metric.GetHistogram() != nil:
+		histogram := metric.GetHistogram()
+		sample.Count, sample.Sum = value(float64(histogram.GetSampleCount())), value(histogram.GetSampleSum())
+		for _, b := range histogram.GetBucket() {
+			sample.Buckets = append(sample.Buckets, rawBucket{UpperBound: rawValue(b.GetUpperBound()), Count: rawValue(float64(b.GetCumulativeCount()))})
+		}
+	default:
+		sample.Value = value(getMetricValue(metric))
+	}
+	return sample
+}
+
+// scrapeRawNodeMetrics returns the matching metric families of the
+// node-exporter of a node.
+func scrapeRawNodeMetrics(cli *client.Client, service *swarm.Service, nodeID string, match *regexp.Regexp) ([]rawMetricFamily, error) {
+	endpoint, err := cachedNodeExporterEndpoint(cli, service, nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("error constructing node-exporter endpoint: %w", err)
+	}
+	metricFamilies, err := scrapeNodeExporter(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching metrics from node-exporter: %w", err)
+	}
+	return selectRawMetricFamilies(metricFamilies, match), nil
+}
+
+// prometheusRawSelector selects the series whose name matches. Prometheus
+// anchors the regular expression itself.
+func prometheusRawSelector(r *http.Request, matchers ...string) string {
+	return `{` + strings.Join(append([]string{"__name__=~" + quotePromQL(r.URL.Query().Get("match"))}, matchers...), ",") + `}`
+}
+
+// nodeRawMetricsHandler returns the metric families of the node-exporter of a
+// node whose name matches the `match` regular expression.
+func nodeRawMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	nodeID := mux.Vars(r)["id"]
+	if nodeID == "" {
+		http.Error(w, "Node ID is required", http.StatusBadRequest)
+		return
+	}
+	match, err := parseRawMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse := func(response rawMetricsResponse) {
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("nodeRawMetricsHandler: encoding response failed: %v", err)
+		}
+	}
+
+	cli, err := getCli()
+	if err != nil {
+		errMsg := "Error getting Docker client: " + err.Error()
+		writeResponse(rawMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+
+	if usingPrometheusBackend() {
+		node, _, err := cli.NodeInspectWithRaw(context.Background(), nodeID)
+		if err != nil {
+			errMsg := "Error inspecting node: " + err.Error()
+			writeResponse(rawMetricsResponse{Available: false, Error: &errMsg})
+			return
+		}
+		series, err := queryPrometheus(prometheusRawSelector(r, prometheusNodeMatcher(node)))
+		if err != nil {
+			writeResponse(rawMetricsResponse{Available: true, Error: prometheusErrorMessage(err)})
+			return
+		}
+		families, err := parseRawMetricFamilies(prometheusSeriesToText(series), match)
+		if err != nil {
+			errMsg := err.Error()
+			writeResponse(rawMetricsResponse{Available: true, Error: &errMsg})
+			return
+		}
+		writeResponse(rawMetricsResponse{Available: true, Families: families})
+		return
+	}
+
+	service, err := cachedNodeExporterService(cli)
+	if err != nil {
+		errMsg := "Error finding node-exporter service: " + err.Error()
+		writeResponse(rawMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	if service == nil {
+		msg := fmt.Sprintf("Node-exporter service not found. Deploy a global service with label '%s' to enable metrics.", nodeExporterLabel)
+		writeResponse(rawMetricsResponse{Available: false, Message: &msg})
+		return
+	}
+
+	families, err := scrapeRawNodeMetrics(cli, service, nodeID, match)
+	if err != nil {
+		errMsg := err.Error()
+		writeResponse(rawMetricsResponse{Available: true, Error: &errMsg})
+		return
+	}
+	writeResponse(rawMetricsResponse{Available: true, Families: families})
+}
+
+// clusterRawMetricsHandler returns, for every node, the metric families of its
+// node-exporter whose name matches the `match` regular expression.
+func clusterRawMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	match, err := parseRawMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse := func(response rawClusterMetricsResponse) {
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("clusterRawMetricsHandler: encoding response failed: %v", err)
+		}
+	}
+
+	cli, err := getCli()
+	if err != nil {
+		errMsg := "Error getting Docker client: " + err.Error()
+		writeResponse(rawClusterMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	nodes, err := cli.NodeList(context.Background(), swarm.NodeListOptions{})
+	if err != nil {
+		errMsg := "Error listing nodes: " + err.Error()
+		writeResponse(rawClusterMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Description.Hostname < nodes[j].Description.Hostname })
+
+	results := make([]rawNodeMetrics, len(nodes))
+	setResult := func(i int, families []rawMetricFamily, err error) {
+		results[i] = rawNodeMetrics{NodeID: nodes[i].ID, Hostname: nodes[i].Description.Hostname, Available: err == nil, Families: families}
+		if families == nil {
+			results[i].Families = []rawMetricFamily{}
+		}
+		if err != nil {
+			errMsg := err.Error()
+			results[i].Error = &errMsg
+		}
+	}
+
+	if usingPrometheusBackend() {
+		series, err := queryPrometheus(prometheusRawSelector(r))
+		if err != nil {
+			writeResponse(rawClusterMetricsResponse{Available: true, Error: prometheusErrorMessage(err)})
+			return
+		}
+		byNode := groupPrometheusSeriesByNode(series, nodes)
+		for i, node := range nodes {
+			families, err := parseRawMetricFamilies(prometheusSeriesToText(byNode[node.ID]), match)
+			setResult(i, families, err)
+		}
+		writeResponse(rawClusterMetricsResponse{Available: true, Nodes: results})
+		return
+	}
+
+	service, err := cachedNodeExporterService(cli)
+	if err != nil {
+		errMsg := "Error finding node-exporter service: " + err.Error()
+		writeResponse(rawClusterMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	if service == nil {
+		msg := fmt.Sprintf("Node-exporter service not found. Deploy a global service with label '%s' to enable metrics.", nodeExporterLabel)
+		writeResponse(rawClusterMetricsResponse{Available: false, Message: &msg})
+		return
+	}
+
+	fanOut := newMetricsFanOut()
+	for i := range nodes {
+		index := i
+		fanOut.Go(func() {
+			families, err := scrapeRawNodeMetrics(cli, service, nodes[index].ID, match)
+			setResult(index, families, err)
+		})
+	}
+	fanOut.Wait()
+	writeResponse(rawClusterMetricsResponse{Available: true, Nodes: results})
+}
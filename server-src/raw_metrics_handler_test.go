@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/gorilla/mux"
+)
+
+const rawNodeExporterMetrics = `# HELP node_textfile_backup_age_seconds Age of the last backup.
+# TYPE node_textfile_backup_age_seconds gauge
+node_textfile_backup_age_seconds{job="db"} 3600
+node_textfile_backup_age_seconds{job="files"} NaN
+# TYPE node_load1 gauge
+node_load1 0.5
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.1"} 3
+http_request_duration_seconds_bucket{le="+Inf"} 5
+http_request_duration_seconds_sum 1.5
+http_request_duration_seconds_count 5
+`
+
+// TestParseRawMetricFamilies verifies that the whole name must match and that
+// labels, values and histograms are kept.
+func TestParseRawMetricFamilies(t *testing.T) {
+	families, err := parseRawMetricFamilies(rawNodeExporterMetrics, regexp.MustCompile("^(?:node_textfile_.+|http_.+)$"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(families) != 2 || families[0].Name != "http_request_duration_seconds" || families[1].Name != "node_textfile_backup_age_seconds" {
+		t.Fatalf("unexpected families %+v", families)
+	}
+	backup := families[1]
+	if backup.Type != "gauge" || backup.Help != "Age of the last backup." || len(backup.Samples) != 2 || backup.Samples[0].Labels["job"] != "db" || *backup.Samples[0].Value != 3600 {
+		t.Fatalf("unexpected gauge %+v", backup)
+	}
+	histogram := families[0].Samples[0]
+	if families[0].Type != "histogram" || *histogram.Count != 5 || *histogram.Sum != 1.5 || len(histogram.Buckets) != 2 {
+		t.Fatalf("unexpected histogram %+v", families[0])
+	}
+
+	// NaN and +Inf are not valid JSON numbers.
+	encoded, err := json.Marshal(families)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if !strings.Contains(string(encoded), `"value":"NaN"`) || !strings.Contains(string(encoded), `"upperBound":"+Inf"`) || !strings.Contains(string(encoded), `"value":3600`) {
+		t.Fatalf("unexpected encoding %s", encoded)
+	}
+
+	if _, err := parseRawMetricFamilies("not a metric{", regexp.MustCompile(".*")); err == nil {
+		t.Fatal("expected a parse error")
+	}
+}
+
+// TestRawMetricsHandlers_BadMatch verifies that a missing or invalid match is rejected.
+func TestRawMetricsHandlers_BadMatch(t *testing.T) {
+	for _, query := range []string{"", "?match=(", "?match="} {
+		rr := httptest.NewRecorder()
+		nodeRawMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n1/metrics/raw"+query, nil), map[string]string{"id": "n1"}))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("node %q: expected 400, got %d", query, rr.Code)
+		}
+		rr = httptest.NewRecorder()
+		clusterRawMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics/raw"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("cluster %q: expected 400, got %d", query, rr.Code)
+		}
+	}
+}
+
+// TestNodeRawMetricsHandler verifies the matching families of a node-exporter.
+func TestNodeRawMetricsHandler(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(rawNodeExporterMetrics))
+	}))
+	defer exporter.Close()
+	u, _ := url.Parse(exporter.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": []swarm.Node{{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}}},
+		"/v1.35/services": []swarm.Service{{ID: "s-exporter", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{nodeExporterLabel: "true"}}},
+			Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}}},
+		"/v1.35/tasks": []swarm.Task{{NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}}},
+	})
+
+	rr := httptest.NewRecorder()
+	nodeRawMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n1/metrics/raw?match=node_textfile_.%2B", nil), map[string]string{"id": "n1"}))
+	var response rawMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v (%s)", err, rr.Body.String())
+	}
+	if !response.Available || len(response.Families) != 1 || response.Families[0].Name != "node_textfile_backup_age_seconds" {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	clusterRawMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics/raw?match=node_load1", nil))
+	var cluster rawClusterMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &cluster); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !cluster.Available || len(cluster.Nodes) != 1 || !cluster.Nodes[0].Available || cluster.Nodes[0].Hostname != "alpha" || len(cluster.Nodes[0].Families) != 1 {
+		t.Fatalf("unexpected cluster response %s", rr.Body.String())
+	}
+}
+
+// TestClusterRawMetricsHandler_Prometheus verifies that the series are queried
+// by name and grouped by node.
+func TestClusterRawMetricsHandler_Prometheus(t *testing.T) {
+	_, queries := stubPrometheus(t, map[string][]prometheusSeries{"node_textfile": {
+		series("3600", "__name__", "node_textfile_backup_age_seconds", "instance", "alpha:9100", "job", "db"),
+		series("60", "__name__", "node_textfile_backup_age_seconds", "instance", "unknown:9100", "job", "db"),
+	}})
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": []swarm.Node{{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}}, {ID: "n2", Description: swarm.NodeDescription{Hostname: "beta"}}},
+	})
+
+	rr := httptest.NewRecorder()
+	clusterRawMetricsHandler(rr, httptest.NewRequest("GET", "/docker/nodes/metrics/raw?match=node_textfile_.%2B", nil))
+	var response rawClusterMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(response.Nodes) != 2 || len(response.Nodes[0].Families) != 1 || *response.Nodes[0].Families[0].Samples[0].Value != 3600 || len(response.Nodes[1].Families) != 0 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if (*queries)[0] != `{__name__=~"node_textfile_.+"}` {
+		t.Fatalf("unexpected query %q", (*queries)[0])
+	}
+}
+
+// TestNodeRawMetricsHandler_Prometheus verifies that the series of a node are
+// selected by name and node, and that a failing Prometheus is reported.
+func TestNodeRawMetricsHandler_Prometheus(t *testing.T) {
+	srv, queries := stubPrometheus(t, map[string][]prometheusSeries{"node_textfile": {
+		series("3600", "__name__", "node_textfile_backup_age_seconds", "instance", "alpha:9100", "job", "db"),
+	}})
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes/n1": swarm.Node{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}},
+	})
+	request := func(id string) rawMetricsResponse {
+		rr := httptest.NewRecorder()
+		nodeRawMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/"+id+"/metrics/raw?match=node_textfile_.%2B", nil), map[string]string{"id": id}))
+		var response rawMetricsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode: %v (%s)", err, rr.Body.String())
+		}
+		return response
+	}
+
+	response := request("n1")
+	if !response.Available || len(response.Families) != 1 || *response.Families[0].Samples[0].Value != 3600 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if len(*queries) != 1 || !strings.HasPrefix((*queries)[0], `{__name__=~"node_textfile_.+",`) || !strings.Contains((*queries)[0], "alpha") {
+		t.Fatalf("unexpected queries %q", *queries)
+	}
+
+	if response := request("n9"); response.Available || response.Error == nil || !strings.Contains(*response.Error, "Error inspecting node") {
+		t.Errorf("expected the unknown node to fail, got %+v", response)
+	}
+
+	srv.Close()
+	response = request("n1")
+	want := "Error querying Prometheus at " + srv.URL
+	if !response.Available || response.Error == nil || !strings.HasPrefix(*response.Error, want) {
+		t.Fatalf("expected %q, got %+v", want, response)
+	}
+}
+
+// TestNodeRawMetricsHandler_Unavailable verifies the response without
+// node-exporter service and when the node-exporter fails.
+func TestNodeRawMetricsHandler_Unavailable(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	stubDocker(t, map[string]interface{}{"/v1.35/services": []swarm.Service{}})
+	request := func() rawMetricsResponse {
+		rr := httptest.NewRecorder()
+		nodeRawMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/docker/nodes/n1/metrics/raw?match=node_load1", nil), map[string]string{"id": "n1"}))
+		var response rawMetricsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode: %v (%s)", err, rr.Body.String())
+		}
+		return response
+	}
+
+	if response := request(); response.Available || response.Message == nil || !strings.Contains(*response.Message, nodeExporterLabel) {
+		t.Fatalf("expected the missing service to be reported, got %+v", response)
+	}
+
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer exporter.Close()
+	u, _ := url.Parse(exporter.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+	resetMetricsCaches()
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/services": []swarm.Service{{ID: "s-exporter", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{nodeExporterLabel: "true"}}},
+			Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}}},
+		"/v1.35/tasks": []swarm.Task{{NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}}},
+	})
+	if response := request(); !response.Available || response.Error == nil || len(response.Families) != 0 {
+		t.Fatalf("expected the scrape error to be reported, got %+v", response)
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/docker/docker/api/types/filters"
@@ -13,29 +13,54 @@ import (
 	"github.com/docker/docker/client"
 	"github.com/gorilla/mux"
 	dto "github.com/prometheus/client_model/go"
-	"github.com/prometheus/common/expfmt"
-	"github.com/prometheus/common/model"
 )
 
 // ContainerMemoryMetrics represents memory metrics for a single container/task
 type ContainerMemoryMetrics struct {
-	ContainerID      string  `json:"containerId"`
-	TaskID           string  `json:"taskId"`
-	TaskName         string  `json:"taskName"`
-	Usage            float64 `json:"usage"`
-	WorkingSet       float64 `json:"workingSet"`
-	MemoryCache      float64 `json:"memoryCache"` // File-backed / cache pages
-	Limit            float64 `json:"limit"`
-	UsagePercent     float64 `json:"usagePercent"`
-	CPUUsage         float64 `json:"cpuUsage"`         // Total CPU time in seconds
-	CPUUserSeconds   float64 `json:"cpuUserSeconds"`   // User-space CPU time in seconds
-	CPUSystemSeconds float64 `json:"cpuSystemSeconds"` // Kernel-space CPU time in seconds
-	CPUPercent       float64 `json:"cpuPercent"`       // CPU usage as % of quota
-	NetworkRxBytes   float64 `json:"networkRxBytes"`   // Total received bytes across all interfaces
-	NetworkTxBytes   float64 `json:"networkTxBytes"`   // Total transmitted bytes across all interfaces
-	FSUsage          float64 `json:"fsUsage"`          // Container filesystem usage in bytes
-	FSLimit          float64 `json:"fsLimit"`          // Container filesystem limit in bytes
-	ServerTime       float64 `json:"serverTime"`       // Unix timestamp
+	ContainerID             string                      `json:"containerId"`
+	TaskID                  string                      `json:"taskId"`
+	TaskName                string                      `json:"taskName"`
+	Usage                   float64                     `json:"usage"`
+	WorkingSet              float64                     `json:"workingSet"`
+	MemoryCache             float64                     `json:"memoryCache"` // File-backed / cache pages
+	Limit                   float64                     `json:"limit"`
+	UsagePercent            float64                     `json:"usagePercent"`
+	CPUUsage                float64                     `json:"cpuUsage"`                    // Total CPU time in seconds
+	CPUUserSeconds          float64                     `json:"cpuUserSeconds"`              // User-space CPU time in seconds
+	CPUSystemSeconds        float64                     `json:"cpuSystemSeconds"`            // Kernel-space CPU time in seconds
+	CPUPercent              float64                     `json:"cpuPercent"`                  // CPU usage as % of quota
+	CPUUsagePercent         float64                     `json:"cpuUsagePercent"`             // CPU in use since the previous sample, as % of one core
+	CPUQuotaUsagePercent    float64                     `json:"cpuQuotaUsagePercent"`        // CPU in use since the previous sample, as % of the quota
+	NetworkRxBytes          float64                     `json:"networkRxBytes"`              // Total received bytes across all interfaces
+	NetworkTxBytes          float64                     `json:"networkTxBytes"`              // Total transmitted bytes across all interfaces
+	NetworkRxBytesPerSecond float64                     `json:"networkRxBytesPerSecond"`     // Received bytes per second since the previous sample
+	NetworkTxBytesPerSecond float64                     `json:"networkTxBytesPerSecond"`     // Transmitted bytes per second since the previous sample
+	FSUsage                 float64                     `json:"fsUsage"`                     // Container filesystem usage in bytes
+	FSLimit                 float64                     `json:"fsLimit"`                     // Container filesystem limit in bytes
+	FSReadBytes             float64                     `json:"fsReadBytes"`                 // Total bytes read across all devices
+	FSWriteBytes            float64                     `json:"fsWriteBytes"`                // Total bytes written across all devices
+	MemoryRSS               float64                     `json:"memoryRss"`                   // Anonymous memory and swap cache
+	MemorySwap              float64                     `json:"memorySwap"`                  // Swap usage in bytes
+	OOMEvents               float64                     `json:"oomEvents"`                   // Out-of-memory kills in the container
+	CPUPeriods              float64                     `json:"cpuPeriods"`                  // CFS enforcement periods elapsed
+	CPUThrottledPeriods     float64                     `json:"cpuThrottledPeriods"`         // CFS periods the container was throttled in
+	CPUThrottledSeconds     float64                     `json:"cpuThrottledSeconds"`         // Total time the container was throttled
+	CPUThrottledPercent     float64                     `json:"cpuThrottledPercent"`         // Throttled periods as % of the elapsed periods
+	NetworkInterfaces       []ContainerNetworkInterface `json:"networkInterfaces,omitempty"` // Counters of every network interface
+	ServerTime              float64                     `json:"serverTime"`                  // Unix timestamp
+}
+
+// ContainerNetworkInterface holds the network counters of one interface of a container
+type ContainerNetworkInterface struct {
+	Interface string  `json:"interface"`
+	RxBytes   float64 `json:"rxBytes"`
+	TxBytes   float64 `json:"txBytes"`
+	RxPackets float64 `json:"rxPackets"`
+	TxPackets float64 `json:"txPackets"`
+	RxErrors  float64 `json:"rxErrors"`
+	TxErrors  float64 `json:"txErrors"`
+	RxDropped float64 `json:"rxDropped"`
+	TxDropped float64 `json:"txDropped"`
 }
 
 // ServiceMemoryMetrics represents aggregated memory metrics for a service
@@ -44,6 +69,13 @@ type ServiceMemoryMetrics struct {
 	TotalLimit       float64                  `json:"totalLimit"`
 	AverageUsage     float64                  `json:"averageUsage"`
 	AveragePercent   float64                  `json:"averagePercent"`
+	TotalRSS         float64                  `json:"totalRss"`
+	TotalSwap        float64                  `json:"totalSwap"`
+	TotalOOMEvents   float64                  `json:"totalOomEvents"`
+	TotalFSRead      float64                  `json:"totalFsReadBytes"`
+	TotalFSWrite     float64                  `json:"totalFsWriteBytes"`
+	ThrottledSeconds float64                  `json:"cpuThrottledSeconds"`
+	ThrottledPercent float64                  `json:"cpuThrottledPercent"` // Throttled periods as % of the periods of all containers
 	ContainerMetrics []ContainerMemoryMetrics `json:"containers"`
 	ServerTime       float64                  `json:"serverTime"`
 }
@@ -52,48 +84,52 @@ type ServiceMemoryMetrics struct {
 type serviceMetricsResponse struct {
 	Available bool                  `json:"available"`
 	Metrics   *ServiceMemoryMetrics `json:"metrics,omitempty"`
+	History   []serviceMetricsPoint `json:"history,omitempty"`
 	Error     *string               `json:"error,omitempty"`
 	Message   *string               `json:"message,omitempty"`
 }
 
+// serviceMetricsPoint is a service's metrics at one point of the collected history
+type serviceMetricsPoint struct {
+	Time    float64               `json:"time"` // Unix timestamp
+	Metrics *ServiceMemoryMetrics `json:"metrics"`
+}
+
 // getCAdvisorEndpoint returns the endpoint URL for the cadvisor service
 // It prefers the task's overlay network address so the dashboard can query the cadvisor
 // instance running on the same node as the target service task.
-func getCAdvisorEndpoint(cli *client.Client, service *swarm.Service, nodeID string) (string, error) {
-	return resolveServiceEndpoint(cli, service, nodeID, 8080)
-}
-
-// fetchMetricsFromCAdvisor fetches metrics from the cadvisor endpoint
-func fetchMetricsFromCAdvisor(url string) (string, error) {
-	resp, err := metricsHttpClient.Get(url)
-	if err != nil {
-		return "", err
+func getCAdvisorEndpoint(cli *client.Client, service *swarm.Service, nodeID string) (exporterEndpoint, error) {
+	if cadvisorDiscovery.mode() != exporterDiscoveryLabel {
+		return cadvisorDiscovery.endpoint(cli, nodeID)
 	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("cadvisor returned status %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
+	config := cadvisorScrapeConfig(service)
+	url, err := resolveServiceEndpoint(cli, service, nodeID, 8080, config)
 	if err != nil {
-		return "", err
+		return exporterEndpoint{}, err
 	}
+	return exporterEndpoint{url: url, config: config}, nil
+}
 
-	return string(body), nil
+// fetchMetricsFromCAdvisor fetches and decodes the metrics of the cadvisor endpoint
+func fetchMetricsFromCAdvisor(endpoint exporterEndpoint) (map[string]*dto.MetricFamily, error) {
+	return fetchMetricFamilies(endpoint.url, "cadvisor", endpoint.config)
 }
 
 // parseCAdvisorMetrics parses Prometheus text format and extracts container memory metrics for a specific service
 func parseCAdvisorMetrics(metricsText string, serviceID string, serviceName string) (*ServiceMemoryMetrics, error) {
-	parser := expfmt.NewTextParser(model.LegacyValidation)
-	metricFamilies, err := parser.TextToMetricFamilies(strings.NewReader(metricsText))
+	metricFamilies, err := decodeTextMetrics(strings.NewReader(metricsText))
 	if err != nil {
 		// Handle malformed data gracefully by returning empty metrics instead of error
 		return &ServiceMemoryMetrics{
 			ContainerMetrics: []ContainerMemoryMetrics{},
 		}, nil
 	}
+	return parseCAdvisorMetricFamilies(metricFamilies, serviceID, serviceName)
+}
 
+// parseCAdvisorMetricFamilies extracts the container metrics of a specific
+// service, or of every container when serviceID is empty
+func parseCAdvisorMetricFamilies(metricFamilies map[string]*dto.MetricFamily, serviceID string, serviceName string) (*ServiceMemoryMetrics, error) {
 	containerMetrics := make(map[string]*ContainerMemoryMetrics)
 	var serverTime float64
 
@@ -387,6 +423,65 @@ func parseCAdvisorMetrics(metricsText string, serviceID string, serviceName stri
 		}
 	}
 
+	// Extract the extended counters summed per container: memory details, OOM
+	// kills, CFS throttling and disk I/O
+	containerSums := []struct {
+		family string
+		field  func(*ContainerMemoryMetrics) *float64
+	}{
+		{"container_memory_rss", func(cm *ContainerMemoryMetrics) *float64 { return &cm.MemoryRSS }},
+		{"container_memory_swap", func(cm *ContainerMemoryMetrics) *float64 { return &cm.MemorySwap }},
+		{"container_oom_events_total", func(cm *ContainerMemoryMetrics) *float64 { return &cm.OOMEvents }},
+		{"container_cpu_cfs_periods_total", func(cm *ContainerMemoryMetrics) *float64 { return &cm.CPUPeriods }},
+		{"container_cpu_cfs_throttled_periods_total", func(cm *ContainerMemoryMetrics) *float64 { return &cm.CPUThrottledPeriods }},
+		{"container_cpu_cfs_throttled_seconds_total", func(cm *ContainerMemoryMetrics) *float64 { return &cm.CPUThrottledSeconds }},
+		{"container_fs_reads_bytes_total", func(cm *ContainerMemoryMetrics) *float64 { return &cm.FSReadBytes }},
+		{"container_fs_writes_bytes_total", func(cm *ContainerMemoryMetrics) *float64 { return &cm.FSWriteBytes }},
+	}
+	for _, sum := range containerSums {
+		forEachContainerSample(metricFamilies[sum.family], serviceID, serviceName, containerMetrics, func(cm *ContainerMemoryMetrics, metric *dto.Metric) {
+			*sum.field(cm) += getMetricValue(metric)
+		})
+	}
+
+	// Extract the network counters of every interface
+	interfaceCounters := []struct {
+		family string
+		field  func(*ContainerNetworkInterface) *float64
+	}{
+		{"container_network_receive_bytes_total", func(ni *ContainerNetworkInterface) *float64 { return &ni.RxBytes }},
+		{"container_network_transmit_bytes_total", func(ni *ContainerNetworkInterface) *float64 { return &ni.TxBytes }},
+		{"container_network_receive_packets_total", func(ni *ContainerNetworkInterface) *float64 { return &ni.RxPackets }},
+		{"container_network_transmit_packets_total", func(ni *ContainerNetworkInterface) *float64 { return &ni.TxPackets }},
+		{"container_network_receive_errors_total", func(ni *ContainerNetworkInterface) *float64 { return &ni.RxErrors }},
+		{"container_network_transmit_errors_total", func(ni *ContainerNetworkInterface) *float64 { return &ni.TxErrors }},
+		{"container_network_receive_packets_dropped_total", func(ni *ContainerNetworkInterface) *float64 { return &ni.RxDropped }},
+		{"container_network_transmit_packets_dropped_total", func(ni *ContainerNetworkInterface) *float64 { return &ni.TxDropped }},
+	}
+	for _, counter := range interfaceCounters {
+		forEachContainerSample(metricFamilies[counter.family], serviceID, serviceName, containerMetrics, func(cm *ContainerMemoryMetrics, metric *dto.Metric) {
+			name := getContainerInterface(metric)
+			var iface *ContainerNetworkInterface
+			for i := range cm.NetworkInterfaces {
+				if cm.NetworkInterfaces[i].Interface == name {
+					iface = &cm.NetworkInterfaces[i]
+					break
+				}
+			}
+			if iface == nil {
+				cm.NetworkInterfaces = append(cm.NetworkInterfaces, ContainerNetworkInterface{Interface: name})
+				iface = &cm.NetworkInterfaces[len(cm.NetworkInterfaces)-1]
+			}
+			*counter.field(iface) += getMetricValue(metric)
+		})
+	}
+	for _, cm := range containerMetrics {
+		sort.Slice(cm.NetworkInterfaces, func(i, j int) bool { return cm.NetworkInterfaces[i].Interface < cm.NetworkInterfaces[j].Interface })
+		if cm.CPUPeriods > 0 {
+			cm.CPUThrottledPercent = (cm.CPUThrottledPeriods / cm.CPUPeriods) * 100
+		}
+	}
+
 	// Calculate CPU percent from quota/period
 	for containerID, cm := range containerMetrics {
 		if quota, hasQuota := cpuQuota[containerID]; hasQuota {
@@ -398,8 +493,20 @@ func parseCAdvisorMetrics(metricsText string, serviceID string, serviceName stri
 		}
 	}
 
+	// The rates are derived over the time the samples of a container were taken
+	for _, family := range metricFamilies {
+		for _, metric := range family.GetMetric() {
+			containerID, _, _, _ := extractSwarmLabels(metric)
+			if cm := containerMetrics[containerID]; cm != nil {
+				if at := sampleTime(metric); at > cm.ServerTime {
+					cm.ServerTime = at
+				}
+			}
+		}
+	}
+
 	// Calculate usage percentages and aggregate totals
-	var totalUsage, totalLimit, usageWithLimit float64
+	var totalUsage, totalLimit, usageWithLimit, latest float64
 	var containerCount int
 	containers := make([]ContainerMemoryMetrics, 0, len(containerMetrics))
 
@@ -407,7 +514,12 @@ func parseCAdvisorMetrics(metricsText string, serviceID string, serviceName stri
 		if cm.Limit > 0 {
 			cm.UsagePercent = (cm.Usage / cm.Limit) * 100
 		}
-		cm.ServerTime = serverTime
+		if cm.ServerTime == 0 {
+			cm.ServerTime = serverTime
+		}
+		if serverTime == 0 && cm.ServerTime > latest {
+			latest = cm.ServerTime
+		}
 
 		totalUsage += cm.Usage
 		if cm.Limit > 0 {
@@ -427,14 +539,65 @@ func parseCAdvisorMetrics(metricsText string, serviceID string, serviceName stri
 		}
 	}
 
-	return &ServiceMemoryMetrics{
+	result := &ServiceMemoryMetrics{
 		TotalUsage:       totalUsage,
 		TotalLimit:       totalLimit,
 		AverageUsage:     avgUsage,
 		AveragePercent:   avgPercent,
 		ContainerMetrics: containers,
 		ServerTime:       serverTime,
-	}, nil
+	}
+	if serverTime == 0 {
+		result.ServerTime = latest
+	}
+	sumExtendedContainerMetrics(result)
+	return result, nil
+}
+
+// forEachContainerSample calls fn with the container of every sample of a
+// metric family belonging to the service, creating the container if needed.
+func forEachContainerSample(family *dto.MetricFamily, serviceID, serviceName string, containerMetrics map[string]*ContainerMemoryMetrics, fn func(*ContainerMemoryMetrics, *dto.Metric)) {
+	if family == nil {
+		return
+	}
+	for _, metric := range family.GetMetric() {
+		containerID, taskID, taskName, svcName := extractSwarmLabels(metric)
+		if svcName != serviceName && !strings.Contains(containerID, serviceID) {
+			continue
+		}
+		if containerID == "" {
+			continue
+		}
+		if containerMetrics[containerID] == nil {
+			containerMetrics[containerID] = &ContainerMemoryMetrics{
+				ContainerID: containerID,
+				TaskID:      taskID,
+				TaskName:    taskName,
+			}
+		}
+		fn(containerMetrics[containerID], metric)
+	}
+}
+
+// sumExtendedContainerMetrics totals the memory details, OOM kills, disk I/O
+// and CPU throttling of the containers of a service.
+func sumExtendedContainerMetrics(summary *ServiceMemoryMetrics) {
+	summary.TotalRSS, summary.TotalSwap, summary.TotalOOMEvents = 0, 0, 0
+	summary.TotalFSRead, summary.TotalFSWrite, summary.ThrottledSeconds, summary.ThrottledPercent = 0, 0, 0, 0
+	var periods, throttledPeriods float64
+	for _, container := range summary.ContainerMetrics {
+		summary.TotalRSS += container.MemoryRSS
+		summary.TotalSwap += container.MemorySwap
+		summary.TotalOOMEvents += container.OOMEvents
+		summary.TotalFSRead += container.FSReadBytes
+		summary.TotalFSWrite += container.FSWriteBytes
+		summary.ThrottledSeconds += container.CPUThrottledSeconds
+		periods += container.CPUPeriods
+		throttledPeriods += container.CPUThrottledPeriods
+	}
+	if periods > 0 {
+		summary.ThrottledPercent = (throttledPeriods / periods) * 100
+	}
 }
 
 // extractSwarmLabels extracts Swarm-specific labels from a metric
@@ -454,6 +617,16 @@ func extractSwarmLabels(metric *dto.Metric) (containerID, taskID, taskName, serv
 	return
 }
 
+// getContainerInterface extracts the network interface name from cAdvisor metric labels
+func getContainerInterface(metric *dto.Metric) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == "interface" {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
 // serviceMetricsHandler handles requests for service metrics from cadvisor
 func serviceMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
@@ -464,6 +637,12 @@ func serviceMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	historyRequest, wantsHistory, err := parseMetricsRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	cli, err := getCli()
 	if err != nil {
 		errMsg := "Error getting Docker client: " + err.Error()
@@ -502,11 +681,21 @@ func serviceMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if wantsHistory {
+		writeServiceMetricsHistory(w, cli, serviceID, historyRequest)
+		return
+	}
+
 	service := services[0]
 	serviceName := service.Spec.Name
 
+	if usingPrometheusBackend() {
+		writePrometheusServiceMetrics(w, serviceID)
+		return
+	}
+
 	// Find the cadvisor service
-	cadvisorService, err := findCAdvisorService(cli)
+	cadvisorService, err := cachedCAdvisorService(cli)
 	if err != nil {
 		errMsg := "Error finding cadvisor service: " + err.Error()
 		response := serviceMetricsResponse{
@@ -571,21 +760,26 @@ func serviceMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	resultsChan := make(chan nodeResult, len(nodeIDs))
 
+	fanOut := newMetricsFanOut()
 	for nID := range nodeIDs {
-		go func(nodeID string) {
-			endpoint, err := getCAdvisorEndpoint(cli, cadvisorService, nodeID)
+		nodeID := nID
+		fanOut.Go(func() {
+			endpoint, err := cachedCAdvisorEndpoint(cli, cadvisorService, nodeID)
 			if err != nil {
 				resultsChan <- nodeResult{err: err}
 				return
 			}
-			metricsText, err := fetchMetricsFromCAdvisor(endpoint)
+			metricFamilies, err := scrapeCAdvisor(endpoint)
 			if err != nil {
 				resultsChan <- nodeResult{err: err}
 				return
 			}
-			parsed, err := parseCAdvisorMetrics(metricsText, serviceID, serviceName)
+			parsed, err := parseCAdvisorMetricFamilies(metricFamilies, serviceID, serviceName)
+			if err == nil {
+				applyContainerRates(parsed.ContainerMetrics)
+			}
 			resultsChan <- nodeResult{metrics: parsed, err: err}
-		}(nID)
+		})
 	}
 
 	// Aggregate results from all nodes
@@ -619,6 +813,7 @@ func serviceMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Recalculate averages
+	sumExtendedContainerMetrics(&aggregatedMetrics)
 	containerCount := len(aggregatedMetrics.ContainerMetrics)
 	if containerCount > 0 {
 		aggregatedMetrics.AverageUsage = aggregatedMetrics.TotalUsage / float64(containerCount)
@@ -635,3 +830,49 @@ func serviceMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(response)
 }
+
+// writeServiceMetricsHistory answers a service metrics request for a time
+// range from the background collector, aggregating the containers of the
+// service's tasks at every point.
+func writeServiceMetricsHistory(w http.ResponseWriter, cli *client.Client, serviceID string, request metricsRangeRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	rounds, msg := metricsHistoryRounds(request)
+	if msg != nil {
+		_ = json.NewEncoder(w).Encode(serviceMetricsResponse{Available: false, Message: msg})
+		return
+	}
+
+	tasksFilter := filters.NewArgs()
+	tasksFilter.Add("service", serviceID)
+	tasks, err := cli.TaskList(context.Background(), swarm.TaskListOptions{Filters: tasksFilter})
+	if err != nil {
+		errMsg := "Error fetching service tasks: " + err.Error()
+		_ = json.NewEncoder(w).Encode(serviceMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	taskIDs := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		taskIDs[task.ID] = true
+	}
+
+	response := serviceMetricsResponse{Available: true, History: []serviceMetricsPoint{}}
+	for _, round := range rounds {
+		containers := []ContainerMemoryMetrics{}
+		for _, container := range round.containers {
+			if taskIDs[container.TaskID] {
+				containers = append(containers, container)
+			}
+		}
+		if len(containers) == 0 {
+			continue
+		}
+		response.History = append(response.History, serviceMetricsPoint{
+			Time:    metricsPointTime(round),
+			Metrics: summarizeServiceContainers(containers),
+		})
+	}
+	if len(response.History) > 0 {
+		response.Metrics = response.History[len(response.History)-1].Metrics
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
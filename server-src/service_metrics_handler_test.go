@@ -317,8 +317,8 @@ func TestGetCAdvisorEndpoint(t *testing.T) {
 	}
 
 	expected := "http://10.0.0.2:8080/metrics"
-	if endpoint != expected {
-		t.Errorf("Expected endpoint '%s', got '%s'", expected, endpoint)
+	if endpoint.url != expected {
+		t.Errorf("Expected endpoint '%s', got '%s'", expected, endpoint.url)
 	}
 }
 
@@ -397,18 +397,19 @@ func TestFetchMetricsFromCAdvisor(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	metrics, err := fetchMetricsFromCAdvisor(mockServer.URL + "/metrics")
+	metrics, err := fetchMetricsFromCAdvisor(exporterEndpoint{url: mockServer.URL + "/metrics"})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	if metrics != metricsData {
-		t.Errorf("Expected metrics '%s', got '%s'", metricsData, metrics)
+	usage, ok := metrics["container_memory_usage_bytes"]
+	if !ok || len(usage.GetMetric()) != 1 || getMetricValue(usage.GetMetric()[0]) != 104857600 {
+		t.Errorf("Expected the decoded memory sample of '%s', got %v", metricsData, metrics)
 	}
 }
 
 func TestFetchMetricsFromCAdvisor_Error(t *testing.T) {
-	_, err := fetchMetricsFromCAdvisor("http://localhost:99999/metrics")
+	_, err := fetchMetricsFromCAdvisor(exporterEndpoint{url: "http://localhost:99999/metrics"})
 	if err == nil {
 		t.Error("Expected error when connecting to invalid endpoint")
 	}
@@ -756,8 +757,8 @@ func TestGetCAdvisorEndpoint_NoTasks(t *testing.T) {
 		t.Errorf("Expected no error with DNS fallback, got: %v", err)
 	}
 	// Should use DNS fallback
-	if !strings.Contains(endpoint, "cadvisor") {
-		t.Errorf("Expected endpoint to contain service name, got: %s", endpoint)
+	if !strings.Contains(endpoint.url, "cadvisor") {
+		t.Errorf("Expected endpoint to contain service name, got: %s", endpoint.url)
 	}
 }
 
@@ -793,7 +794,7 @@ func TestGetCAdvisorEndpoint_NoTasksNoName(t *testing.T) {
 	if err == nil {
 		t.Error("Expected error when no tasks found and no service name")
 	}
-	if endpoint != "" {
+	if endpoint.url != "" {
 		t.Error("Expected empty endpoint when no tasks and no name")
 	}
 }
@@ -828,8 +829,8 @@ func TestGetCAdvisorEndpoint_TaskListError(t *testing.T) {
 		t.Errorf("Expected no error with DNS fallback, got: %v", err)
 	}
 	// Should use DNS fallback
-	if !strings.Contains(endpoint, "cadvisor") {
-		t.Errorf("Expected endpoint to contain service name, got: %s", endpoint)
+	if !strings.Contains(endpoint.url, "cadvisor") {
+		t.Errorf("Expected endpoint to contain service name, got: %s", endpoint.url)
 	}
 }
 
@@ -878,8 +879,8 @@ func TestGetCAdvisorEndpoint_NoNetworkAttachments(t *testing.T) {
 		t.Errorf("Expected no error with DNS fallback, got: %v", err)
 	}
 	// Should use DNS fallback
-	if !strings.Contains(endpoint, "cadvisor") {
-		t.Errorf("Expected endpoint to contain service name, got: %s", endpoint)
+	if !strings.Contains(endpoint.url, "cadvisor") {
+		t.Errorf("Expected endpoint to contain service name, got: %s", endpoint.url)
 	}
 }
 
@@ -888,11 +889,11 @@ func TestFetchMetricsFromCAdvisor_InvalidURL(t *testing.T) {
 	// Use invalid URL
 	url := "http://[::1]:99999" // Invalid port
 
-	data, err := fetchMetricsFromCAdvisor(url)
+	data, err := fetchMetricsFromCAdvisor(exporterEndpoint{url: url})
 	if err == nil {
 		t.Error("Expected error for invalid URL")
 	}
-	if data != "" {
+	if data != nil {
 		t.Error("Expected empty data on error")
 	}
 }
@@ -1210,7 +1211,7 @@ func TestGetCAdvisorEndpoint_NilService(t *testing.T) {
 	if !strings.Contains(err.Error(), "service is nil") {
 		t.Errorf("Expected error about nil service, got: %v", err)
 	}
-	if endpoint != "" {
+	if endpoint.url != "" {
 		t.Error("Expected empty endpoint when service is nil")
 	}
 }
@@ -1254,8 +1255,8 @@ func TestGetCAdvisorEndpoint_PublishedPort(t *testing.T) {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 	// Should use published port 9090
-	if !strings.Contains(endpoint, ":9090") {
-		t.Errorf("Expected endpoint to use port 9090, got: %s", endpoint)
+	if !strings.Contains(endpoint.url, ":9090") {
+		t.Errorf("Expected endpoint to use port 9090, got: %s", endpoint.url)
 	}
 }
 
@@ -1289,8 +1290,8 @@ func TestGetCAdvisorEndpoint_NoServiceID(t *testing.T) {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 	// Should use DNS name fallback
-	if !strings.Contains(endpoint, "cadvisor-service") {
-		t.Errorf("Expected endpoint to contain service name, got: %s", endpoint)
+	if !strings.Contains(endpoint.url, "cadvisor-service") {
+		t.Errorf("Expected endpoint to contain service name, got: %s", endpoint.url)
 	}
 }
 
@@ -1428,8 +1429,8 @@ func TestGetCAdvisorEndpoint_AddressWithCIDR(t *testing.T) {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 	// Should strip CIDR and use the IP
-	if !strings.Contains(endpoint, host) {
-		t.Errorf("Expected endpoint to contain host %s, got: %s", host, endpoint)
+	if !strings.Contains(endpoint.url, host) {
+		t.Errorf("Expected endpoint to contain host %s, got: %s", host, endpoint.url)
 	}
 }
 
@@ -1505,8 +1506,8 @@ func TestGetCAdvisorEndpoint_NonRunningTask(t *testing.T) {
 		t.Fatalf("Unexpected error (should use DNS fallback): %v", err)
 	}
 	// Should use DNS fallback when no running tasks
-	if !strings.Contains(endpoint, "cadvisor") {
-		t.Errorf("Expected DNS fallback endpoint, got: %s", endpoint)
+	if !strings.Contains(endpoint.url, "cadvisor") {
+		t.Errorf("Expected DNS fallback endpoint, got: %s", endpoint.url)
 	}
 }
 
@@ -1836,9 +1837,9 @@ func TestGetCAdvisorEndpoint_TaskListErrorNoName(t *testing.T) {
 	cli, _ := getCli()
 	endpoint, err := getCAdvisorEndpoint(cli, cadvisorSvc, "node-1")
 	if err == nil {
-		t.Errorf("expected error when task list fails and no service name, got endpoint=%s", endpoint)
+		t.Errorf("expected error when task list fails and no service name, got endpoint=%s", endpoint.url)
 	}
-	if endpoint != "" {
+	if endpoint.url != "" {
 		t.Error("expected empty endpoint on error")
 	}
 }
@@ -2065,8 +2066,62 @@ func TestFetchMetricsFromCAdvisor_NonOKStatus(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	_, err := fetchMetricsFromCAdvisor(mockServer.URL + "/metrics")
+	_, err := fetchMetricsFromCAdvisor(exporterEndpoint{url: mockServer.URL + "/metrics"})
 	if err == nil {
 		t.Error("expected error for non-200 status")
 	}
 }
+
+// TestParseCAdvisorMetrics_ExtendedMetrics tests the throttling, OOM, disk
+// I/O, memory detail and per-interface network counters and their totals
+func TestParseCAdvisorMetrics_ExtendedMetrics(t *testing.T) {
+	labels := `id="/docker/abc",container_label_com_docker_swarm_service_name="test-service",container_label_com_docker_swarm_task_name="test-service.1"`
+	metricsData := `
+container_memory_usage_bytes{` + labels + `} 1000
+container_memory_rss{` + labels + `} 600
+container_memory_swap{` + labels + `} 50
+container_oom_events_total{` + labels + `} 2
+container_cpu_cfs_periods_total{` + labels + `} 200
+container_cpu_cfs_throttled_periods_total{` + labels + `} 50
+container_cpu_cfs_throttled_seconds_total{` + labels + `} 3.5
+container_fs_reads_bytes_total{` + labels + `,device="/dev/sda"} 100
+container_fs_reads_bytes_total{` + labels + `,device="/dev/sdb"} 20
+container_fs_writes_bytes_total{` + labels + `,device="/dev/sda"} 300
+container_network_receive_bytes_total{` + labels + `,interface="eth1"} 70
+container_network_receive_bytes_total{` + labels + `,interface="eth0"} 30
+container_network_transmit_errors_total{` + labels + `,interface="eth0"} 4
+container_network_receive_packets_dropped_total{` + labels + `,interface="eth1"} 6
+container_oom_events_total{id="/docker/other",container_label_com_docker_swarm_service_name="other"} 9
+`
+
+	result, err := parseCAdvisorMetrics(metricsData, "s-test", "test-service")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result.ContainerMetrics) != 1 {
+		t.Fatalf("Expected 1 container, got %d", len(result.ContainerMetrics))
+	}
+
+	c := result.ContainerMetrics[0]
+	if c.MemoryRSS != 600 || c.MemorySwap != 50 || c.OOMEvents != 2 {
+		t.Errorf("unexpected memory details %+v", c)
+	}
+	if c.CPUThrottledPeriods != 50 || c.CPUThrottledSeconds != 3.5 || c.CPUThrottledPercent != 25 {
+		t.Errorf("unexpected throttling %+v", c)
+	}
+	if c.FSReadBytes != 120 || c.FSWriteBytes != 300 {
+		t.Errorf("unexpected disk I/O %+v", c)
+	}
+	if c.NetworkRxBytes != 100 || len(c.NetworkInterfaces) != 2 {
+		t.Fatalf("unexpected network counters %+v", c)
+	}
+	eth0, eth1 := c.NetworkInterfaces[0], c.NetworkInterfaces[1]
+	if eth0.Interface != "eth0" || eth0.RxBytes != 30 || eth0.TxErrors != 4 || eth1.RxBytes != 70 || eth1.RxDropped != 6 {
+		t.Errorf("unexpected interfaces %+v", c.NetworkInterfaces)
+	}
+
+	if result.TotalRSS != 600 || result.TotalSwap != 50 || result.TotalOOMEvents != 2 || result.TotalFSRead != 120 || result.TotalFSWrite != 300 ||
+		result.ThrottledSeconds != 3.5 || result.ThrottledPercent != 25 {
+		t.Errorf("unexpected service totals %+v", result)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/gorilla/mux"
+)
+
+const stackNamespaceLabel = "com.docker.stack.namespace"
+
+// stackResourceTotals sums the resource usage of containers.
+type stackResourceTotals struct {
+	ContainerCount          int     `json:"containerCount"`
+	CPUUsagePercent         float64 `json:"cpuUsagePercent"` // Sum over the containers, as % of one core
+	MemoryUsage             float64 `json:"memoryUsage"`
+	MemoryLimit             float64 `json:"memoryLimit"` // Sum of the limits of the containers having one
+	MemoryPercent           float64 `json:"memoryPercent"`
+	NetworkRxBytes          float64 `json:"networkRxBytes"`
+	NetworkTxBytes          float64 `json:"networkTxBytes"`
+	NetworkRxBytesPerSecond float64 `json:"networkRxBytesPerSecond"`
+	NetworkTxBytesPerSecond float64 `json:"networkTxBytesPerSecond"`
+	FSUsage                 float64 `json:"fsUsage"`
+	FSLimit                 float64 `json:"fsLimit"`
+	usageWithLimit          float64
+}
+
+// add accounts for a container.
+func (t *stackResourceTotals) add(container ContainerMemoryMetrics) {
+	t.ContainerCount++
+	t.CPUUsagePercent += container.CPUUsagePercent
+	t.MemoryUsage += container.Usage
+	if container.Limit > 0 {
+		t.MemoryLimit += container.Limit
+		t.usageWithLimit += container.Usage
+		t.MemoryPercent = (t.usageWithLimit / t.MemoryLimit) * 100
+	}
+	t.NetworkRxBytes += container.NetworkRxBytes
+	t.NetworkTxBytes += container.NetworkTxBytes
+	t.NetworkRxBytesPerSecond += container.NetworkRxBytesPerSecond
+	t.NetworkTxBytesPerSecond += container.NetworkTxBytesPerSecond
+	t.FSUsage += container.FSUsage
+	t.FSLimit += container.FSLimit
+}
+
+// stackServiceMetrics is the share of a service in the stack usage.
+type stackServiceMetrics struct {
+	ServiceID    string `json:"serviceId"`
+	ServiceName  string `json:"serviceName"`
+	RunningTasks int    `json:"runningTasks"`
+	stackResourceTotals
+}
+
+// StackMetrics is the resource usage of the services of a stack.
+type StackMetrics struct {
+	Stack string `json:"stack"`
+	stackResourceTotals
+	Services   []stackServiceMetrics `json:"services"`
+	ServerTime float64               `json:"serverTime"`
+}
+
+// stackMetricsResponse represents the response structure for stack metrics endpoint
+type stackMetricsResponse struct {
+	Available        bool          `json:"available"`
+	Metrics          *StackMetrics `json:"metrics,omitempty"`
+	NodesQueried     int           `json:"nodesQueried,omitempty"`
+	NodesWithMetrics int           `json:"nodesWithMetrics,omitempty"`
+	Error            *string       `json:"error,omitempty"`
+	Message          *string       `json:"message,omitempty"`
+}
+
+// aggregateStackMetrics sums the containers of the stack tasks by service.
+// `taskServices` maps the task IDs of the stack to their service ID.
+func aggregateStackMetrics(stack string, services []swarm.Service, taskServices map[string]string, runningTasks map[string]int, containers []ContainerMemoryMetrics) *StackMetrics {
+	metrics := &StackMetrics{Stack: stack, Services: make([]stackServiceMetrics, 0, len(services))}
+	byService := make(map[string]*stackServiceMetrics, len(services))
+	for _, service := range services {
+		metrics.Services = append(metrics.Services, stackServiceMetrics{ServiceID: service.ID, ServiceName: service.Spec.Name, RunningTasks: runningTasks[service.ID]})
+	}
+	sort.Slice(metrics.Services, func(i, j int) bool { return metrics.Services[i].ServiceName < metrics.Services[j].ServiceName })
+	for i := range metrics.Services {
+		byService[metrics.Services[i].ServiceID] = &metrics.Services[i]
+	}
+
+	for _, container := range containers {
+		service, ok := byService[taskServices[container.TaskID]]
+		if !ok {
+			continue
+		}
+		service.add(container)
+		metrics.add(container)
+		if container.ServerTime > metrics.ServerTime {
+			metrics.ServerTime = container.ServerTime
+		}
+	}
+	return metrics
+}
+
+// fetchStackContainersFromCAdvisor scrapes cAdvisor once on every node and
+// keeps the containers of the given tasks. It returns the number of nodes
+// that answered.
+func fetchStackContainersFromCAdvisor(cli *client.Client, cadvisorService *swarm.Service, nodeIDs map[string]bool, taskServices map[string]string) ([]ContainerMemoryMetrics, int) {
+	type nodeResult struct {
+		containers []ContainerMemoryMetrics
+		err        error
+	}
+	resultsChan := make(chan nodeResult, len(nodeIDs))
+	fanOut := newMetricsFanOut()
+	for nID := range nodeIDs {
+		nodeID := nID
+		fanOut.Go(func() {
+			endpoint, err := cachedCAdvisorEndpoint(cli, cadvisorService, nodeID)
+			if err != nil {
+				resultsChan <- nodeResult{err: err}
+				return
+			}
+			metricFamilies, err := scrapeCAdvisor(endpoint)
+			if err != nil {
+				resultsChan <- nodeResult{err: err}
+				return
+			}
+			// A single scrape holds the containers of every service of the node.
+			parsed, err := parseCAdvisorMetricFamilies(metricFamilies, "", "")
+			if err != nil {
+				resultsChan <- nodeResult{err: err}
+				return
+			}
+			containers := []ContainerMemoryMetrics{}
+			for _, container := range parsed.ContainerMetrics {
+				if _, ok := taskServices[container.TaskID]; ok {
+					containers = append(containers, container)
+				}
+			}
+			resultsChan <- nodeResult{containers: containers}
+		})
+	}
+	fanOut.Wait()
+	close(resultsChan)
+
+	containers := []ContainerMemoryMetrics{}
+	nodesWithMetrics := 0
+	for res := range resultsChan {
+		if res.err != nil {
+			log.Printf("stackMetricsHandler: fetching cAdvisor metrics failed: %v", res.err)
+			continue
+		}
+		nodesWithMetrics++
+		containers = append(containers, res.containers...)
+	}
+	applyContainerRates(containers)
+	return containers, nodesWithMetrics
+}
+
+// stackMetricsHandler handles requests for the aggregated metrics of the
+// services of a stack.
+func stackMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	stack := mux.Vars(r)["name"]
+	if stack == "" {
+		http.Error(w, "Stack name is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse := func(response stackMetricsResponse) {
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("stackMetricsHandler: encoding response failed: %v", err)
+		}
+	}
+
+	cli, err := getCli()
+	if err != nil {
+		errMsg := "Error getting Docker client: " + err.Error()
+		writeResponse(stackMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+
+	servicesFilter := filters.NewArgs()
+	servicesFilter.Add("label", stackNamespaceLabel+"="+stack)
+	services, err := cli.ServiceList(context.Background(), swarm.ServiceListOptions{Filters: servicesFilter})
+	if err != nil {
+		errMsg := "Error fetching services: " + err.Error()
+		writeResponse(stackMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	if len(services) == 0 {
+		errMsg := "Stack not found"
+		writeResponse(stackMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+
+	tasks, err := cli.TaskList(context.Background(), swarm.TaskListOptions{})
+	if err != nil {
+		errMsg := "Error fetching stack tasks: " + err.Error()
+		writeResponse(stackMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	stackServices := make(map[string]bool, len(services))
+	for _, service := range services {
+		stackServices[service.ID] = true
+	}
+	taskServices := make(map[string]string)
+	runningTasks := make(map[string]int)
+	nodeIDs := make(map[string]bool)
+	for _, task := range tasks {
+		if !stackServices[task.ServiceID] {
+			continue
+		}
+		taskServices[task.ID] = task.ServiceID
+		if task.Status.State == swarm.TaskStateRunning {
+			runningTasks[task.ServiceID]++
+			nodeIDs[task.NodeID] = true
+		}
+	}
+
+	if usingPrometheusBackend() {
+		metrics, err := fetchContainerMetricsFromPrometheus("container_label_com_docker_stack_namespace=" + quotePromQL(stack))
+		if err != nil {
+			writeResponse(stackMetricsResponse{Available: true, Error: prometheusErrorMessage(err)})
+			return
+		}
+		applyContainerRates(metrics.ContainerMetrics)
+		writeResponse(stackMetricsResponse{Available: true, Metrics: aggregateStackMetrics(stack, services, taskServices, runningTasks, metrics.ContainerMetrics)})
+		return
+	}
+
+	cadvisorService, err := cachedCAdvisorService(cli)
+	if err != nil {
+		errMsg := "Error finding cadvisor service: " + err.Error()
+		writeResponse(stackMetricsResponse{Available: false, Error: &errMsg})
+		return
+	}
+	if cadvisorService == nil {
+		msg := fmt.Sprintf("cAdvisor service not found. Deploy a global service with label '%s' to enable metrics.", cadvisorLabel)
+		writeResponse(stackMetricsResponse{Available: false, Message: &msg})
+		return
+	}
+
+	if len(nodeIDs) == 0 {
+		errMsg := "No running tasks found for stack"
+		writeResponse(stackMetricsResponse{Available: true, Error: &errMsg})
+		return
+	}
+
+	containers, nodesWithMetrics := fetchStackContainersFromCAdvisor(cli, cadvisorService, nodeIDs, taskServices)
+	if nodesWithMetrics == 0 {
+		errMsg := "Failed to fetch metrics from any node"
+		writeResponse(stackMetricsResponse{Available: false, NodesQueried: len(nodeIDs), Error: &errMsg})
+		return
+	}
+	writeResponse(stackMetricsResponse{
+		Available:        true,
+		Metrics:          aggregateStackMetrics(stack, services, taskServices, runningTasks, containers),
+		NodesQueried:     len(nodeIDs),
+		NodesWithMetrics: nodesWithMetrics,
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/gorilla/mux"
+)
+
+// stackCAdvisorMetrics holds two containers of the stack and one of another
+// service on the same node.
+const stackCAdvisorMetrics = `container_memory_usage_bytes{id="/docker/c1",container_label_com_docker_swarm_task_id="t1",container_label_com_docker_swarm_service_name="shop_web"} 100
+container_memory_usage_bytes{id="/docker/c2",container_label_com_docker_swarm_task_id="t2",container_label_com_docker_swarm_service_name="shop_db"} 300
+container_memory_usage_bytes{id="/docker/c9",container_label_com_docker_swarm_task_id="t9",container_label_com_docker_swarm_service_name="other"} 5000
+container_spec_memory_limit_bytes{id="/docker/c1",container_label_com_docker_swarm_task_id="t1",container_label_com_docker_swarm_service_name="shop_web"} 400
+container_network_receive_bytes_total{id="/docker/c1",container_label_com_docker_swarm_task_id="t1",container_label_com_docker_swarm_service_name="shop_web",interface="eth0"} 10
+container_network_receive_bytes_total{id="/docker/c2",container_label_com_docker_swarm_task_id="t2",container_label_com_docker_swarm_service_name="shop_db",interface="eth0"} 20
+container_fs_usage_bytes{id="/docker/c2",container_label_com_docker_swarm_task_id="t2",container_label_com_docker_swarm_service_name="shop_db",device="/dev/sda"} 7
+`
+
+// withSampleTime stamps every sample of an exposition with a Unix time, as
+// cAdvisor does with the time of its stats.
+func withSampleTime(text string, at int64) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		lines = append(lines, line+" "+strconv.FormatInt(at*1000, 10))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// TestStackMetricsHandler verifies that the containers of the stack are
+// summed by service from a single scrape of the node.
+func TestStackMetricsHandler(t *testing.T) {
+	var scrapes int32
+	cadvisor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+		_, _ = w.Write([]byte(stackCAdvisorMetrics))
+	}))
+	defer cadvisor.Close()
+	u, _ := url.Parse(cadvisor.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	running := swarm.TaskStatus{State: swarm.TaskStateRunning}
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/services": []swarm.Service{
+			{ID: "s1", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "shop_web"}}},
+			{ID: "s2", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "shop_db"}}},
+			{ID: "s-cadvisor", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{cadvisorLabel: "true"}}},
+				Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}},
+		},
+		"/v1.35/tasks": []swarm.Task{
+			{ID: "t1", ServiceID: "s1", NodeID: "n1", Status: running},
+			{ID: "t2", ServiceID: "s2", NodeID: "n1", Status: running},
+			{ID: "t9", ServiceID: "s9", NodeID: "n1", Status: running},
+			{ID: "tc", ServiceID: "s-cadvisor", NodeID: "n1", Status: running,
+				NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}},
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	stackMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/ui/stacks/shop/metrics", nil), map[string]string{"name": "shop"}))
+
+	var response stackMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || response.Metrics == nil || response.NodesQueried != 1 || response.NodesWithMetrics != 1 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if got := atomic.LoadInt32(&scrapes); got != 1 {
+		t.Fatalf("expected a single scrape of the node, got %d", got)
+	}
+	// The stub lists every service, so the cAdvisor service shows up with no containers.
+	metrics := response.Metrics
+	if metrics.ContainerCount != 2 || metrics.MemoryUsage != 400 || metrics.MemoryLimit != 400 || metrics.MemoryPercent != 25 || metrics.NetworkRxBytes != 30 || metrics.FSUsage != 7 {
+		t.Fatalf("unexpected totals %+v", metrics.stackResourceTotals)
+	}
+	if len(metrics.Services) != 3 {
+		t.Fatalf("expected a breakdown by service, got %+v", metrics.Services)
+	}
+	db, web := metrics.Services[1], metrics.Services[2]
+	if db.ServiceName != "shop_db" || db.MemoryUsage != 300 || db.ContainerCount != 1 || db.RunningTasks != 1 || db.MemoryPercent != 0 {
+		t.Errorf("unexpected db breakdown %+v", db)
+	}
+	if web.ServiceName != "shop_web" || web.MemoryUsage != 100 || web.MemoryPercent != 25 || web.NetworkRxBytes != 10 {
+		t.Errorf("unexpected web breakdown %+v", web)
+	}
+}
+
+// TestStackMetricsHandler_NotFound verifies the response for an unknown stack.
+func TestStackMetricsHandler_NotFound(t *testing.T) {
+	stubDocker(t, map[string]interface{}{"/v1.35/services": []swarm.Service{}})
+
+	rr := httptest.NewRecorder()
+	stackMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/ui/stacks/none/metrics", nil), map[string]string{"name": "none"}))
+	if !strings.Contains(rr.Body.String(), "Stack not found") {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+}
+
+// TestStackMetricsHandler_Prometheus verifies that the containers of the
+// stack are selected by its namespace label in Prometheus.
+func TestStackMetricsHandler_Prometheus(t *testing.T) {
+	_, queries := stubPrometheus(t, map[string][]prometheusSeries{"container_": {
+		series("100", "__name__", "container_memory_usage_bytes", "id", "/docker/c1", "container_label_com_docker_swarm_task_id", "t1"),
+	}})
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/services": []swarm.Service{{ID: "s1", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "shop_web"}}}},
+		"/v1.35/tasks":    []swarm.Task{{ID: "t1", ServiceID: "s1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning}}},
+	})
+
+	rr := httptest.NewRecorder()
+	stackMetricsHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/ui/stacks/shop/metrics", nil), map[string]string{"name": "shop"}))
+
+	var response stackMetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || response.Metrics == nil || response.Metrics.MemoryUsage != 100 || response.Metrics.Services[0].ContainerCount != 1 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if !strings.Contains((*queries)[0], `container_label_com_docker_stack_namespace="shop"`) {
+		t.Fatalf("expected the query to select the stack, got %q", (*queries)[0])
+	}
+}
@@ -17,12 +17,29 @@ import (
 type taskMetricsResponse struct {
 	Available bool                    `json:"available"`
 	Metrics   *ContainerMemoryMetrics `json:"metrics,omitempty"`
+	History   []taskMetricsPoint      `json:"history,omitempty"`
 	Error     *string                 `json:"error,omitempty"`
 	Message   *string                 `json:"message,omitempty"`
 }
 
+// taskMetricsPoint is a task's metrics at one point of the collected history
+type taskMetricsPoint struct {
+	Time    float64                 `json:"time"` // Unix timestamp
+	Metrics *ContainerMemoryMetrics `json:"metrics"`
+}
+
 // taskMetricsHandler returns memory and CPU metrics for a specific task from cAdvisor
 func taskMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	historyRequest, wantsHistory, err := parseMetricsRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wantsHistory {
+		writeTaskMetricsHistory(w, mux.Vars(r)["id"], historyRequest)
+		return
+	}
+
 	cli, err := getCli()
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to get Docker client: %v", err)
@@ -65,8 +82,13 @@ func taskMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if usingPrometheusBackend() {
+		writePrometheusTaskMetrics(w, taskID)
+		return
+	}
+
 	// Find cAdvisor service
-	cadvisorService, err := findCAdvisorService(cli)
+	cadvisorService, err := cachedCAdvisorService(cli)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to find cAdvisor service: %v", err)
 		if err := json.NewEncoder(w).Encode(taskMetricsResponse{
@@ -90,7 +112,7 @@ func taskMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get cAdvisor endpoint on the same node as the task
-	endpoint, err := getCAdvisorEndpoint(cli, cadvisorService, task.NodeID)
+	endpoint, err := cachedCAdvisorEndpoint(cli, cadvisorService, task.NodeID)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to get cAdvisor endpoint: %v", err)
 		if err := json.NewEncoder(w).Encode(taskMetricsResponse{
@@ -102,12 +124,11 @@ func taskMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Fetch metrics from cAdvisor. `endpoint` may already be a full URL
-	metricsURL := endpoint
-	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
-		metricsURL = fmt.Sprintf("http://%s/metrics", endpoint)
+	// Fetch metrics from cAdvisor. `endpoint.url` may already be a full URL
+	if !strings.HasPrefix(endpoint.url, "http://") && !strings.HasPrefix(endpoint.url, "https://") {
+		endpoint.url = fmt.Sprintf("http://%s/metrics", endpoint.url)
 	}
-	metricsText, err := fetchMetricsFromCAdvisor(metricsURL)
+	metricFamilies, err := scrapeCAdvisor(endpoint)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to fetch metrics: %v", err)
 		if err := json.NewEncoder(w).Encode(taskMetricsResponse{
@@ -130,7 +151,7 @@ func taskMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse the metrics
-	serviceMetrics, err := parseCAdvisorMetrics(metricsText, task.ServiceID, serviceName)
+	serviceMetrics, err := parseCAdvisorMetricFamilies(metricFamilies, task.ServiceID, serviceName)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to parse metrics: %v", err)
 		if err := json.NewEncoder(w).Encode(taskMetricsResponse{
@@ -142,6 +163,8 @@ func taskMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	applyContainerRates(serviceMetrics.ContainerMetrics)
+
 	// Find the specific container metrics for this task
 	var taskMetrics *ContainerMemoryMetrics
 	for i := range serviceMetrics.ContainerMetrics {
@@ -171,3 +194,31 @@ func taskMetricsHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("taskMetricsHandler: encoding response failed: %v", err)
 	}
 }
+
+// writeTaskMetricsHistory answers a task metrics request for a time range from
+// the background collector.
+func writeTaskMetricsHistory(w http.ResponseWriter, taskID string, request metricsRangeRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	rounds, msg := metricsHistoryRounds(request)
+	if msg != nil {
+		if err := json.NewEncoder(w).Encode(taskMetricsResponse{Available: false, Message: msg}); err != nil {
+			log.Printf("taskMetricsHandler: encoding response failed: %v", err)
+		}
+		return
+	}
+	response := taskMetricsResponse{Available: true, History: []taskMetricsPoint{}}
+	for _, round := range rounds {
+		for i := range round.containers {
+			if round.containers[i].TaskID == taskID {
+				response.History = append(response.History, taskMetricsPoint{Time: metricsPointTime(round), Metrics: &round.containers[i]})
+				break
+			}
+		}
+	}
+	if len(response.History) > 0 {
+		response.Metrics = response.History[len(response.History)-1].Metrics
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("taskMetricsHandler: encoding response failed: %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	defaultTopLimit = 20
+	maxTopLimit     = 1000
+)
+
+// The resources containers can be ranked by.
+const (
+	topByMemory  = "memory"
+	topByCPU     = "cpu"
+	topByNetwork = "network"
+	topByFS      = "fs"
+)
+
+// topContainer is a task container ranked by its resource usage.
+type topContainer struct {
+	ContainerID             string  `json:"containerId"`
+	TaskID                  string  `json:"taskId"`
+	TaskName                string  `json:"taskName"`
+	Slot                    int     `json:"slot,omitempty"`
+	ServiceID               string  `json:"serviceId"`
+	ServiceName             string  `json:"serviceName"`
+	Stack                   string  `json:"stack,omitempty"`
+	NodeID                  string  `json:"nodeId"`
+	Hostname                string  `json:"hostname"`
+	Value                   float64 `json:"value"` // The ranked value
+	MemoryUsage             float64 `json:"memoryUsage"`
+	MemoryLimit             float64 `json:"memoryLimit"`
+	MemoryPercent           float64 `json:"memoryPercent"`
+	CPUUsagePercent         float64 `json:"cpuUsagePercent"`
+	NetworkRxBytesPerSecond float64 `json:"networkRxBytesPerSecond"`
+	NetworkTxBytesPerSecond float64 `json:"networkTxBytesPerSecond"`
+	FSUsage                 float64 `json:"fsUsage"`
+}
+
+// topResponse represents the response structure for the top consumers endpoint
+type topResponse struct {
+	Available        bool           `json:"available"`
+	By               string         `json:"by"`
+	Limit            int            `json:"limit"`
+	Containers       []topContainer `json:"containers"`
+	NodesQueried     int            `json:"nodesQueried,omitempty"`
+	NodesWithMetrics int            `json:"nodesWithMetrics,omitempty"`
+	RatesPending     int            `json:"ratesPending,omitempty"` // Containers without CPU and network rates yet
+	Error            *string        `json:"error,omitempty"`
+	Message          *string        `json:"message,omitempty"`
+}
+
+// topRequest is a parsed top consumers request.
+type topRequest struct {
+	by    string
+	limit int
+	node  string // Node ID or hostname, empty for the whole cluster
+}
+
+// parseTopRequest reads the `by`, `limit` and `node` query parameters.
+func parseTopRequest(r *http.Request) (topRequest, error) {
+	query := r.URL.Query()
+	request := topRequest{by: topByMemory, limit: defaultTopLimit, node: query.Get("node")}
+	if by := query.Get("by"); by != "" {
+		switch by {
+		case topByMemory, topByCPU, topByNetwork, topByFS:
+			request.by = by
+		default:
+			return request, fmt.Errorf("invalid by %q: expected memory, cpu, network or fs", by)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 || parsed > maxTopLimit {
+			return request, fmt.Errorf("invalid limit %q: expected a number between 1 and %d", limit, maxTopLimit)
+		}
+		request.limit = parsed
+	}
+	return request, nil
+}
+
+// topValue is the value a container is ranked by.
+func topValue(container ContainerMemoryMetrics, by string) float64 {
+	switch by {
+	case topByCPU:
+		return container.CPUUsagePercent
+	case topByNetwork:
+		return container.NetworkRxBytesPerSecond + container.NetworkTxBytesPerSecond
+	case topByFS:
+		return container.FSUsage
+	default:
+		return container.Usage
+	}
+}
+
+// scrapedContainer is a container and the node whose cAdvisor reported it.
+type scrapedContainer struct {
+	ContainerMemoryMetrics
+	nodeID string
+}
+
+// fetchAllContainersFromCAdvisor scrapes the cAdvisor of every given node in
+// parallel and returns the task containers, with the number of nodes that
+// answered.
+func fetchAllContainersFromCAdvisor(cli *client.Client, cadvisorService *swarm.Service, nodes []swarm.Node) ([]scrapedContainer, int) {
+	type nodeResult struct {
+		containers []scrapedContainer
+		err        error
+	}
+	resultsChan := make(chan nodeResult, len(nodes))
+	fanOut := newMetricsFanOut()
+	for _, n := range nodes {
+		nodeID := n.ID
+		fanOut.Go(func() {
+			endpoint, err := cachedCAdvisorEndpoint(cli, cadvisorService, nodeID)
+			if err != nil {
+				resultsChan <- nodeResult{err: err}
+				return
+			}
+			metricFamilies, err := scrapeCAdvisor(endpoint)
+			if err != nil {
+				resultsChan <- nodeResult{err: err}
+				return
+			}
+			parsed, err := parseCAdvisorMetricFamilies(metricFamilies, "", "")
+			if err != nil {
+				resultsChan <- nodeResult{err: err}
+				return
+			}
+			containers := make([]scrapedContainer, 0, len(parsed.ContainerMetrics))
+			for _, container := range parsed.ContainerMetrics {
+				containers = append(containers, scrapedContainer{ContainerMemoryMetrics: container, nodeID: nodeID})
+			}
+			resultsChan <- nodeResult{containers: containers}
+		})
+	}
+	fanOut.Wait()
+	close(resultsChan)
+
+	containers := []scrapedContainer{}
+	nodesWithMetrics := 0
+	for res := range resultsChan {
+		if res.err != nil {
+			log.Printf("topHandler: fetching cAdvisor metrics failed: %v", res.err)
+			continue
+		}
+		nodesWithMetrics++
+		containers = append(containers, res.containers...)
+	}
+	return containers, nodesWithMetrics
+}
+
+// rankContainers joins the task containers to their task, service, stack and
+// node, and returns the `limit` largest by the requested resource, with the
+// number of them whose rates need a second sample.
+func rankContainers(containers []scrapedContainer, request topRequest, tasks []swarm.Task, services []swarm.Service, nodes []swarm.Node) ([]topContainer, int) {
+	tasksByID := make(map[string]swarm.Task, len(tasks))
+	for _, task := range tasks {
+		tasksByID[task.ID] = task
+	}
+	servicesByID := make(map[string]swarm.Service, len(services))
+	for _, service := range services {
+		servicesByID[service.ID] = service
+	}
+	hostnames := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		hostnames[node.ID] = node.Description.Hostname
+	}
+
+	ranked := []topContainer{}
+	metrics := []ContainerMemoryMetrics{}
+	for _, container := range containers {
+		// Containers not started by a swarm task are not ranked.
+		if container.TaskID == "" {
+			continue
+		}
+		entry := topContainer{
+			ContainerID: container.ContainerID,
+			TaskID:      container.TaskID,
+			TaskName:    container.TaskName,
+			NodeID:      container.nodeID,
+		}
+		if task, ok := tasksByID[container.TaskID]; ok {
+			entry.Slot = task.Slot
+			entry.ServiceID = task.ServiceID
+			if task.NodeID != "" {
+				entry.NodeID = task.NodeID
+			}
+			if service, ok := servicesByID[task.ServiceID]; ok {
+				entry.ServiceName = service.Spec.Name
+				entry.Stack = service.Spec.Labels[stackNamespaceLabel]
+			}
+		}
+		entry.Hostname = hostnames[entry.NodeID]
+		if request.node != "" && request.node != entry.NodeID && request.node != entry.Hostname {
+			continue
+		}
+		ranked = append(ranked, entry)
+		metrics = append(metrics, container.ContainerMemoryMetrics)
+	}
+
+	pending := applyContainerRates(metrics)
+	for i := range ranked {
+		ranked[i].Value = topValue(metrics[i], request.by)
+		ranked[i].MemoryUsage = metrics[i].Usage
+		ranked[i].MemoryLimit = metrics[i].Limit
+		ranked[i].MemoryPercent = metrics[i].UsagePercent
+		ranked[i].CPUUsagePercent = metrics[i].CPUUsagePercent
+		ranked[i].NetworkRxBytesPerSecond = metrics[i].NetworkRxBytesPerSecond
+		ranked[i].NetworkTxBytesPerSecond = metrics[i].NetworkTxBytesPerSecond
+		ranked[i].FSUsage = metrics[i].FSUsage
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Value != ranked[j].Value {
+			return ranked[i].Value > ranked[j].Value
+		}
+		return ranked[i].TaskName < ranked[j].TaskName
+	})
+	if len(ranked) > request.limit {
+		ranked = ranked[:request.limit]
+	}
+	return ranked, pending
+}
+
+// topHandler ranks the task containers of the cluster, or of one node, by
+// their memory, CPU, network or filesystem usage.
+func topHandler(w http.ResponseWriter, r *http.Request) {
+	request, err := parseTopRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := topResponse{By: request.by, Limit: request.limit, Containers: []topContainer{}}
+	writeResponse := func() {
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("topHandler: encoding response failed: %v", err)
+		}
+	}
+
+	cli, err := getCli()
+	if err != nil {
+		errMsg := "Error getting Docker client: " + err.Error()
+		response.Error = &errMsg
+		writeResponse()
+		return
+	}
+	nodes, err := cli.NodeList(context.Background(), swarm.NodeListOptions{})
+	if err != nil {
+		errMsg := "Error listing nodes: " + err.Error()
+		response.Error = &errMsg
+		writeResponse()
+		return
+	}
+	services, err := cli.ServiceList(context.Background(), swarm.ServiceListOptions{})
+	if err != nil {
+		errMsg := "Error fetching services: " + err.Error()
+		response.Error = &errMsg
+		writeResponse()
+		return
+	}
+	tasks, err := cli.TaskList(context.Background(), swarm.TaskListOptions{})
+	if err != nil {
+		errMsg := "Error fetching tasks: " + err.Error()
+		response.Error = &errMsg
+		writeResponse()
+		return
+	}
+
+	scrapedNodes := nodes
+	if request.node != "" {
+		scrapedNodes = nil
+		for _, node := range nodes {
+			if node.ID == request.node || node.Description.Hostname == request.node {
+				scrapedNodes = append(scrapedNodes, node)
+			}
+		}
+		if len(scrapedNodes) == 0 {
+			errMsg := "Node not found"
+			response.Error = &errMsg
+			writeResponse()
+			return
+		}
+	}
+
+	var containers []scrapedContainer
+	if usingPrometheusBackend() {
+		metrics, err := fetchContainerMetricsFromPrometheus("")
+		if err != nil {
+			response.Error = prometheusErrorMessage(err)
+			writeResponse()
+			return
+		}
+		for _, container := range metrics.ContainerMetrics {
+			containers = append(containers, scrapedContainer{ContainerMemoryMetrics: container})
+		}
+	} else {
+		cadvisorService, err := cachedCAdvisorService(cli)
+		if err != nil {
+			errMsg := "Error finding cadvisor service: " + err.Error()
+			response.Error = &errMsg
+			writeResponse()
+			return
+		}
+		if cadvisorService == nil {
+			msg := fmt.Sprintf("cAdvisor service not found. Deploy a global service with label '%s' to enable metrics.", cadvisorLabel)
+			response.Message = &msg
+			writeResponse()
+			return
+		}
+		// Only the nodes running a cAdvisor, or with a static or DNS target, are scraped.
+		cadvisorNodeIDs, err := cadvisorDiscovery.nodeIDs(cli, cadvisorService)
+		if err != nil {
+			errMsg := "Error listing cadvisor tasks: " + err.Error()
+			response.Error = &errMsg
+			writeResponse()
+			return
+		}
+		withCAdvisor := make(map[string]bool, len(cadvisorNodeIDs))
+		for _, nodeID := range cadvisorNodeIDs {
+			withCAdvisor[nodeID] = true
+		}
+		var cadvisorNodes []swarm.Node
+		for _, node := range scrapedNodes {
+			if withCAdvisor[node.ID] {
+				cadvisorNodes = append(cadvisorNodes, node)
+			}
+		}
+		if len(cadvisorNodes) == 0 {
+			msg := "No cAdvisor runs on the requested nodes."
+			response.Message = &msg
+			writeResponse()
+			return
+		}
+		containers, response.NodesWithMetrics = fetchAllContainersFromCAdvisor(cli, cadvisorService, cadvisorNodes)
+		response.NodesQueried = len(cadvisorNodes)
+		if response.NodesWithMetrics == 0 {
+			errMsg := "Failed to fetch metrics from any node"
+			response.Error = &errMsg
+			writeResponse()
+			return
+		}
+	}
+
+	response.Available = true
+	response.Containers, response.RatesPending = rankContainers(containers, request, tasks, services, nodes)
+	writeResponse()
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// TestParseTopRequest verifies the defaults and the rejected parameters.
+func TestParseTopRequest(t *testing.T) {
+	request, err := parseTopRequest(httptest.NewRequest("GET", "/ui/top", nil))
+	if err != nil || request.by != topByMemory || request.limit != defaultTopLimit {
+		t.Fatalf("unexpected defaults %+v/%v", request, err)
+	}
+	request, err = parseTopRequest(httptest.NewRequest("GET", "/ui/top?by=cpu&limit=5&node=alpha", nil))
+	if err != nil || request.by != topByCPU || request.limit != 5 || request.node != "alpha" {
+		t.Fatalf("unexpected request %+v/%v", request, err)
+	}
+	for _, query := range []string{"by=disk", "limit=0", "limit=x", "limit=1001"} {
+		rr := httptest.NewRecorder()
+		topHandler(rr, httptest.NewRequest("GET", "/ui/top?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rr.Code)
+		}
+	}
+}
+
+// TestTopHandler verifies that the task containers are ranked and joined to
+// their service, stack, slot and node.
+func TestTopHandler(t *testing.T) {
+	cadvisor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(stackCAdvisorMetrics + `container_memory_usage_bytes{id="/"} 99999
+`))
+	}))
+	defer cadvisor.Close()
+	u, _ := url.Parse(cadvisor.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	running := swarm.TaskStatus{State: swarm.TaskStateRunning}
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": []swarm.Node{{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}}},
+		"/v1.35/services": []swarm.Service{
+			{ID: "s1", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "shop_web", Labels: map[string]string{stackNamespaceLabel: "shop"}}}},
+			{ID: "s2", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "shop_db", Labels: map[string]string{stackNamespaceLabel: "shop"}}}},
+			{ID: "s-cadvisor", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{cadvisorLabel: "true"}}},
+				Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}},
+		},
+		"/v1.35/tasks": []swarm.Task{
+			{ID: "t1", ServiceID: "s1", NodeID: "n1", Slot: 1, Status: running},
+			{ID: "t2", ServiceID: "s2", NodeID: "n1", Slot: 3, Status: running},
+			{ID: "tc", ServiceID: "s-cadvisor", NodeID: "n1", Status: running,
+				NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}},
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	topHandler(rr, httptest.NewRequest("GET", "/ui/top?limit=2", nil))
+	var response topResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	// The root cgroup belongs to no task; t9 to no known task, yet to the scraped node.
+	if !response.Available || response.NodesWithMetrics != 1 || len(response.Containers) != 2 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	first := response.Containers[0]
+	if first.TaskID != "t9" || first.Value != 5000 || first.ServiceName != "" || first.Hostname != "alpha" {
+		t.Errorf("expected the unknown task to rank first by memory, got %+v", first)
+	}
+	second := response.Containers[1]
+	if second.TaskID != "t2" || second.ServiceName != "shop_db" || second.Stack != "shop" || second.Slot != 3 || second.Hostname != "alpha" || second.Value != 300 {
+		t.Errorf("unexpected second entry %+v", second)
+	}
+
+	rr = httptest.NewRecorder()
+	topHandler(rr, httptest.NewRequest("GET", "/ui/top?by=fs&node=alpha", nil))
+	response = topResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(response.Containers) != 3 || response.Containers[0].TaskID != "t2" || response.Containers[0].Value != 7 {
+		t.Fatalf("expected the containers of alpha ranked by filesystem usage, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	topHandler(rr, httptest.NewRequest("GET", "/ui/top?node=missing", nil))
+	response = topResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if response.Available || response.Error == nil {
+		t.Fatalf("expected an unknown node to be reported, got %s", rr.Body.String())
+	}
+}
+
+// TestTopHandler_RatesPending verifies that only the nodes with a cAdvisor are
+// scraped and that CPU rankings count the containers whose rates need a second
+// sample.
+func TestTopHandler_RatesPending(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	containerRateSamples = newCounterSampler()
+	defer func() { containerRateSamples = newCounterSampler() }()
+	var scrapes int32
+	cadvisor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&scrapes, 1)
+		_, _ = w.Write([]byte(withSampleTime(stackCAdvisorMetrics+fmt.Sprintf(
+			"container_cpu_usage_seconds_total{id=\"/docker/c2\",container_label_com_docker_swarm_task_id=\"t2\"} %d\n", 5*n), int64(1700000000+10*n))))
+	}))
+	defer cadvisor.Close()
+	u, _ := url.Parse(cadvisor.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	running := swarm.TaskStatus{State: swarm.TaskStateRunning}
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes": []swarm.Node{{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}}, {ID: "n2", Description: swarm.NodeDescription{Hostname: "beta"}}},
+		"/v1.35/services": []swarm.Service{{ID: "s-cadvisor", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{cadvisorLabel: "true"}}},
+			Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}}},
+		"/v1.35/tasks": []swarm.Task{{ID: "tc", ServiceID: "s-cadvisor", NodeID: "n1", Status: running,
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}}},
+	})
+	request := func() topResponse {
+		rr := httptest.NewRecorder()
+		topHandler(rr, httptest.NewRequest("GET", "/ui/top?by=cpu", nil))
+		var response topResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return response
+	}
+
+	first := request()
+	if !first.Available || first.NodesQueried != 1 || first.NodesWithMetrics != 1 || len(first.Containers) != 3 {
+		t.Fatalf("expected only alpha to be scraped, got %+v", first)
+	}
+	if first.RatesPending != 3 || first.Message != nil {
+		t.Fatalf("expected the rates to be pending, got %+v", first)
+	}
+
+	resetMetricsCaches() // Scrape again rather than read the cached sample
+	second := request()
+	if second.RatesPending != 0 || second.Message != nil {
+		t.Fatalf("expected the rates to be ready, got %+v", second)
+	}
+	if top := second.Containers[0]; top.TaskID != "t2" || top.Value != 50 {
+		t.Fatalf("expected t2 to use half a core, got %+v", top)
+	}
+}
+
+// TestTopHandler_Unavailable verifies that invalid requests, Docker errors, a
+// missing cAdvisor and failing scrapes are reported.
+func TestTopHandler_Unavailable(t *testing.T) {
+	resetMetricsCaches()
+	defer resetMetricsCaches()
+	request := func(target string) topResponse {
+		rr := httptest.NewRecorder()
+		topHandler(rr, httptest.NewRequest("GET", target, nil))
+		var response topResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode: %v (%s)", err, rr.Body.String())
+		}
+		return response
+	}
+	expectError := func(response topResponse, want string) {
+		t.Helper()
+		if response.Available || response.Error == nil || !strings.Contains(*response.Error, want) {
+			t.Fatalf("expected the error %q, got %+v", want, response)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	topHandler(rr, httptest.NewRequest("GET", "/ui/top?by=disk", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid ranking, got %d", rr.Code)
+	}
+
+	nodes := []swarm.Node{{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}}}
+	stubDocker(t, map[string]interface{}{})
+	expectError(request("/ui/top"), "Error listing nodes")
+	stubDocker(t, map[string]interface{}{"/v1.35/nodes": nodes})
+	expectError(request("/ui/top"), "Error fetching services")
+	stubDocker(t, map[string]interface{}{"/v1.35/nodes": nodes, "/v1.35/services": []swarm.Service{}})
+	expectError(request("/ui/top"), "Error fetching tasks")
+
+	stubDocker(t, map[string]interface{}{"/v1.35/nodes": nodes, "/v1.35/services": []swarm.Service{}, "/v1.35/tasks": []swarm.Task{}})
+	if response := request("/ui/top"); response.Available || response.Message == nil || !strings.Contains(*response.Message, cadvisorLabel) {
+		t.Fatalf("expected the missing service to be reported, got %+v", response)
+	}
+
+	cadvisor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer cadvisor.Close()
+	u, _ := url.Parse(cadvisor.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+	services := []swarm.Service{{ID: "s-cadvisor", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Labels: map[string]string{cadvisorLabel: "true"}}},
+		Endpoint: swarm.Endpoint{Ports: []swarm.PortConfig{{TargetPort: uint32(port)}}}}}
+	resetMetricsCaches()
+	stubDocker(t, map[string]interface{}{"/v1.35/nodes": nodes, "/v1.35/services": services, "/v1.35/tasks": []swarm.Task{}})
+	if response := request("/ui/top"); response.Available || response.Message == nil || !strings.Contains(*response.Message, "No cAdvisor runs") {
+		t.Fatalf("expected the nodes without cAdvisor to be reported, got %+v", response)
+	}
+
+	resetMetricsCaches()
+	stubDocker(t, map[string]interface{}{"/v1.35/nodes": nodes, "/v1.35/services": services, "/v1.35/tasks": []swarm.Task{
+		{ID: "tc", ServiceID: "s-cadvisor", NodeID: "n1", Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{host + "/24"}}}},
+	}})
+	response := request("/ui/top")
+	expectError(response, "Failed to fetch metrics from any node")
+	if response.NodesQueried != 1 || response.NodesWithMetrics != 0 {
+		t.Errorf("expected the failed node to be counted, got %+v", response)
+	}
+
+	srv, _ := stubPrometheus(t, map[string][]prometheusSeries{})
+	srv.Close()
+	expectError(request("/ui/top"), "Error querying Prometheus at "+srv.URL)
+}
+
+// TestTopHandler_Prometheus verifies that the containers are ranked from the
+// series of Prometheus.
+func TestTopHandler_Prometheus(t *testing.T) {
+	stubPrometheus(t, map[string][]prometheusSeries{"container_": {
+		series("100", "__name__", "container_memory_usage_bytes", "id", "/docker/c1", "container_label_com_docker_swarm_task_id", "t1"),
+		series("300", "__name__", "container_memory_usage_bytes", "id", "/docker/c2", "container_label_com_docker_swarm_task_id", "t2"),
+	}})
+	stubDocker(t, map[string]interface{}{
+		"/v1.35/nodes":    []swarm.Node{{ID: "n1", Description: swarm.NodeDescription{Hostname: "alpha"}}},
+		"/v1.35/services": []swarm.Service{{ID: "s1", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "web"}}}},
+		"/v1.35/tasks": []swarm.Task{
+			{ID: "t1", ServiceID: "s1", NodeID: "n1", Slot: 1},
+			{ID: "t2", ServiceID: "s1", NodeID: "n1", Slot: 2},
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	topHandler(rr, httptest.NewRequest("GET", "/ui/top", nil))
+	var response topResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !response.Available || len(response.Containers) != 2 {
+		t.Fatalf("unexpected response %s", rr.Body.String())
+	}
+	if first := response.Containers[0]; first.TaskID != "t2" || first.ServiceName != "web" || first.Slot != 2 || first.Hostname != "alpha" {
+		t.Errorf("unexpected first entry %+v", first)
+	}
+}